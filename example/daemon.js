@@ -1,19 +1,19 @@
-function watcher(input) {
+function watcher() {
     console.log(Object.keys(mithras));
     var catalog = mithras.run();
     console.log(Object.keys(catalog));
-    return;
 }
 
+var job;
+
 function run() {
     log0("Starting daemon.")
-    workers.create("watcher", watcher.toString(), 10);
-    workers.run("watcher")
+    job = schedule.every("10s", watcher);
     return true;
 }
 
 function stop(signal) {
     log0("Daemon terminating.")
-    workers.stop("watcher");
+    schedule.cancel(job);
     return true;
 }
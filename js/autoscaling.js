@@ -275,10 +275,12 @@
 			if (mithras.verbose) {
 			    log(sprintf("Creating ASG launch config"));
 			}
-			aws.autoscaling.launchConfigs.create(params.region,
-							     params.launchConfig);
-			config = aws.autoscaling.launchConfigs.describe(params.region, 
-									cName);
+			config = aws.autoscaling.launchConfigs.create(params.region,
+								      params.launchConfig);
+			if (!mithras.dryRun) {
+			    config = aws.autoscaling.launchConfigs.describe(params.region, 
+									    cName);
+			}
 			catalog.autoscalingLaunchConfigs.push(config);
 		    }
 		} else {
@@ -292,8 +294,10 @@
                     if (mithras.verbose) {
 			log(sprintf("Creating ASG '%s'", name));
                     }
-                    aws.autoscaling.groups.create(params.region, params.group);
-		    group = aws.autoscaling.groups.describe(params.region, name);
+                    group = aws.autoscaling.groups.create(params.region, params.group);
+		    if (!mithras.dryRun) {
+			group = aws.autoscaling.groups.describe(params.region, name);
+		    }
                     catalog.autoscalingGroups.push(group);
 		} else {
                     if (mithras.verbose) {
@@ -308,8 +312,10 @@
 			if (mithras.verbose) {
 			    log(sprintf("Creating ASG lifecycle hook"));
 			}
-			aws.autoscaling.hooks.create(params.region, params.hook);
-			hook = aws.autoscaling.hooks.describe(params.region, hName);
+			hook = aws.autoscaling.hooks.create(params.region, params.hook);
+			if (!mithras.dryRun) {
+			    hook = aws.autoscaling.hooks.describe(params.region, hName);
+			}
 			catalog.autoscalingHooks.push(config);
 		    }
 		} else {
@@ -324,6 +330,51 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var group = target.group && 
+                aws.autoscaling.groups.describe(region, target.group.AutoScalingGroupName);
+            var hook = target.hook && 
+                aws.autoscaling.hooks.describe(region, 
+                                               target.hook.AutoScalingGroupName,
+                                               target.hook.LifecycleHookName);
+            var config = target.config && 
+                aws.autoscaling.launchConfigs.describe(region, 
+                                                       target.config.LaunchConfigurationName);
+            if (group) {
+                mithras.catalogAdd(catalog, "autoscalingGroups", group, "AutoScalingGroupName");
+            }
+            if (hook) {
+                mithras.catalogAdd(catalog, "autoscalingHooks", hook, "LifecycleHookName");
+            }
+            if (config) {
+                mithras.catalogAdd(catalog, "autoscalingLaunchConfigs", config, 
+                                   "LaunchConfigurationName");
+            }
+            if (group || hook || config) {
+                return {group: group || null, hook: hook || null, config: config || null};
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var found = resource._target;
+            var desired = {
+                group: _.pick(params.group, "AutoScalingGroupName", "LaunchConfigurationName",
+                              "MinSize", "MaxSize", "DesiredCapacity")
+            };
+            if (params.launchConfig) {
+                desired.launchConfig = _.pick(params.launchConfig, "LaunchConfigurationName",
+                                              "ImageId", "InstanceType", "KeyName");
+            }
+            if (params.hook) {
+                desired.hook = _.pick(params.hook, "LifecycleHookName", "LifecycleTransition");
+            }
+            var current = found && {
+                group: found.group
+                launchConfig: found.config
+                hook: found.hook
+            };
+            return mithras.plan.compare(params.ensure, desired, current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -341,8 +392,10 @@
     
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
@@ -399,6 +399,66 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var app = target.app && 
+                aws.beanstalk.apps.describe(region, target.app.ApplicationName);
+            var version = target.version && 
+                aws.beanstalk.versions.describe(region, 
+                                                target.version.ApplicationName,
+                                                target.version.VersionLabel);
+            var config = target.config && 
+                aws.beanstalk.configs.describe(region, 
+                                               target.config.ApplicationName,
+                                               target.config.TemplateName);
+            var env = target.env && 
+                aws.beanstalk.environments.describe(region, 
+                                                    target.env.ApplicationName,
+                                                    target.env.EnvironmentName);
+            if (env && env.Status === "Terminated") {
+                env = null;
+            }
+            if (app) {
+                mithras.catalogAdd(catalog, "beanstalkApps", app, "ApplicationName");
+            }
+            if (version) {
+                mithras.catalogAdd(catalog, "beanstalkVersions", version, "VersionLabel");
+            }
+            if (config) {
+                mithras.catalogAdd(catalog, "beanstalkConfigs", config, "TemplateName");
+            }
+            if (env) {
+                mithras.catalogAdd(catalog, "beanstalkEnvironments", env, "EnvironmentId");
+            }
+            if (app || version || config || env) {
+                return {app: app || undefined, version: version || undefined,
+                        config: config || undefined, env: env || undefined};
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var found = resource._target;
+            var desired = {};
+            if (params.app) {
+                desired.app = _.pick(params.app, "ApplicationName", "Description");
+            }
+            if (params.version) {
+                desired.version = _.pick(params.version, "ApplicationName", "VersionLabel");
+            }
+            if (params.config) {
+                desired.config = _.pick(params.config, "ApplicationName", "TemplateName");
+            }
+            if (params.environment) {
+                desired.environment = _.pick(params.environment, "ApplicationName",
+                                             "EnvironmentName", "SolutionStackName");
+            }
+            var current = found && {
+                app: found.app
+                version: found.version
+                config: found.config
+                environment: found.env
+            };
+            return mithras.plan.compare(params.ensure, desired, current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -412,8 +472,10 @@
     
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
@@ -217,10 +217,12 @@
                 if (mithras.verbose) {
                     log(sprintf("Creating elasticache instance '%s' (WAIT FOR IT...)", id));
                 }
-                aws.elasticache.create(p.region, p.cache, p.wait);
+                cache = aws.elasticache.create(p.region, p.cache, p.wait);
 
                 // re-describe it
-                cache = aws.elasticache.describe(p.region, id);
+                if (!mithras.dryRun) {
+                    cache = aws.elasticache.describe(p.region, id);
+                }
 
                 // add to catalog
                 catalog.caches.push(cache);
@@ -241,6 +243,19 @@
                 return inst.CacheClusterId === id;
             });
         }
+        refresh: function(region, target, catalog) {
+            var cache = aws.elasticache.describe(region, target.CacheClusterId);
+            if (cache) {
+                return mithras.catalogAdd(catalog, "caches", cache, "CacheClusterId");
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var p = resource.params;
+            return mithras.plan.compare(p.ensure,
+                                        _.pick(p.cache, "CacheClusterId", "CacheNodeType",
+                                               "Engine", "EngineVersion", "NumCacheNodes"),
+                                        resource._target);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -260,8 +275,10 @@
 
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
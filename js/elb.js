@@ -187,6 +187,12 @@
                 return elb.LoadBalancerName === elbName;
             });
         }
+        // When mithras.run uses state instead of scanning AWS, LBs
+        // other scripts manage aren't in the catalog.
+        findLB: function(catalog, resource, region, elbName) {
+            return handler.findInCatalog(catalog, resource, elbName) ||
+                aws.elbs.describe(region, elbName);
+        }
         handle: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -262,9 +268,8 @@
                 return [null, true];
                 break;
             case "elbMembership":
-                var elb = handler.findInCatalog(catalog, 
-						resource,
-                                                params.membership.LoadBalancerName);
+                var elb = handler.findLB(catalog, resource, params.region,
+                                         params.membership.LoadBalancerName);
 
                 if (ensure === "present") {
                     if (!elb) { 
@@ -372,6 +377,42 @@
                 break;
             }
         }
+        refresh: function(region, target, catalog) {
+            var elb = aws.elbs.describe(region, target.LoadBalancerName);
+            if (elb) {
+                return mithras.catalogAdd(catalog, "elbs", elb, "LoadBalancerName");
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            if (resource.module === handler.moduleNames[0]) {
+                return mithras.plan.compare(params.ensure,
+                                            _.pick(params.elb, "LoadBalancerName", "Scheme",
+                                                   "Subnets", "SecurityGroups"),
+                                            resource._target);
+            }
+
+            // Membership: the instances registered afterwards
+            var elb = handler.findLB(catalog, resource, params.region,
+                                     params.membership.LoadBalancerName);
+            var lbIds = elb && elb.Instances ? _.pluck(elb.Instances, "InstanceId") : [];
+            var inIds = _.isArray(params.membership.Instances) ?
+                _.pluck(params.membership.Instances, "InstanceId") : [];
+            var ids;
+            switch(params.ensure) {
+            case "absent":
+                ids = _.difference(lbIds, inIds);
+                break;
+            case "converge":
+                ids = inIds;
+                break;
+            default:
+                ids = _.union(lbIds, inIds);
+            }
+            return mithras.plan.compare("present",
+                                        {Instances: ids.sort()},
+                                        {Instances: lbIds.sort()});
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -391,9 +432,11 @@
     };
     
     handler.init = function () {
+        mithras.modules.refresh.register(handler.moduleNames[0], handler.refresh);
         _.each(handler.moduleNames, function(name) {
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
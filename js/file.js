@@ -145,6 +145,33 @@
 //
 // If `true`, any `file` will be overwritten, even if it already exists.
 //
+// ### `replace`
+//
+// * Required: false
+// * Allowed Values: boolean
+//
+// If `true` and `src` is an `scp://localhost/...` URL, `src` is
+// copied even if `dest` already exists.
+//
+// ### `sync`
+//
+// * Required: false
+// * Allowed Values: boolean
+//
+// If `true` and `src` is an `scp://localhost/...` URL, `dest` is made
+// the same as `src` on every run, with `mithras.remote.put`: only
+// files whose contents differ are copied, and `mode` and `owner` are
+// set as they arrive.  Without it, `src` is copied only if `dest`
+// doesn't exist.  Each changed file is logged.
+//
+// ### `delete`
+//
+// * Required: false
+// * Allowed Values: boolean
+//
+// With `sync`, if `true`, files under `dest` which aren't under
+// `src` are removed.
+//
 (function (root, factory){
     if (typeof module === 'object' && typeof module.exports === 'object') {
 	module.exports = factory();
@@ -182,6 +209,7 @@
             // Loop over hosts
             var target = resource._target = {};
             _.each(p.hosts, function(host) {
+                var addr = mithras.sshHostForInstance(resource, host);
                 var key = mithras.sshKeyPathForInstance(resource, host);
                 var user = mithras.sshUserForInstance(resource, host);
 
@@ -197,7 +225,7 @@
                 var updatedParams = updated.params;
 
                 cmd = sprintf("test -e '%s' && echo 'found'", updatedParams.dest);
-                var result = mithras.remote.shell(host.PublicIpAddress, 
+                var result = mithras.remote.shell(addr, 
                                                   user, 
                                                   key, 
                                                   "",
@@ -209,7 +237,7 @@
                     log(sprintf("File '%s': %s.", 
                                 updatedParams.dest,
                                 out != "" ? out : "success"));
-                    target[host.PublicIpAddress] = out;
+                    target[addr] = out;
                     target[host.InstanceId] = out;
                 }
             });
@@ -437,8 +465,36 @@
 	    }
 	}
 
+	sync: function(path, resource, updatedParams, host) {
+            var addr = mithras.sshHostForInstance(resource, host);
+            var key = mithras.sshKeyPathForInstance(resource, host);
+            var user = mithras.sshUserForInstance(resource, host);
+            var mode = updatedParams.mode;
+            if (typeof(mode) === "number") {
+                mode = mode.toString(8);
+            }
+            var result = mithras.remote.put(addr, user, key, path, updatedParams.dest, {
+                delete: updatedParams.delete
+                mode: mode
+                owner: updatedParams.owner
+                become: updatedParams.become
+                becomeUser: updatedParams.becomeUser
+                becomeMethod: updatedParams.becomeMethod
+            });
+            _.each(result.files, function(f) {
+                if (f.changed) {
+                    log(sprintf("File '%s': %s %s.", updatedParams.dest, f.path, f.action));
+                }
+            });
+            if (!result.changed && mithras.verbose) {
+                log(sprintf("File '%s' unchanged.", updatedParams.dest));
+            }
+            return result;
+        }
+
 	scp: function(path, resource, updatedParams, host) {
             var pre = resource._target || {};
+            var addr = mithras.sshHostForInstance(resource, host);
             var key = mithras.sshKeyPathForInstance(resource, host);
             var user = mithras.sshUserForInstance(resource, host);
 
@@ -449,13 +505,13 @@
                 console.log(sprintf("Invalid 'file' param property ensure: %s", updatedParams.ensure));
                 os.exit(3);
             } else if ((updatedParams.ensure === 'absent')  &&
-                       (pre[host.PublicIpAddress] != "found")) {
+                       (pre[host.InstanceId] != "found")) {
                 log("Ensure: absent; skipping.")
 	    } else if (updatedParams.ensure === 'absent') {
                 log("Ensure: absent but scp handler does not remove files.")
 	    } else if ((updatedParams.ensure === 'present') &&
-                       (pre[host.PublicIpAddress] != "found")) {
-                var result = mithras.remote.scp(host.PublicIpAddress, 
+                       (pre[host.InstanceId] != "found" || updatedParams.replace)) {
+                var result = mithras.remote.scp(addr, 
                                                 user, 
                                                 key, 
                                                 path,
@@ -471,7 +527,7 @@
                     }
                 } else if (status == 255) {
                     log(sprintf("SCP error remote system '%s', dest '%s': %s %s",
-                                host.PublicIpAddress, 
+                                addr, 
                                 updatedParams.dest, 
                                 err ? err.trim() : "", 
                                 out ? out.trim() : ""));
@@ -501,7 +557,7 @@
 	    var js = sprintf("var run = function() {\n (%s)(%s); };\n", 
 			     handler.run.toString(),
 			     JSON.stringify(_.omit(updatedParams, 'hosts')));
-	    var result = mithras.remote.mithras(host,
+	    var result = mithras.remote.mithras(mithras.sshHostForInstance(resource, host),
 						user,
 						key,
 						js,
@@ -534,6 +590,12 @@
 	    if (src) {
 		var url = web.url.parse(src);
 		var scheme = url.scheme;
+		if (scheme === "scp" && updatedParams.sync &&
+                    updatedParams.ensure !== "absent") {
+		    return function() {
+			handler.sync(url.path, resource, updatedParams, host);
+		    };
+		}
 		if (scheme === "scp") {
 		    return function() {
 			handler.scp(url.path, resource, updatedParams, host);
@@ -569,7 +631,8 @@
 							 resources,
 							 resource.name);
                     if (mithras.verbose) {
-			log(sprintf("Host: '%s' (%s)", host.PublicIpAddress, 
+			log(sprintf("Host: '%s' (%s)", 
+                                    mithras.sshAddressForInstance(resource, host), 
                                     host.InstanceId));
                     }
 		    if (updated.params.skip == true) {
@@ -99,9 +99,10 @@
 	moduleNames: ["git"]
 	check: function(resource, instance, user, key) {
 	    var p = resource.params;
+	    var addr = mithras.sshHostForInstance(resource, instance);
 	    var cmd = sprintf("test -d '%s' && cd '%s' && git rev-parse --is-inside-work-tree > /dev/null 2>&1 && git rev-parse HEAD", p.dest, p.dest)
 	    cmd = become(p.become, p.becomeUser, p.becomeMethod, cmd);
-	    result = mithras.remote.shell(instance.PublicIpAddress, 
+	    result = mithras.remote.shell(addr, 
 					  user, 
 					  key, 
 					  null,
@@ -130,7 +131,7 @@
 		}
 	    } else if (status == 255) {
 		log(sprintf("Error communicating with remote system '%s', repo '%s', dest '%s': %s",
-			    instance.PublicIpAddress, p.repo, p.dest, err.trim()));
+			    addr, p.repo, p.dest, err.trim()));
 		os.exit(3);
 	    } else if (status == 1 && mithras.verbose) {
 		log(sprintf("Git '%s', dest '%s' not found.", p.repo, p.dest));
@@ -143,6 +144,7 @@
 	
 	install: function(resource, inst, user, key) {
 	    var p = resource.params;
+	    var addr = mithras.sshHostForInstance(resource, inst);
 	    var cmd = "";
 	    switch (p.ensure) {
 	    case "present":
@@ -157,7 +159,7 @@
 	    cmd = become(p.become, p.becomeUser, p.becomeMethod, cmd);
 	    cmd = "GIT_SSH_COMMAND='ssh -o ForwardAgent=yes -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no' " + cmd;
 
-	    var result = mithras.remote.shell(inst.PublicIpAddress, user, key, null, cmd, null, false);
+	    var result = mithras.remote.shell(addr, user, key, null, cmd, null, false);
 
 	    var out = result[0];
 	    var err = result[1];
@@ -170,7 +172,7 @@
 		return true;
 	    } else if (status == 255) {
 		log(sprintf("Remote SSH error communicating with remote system '%s', repo '%s': %s %s",
-			    inst.PublicIpAddress, 
+			    addr, 
                             p.repo, 
                             err.trim(), 
                             out.trim()));
@@ -178,7 +180,7 @@
 	    } else if (status == 1) {
 		if (mithras.verbose) {
 		    log(sprintf("Remote Git host '%s' error: %s %s", 
-                                inst.PublicIpAddress,
+                                addr,
                                 err, 
                                 out));
 		}
@@ -186,7 +188,7 @@
 	    } else {
 		if (mithras.verbose) {
 		    log(sprintf("Remote Git host '%s': status %d out %s", 
-				inst.PublicIpAddress,
+				addr,
 				status, 
 				out));
 		}
@@ -219,7 +221,7 @@
 		var key = mithras.sshKeyPathForInstance(resource, host);
 		var user = mithras.sshUserForInstance(resource, host);
 		if (mithras.verbose) {
-		    log(sprintf("Host: '%s' (%s)", host.PublicIpAddress, 
+		    log(sprintf("Host: '%s' (%s)", mithras.sshAddressForInstance(resource, host), 
 				host.InstanceId));
 		}
 		
@@ -0,0 +1,308 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+// # graph
+//
+// Graph describes the dependencies among a set of resources, and
+// renders them for viewing.  It is used by the `mithras graph`
+// command, and is available to scripts as `mithras.graph`.
+//
+// This module exports:
+//
+// > * `build(resources, reverse)` Describe the dependency graph of `resources`
+// > * `render(graphs, format)` Render an array of graphs as `"dot"`, `"json"` or `"mermaid"`
+// > * `problems(graph)` Describe dangling references and cycles, as an array of strings
+// > * `capture` When `true`, `mithras.apply` records the graph of its resources in `graphs` instead of handling them
+// > * `graphs` The graphs recorded while `capture` is set
+//
+// Usage:
+//
+// `var graph = mithras.graph.build(resources);`
+//
+// ## Graphs
+//
+// `build` returns an object with these properties:
+//
+// > * `reverse`: `true` if built for a reverse apply
+// > * `nodes`: an array with an entry for each resource, giving its `name`, `module`, `skip` state, `dependsOn` names, and `order`, its position in the computed order (starting at 1), or `null` if there is a cycle
+// > * `edges`: an array of `{from, to}` pairs, where `from` depends on `to`
+// > * `order`: the order in which `mithras.apply` would handle the resources
+// > * `dangling`: an array of `{from, to}` pairs, where `from` depends on `to` and there is no resource named `to`
+// > * `cycles`: an array of dependency cycles.  Each is an array of names, starting and ending with the same resource.
+//
+// Example:
+//
+// ```
+//
+//  var g = mithras.graph.build(resources);
+//  _.each(mithras.graph.problems(g), function(p) { log(p); });
+//  console.log(mithras.graph.render([g], "mermaid"));
+//
+// ```
+//
+(function (root, factory){
+    if (typeof module === 'object' && typeof module.exports === 'object') {
+	module.exports = factory();
+    }
+})(this, function() {
+
+    var sprintf = require("sprintf.js").sprintf;
+    var DepGraph = require("dep-graph").DepGraph;
+
+    var dependsOn = function(r) {
+        if (typeof(r.dependsOn) === "string") {
+            return [r.dependsOn];
+        } else if (Array.isArray(r.dependsOn)) {
+            return r.dependsOn;
+        }
+        return [];
+    };
+
+    // Every cycle reached by a depth-first walk, each given once.
+    var findCycles = function(names, adjacent) {
+        var cycles = [];
+        var seen = {};
+        var visited = {};
+        var path = [];
+        var walk = function(name) {
+            visited[name] = true;
+            path.push(name);
+            _.each(adjacent[name], function(next) {
+                var idx = path.indexOf(next);
+                if (idx >= 0) {
+                    var cycle = path.slice(idx);
+                    // The same cycle may be entered at any resource
+                    var start = cycle.indexOf(_.min(cycle, function(n) {
+                        return names.indexOf(n);
+                    }));
+                    var key = cycle.slice(start).concat(cycle.slice(0, start)).join("\n");
+                    if (!seen[key]) {
+                        seen[key] = true;
+                        cycles.push(cycle.concat([next]));
+                    }
+                } else if (!visited[next]) {
+                    walk(next);
+                }
+            });
+            path.pop();
+        };
+        _.each(names, function(name) {
+            if (!visited[name]) {
+                walk(name);
+            }
+        });
+        return cycles;
+    };
+
+    var dotQuote = function(s) {
+        return '"' + String(s).replace(/\\/g, "\\\\").replace(/"/g, '\\"').replace(/\n/g, "\\n") + '"';
+    };
+
+    var mermaidQuote = function(s) {
+        return '"' + String(s).replace(/"/g, "#quot;") + '"';
+    };
+
+    var label = function(node) {
+        var lines = [node.name];
+        if (node.module) {
+            lines.push(node.module);
+        }
+        if (node.order) {
+            lines.push("#" + node.order);
+        }
+        if (node.skip) {
+            lines.push("(skip)");
+        }
+        return lines;
+    };
+
+    var inCycle = function(graph) {
+        var result = {nodes: {}, edges: {}};
+        _.each(graph.cycles, function(cycle) {
+            for (var i = 0; i < cycle.length - 1; i++) {
+                result.nodes[cycle[i]] = true;
+                result.edges[cycle[i] + "\n" + cycle[i + 1]] = true;
+            }
+        });
+        return result;
+    };
+
+    var renderDot = function(graph, idx) {
+        var out = [];
+        var marked = inCycle(graph);
+        out.push(sprintf("digraph %s {", dotQuote(idx > 0 ? "mithras " + (idx + 1) : "mithras")));
+        if (graph.reverse) {
+            out.push('  label="reverse";');
+        }
+        out.push("  rankdir=LR;");
+        out.push("  node [shape=box];");
+        _.each(graph.nodes, function(node) {
+            var attrs = ["label=" + dotQuote(label(node).join("\n"))];
+            if (node.skip) {
+                attrs.push("style=dashed");
+            }
+            if (marked.nodes[node.name]) {
+                attrs.push("color=red");
+            }
+            out.push(sprintf("  %s [%s];", dotQuote(node.name), attrs.join(", ")));
+        });
+        _.each(graph.edges, function(e) {
+            var attrs = marked.edges[e.from + "\n" + e.to] ? " [color=red]" : "";
+            out.push(sprintf("  %s -> %s%s;", dotQuote(e.from), dotQuote(e.to), attrs));
+        });
+        _.each(_.uniq(_.pluck(graph.dangling, "to")), function(to) {
+            out.push(sprintf("  %s [label=%s, style=dashed, color=red];",
+                             dotQuote(to), dotQuote(to + "\n(missing)")));
+        });
+        _.each(graph.dangling, function(e) {
+            out.push(sprintf("  %s -> %s [style=dashed, color=red];",
+                             dotQuote(e.from), dotQuote(e.to)));
+        });
+        out.push("}");
+        return out.join("\n");
+    };
+
+    var renderMermaid = function(graph, idx) {
+        var out = [];
+        var marked = inCycle(graph);
+        var ids = {};
+        _.each(graph.nodes, function(node, i) {
+            ids[node.name] = "n" + i;
+        });
+        _.each(_.uniq(_.pluck(graph.dangling, "to")), function(to, i) {
+            ids[to] = "m" + i;
+        });
+        if (idx > 0 || graph.reverse) {
+            out.push(sprintf("%%%% apply %d%s", idx + 1, graph.reverse ? " (reverse)" : ""));
+        }
+        out.push("graph LR");
+        _.each(graph.nodes, function(node) {
+            out.push(sprintf("  %s[%s]", ids[node.name], mermaidQuote(label(node).join("<br/>"))));
+        });
+        _.each(_.uniq(_.pluck(graph.dangling, "to")), function(to) {
+            out.push(sprintf("  %s[%s]", ids[to], mermaidQuote(to + "<br/>(missing)")));
+        });
+        _.each(graph.edges, function(e) {
+            out.push(sprintf("  %s --> %s", ids[e.from], ids[e.to]));
+        });
+        _.each(graph.dangling, function(e) {
+            out.push(sprintf("  %s -.-> %s", ids[e.from], ids[e.to]));
+        });
+        out.push("  classDef skipped stroke-dasharray: 5 5");
+        out.push("  classDef problem stroke:#f00,color:#f00");
+        var skipped = _.map(_.where(graph.nodes, {skip: true}), function(node) {
+            return ids[node.name];
+        });
+        if (skipped.length > 0) {
+            out.push(sprintf("  class %s skipped", skipped.join(",")));
+        }
+        var problems = _.map(_.keys(marked.nodes).concat(_.uniq(_.pluck(graph.dangling, "to"))), function(name) {
+            return ids[name];
+        });
+        if (problems.length > 0) {
+            out.push(sprintf("  class %s problem", problems.join(",")));
+        }
+        return out.join("\n");
+    };
+
+    var graph = {
+        capture: false
+        graphs: []
+
+        build: function(resources, reverse) {
+            var names = _.pluck(resources, "name");
+            var graph = {
+                reverse: !!reverse
+                nodes: []
+                edges: []
+                order: []
+                dangling: []
+                cycles: []
+            };
+            var adjacent = {};
+            _.each(resources, function(r) {
+                var deps = dependsOn(r);
+                graph.nodes.push({
+                    name: r.name
+                    module: r.module || null
+                    skip: !!r.skip
+                    dependsOn: deps
+                    order: null
+                });
+                adjacent[r.name] = adjacent[r.name] || [];
+                _.each(deps, function(d) {
+                    if (_.contains(names, d)) {
+                        graph.edges.push({from: r.name, to: d});
+                        adjacent[r.name].push(d);
+                    } else {
+                        graph.dangling.push({from: r.name, to: d});
+                    }
+                });
+            });
+
+            graph.cycles = findCycles(names, adjacent);
+            if (graph.cycles.length > 0) {
+                return graph;
+            }
+
+            // The order mithras.apply would use
+            var deps = new DepGraph();
+            _.each(names, function(name) {
+                deps.addNode(name);
+            });
+            _.each(graph.edges, function(e) {
+                if (reverse) {
+                    deps.addDependency(e.to, e.from);
+                } else {
+                    deps.addDependency(e.from, e.to);
+                }
+            });
+            graph.order = deps.overallOrder();
+            _.each(graph.nodes, function(node) {
+                node.order = graph.order.indexOf(node.name) + 1;
+            });
+            return graph;
+        }
+
+        problems: function(graph) {
+            var result = [];
+            _.each(graph.dangling, function(e) {
+                result.push(sprintf("Resource '%s' depends on '%s', which does not exist",
+                                    e.from, e.to));
+            });
+            _.each(graph.cycles, function(cycle) {
+                result.push(sprintf("Dependency cycle: %s", cycle.join(" -> ")));
+            });
+            return result;
+        }
+
+        render: function(graphs, format) {
+            switch (format || "dot") {
+            case "json":
+                return JSON.stringify(graphs, null, 2);
+            case "dot":
+                return _.map(graphs, renderDot).join("\n\n");
+            case "mermaid":
+                return _.map(graphs, renderMermaid).join("\n\n");
+            }
+            throw new Error(sprintf("Unknown graph format '%s'", format));
+        }
+    };
+
+    return graph;
+});
@@ -289,6 +289,13 @@
                         log(sprintf("IAM profile role found, no action taken."));
                     }
                     
+                    if (mithras.dryRun) {
+                        var profile = _.extend({}, p || created, {Roles: [role]});
+                        catalog.iamProfiles.push(profile);
+                        catalog.iamRoles.push(role);
+                        return [profile, true];
+                    }
+
                     // Wait for association between profile and role
                     var profile = aws.iam.profiles.describe(params.region, profileName);
                     do {
@@ -313,6 +320,36 @@
                 break;
             }
         }
+        refresh: function(region, target, catalog) {
+            var profile = aws.iam.profiles.describe(region, target.InstanceProfileName);
+            if (!profile) {
+                return;
+            }
+            _.each(profile.Roles, function(role) {
+                role = aws.iam.roles.describe(region, role.RoleName);
+                if (role) {
+                    mithras.catalogAdd(catalog, "iamRoles", role, "RoleName");
+                }
+            });
+            return mithras.catalogAdd(catalog, "iamProfiles", profile, "InstanceProfileName");
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            if (resource.module !== handler.moduleNames[1]) {
+                return;
+            }
+            var p = resource._target;
+            var current = p && {
+                InstanceProfileName: p.InstanceProfileName
+                RoleName: (p.Roles && p.Roles.length > 0) ? p.Roles[0].RoleName : null
+            };
+            return mithras.plan.compare(params.ensure,
+                                        {
+                                            InstanceProfileName: params.profile.InstanceProfileName
+                                            RoleName: params.role ? params.role.RoleName : undefined
+                                        },
+                                        current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -333,9 +370,11 @@
     };
     
     handler.init = function () {
+        mithras.modules.refresh.register(handler.moduleNames[1], handler.refresh);
         _.each(handler.moduleNames, function(name) {
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
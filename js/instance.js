@@ -129,6 +129,21 @@
 //
 // A map of tags to be applied to created instances
 // 
+// ### `seedHostKeys`
+//
+// * Required: false
+// * Allowed Values: true or false
+//
+// If `true`, the SSH host keys each matching instance printed to its
+// console are added to the `known_hosts` file mithras manages, for
+// its public and private addresses and public DNS name.  See
+// `mithras.remote.hostKeys.seed`.  Console output is only available a
+// few minutes after an instance starts, so keys may not be seeded
+// until a later run.
+//
+// Whatever this is set to, keys known for the addresses of deleted
+// instances are forgotten.
+// 
 (function (root, factory){
     if (typeof module === 'object' && typeof module.exports === 'object') {
         module.exports = factory();
@@ -137,6 +152,12 @@
     
     var sprintf = require("sprintf.js").sprintf;
 
+    var addresses = function(inst) {
+        return _.compact([inst.PublicIpAddress,
+                          inst.PrivateIpAddress,
+                          inst.PublicDnsName]);
+    };
+
     var handler = {
         moduleNames: ["instance"]
         findInCatalog: function(catalog, resources, resource) {
@@ -186,6 +207,7 @@
                     var inst = found[idx];
                     aws.instances.delete(params.region, 
                                          inst.InstanceId);
+                    handler.forgetHostKeys(inst);
                     catalog.instances = 
                         _.reject(catalog.instances,
                                  function(i) { 
@@ -204,6 +226,7 @@
                         var inst = found[idx];
                         aws.instances.delete(params.region, 
                                              inst.InstanceId);
+                        handler.forgetHostKeys(inst);
                         catalog.instances = 
                             _.reject(catalog.instances,
                                      function(i) { 
@@ -229,8 +252,13 @@
                     
                     // describe 'em (to get tags) and add to catalog
                     for (var idx in created) {
-                        var inst = aws.instances.describe(params.region,
-                                                          created[idx].InstanceId);
+                        var inst = created[idx];
+                        if (mithras.dryRun) {
+                            inst.Tags = mithras.tagList(params.tags);
+                        } else {
+                            inst = aws.instances.describe(params.region,
+                                                          inst.InstanceId);
+                        }
                         catalog.instances.push(inst);
                     }
                 } else {
@@ -240,11 +268,85 @@
                 }
                 
                 // return 'em
-                return [handler.findInCatalog(catalog, resources, resource), true];
+                var result = handler.findInCatalog(catalog, resources, resource);
+                if (params.seedHostKeys) {
+                    handler.seedHostKeys(params.region, result);
+                }
+                return [result, true];
                 break;
             }
             return [null, true];
         }
+        seedHostKeys: function(region, instances) {
+            if (mithras.dryRun) {
+                return;
+            }
+            _.each(instances, function(inst) {
+                try {
+                    var known = aws.instances.hostKeys(region, inst.InstanceId);
+                    if (known.keys.length == 0 && known.fingerprints.length == 0) {
+                        log(sprintf("No host keys in console output of '%s' yet.",
+                                    inst.InstanceId));
+                        return;
+                    }
+                    _.each(addresses(inst), function(addr) {
+                        mithras.remote.hostKeys.seed(addr, known);
+                    });
+                } catch (e) {
+                    log(sprintf("Can't seed host keys of '%s': %s",
+                                inst.InstanceId, e));
+                }
+            });
+        }
+        forgetHostKeys: function(inst) {
+            if (mithras.dryRun) {
+                return;
+            }
+            _.each(addresses(inst), function(addr) {
+                mithras.remote.hostKeys.forget(addr);
+            });
+        }
+        refresh: function(region, target, catalog) {
+            var found = _.filter(_.map(target, function(inst) {
+                return aws.instances.describe(region, inst.InstanceId);
+            }), function(inst) {
+                return inst && inst.State.Name !== "terminated";
+            });
+            if (found.length > 0) {
+                _.each(found, function(inst) {
+                    mithras.catalogAdd(catalog, "instances", inst, "InstanceId");
+                });
+                return found;
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var found = resource._target || [];
+            var desired = _.extend(_.pick(params.instance, "ImageId", "InstanceType", "KeyName", "SubnetId"),
+                                   {Tags: params.tags});
+            if (found.length == 0) {
+                return mithras.plan.compare(params.ensure,
+                                            _.extend({Count: params.instance.MaxCount}, desired));
+            }
+            if (params.ensure === "absent") {
+                var ids = _.pluck(found, "InstanceId");
+                return mithras.plan.compare("absent", {InstanceIds: ids}, {InstanceIds: ids});
+            }
+
+            // Launching or terminating brings the count to MaxCount
+            var changes = [];
+            if (found.length < params.instance.MinCount || 
+                found.length > params.instance.MaxCount) {
+                changes.push({field: "Count", from: found.length, to: params.instance.MaxCount});
+            }
+            _.each(found, function(inst) {
+                var current = _.extend({}, inst, {Tags: mithras.tagMap(inst.Tags)});
+                _.each(mithras.plan.diff(desired, current), function(c) {
+                    changes.push(_.extend(c, {field: inst.InstanceId + "." + c.field}));
+                });
+            });
+            return {action: changes.length > 0 ? "update" : "no-op", changes: changes};
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -263,6 +365,8 @@
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
             mithras.modules.preflight.register(name, handler.preflight);
+            mithras.modules.refresh.register(name, handler.refresh);
+            mithras.modules.plan.register(name, handler.plan);
             mithras.modules.handlers.register(name, handler.handle);
         });
         return handler;
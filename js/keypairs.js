@@ -155,6 +155,10 @@
                     log(sprintf("Creating key '%s'", params.key.KeyName));
                 }
                 var raw = aws.keypairs.create(params.region, params.key.KeyName);
+                if (mithras.dryRun) {
+                    catalog.keypairs.push({KeyName: params.key.KeyName});
+                    return [handler.findInCatalog(catalog, resource), true];
+                }
                 if (mithras.verbose) {
                     log(sprintf("Writing key '%s' to '%s'", 
                                 params.key.KeyName, 
@@ -182,6 +186,18 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var key = aws.keypairs.describe(region, target.KeyName);
+            if (key) {
+                return mithras.catalogAdd(catalog, "keypairs", key, "KeyName");
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            return mithras.plan.compare(params.ensure,
+                                        {KeyName: params.key.KeyName},
+                                        resource._target);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -198,8 +214,10 @@
     
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
@@ -35,19 +35,35 @@
 // > * [become](#become)
 // > * [bootstrap](#bootstrap)
 // > * [buildDeps](#buildDeps)
+// > * [catalogAdd](#catalogAdd)
 // > * [depGraph](#depGraph)
 // > * [doIncludes](#doIncludes)
+// > * [dryRun](#dryRun)
+// > * [excludes](#excludes)
 // > * [findGWByVpcId](#findGWByVpcId)
+// > * [graph](#graph)
 // > * [modules.handlers.register](#modules.handlers.register)
 // > * [modules.handlers.run](#modules.handlers.run)
+// > * [modules.plan.register](#modules.plan.register)
 // > * [modules.preflight.register](#modules.preflight.register)
 // > * [modules.preflight.run](#modules.preflight.run)
+// > * [modules.refresh.register](#modules.refresh.register)
 // > * [objectPath](#objectPath)
+// > * [parallelism](#parallelism)
 // > * [remote](#remote)
+// > * [resource](#resource)
 // > * [resourceMap](#resourceMap)
 // > * [run](#run) 
+// > * [scanConcurrency](#scanConcurrency)
+// > * [scanReport](#scanReport)
+// > * [sshAddressForInstance](#sshAddressForInstance)
+// > * [sshHostForInstance](#sshHostForInstance)
+// > * [sshJumpForInstance](#sshJumpForInstance)
 // > * [sshKeyPathForInstance](#sshKeyPathForInstance)
 // > * [sshUserForInstance](#sshUserForInstance)
+// > * [tagMap](#tagMap)
+// > * [tagList](#tagList)
+// > * [targets](#targets)
 // > * [traverse](#traverse)
 // > * [updateResource](#updateResource)
 // > * [verbose](#verbose)
@@ -71,6 +87,14 @@
 //
 // See the documentation for the [dep-graph.js](https://github.com/TrevorBurnham/dep-graph) module.
 // 
+// ### `graph` <a name="graph"></a>
+//
+// See the documentation for the [graph](graph.html) module.  While
+// `mithras.graph.capture` is set, as it is by `mithras graph`,
+// `mithras.apply` records the dependency graph of its resources
+// instead of handling them, and `mithras.run` returns an empty
+// catalog without talking to AWS.
+// 
 // ### `resourceMap(resources) {...}` <a name="resourceMap"></a>
 //
 // Helper function.  Returns a map of resources by their names.
@@ -164,6 +188,35 @@
 // See [Design and Concepts](design.html) for a more detailed
 // explanation of how this all works.
 // 
+// ### `modules.refresh.register(name, cb) {...}` <a name="modules.refresh.register"></a>
+//
+// Register a function to refresh targets loaded from [state](core_state.html).
+// 
+// A refresh function takes three arguments: the `region` recorded for
+// the resource, the `target` recorded for it, and the `catalog`.  It
+// returns the target as it is now in AWS, or `undefined` if it no
+// longer exists.  What it finds, and anything else its handler looks
+// for in the catalog, it adds to the catalog, with
+// [catalogAdd](#catalogAdd).
+// 
+// Only resources whose module has a refresh function are recorded in
+// state.  A module whose handler looks for resources in the catalog
+// must have one, for scripts to tell `mithras.run` to use state
+// instead of scanning AWS; see [run](#run).
+// 
+// ### `modules.plan.register(name, cb) {...}` <a name="modules.plan.register"></a>
+//
+// Register a function to plan a resource when `mithras.dryRun` is
+// set.
+// 
+// A plan function is called with the same three arguments as a
+// handler: `catalog`, `resources` and `targetResource`.  It compares
+// the parameters the resource asks for with its `_target`, usually
+// with [mithras.plan.compare](core_plan.html#compare), and returns
+// the proposal: an object with the `action` to be taken and the
+// `changes` it would make.  If it returns nothing, the resource is
+// planned from the calls its handler makes.
+// 
 // ### `MODULES` <a name="modules"></a>
 //
 // A map of loaded core module names to their version strings.
@@ -191,6 +244,49 @@
 // Set to `true` if the `-v` global flag is used to invoke Mithras on
 // the command line.  Eg., `mithras -v run ...`
 // 
+// ### `parallelism` <a name="parallelism"></a>
+//
+// The number of resources `mithras.apply` may handle at once,
+// unless overridden by its `options`.  Defaults to 1.  Set by the
+// `--parallel` flag of `mithras run`.  Eg., `mithras run -p 10`
+//
+// ### `scanConcurrency` <a name="scanConcurrency"></a>
+//
+// The number of AWS scans `mithras.run` runs at once.  Defaults to 8.
+//
+// ### `scanReport` <a name="scanReport"></a>
+//
+// After `mithras.run`, an array describing each scan it ran: its
+// `scanner`, `region`, `count` of resources found, `duration` in
+// seconds, and `error`, if it failed.
+//
+// ### `targets` <a name="targets"></a>
+//
+// The names of the resources `mithras.apply` should handle, unless
+// overridden by its `options`.  Empty by default, meaning all of
+// them.  Set by the `--target` flag of `mithras run`.
+// Eg., `mithras run --target webserver`
+//
+// ### `excludes` <a name="excludes"></a>
+//
+// The names of resources `mithras.apply` should not handle, unless
+// overridden by its `options`.  Empty by default.  Set by the
+// `--exclude` flag of `mithras run`.
+//
+// ### `resource` <a name="resource"></a>
+//
+// The name of the resource being handled by
+// `mithras.modules.handlers.run`, or `undefined`.  Lines of output
+// streamed from remote commands are labelled with it.  See
+// `mithras.remote.output` in the [remote](core_remote.html) core.
+//
+// ### `dryRun` <a name="dryRun"></a>
+//
+// Set to `true` by `mithras plan`.  Core functions which would change
+// AWS resources or remote hosts do nothing, and instead record the
+// change they would have made in `mithras.plan`.  See the
+// documentation for the [plan](core_plan.html) core.
+// 
 (function(){
 
     var objectPath = require("object_path.js");
@@ -221,12 +317,184 @@
         }, {});
     }
 
+    // Names of the resources whose `_target` came from state.  Set by
+    // mithras.apply; preflight leaves them alone.
+    var fromState = {};
+
+    // Set by mithras.run when told to use state instead of scanning
+    // AWS: the catalog it returned, and how to fill it in should
+    // apply find a resource state doesn't cover.
+    var pendingScan;
+
+    // The resources of modules which keep state, but which state
+    // didn't give a target.  Their modules look for them in the
+    // catalog.
+    var uncovered = function(resources) {
+        return _.filter(resources, function(r) {
+            return !r._target && mithras.modules.refresh.funcs[r.module];
+        });
+    }
+
+    // Give resources the targets recorded for them in state,
+    // refreshed from AWS by their module.  Refresh functions put what
+    // they find in the catalog, too.
+    var preloadState = function(resources, catalog) {
+        _.each(resources, function(r) {
+            var entry = mithras.state.get(r.name);
+            if (!entry || entry.module !== r.module || r._target) {
+                return;
+            }
+            var refresh = mithras.modules.refresh.funcs[r.module];
+            if (!refresh) {
+                log(sprintf("Module '%s' can't refresh '%s' from state; ignoring its entry.",
+                            r.module, r.name));
+                return;
+            }
+            var target = refresh(entry.region, entry.target, catalog);
+            if (target) {
+                log.debug(sprintf("  --- Setting _target from state for %s", r.name));
+                r._target = target;
+                fromState[r.name] = true;
+            } else if (mithras.verbose) {
+                log(sprintf("'%s' in state no longer exists", r.name));
+            }
+        });
+    }
+
+    // Record the targets of handled resources in state.  Only
+    // resources whose module can refresh them are kept.
+    var recordState = function(dict, order, regions) {
+        _.each(order, function(rName) {
+            var r = dict[rName];
+            if (r.skip || !r.module || !mithras.modules.refresh.funcs[r.module]) {
+                return;
+            }
+            if (r._target) {
+                mithras.state.set(rName, {
+                    module: r.module
+                    region: regions[rName]
+                    target: r._target
+                });
+            } else if (mithras.state.get(rName)) {
+                mithras.state.remove(rName);
+            }
+        });
+        mithras.state.save();
+    }
+
+    // Scan AWS for the `targets` kinds of resources, filling in
+    // `catalog`.
+    var scanCatalog = function(catalog, targets, options) {
+	catalog.regions = aws.regions.scan();
+	var regions = mithras.activeRegions(catalog);
+        if (mithras.verbose) {
+            log(sprintf("Scanning ec2 regions: %s", regions.join(", ")));
+        }
+
+	var result = aws.catalog.scan(regions, targets, {
+            concurrency: options.concurrency || mithras.scanConcurrency
+        });
+        mithras.scanReport = result.report;
+        _.each(result.report, function(r) {
+            if (r.error) {
+                log.warn(sprintf("Scanning %s in %s failed: %s", 
+                                 r.scanner, r.region, r.error));
+            } else if (mithras.verbose) {
+                log(sprintf("Scanned %s in %s: %d found in %.2fs", 
+                            r.scanner, r.region, r.count, r.duration));
+            }
+        });
+
+        return _.extend(catalog, result.catalog);
+    }
+
+    // A catalog with nothing in it.
+    var emptyCatalog = function(targets) {
+        return _.reduce(targets || aws.catalog.scanners(), function(memo, t) {
+            memo[t] = [];
+            return memo;
+        }, {regions: []});
+    }
+
+    // The names of the resources to handle: the targets and
+    // everything they need, less the exclusions.  With no targets,
+    // everything but the exclusions.
+    var selectResources = function(dict, deps, targets, excludes) {
+        var check = function(name) {
+            if (!dict[name]) {
+                throw new Error(sprintf("No resource named '%s'", name));
+            }
+        };
+        var selected = {};
+        if (targets && targets.length > 0) {
+            _.each(targets, function(t) {
+                check(t);
+                selected[t] = true;
+                _.each(deps.dependenciesOf(t), function(d) {
+                    selected[d] = true;
+                });
+            });
+        } else {
+            _.each(dict, function(r, name) {
+                selected[name] = true;
+            });
+        }
+        _.each(excludes, function(e) {
+            check(e);
+            delete selected[e];
+        });
+        return selected;
+    }
+
+    // What changed between two snapshots of a catalog.  Arrays are
+    // compared item by item.
+    var catalogChanges = function(before, after) {
+        var changes = {added: {}, removed: {}, set: {}};
+        _.each(after, function(v, k) {
+            var old = before[k];
+            if (Array.isArray(v) && Array.isArray(old)) {
+                var oldJSON = _.map(old, JSON.stringify);
+                var newJSON = _.map(v, JSON.stringify);
+                changes.added[k] = _.filter(v, function(item, idx) {
+                    return !_.contains(oldJSON, newJSON[idx]);
+                });
+                changes.removed[k] = _.filter(old, function(item, idx) {
+                    return !_.contains(newJSON, oldJSON[idx]);
+                });
+            } else if (JSON.stringify(v) !== JSON.stringify(old)) {
+                changes.set[k] = v;
+            }
+        });
+        return changes;
+    }
+
+    // Apply changes found by `catalogChanges` to a catalog.
+    var mergeCatalog = function(catalog, changes) {
+        _.each(changes.removed, function(items, k) {
+            var gone = _.map(items, JSON.stringify);
+            catalog[k] = _.reject(catalog[k], function(item) {
+                return _.contains(gone, JSON.stringify(item));
+            });
+        });
+        _.each(changes.added, function(items, k) {
+            catalog[k] = (catalog[k] || []).concat(items);
+        });
+        _.extend(catalog, changes.set);
+    }
+
     _.extend(mithras, {
         traverse: require("traverse.js")
         objectPath: require("object_path.js")
         depGraph: require("dep-graph").DepGraph
+        graph: require("graph")
         resourceMap: resourceMap
         become: become
+        dryRun: false
+        parallelism: 1
+        targets: []
+        excludes: []
+        scanConcurrency: 8
+        scanReport: []
 
         modules: {
             handlers: {
@@ -245,13 +513,19 @@
                     var f = mithras.modules.handlers.funcs[targetResource.module];
                     if (f) {
                         var result;
-                        if ((typeof(targetResource.on_handle) == "function")) {
-                            result = targetResource.on_handle(catalog, 
-                                                              resources, 
-                                                              targetResource, 
-                                                              f);
-                        } else {
-                            result = f(catalog, resources, targetResource);
+                        var outer = mithras.resource;
+                        mithras.resource = name;
+                        try {
+                            if ((typeof(targetResource.on_handle) == "function")) {
+                                result = targetResource.on_handle(catalog, 
+                                                                  resources, 
+                                                                  targetResource, 
+                                                                  f);
+                            } else {
+                                result = f(catalog, resources, targetResource);
+                            }
+                        } finally {
+                            mithras.resource = outer;
                         }
                         var target = result[0];
                         handled = result[1];
@@ -261,6 +535,15 @@
                             });
 			    log.debug("  --- Setting _target")
                             r._target = target;
+                        } else if (handled && targetResource.params &&
+                                   targetResource.params.ensure === "absent") {
+                            // Gone; forget any target loaded from state
+                            var r = _.find(resources, function(r){ 
+                                return r.name === name; 
+                            });
+                            if (r) {
+                                delete r._target;
+                            }
                         }
                     }
                     if (!handled && targetResource.module) {
@@ -271,6 +554,18 @@
                     }
                 }
             }
+            refresh: {
+                funcs: {}
+                register: function(name, cb) {
+                    mithras.modules.refresh.funcs[name] = cb;
+                }
+            }
+            plan: {
+                funcs: {}
+                register: function(name, cb) {
+                    mithras.modules.plan.funcs[name] = cb;
+                }
+            }
             preflight: {
                 funcs: {}
                 register: function(name, cb) {
@@ -290,6 +585,11 @@
 
                         var handled = false;
                         var f = mithras.modules.preflight.funcs[updated.module];
+                        if (f && fromState[name]) {
+                            // State knows better than the catalog
+                            log.debug("  --- Keeping _target from state");
+                            return;
+                        }
                         if (f) {
                             var result = f(catalog, resources, updated);
                             var target = result[0];
@@ -323,6 +623,13 @@
         // the resources need to bootstrap an instance for use with
         // Mithras.
         //
+        // The helper binaries, `wrapper` and `runner`, are copied
+        // from the build cache for each host's OS and architecture.
+        // On later runs, they are copied again if the build hash they
+        // report differs from the cached build, as it does once
+        // Mithras is upgraded and `mithras build` run again.  See
+        // [mithras.remote.helpers](core_remote.html#helpers).
+        //
         // Example template supplied by caller:
         // ```
         // { 
@@ -368,12 +675,12 @@
             }
 
             var skipper = function(resourceName) {
-                var path = resourceName + "._currentHost.PublicIpAddress";
+                var path = resourceName + "._currentHost.InstanceId";
                 return mithras.watch(resourceName + "._target",
                                      function(catalog, resources, results) {
-                                         var ip = objectPath.get(resources, path);
-                                         if (ip) {
-					     var found = results[ip] ? results[ip].trim() : "";
+                                         var id = objectPath.get(resources, path);
+                                         if (id) {
+					     var found = results[id] ? results[id].trim() : "";
                                              return (found === "found");
                                          }
                                      });
@@ -432,16 +739,16 @@
                 if (!instance) {
                     return;
                 }
-                var ip = instance.PublicIpAddress;
+                var id = instance.InstanceId;
                 var u = objectPath.get(resources, "mithrasUname._target");
-                if (!u || !u[ip] || typeof(u[ip]) != "string") {
-                    console.log(sprintf("No uname for '%s'", ip));
+                if (!u || !u[id] || typeof(u[id]) != "string") {
+                    console.log(sprintf("No uname for '%s'", id));
                     os.exit(3);
                 }
 
                 // Instance os
                 var theOS = null;
-                switch (u[ip].trim()) {
+                switch (u[id].trim()) {
                 case "Linux":
                     theOS = "linux";
                     break;
@@ -449,7 +756,7 @@
                     theOS = "darwin";
                     break;
                 default:
-                    console.log(sprintf("Unknown os '%s'", u[ip]));
+                    console.log(sprintf("Unknown os '%s'", u[id]));
                     os.exit(3);
                 }
                 
@@ -467,21 +774,60 @@
                 return [theOS, arch];
             }
 
+	    // Helper versions, to find stale binaries
+            var helpers = _.extend({}, template, {
+                name: "mithrasHelpers"
+                module: "shell"
+            });
+            helpers.dependsOn = (helpers.dependsOn || []).concat([uname.name, binDir.name]);
+            helpers.params = _.extend({},
+                                      paramsWithoutBecome,
+                                      {
+                                          skip: (ensure === "absent")
+                                          command: mithras.remote.helpers.command
+                                      });
+
+            // Skip copying a helper to a host which has the same
+            // build as the cache
+            var helperSkipper = function(resourceName, helper) {
+                return mithras.watch(resourceName + "._currentHost",
+                                     function(catalog, resources, inst) {
+                                         var reported = objectPath.get(resources, "mithrasHelpers._target");
+                                         if (!reported || typeof(reported[inst.InstanceId]) != "string") {
+                                             return false;
+                                         }
+                                         var result = osAndArchForInstance(catalog, resources, inst);
+                                         if (!result) {
+                                             return false;
+                                         }
+                                         var stale = mithras.remote.helpers.stale(reported[inst.InstanceId],
+                                                                                  helper,
+                                                                                  result[0],
+                                                                                  result[1]);
+                                         if (stale) {
+                                             log(sprintf("Helper '%s' on '%s' is stale; copying.",
+                                                         helper, inst.InstanceId));
+                                         }
+                                         return !stale;
+                                     });
+            };
+
 	    // Wrapper binary
             var wrapper = _.extend({}, template, {
                 name: "mithrasWrapper"
                 module: "file"
             });
-            wrapper.dependsOn = (wrapper.dependsOn || []).concat([uname.name, binDir.name]);
+            wrapper.dependsOn = (wrapper.dependsOn || []).concat([uname.name, binDir.name, helpers.name]);
             wrapper.params = _.extend({}, template.params, {
                 dest: ".mithras/bin/wrapper"
-                skip: (ensure === "absent") ? true : skipper(wrapper.name)
+                replace: true
+                skip: (ensure === "absent") ? true : helperSkipper(wrapper.name, "wrapper")
                 src: mithras.watch("mithrasWrapper._currentHost", 
                                    function(catalog, resources, inst) {
                                        var u = objectPath.get(resources, 
 							      "mithrasUname._target");
-                                       var ip = inst.PublicIpAddress;
-                                       if (!u || !u[ip] || typeof(u[ip]) != "string") {
+                                       var id = inst.InstanceId;
+                                       if (!u || !u[id] || typeof(u[id]) != "string") {
                                            return;
                                        }
                                        var result = osAndArchForInstance(catalog, 
@@ -504,15 +850,16 @@
                 name: "mithrasRunner"
                 module: "file"
             });
-            runner.dependsOn = (runner.dependsOn || []).concat([uname.name, binDir.name, wrapper.name]);
+            runner.dependsOn = (runner.dependsOn || []).concat([uname.name, binDir.name, helpers.name, wrapper.name]);
             runner.params = _.extend({}, template.params, {
                 dest: ".mithras/bin/runner"
-                skip: (ensure === "absent") ? true : skipper(runner.name)
+                replace: true
+                skip: (ensure === "absent") ? true : helperSkipper(runner.name, "runner")
                 src: mithras.watch("mithrasWrapper._currentHost", 
                                    function(catalog, resources, inst) {
                                        var u = objectPath.get(resources, "mithrasUname._target");
-                                       var ip = inst.PublicIpAddress;
-                                       if (!u || !u[ip] || typeof(u[ip]) != "string") {
+                                       var id = inst.InstanceId;
+                                       if (!u || !u[id] || typeof(u[id]) != "string") {
                                            return;
                                        }
                                        var result = osAndArchForInstance(catalog, resources, inst);
@@ -530,7 +877,7 @@
 
             // Give back the base resource, which includes all the dependencies.
             _.extend(this, template, {
-                includes: [dir, binDir, jsDir, scriptsDir, uname, wrapper, runner, ssh]
+                includes: [dir, binDir, jsDir, scriptsDir, uname, helpers, wrapper, runner, ssh]
                 dependsOn: (template.dependsOn || []).concat([wrapper.name, 
                                                               runner.name, 
                                                               scriptsDir.name,
@@ -541,12 +888,18 @@
         // @public
         // <a name="apply"></a>
 	// 
-        // ### `apply(catalog, resources, reverse) {...}`
+        // ### `apply(catalog, resources, reverse, options) {...}`
         //
         // The "core" function of Mithras.  Given a `catalog`, an
         // array of resource objects in `resources`, and a boolean
         // (`reverse`), apply the resources to the catalog.
         //
+        // The optional `options` object may have these properties:
+        //
+        // > * `parallelism`: the number of resources to handle at once.  Defaults to [mithras.parallelism](#parallelism).
+        // > * `targets`: an array of resource names.  Only these resources, and the resources they depend on (transitively), are handled.  In reverse, the resources which depend on them are handled instead.  Defaults to [mithras.targets](#targets); if empty, all resources are handled.
+        // > * `exclude`: an array of names of resources not to handle.  Defaults to [mithras.excludes](#excludes).
+        //
         // First a dependency graph is built.  In forward order, all
         // resources are preflighted.
         //
@@ -554,15 +907,47 @@
         // `true`), the resources are run through their handlers in
         // dependency order.
         //
+        // When `parallelism` is greater than 1, resources are
+        // handled concurrently by [mithras.dag.run](core_dag.html),
+        // each as soon as everything it depends on has been handled.
+        // Each handler runs in its own copy of the JS runtime.  When
+        // it finishes, the `_target` it set and the changes it made
+        // to the catalog are merged back.  Handlers must not rely on
+        // any other side effects.
+        //
+        // If [state](core_state.html) is kept, resources are first
+        // given the `_target` recorded for them by the last run,
+        // refreshed from AWS by their module's refresh function.
+        // Preflight leaves these targets be; it only looks in the
+        // catalog for resources state has no target for.  Should
+        // `mithras.run` have been told to skip scanning AWS, and a
+        // resource not be covered by state, AWS is scanned first.
+        // Afterwards, the `_target` of every handled resource whose
+        // module can refresh it is recorded, and the state saved.
+        //
+        // If `mithras.dryRun` is set, nothing is changed.  Each
+        // resource is recorded in `mithras.plan`, along with what
+        // its module's plan function proposes and the calls its
+        // handler would have made.  Dry runs always handle one
+        // resource at a time.
+        //
         // The catalog, after update by handlers, is returned.
         //
 	// See [Design and Concepts](design.html) for a more detailed
 	// explanation of how this all works.
 	// 
-        apply: function(catalog, resources, reverse) {
+        apply: function(catalog, resources, reverse, options) {
+            options = options || {};
+
             // include sub-resources
             var resources = mithras.doIncludes(resources);
-            
+
+            // Just looking
+            if (mithras.graph.capture) {
+                mithras.graph.graphs.push(mithras.graph.build(resources, reverse));
+                return catalog;
+            }
+
             // build dep graph
             var fwdDeps = new mithras.depGraph();
             _.each(resources, function(r) {
@@ -599,18 +984,52 @@
             var fwdOrder = fwdDeps.overallOrder();
             var revOrder = revDeps.overallOrder();
             
-            // Preflight in fwd deps order
-            mithras.modules.preflight.run(catalog, resources, fwdOrder);
-            
             // Build map of resource name to resource
             var dict = resourceMap(resources);
 
+            // Handle only what was asked for
+            var selected = selectResources(dict,
+                                           reverse ? revDeps : fwdDeps,
+                                           options.targets || mithras.targets,
+                                           options.exclude || mithras.excludes);
+            var isSelected = function(rName) {
+                return selected[rName];
+            };
+
+            // Start from what we knew last time
+            var keepState = mithras.state.enabled();
+            fromState = {};
+            if (keepState) {
+                preloadState(resources, catalog);
+            }
+
+            // Scan after all, if mithras.run skipped it and state
+            // doesn't cover everything
+            if (pendingScan && pendingScan.catalog === catalog) {
+                var missing = uncovered(_.filter(resources, function(r) { 
+                    return selected[r.name]; 
+                }));
+                if (missing.length > 0) {
+                    log(sprintf("Not found from state: %s; scanning AWS.", 
+                                _.pluck(missing, "name").join(", ")));
+                    scanCatalog(catalog, pendingScan.targets, pendingScan.options);
+                    pendingScan = undefined;
+                }
+            }
+            
+            // Preflight in fwd deps order
+            mithras.modules.preflight.run(catalog, resources, _.filter(fwdOrder, isSelected));
+
             // Call handlers in specified order
             var order = fwdOrder;
+            var deps = fwdDeps;
             if (reverse) {
                 order = revOrder;
+                deps = revDeps;
             }
-            _.each(order, function(rName) {
+            order = _.filter(order, isSelected);
+            var regions = {};
+            var handle = function(rName) {
                 if (dict[rName].skip) {
                     if (mithras.verbose) {
                         log0(sprintf("SKIPPING: %s", rName));
@@ -618,11 +1037,42 @@
                 } else {
                     log0(sprintf("RESOURCE: %s", rName));
 
+                    if (mithras.dryRun) {
+                        mithras.plan.resource(rName, dict[rName].module);
+                        try {
+                            var updated = mithras.updateResource(dict[rName], 
+                                                                 catalog, 
+                                                                 resources, 
+                                                                 rName);
+                            var plan = mithras.modules.plan.funcs[updated.module];
+                            var proposal = plan && plan(catalog, resources, updated);
+                            if (proposal) {
+                                mithras.plan.propose(rName, proposal);
+                            }
+                            mithras.modules.handlers.run(catalog, resources, updated, dict);
+                        } catch (e) {
+                            // Handlers may still need what only exists
+                            // once earlier resources are applied.
+                            mithras.plan.error(rName, e.toString());
+                        }
+                        // Planned calls may hand back nothing; keep
+                        // the catalog free of holes.
+                        _.each(catalog, function(v, k) {
+                            if (Array.isArray(v)) {
+                                catalog[k] = _.compact(v);
+                            }
+                        });
+                        return;
+                    }
+
                     // Update the resource
                     var updated = mithras.updateResource(dict[rName], 
 							 catalog, 
 							 resources, 
 							 rName);
+                    if (updated.params) {
+                        regions[rName] = updated.params.region;
+                    }
 
                     // Run handlers on updated resource
                     mithras.modules.handlers.run(catalog, resources, updated, dict);
@@ -635,8 +1085,54 @@
                         time.sleep(updated.delay);
                     }
                 }
-            });
+            };
+
+            var parallelism = options.parallelism || mithras.parallelism || 1;
+            if (parallelism < 2 || mithras.dryRun) {
+                _.each(order, handle);
+                if (keepState && !mithras.dryRun) {
+                    recordState(dict, order, regions);
+                }
+                return catalog;
+            }
 
+            // Runs in a copy of the runtime; hand back what changed.
+            var task = function(rName) {
+                var before = JSON.parse(JSON.stringify(catalog));
+                handle(rName);
+                var r = _.find(resources, function(r) { 
+                    return r.name === rName; 
+                });
+                return {
+                    target: r._target
+                    region: regions[rName]
+                    changes: catalogChanges(before, catalog)
+                };
+            };
+            var done = function(rName, result) {
+                var r = _.find(resources, function(r) { 
+                    return r.name === rName; 
+                });
+                if (result.target) {
+                    r._target = result.target;
+                } else {
+                    delete r._target;
+                }
+                regions[rName] = result.region;
+                mergeCatalog(catalog, result.changes);
+            };
+            mithras.dag.run({
+                order: order
+                deps: _.reduce(order, function(memo, rName) {
+                    memo[rName] = _.filter(deps.dependenciesOf(rName), isSelected);
+                    return memo;
+                }, {})
+                parallelism: parallelism
+            }, task, done);
+
+            if (keepState) {
+                recordState(dict, order, regions);
+            }
             return catalog;
         }
 
@@ -762,6 +1258,81 @@
             }
         }
 
+        // @public
+        // <a name="sshAddressForInstance"></a>
+        // 
+        // ### `sshAddressForInstance(resource, instance) {}`
+        //
+        // Given a `resource` and an ec2 `instance` object, return the
+        // address at which to reach the instance over SSH.
+        //
+        // If the resource has a property named
+        // `sshAddressForInstance`, it is invoked and its return value
+        // used.  Otherwise, the resource's `sshAddress` property
+        // chooses the address: `"public-ip"`, `"private-ip"`,
+        // `"public-dns"` or `"private-dns"`.
+        //
+        // The default is chosen by the `address` setting of
+        // `mithras.remote.configure`, which is `"public-ip"` unless
+        // changed.
+        //
+        sshAddressForInstance: function(resource, instance) {
+            if (resource.params &&
+                typeof(resource.params.sshAddressForInstance) === 'function') {
+                return resource.params.sshAddressForInstance(instance);
+            }
+            return mithras.remote.address(instance, 
+                                          resource.params && resource.params.sshAddress);
+        }
+
+        // @public
+        // <a name="sshJumpForInstance"></a>
+        // 
+        // ### `sshJumpForInstance(resource, instance) {}`
+        //
+        // Given a `resource` and an ec2 `instance` object, return the
+        // chain of jump hosts through which to reach the instance, as
+        // a string or an array of `"[user@]host[:port]"` hops.
+        //
+        // If the resource has a property named `sshJumpForInstance`,
+        // it is invoked and its return value used.  Otherwise, the
+        // resource's `sshJump` property is used.
+        //
+        // The default is `undefined`, meaning the chain set by the
+        // `jump` setting of `mithras.remote.configure`.
+        //
+        sshJumpForInstance: function(resource, instance) {
+            if (resource.params &&
+                typeof(resource.params.sshJumpForInstance) === 'function') {
+                return resource.params.sshJumpForInstance(instance);
+            } else if (resource.params) {
+                return resource.params.sshJump;
+            }
+        }
+
+        // @public
+        // <a name="sshHostForInstance"></a>
+        // 
+        // ### `sshHostForInstance(resource, instance) {}`
+        //
+        // Given a `resource` and an ec2 `instance` object, return the
+        // address to pass to the `mithras.remote` functions to reach
+        // the instance, and route them through the jump hosts given
+        // by `sshJumpForInstance`.
+        //
+        // The route is only ever added; without jump hosts for the
+        // instance, the route already set for its address, if any,
+        // is kept.  Routing an address through jump hosts other than
+        // those set for it already is an error.  See
+        // [mithras.remote.route](core_remote.html#route).
+        //
+        sshHostForInstance: function(resource, instance) {
+            var addr = mithras.sshAddressForInstance(resource, instance);
+            mithras.remote.route(addr, mithras.sshJumpForInstance(resource, instance),
+                                 {replace: false});
+            return addr;
+        }
+
         paramFunction: function(f) {
             return function() { return f; };
         }
@@ -874,75 +1445,111 @@
             }
         }
 
+        // @public
+        // <a name="tagMap"></a>
+        // 
+        // ### `tagMap(tags) {...}`
+        //
+        // Given the `Tags` of an AWS resource, an array of objects
+        // with a `Key` and a `Value`, return an object mapping each
+        // key to its value.  Handlers use it to compare the `tags`
+        // in a resource's params with its `_target`.
+        //
+        tagMap: function(tags) {
+            return _.reduce(tags, function(memo, t) {
+                memo[t.Key] = t.Value;
+                return memo;
+            }, {});
+        }
+
+        // @public
+        // <a name="tagList"></a>
+        // 
+        // ### `tagList(tags) {...}`
+        //
+        // The inverse of `tagMap`: given an object mapping keys to
+        // values, return them as AWS `Tags`.  In dry runs, handlers
+        // use it to tag the placeholders returned by creates.
+        //
+        tagList: function(tags) {
+            return _.map(_.keys(tags || {}), function(k) {
+                return {Key: k, Value: tags[k]};
+            });
+        }
+
+        // @public
+        // <a name="catalogAdd"></a>
+        // 
+        // ### `catalogAdd(catalog, key, item, idField) {...}`
+        //
+        // Put `item` in the `key` array of `catalog`, replacing the
+        // one with the same `idField`, if there is one.  Without an
+        // `idField`, as for queue URLs and topic ARNs, items are
+        // compared whole.  Refresh functions use it to fill in the
+        // catalog when `mithras.run` didn't scan AWS.  Returns `item`.
+        //
+        catalogAdd: function(catalog, key, item, idField) {
+            var items = _.reject(catalog[key] || [], function(i) {
+                return idField ? i[idField] === item[idField] : i === item;
+            });
+            items.push(item);
+            catalog[key] = items;
+            return item;
+        }
+
         // @public
         // <a name="run"></a>
         // 
-        // ### `run() {...}`
+        // ### `run(targets, options) {...}`
         //
         // Called by user scripts to interrogate AWS and return a
         // `catalog` of resources.
         //
-        run: function (targets) {
+        // If supplied, `targets` is an array naming the kinds of
+        // resources to look for (eg., `["instances", "vpcs"]`);
+        // otherwise all are scanned.  Every active region is scanned
+        // concurrently by [aws.catalog.scan](core_catalog.html).  The
+        // optional `options` object may set `concurrency`, the
+        // number of scans to run at once.  It defaults to
+        // [mithras.scanConcurrency](#scanConcurrency).
+        //
+        // A scan which fails is logged and leaves its part of the
+        // catalog empty; the rest of the catalog is still built.
+        // The report for every scan is left in
+        // [mithras.scanReport](#scanReport).
+        //
+        // If [state](core_state.html) is kept and has entries, set
+        // `fromState` to `true` in `options` to skip scanning AWS.
+        // The catalog returned is then empty, and `mithras.apply`
+        // fills in what the refresh functions of the resources in
+        // state find.  Should `apply` be given a resource state
+        // doesn't cover, which its module would look for in the
+        // catalog, AWS is scanned then, and the catalog filled in.
+        // Resources are covered by state if their module has a
+        // [refresh function](#modules.refresh.register), and it
+        // found them.  Scripts which look in the catalog themselves,
+        // eg. in an instance's `on_find`, must not use `fromState`.
+        //
+        run: function (targets, options) {
+            options = options || {};
             if (mithras.verbose) {
                 log0(sprintf("--- MITHRAS v %s --- ###", mithras.VERSION));
             }
 
-	    var scanners = {
-		beanstalkApps: aws.beanstalk.apps.scan,
-		beanstalkVersions: aws.beanstalk.versions.scan,
-	        beanstalkEnvironments: aws.beanstalk.environments.scan,
-		beanstalkConfigs: aws.beanstalk.configs.scan,
-		autoscalingGroups: aws.autoscaling.groups.scan,
-		autoscalingLaunchConfigs: aws.autoscaling.launchConfigs.scan,
-		autoscalingHooks: aws.autoscaling.hooks.scan,
-		caches: aws.elasticache.scan,
-		dbs: aws.rds.scan,
-		instances: aws.instances.scan,
-		securityGroups: aws.securityGroups.scan,
-		vpcs: aws.vpcs.scan,
-		gateways: aws.vpcs.gateways.scan,
-		subnets: aws.subnets.scan,
-		routeTables: aws.routeTables.scan,
-		elbs: aws.elbs.scan,
-		zones: aws.route53.zones.scan,
-		rrs: aws.route53.rrs.scan,
-		iamProfiles: aws.iam.profiles.scan,
-		iamRoles: aws.iam.roles.scan,
-		keypairs: aws.keypairs.scan,
-		subs: aws.sns.subs.scan,
-		topics: aws.sns.topics.scan,
-		queues: aws.sqs.scan,
-	    };
-
-	    if (!targets) {
-		targets = Object.keys(scanners);
-	    }
-	    var cat = _.reduce(targets, function(memo, t){ 
-		memo[t] = [];
-		return memo;
-            }, {});
-
-	    targets = _.reduce(targets, function(memo, t){ 
-		memo[t] = scanners[t];
-		return memo;
-            }, {});
+            if (mithras.graph.capture) {
+                return emptyCatalog(targets);
+            }
 
-	    var regions = aws.regions.scan();
-	    cat.regions = regions;
-	    _.each(mithras.activeRegions(cat), function(region) {
-                if (mithras.verbose) {
-                    log(sprintf("Scanning ec2 region: %s", region));
-                }
-                // This concat nonsense is because scan functions return array-LIKE things, but we want real arrays.
-		_.each(targets, function(f, target) {
-                    var scanned = f(region);
-                    if (scanned) {
-		        cat[target] = cat[target].concat(scanned);
-                    }
-		});
-	    });
+            // State says where the resources are
+            if (options.fromState && mithras.state.enabled() && 
+                _.keys(mithras.state.list()).length > 0) {
+                log("Using state; AWS is only scanned if a resource isn't in it.");
+                var cat = emptyCatalog(targets);
+                pendingScan = {catalog: cat, targets: targets, options: options};
+                return cat;
+            }
 
-            return cat;
+            return scanCatalog({}, targets, options);
         }
 
         // @public
@@ -94,8 +94,9 @@
 	    }
 	    var target = resource._target = {};
 	    _.each(p.hosts, function(host) {
+		var addr = mithras.sshHostForInstance(resource, host);
 		if (mithras.verbose) {
-		    log(sprintf("Host: '%s' (%s)", host.PublicIpAddress, 
+		    log(sprintf("Host: '%s' (%s)", addr, 
 				host.InstanceId));
 		}
 
@@ -112,14 +113,16 @@
 		
 		var port = p.port || 22;
 		var timeout = p.timeout || 120;
-		var ok = network.check(host.PublicIpAddress, port, timeout);
+		var ok = network.check(addr, port, timeout,
+				       mithras.sshUserForInstance(resource, host),
+				       mithras.sshKeyPathForInstance(resource, host));
 		
 		if (ok) {
 		    if (ensure === "present") {
 			if (mithras.verbose) {
 			    log(sprintf("Success."));
 			}
-			target[host.PublicIpAddress] = ok;
+			target[addr] = ok;
 			target[host.InstanceId] = ok;
 		    } else if (ensure === "absent") {
 			log("Error: network connection still alive.");
@@ -128,14 +131,14 @@
 		} else {
 		    if (ensure === "present") {
 			log(sprintf("Network error remote system '%s', port %d",
-				    host.PublicIpAddress, 
+				    addr, 
 				    port));
 			os.exit(3);
 		    } else if (ensure === "absent") {
 			if (mithras.verbose) {
 			    log(sprintf("Success."));
 			}
-			target[host.PublicIpAddress] = ok;
+			target[addr] = ok;
 			target[host.InstanceId] = ok;
 		    }
 		}
@@ -113,7 +113,8 @@
             var cmd = sprintf("yum list installed %s", p.name);
             cmd = become(p.become, p.becomeUser, p.becomeMethod, cmd);
             cmd = cmd.split(/[ ]+/);
-            result = mithras.remote.wrapper(instance, user, key, cmd, null);
+            result = mithras.remote.wrapper(mithras.sshHostForInstance(resource, instance),
+                                            user, key, cmd, null);
             var out = result[0];
             var err = result[1];
             var ok = result[2];
@@ -163,7 +164,8 @@
                 break;
             }
             cmd = become(p.become, p.becomeUser, p.becomeMethod, cmd).trim().split(/[ \t]+/);
-            var result = mithras.remote.wrapper(inst, user, key, cmd, null);
+            var result = mithras.remote.wrapper(mithras.sshHostForInstance(resource, inst),
+                                                user, key, cmd, null);
             var out = result[0].trim();
             var err = result[1].trim();
             var ok = result[2];
@@ -216,7 +218,7 @@
                 var key = mithras.sshKeyPathForInstance(resource, host);
                 var user = mithras.sshUserForInstance(resource, host);
                 if (mithras.verbose) {
-                    log(sprintf("Host: '%s' (%s)", host.PublicIpAddress, 
+                    log(sprintf("Host: '%s' (%s)", mithras.sshAddressForInstance(resource, host), 
                                 host.InstanceId));
                 }
 
@@ -224,10 +224,12 @@
 		if (mithras.verbose) {
 		    log(sprintf("Creating rds instance '%s' (WAIT FOR IT...)", id));
 		}
-		aws.rds.create(p.region, p.db, p.wait);
+		db = aws.rds.create(p.region, p.db, p.wait);
 
 		// re-describe it
-		db = aws.rds.describe(p.region, id);
+		if (!mithras.dryRun) {
+		    db = aws.rds.describe(p.region, id);
+		}
 
 		// add to catalog
 		catalog.dbs.push(db);
@@ -248,6 +250,20 @@
 		return inst.DBInstanceIdentifier === id;
 	    });
 	}
+	refresh: function(region, target, catalog) {
+	    var db = aws.rds.describe(region, target.DBInstanceIdentifier);
+	    if (db) {
+		return mithras.catalogAdd(catalog, "dbs", db, "DBInstanceIdentifier");
+	    }
+	}
+	plan: function(catalog, resources, resource) {
+	    var p = resource.params;
+	    return mithras.plan.compare(p.ensure,
+					_.pick(p.db, "DBInstanceIdentifier", "DBInstanceClass",
+					       "Engine", "EngineVersion", "AllocatedStorage", 
+					       "MultiAZ"),
+					resource._target);
+	}
 	preflight: function(catalog, resources, resource) {
 	    if (!_.find(handler.moduleNames, function(m) { 
 		return resource.module === m; 
@@ -267,8 +283,10 @@
 
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
 	return handler;
     };
@@ -193,6 +193,39 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            // The record's zone is the one with the longest name
+            // ending its name
+            var zones = aws.route53.zones.scan(region);
+            _.each(zones, function(z) {
+                mithras.catalogAdd(catalog, "zones", z, "Id");
+            });
+            var zone = _.max(_.filter(zones, function(z) {
+                var i = target.Name.lastIndexOf(z.Name);
+                return i >= 0 && i === target.Name.length - z.Name.length;
+            }), function(z) {
+                return z.Name.length;
+            });
+            if (!zone || !zone.Id) {
+                return;
+            }
+            var set = aws.route53.rrs.describe(region, zone.Id, target.Name, target.Type);
+            if (!set || set.Name !== target.Name || set.Type !== target.Type) {
+                return;
+            }
+            catalog.rrs = _.reject(catalog.rrs || [], function(r) {
+                return r.Name === set.Name && r.Type === set.Type;
+            });
+            catalog.rrs.push(set);
+            return set;
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            return mithras.plan.compare(params.ensure,
+                                        _.pick(params.resource, "Name", "Type", "TTL",
+                                               "ResourceRecords", "AliasTarget"),
+                                        resource._target);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -211,8 +244,10 @@
     
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
@@ -202,6 +202,17 @@
             }
             return [null, true];
         }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            if (!params.bucket) {
+                // Objects are planned from the calls made
+                return;
+            }
+            var buckets = aws.s3.buckets.describe(params.region, "*");
+            return mithras.plan.compare(params.ensure,
+                                        {Name: params.bucket.Bucket},
+                                        _.findWhere(buckets, {"Name": params.bucket.Bucket}));
+        }
         handleBucket: function(catalog, resource) {
             if (!resource.params.bucket) {
                 return;
@@ -313,7 +324,7 @@
                                  JSON.stringify(_.omit(params, 'hosts')));
                 for (var i in params.hosts) {
                     var instance = params.hosts[i];
-                    var result = mithras.remote.mithras(instance,
+                    var result = mithras.remote.mithras(mithras.sshHostForInstance(resource, instance),
                                                         mithras.sshUserForInstance(resource, instance),
                                                         mithras.sshKeyPathForInstance(resource, instance),
                                                         js,
@@ -355,6 +366,7 @@
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
     };
 
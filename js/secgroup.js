@@ -223,7 +223,11 @@
                 }
                 
                 // Reload it to get tags
-                var sg = aws.securityGroups.describe(params.region, sg.GroupId);
+                if (mithras.dryRun) {
+                    sg.Tags = mithras.tagList(params.tags);
+                } else {
+                    var sg = aws.securityGroups.describe(params.region, sg.GroupId);
+                }
                 
                 // add to catalog
                 catalog.securityGroups.push(sg);
@@ -233,6 +237,20 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var sg = aws.securityGroups.describe(region, target.GroupId);
+            if (sg && sg.GroupId) {
+                return mithras.catalogAdd(catalog, "securityGroups", sg, "GroupId");
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var sg = resource._target;
+            var desired = _.extend(_.pick(params.secgroup, "GroupName", "Description", "VpcId"),
+                                   {Tags: params.tags});
+            var current = sg && _.extend({}, sg, {Tags: mithras.tagMap(sg.Tags)});
+            return mithras.plan.compare(params.ensure, desired, current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -252,6 +270,8 @@
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
             mithras.modules.preflight.register(name, handler.preflight);
+            mithras.modules.refresh.register(name, handler.refresh);
+            mithras.modules.plan.register(name, handler.plan);
             mithras.modules.handlers.register(name, handler.handle);
         });
         return handler;
@@ -73,9 +73,10 @@
         moduleNames: ["service"]
         running: function(resource, instance, user, key) {
             var p = resource.params;
+            var addr = mithras.sshHostForInstance(resource, instance);
             var cmd = sprintf("service %s status", p.name)
             cmd = become(p.become, p.becomeUser, p.becomeMethod, cmd);
-            result = mithras.remote.shell(instance.PublicIpAddress, 
+            result = mithras.remote.shell(addr, 
                                           user, 
                                           key, 
                                           null,
@@ -94,7 +95,7 @@
                 }
             } else if (status == 255) {
                 log(sprintf("Error communicating with remote system '%s', svc '%s': %s",
-                            instance.PublicIpAddress, p.name, err.trim()));
+                            addr, p.name, err.trim()));
                 os.exit(3);
             } else if (status == 1 && mithras.verbose) {
                 log(sprintf("Service '%s', ok: %t, status: %d %s %s", 
@@ -110,10 +111,11 @@
         
         startStop: function(resource, inst, user, key, action) {
             var p = resource.params;
+            var addr = mithras.sshHostForInstance(resource, inst);
             var cmd = "";
             cmd = sprintf("service %s %s", p.name, action)
             cmd = become(p.become, p.becomeUser, p.becomeMethod, cmd);
-            var result = mithras.remote.shell(inst.PublicIpAddress, user, key, null, cmd, null);
+            var result = mithras.remote.shell(addr, user, key, null, cmd, null);
             
             var out = result[0].trim();
             var err = result[1].trim();
@@ -126,7 +128,7 @@
                 return true;
             } else if (status == 255) {
                 log(sprintf("SSH error communicating with remote system '%s', service '%s': %s %s",
-                            inst.PublicIpAddress, p.name, err, out));
+                            addr, p.name, err, out));
                 os.exit(3);
             } else if (status == 1) {
                 if (action === 'stop') {
@@ -171,7 +173,7 @@
                 var key = mithras.sshKeyPathForInstance(resource, host);
                 var user = mithras.sshUserForInstance(resource, host);
                 if (mithras.verbose) {
-                    log(sprintf("Host: '%s' (%s)", host.PublicIpAddress, 
+                    log(sprintf("Host: '%s' (%s)", mithras.sshAddressForInstance(resource, host), 
                                 host.InstanceId));
                 }
 
@@ -60,7 +60,43 @@
 // * Required: false
 // * Allowed Values: an array of ec2 instance objects
 //
-// The command is executed on these instances.
+// The command is executed on these instances, several at once, as
+// with `mithras.remote.each`.
+//
+// ### `timeout`
+//
+// * Required: false
+// * Allowed Values: seconds
+//
+// How long the command may take on each instance before it is
+// abandoned.  Defaults to the `timeout` set with
+// `mithras.remote.configure`.
+//
+// ### `retries`
+//
+// * Required: false
+// * Allowed Values: a number
+//
+// How many times to retry the command on an instance which can't be
+// reached.  Defaults to the `retries` set with
+// `mithras.remote.configure`.
+//
+// ### `backoff`
+//
+// * Required: false
+// * Allowed Values: seconds
+//
+// How long to wait before the first retry; each retry after waits
+// twice as long.
+//
+// ### `concurrency`, `batch`, `maxFailPercentage`
+//
+// * Required: false
+// * Allowed Values: as for `mithras.remote.each`
+//
+// How many instances to run the command on at once, in batches of
+// how many, and the percentage of instances which may fail before no
+// more are started.  By default, it runs on 10 at once, in one batch.
 //
 (function (root, factory){
     if (typeof module === 'object' && typeof module.exports === 'object') {
@@ -90,20 +126,21 @@
 		os.exit(3);
 	    }
 	    
-	    // Loop over hosts
+	    // Run on all the hosts at once
 	    if (!Array.isArray(p.hosts)) {
 		return [null, true];
 	    }
 	    var target = resource._target = {};
-	    _.each(p.hosts, function(host) {
+	    var commands = {};
+	    var options = _.extend({resource: resource},
+				   _.pick(p, "concurrency", "batch", "maxFailPercentage"));
+	    var results = mithras.remote.each(p.hosts, options, function(host) {
 		if (mithras.verbose) {
-		    log(sprintf("Host: '%s' (%s)", host.PublicIpAddress, 
+		    log(sprintf("Host: '%s' (%s)", 
+				mithras.sshHostForInstance(resource, host), 
 				host.InstanceId));
 		}
 
-		var key = mithras.sshKeyPathForInstance(resource, host);
-		var user = mithras.sshUserForInstance(resource, host);
-		
 		// update for by-host variance
 		_.find(resources, function(r) {
 		    return r.name === resource.name;
@@ -117,51 +154,61 @@
 
 		if (updatedParams.skip == true) {
                     log("Skipped.");
-		    return;
+		    return null;
 		}
 		
+		commands[host.InstanceId] = updatedParams.command;
 		var cmd = become(updatedParams.become, 
 				 updatedParams.becomeUser, 
 				 updatedParams.becomeMethod, 
 				 updatedParams.command);
-		var result = mithras.remote.shell(host.PublicIpAddress, 
-						  user, 
-						  key, 
-						  null, 
-						  cmd, 
-						  null);
-		
-		var out = result[0];
-		var err = result[1];
-		var ok = result[2];
-		var status = result[3];
-		if (ok && status == 0) {
-		    target[host.PublicIpAddress] = out;
+		return _.extend({shell: cmd, control: true},
+				_.pick(updatedParams, "timeout", "retries", "backoff"));
+	    });
+
+	    _.each(p.hosts, function(host) {
+		var result = results[host.InstanceId];
+		if (!result || result.skipped) {
+		    return;
+		}
+		var addr = result.host;
+		var command = commands[host.InstanceId];
+		var out = result.out;
+		var err = result.err;
+		var status = result.status;
+		if (result.error) {
+		    log(sprintf("Can't run command '%s' on remote system '%s': %s",
+				command, 
+				addr, 
+				result.error));
+		    os.exit(3);
+		} else if (result.success) {
+		    target[addr] = out;
 		    target[host.InstanceId] = out;
 		    if (mithras.verbose) {
 			log("Success.");
 		    }
 		} else if (status == 255) {
-		    log(sprintf("SSH error remote system '%s', command '%s': %s %s",
-				host.PublicIpAddress, 
-				updatedParams.command, 
+		    log(sprintf("SSH error (%s) remote system '%s', command '%s': %s %s",
+				result.failure,
+				addr, 
+				command, 
 				err.trim(), 
 				out.trim()));
 		    os.exit(3);
 		} else if (status == 1) {
 		    if (mithras.verbose) {
-			log(sprintf("Shell '%s' error: %s\n%s", updatedParams.command, err, out));
+			log(sprintf("Shell '%s' error: %s\n%s", command, err, out));
 		    }
 		    os.exit(3);
 		} else {
 		    if (mithras.verbose) {
 			log(sprintf("Shell '%s': status %d; out %s", 
-				    updatedParams.command, 
+				    command, 
 				    status, 
 				    out));
 		    }
 		}
-
 	    });
 	    return [target, true];
 	}
@@ -242,6 +242,39 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var topic = target.topic && aws.sns.topics.describe(region, target.topic);
+            var sub = target.sub && aws.sns.subs.describe(region, target.sub.SubscriptionArn);
+            if (topic) {
+                mithras.catalogAdd(catalog, "topics", topic);
+            }
+            if (sub) {
+                mithras.catalogAdd(catalog, "subs", sub, "SubscriptionArn");
+            }
+            if (topic || sub) {
+                return {topic: topic || null, sub: sub || null};
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var found = resource._target || {};
+            var desired = {};
+            var current = {};
+            if (params.topic) {
+                desired.topic = {Name: params.topic.Name};
+                if (found.topic) {
+                    current.topic = {Name: found.topic.split(":").pop()};
+                }
+            }
+            if (params.sub) {
+                desired.sub = _.pick(params.sub, "TopicArn", "Protocol", "Endpoint");
+                current.sub = found.sub;
+            }
+            if (!current.topic && !current.sub) {
+                current = null;
+            }
+            return mithras.plan.compare(params.ensure, desired, current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -260,8 +293,10 @@
     
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
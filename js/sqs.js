@@ -219,6 +219,25 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var queue = _.find(aws.sqs.scan(region), function(url) {
+                return url === target;
+            });
+            if (queue) {
+                return mithras.catalogAdd(catalog, "queues", queue);
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            if (!params.queue) {
+                // Attributes and messages only
+                return;
+            }
+            var queue = resource._target;
+            return mithras.plan.compare(params.ensure,
+                                        {QueueName: params.queue.QueueName},
+                                        queue && {QueueName: queue.split("/").pop()});
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -235,8 +254,10 @@
     
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
+            mithras.modules.refresh.register(name, handler.refresh);
             mithras.modules.preflight.register(name, handler.preflight);
             mithras.modules.handlers.register(name, handler.handle);
+            mithras.modules.plan.register(name, handler.plan);
         });
         return handler;
     };
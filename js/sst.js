@@ -49,6 +49,8 @@
                         return;
                     }
                 }
+                // What the setup declares belongs to this suite
+                this.currentSuite = suiteName;
                 (suite.setup.bind(this))();
                 if (suite.before) {
                     (suite.before)();
@@ -72,7 +74,7 @@
                 if (suite.after) {
                     (suite.after)();
                 }
-            });
+            }, this);
         }
         report: function(suites) {
             if (suites && !(_.isArray(suites))) {
@@ -222,7 +222,11 @@
                 aws.tags.create(params.region, subnet.SubnetId, params.tags);
                 
                 // Reload it to get tags
-                var subnet = aws.subnets.describe(params.region, subnet.SubnetId);
+                if (mithras.dryRun) {
+                    subnet.Tags = mithras.tagList(params.tags);
+                } else {
+                    var subnet = aws.subnets.describe(params.region, subnet.SubnetId);
+                }
                 
                 // create route table and associate subnet with it
                 if (mithras.verbose) {
@@ -262,6 +266,23 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var subnet = aws.subnets.describe(region, target.SubnetId);
+            if (subnet && subnet.SubnetId) {
+                _.each(aws.routeTables.describeForSubnet(region, subnet.SubnetId), function(t) {
+                    mithras.catalogAdd(catalog, "routeTables", t, "RouteTableId");
+                });
+                return mithras.catalogAdd(catalog, "subnets", subnet, "SubnetId");
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var subnet = resource._target;
+            var desired = _.extend(_.pick(params.subnet, "CidrBlock", "VpcId", "AvailabilityZone"),
+                                   {Tags: params.tags});
+            var current = subnet && _.extend({}, subnet, {Tags: mithras.tagMap(subnet.Tags)});
+            return mithras.plan.compare(params.ensure, desired, current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -281,6 +302,8 @@
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
             mithras.modules.preflight.register(name, handler.preflight);
+            mithras.modules.refresh.register(name, handler.refresh);
+            mithras.modules.plan.register(name, handler.plan);
             mithras.modules.handlers.register(name, handler.handle);
         });
         return handler;
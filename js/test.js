@@ -3,7 +3,10 @@ function run() {
     console.log("RUNNING", filepath.join(mithras.HOME, "js", "test"));
 
     var sst = new (require('sst'))();
-    _.extend(this, sst);
+    var global = this;
+    _.each(["suite", "before", "after", "test", "beforeEach", "afterEach"], function(f) {
+        global[f] = _.bind(sst[f], sst);
+    });
     
     var tests = {};
     filepath.walk(filepath.join(mithras.HOME, "js", "test"), function(path, info, err) {
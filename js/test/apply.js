@@ -0,0 +1,131 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        suite('apply', function() {
+            mithras.modules.handlers.register("testApply", function(catalog, resources, r) {
+                if (r.params.fail) {
+                    throw new Error("failed on purpose");
+                }
+                catalog.things.push({name: r.name, from: r.params.from || null});
+                return [r.name + "!", true];
+            });
+            var resources = function() {
+                return [
+                    {name: "a", module: "testApply", params: {}},
+                    {name: "b", module: "testApply", dependsOn: ["a"], params: {
+                        from: function(catalog, resources) {
+                            return resources.a._target;
+                        }
+                    }},
+                    {name: "c", module: "testApply", params: {}},
+                    {name: "d", module: "testApply", dependsOn: ["b", "c"], params: {}}
+                ];
+            };
+            test('mithras.resource names the resource being handled', function(){
+                var seen;
+                mithras.modules.handlers.register("testResource", function(catalog, resources, r) {
+                    seen = mithras.resource;
+                    return [null, true];
+                });
+                var r = {name: "named", module: "testResource", params: {}};
+                mithras.modules.handlers.run({}, [r], r, {});
+                assert(seen === "named");
+                assert(mithras.resource === undefined);
+            });
+            test('independent resources are handled concurrently', function(){
+                var rs = resources();
+                var catalog = mithras.apply({things: [{name: "old"}]}, rs, false, {parallelism: 3});
+                assert(catalog.things.length === 5);
+                var b = _.find(catalog.things, function(t) { return t.name === "b"; });
+                assert(b.from === "a!");
+                assert(_.find(rs, function(r) { return r.name === "d"; })._target === "d!");
+
+                // Each handler hands a message to the other through a
+                // fifo, which blocks until the other end is opened.
+                // Handled one after the other, the first gives up.
+                var dir = exec.run("mktemp -d -t mithrastest-apply.XXXXXX")[0].trim();
+                exec.run("mkfifo " + filepath.join(dir, "left") + " " + filepath.join(dir, "right"));
+                mithras.modules.handlers.register("testBarrier", function(catalog, resources, r) {
+                    var send = function() {
+                        exec.run("timeout 10 sh -c 'echo " + r.name + " > " +
+                                 filepath.join(dir, r.params.peer) + "'");
+                    };
+                    var receive = function() {
+                        return exec.run("timeout 10 cat " + filepath.join(dir, r.name))[0].trim();
+                    };
+                    var got;
+                    if (r.params.sendFirst) {
+                        send();
+                        got = receive();
+                    } else {
+                        got = receive();
+                        send();
+                    }
+                    return [got === r.params.peer, true];
+                });
+                var pair = [
+                    {name: "left", module: "testBarrier", params: {peer: "right", sendFirst: true}},
+                    {name: "right", module: "testBarrier", params: {peer: "left"}}
+                ];
+                mithras.apply({}, pair, false, {parallelism: 2});
+                fs.removeAll(dir);
+                assert(pair[0]._target === true);
+                assert(pair[1]._target === true);
+            });
+            test('a failing done callback lets running tasks finish', function(){
+                var finished = [];
+                assert.throws(function() {
+                    mithras.dag.run({
+                        order: ["a", "b", "c"]
+                        deps: {c: ["a"]}
+                        parallelism: 2
+                    }, function(name) {
+                        return name;
+                    }, function(name, value) {
+                        finished.push(value);
+                        if (name === "a") {
+                            throw new Error("done failed on purpose");
+                        }
+                    });
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("'a'") >= 0;
+                });
+                assert.equals(finished.sort(), ["a", "b"]);
+            });
+            test('a failing resource fails the apply', function(){
+                var rs = resources();
+                rs[2].params.fail = true;
+                assert.throws(function() {
+                    mithras.apply({things: []}, rs, false, {parallelism: 3});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("'c'") >= 0;
+                });
+            });
+            test('targets restrict apply to their dependencies', function(){
+                var catalog = mithras.apply({things: []}, resources(), false, {targets: ["b"]});
+                assert.equals(_.pluck(catalog.things, "name"), ["a", "b"]);
+                catalog = mithras.apply({things: []}, resources(), false, {
+                    targets: ["d"]
+                    exclude: ["a"]
+                    parallelism: 2
+                });
+                assert.equals(_.pluck(catalog.things, "name").sort(), ["b", "c", "d"]);
+            });
+            test('targets select dependents in reverse', function(){
+                var catalog = mithras.apply({things: []}, resources(), true, {targets: ["c"]});
+                assert.equals(_.pluck(catalog.things, "name"), ["d", "c"]);
+                assert.throws(function() {
+                    mithras.apply({things: []}, resources(), true, {targets: ["nope"]});
+                }, function(e) {
+                    return e.message.indexOf("'nope'") >= 0;
+                });
+            });
+        });
+    }
+    
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
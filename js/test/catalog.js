@@ -0,0 +1,28 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        suite('catalog', function() {
+            test('aws.catalog.scanners() lists the catalog targets', function(){
+                var names = aws.catalog.scanners();
+                assert(_.contains(names, "instances"));
+                assert(_.contains(names, "queues"));
+            });
+            test('a failing scan is reported and does not abort the others', function(){
+                var result = aws.catalog.scan(["us-east-1", "us-west-2"], 
+                                              ["noSuchScanner"], 
+                                              {concurrency: 2});
+                assert(Array.isArray(result.catalog.noSuchScanner));
+                assert(result.catalog.noSuchScanner.length === 0);
+                assert(result.report.length === 2);
+                assert(result.report[1].region === "us-west-2");
+                assert(result.report[0].error.indexOf("No scanner") === 0);
+            });
+        });
+    }
+    
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
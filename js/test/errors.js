@@ -0,0 +1,30 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        suite('errors', function() {
+            test('require() of a missing module throws', function(){
+                assert.throws(function() {
+                    require("no_such_module_anywhere");
+                }, function(e) {
+                    return e.name === "MithrasError" && e.code === "MithrasError";
+                })
+            });
+            test('thrown errors can be caught and recovered from', function(){
+                var caught;
+                try {
+                    web.url.parse("http://[::1");
+                } catch (e) {
+                    caught = e;
+                }
+                assert(caught && caught.name === "MithrasError");
+                assert(caught.message.indexOf("Can't parse url") === 0);
+            });
+        });
+    }
+    
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
@@ -0,0 +1,63 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        var resources = [
+            {name: "web", module: "instance", dependsOn: ["subnet"]},
+            {name: "subnet", module: "subnet", dependsOn: "vpc", skip: true},
+            {name: "vpc", module: "vpc"}
+        ];
+        suite('graph', function() {
+            test('graph.build() computes the apply order', function(){
+                var g = mithras.graph.build(resources);
+                assert.equals(g.order, ["vpc", "subnet", "web"]);
+                assert.equals(_.pluck(g.nodes, "order"), [3, 2, 1]);
+                assert(g.nodes[1].skip);
+                assert.equals(g.edges, [{from: "web", to: "subnet"},
+                                        {from: "subnet", to: "vpc"}]);
+                var r = mithras.graph.build(resources, true);
+                assert.equals(r.order, ["web", "subnet", "vpc"]);
+            });
+            test('graph.build() finds dangling references and cycles', function(){
+                var g = mithras.graph.build([
+                    {name: "a", dependsOn: ["b", "nope"]},
+                    {name: "b", dependsOn: "c"},
+                    {name: "c", dependsOn: "a"}
+                ]);
+                assert.equals(g.dangling, [{from: "a", to: "nope"}]);
+                assert.equals(g.cycles, [["a", "b", "c", "a"]]);
+                assert.equals(g.order, []);
+                assert(mithras.graph.problems(g).length === 2);
+            });
+            test('graph.render() writes dot, json and mermaid', function(){
+                var g = mithras.graph.build(resources);
+                var dot = mithras.graph.render([g], "dot");
+                assert(dot.indexOf('"web" -> "subnet";') >= 0);
+                assert(dot.indexOf('label="subnet\\nsubnet\\n#2\\n(skip)", style=dashed') >= 0);
+                var mermaid = mithras.graph.render([g], "mermaid");
+                assert(mermaid.indexOf("n0 --> n1") >= 0);
+                assert(mermaid.indexOf("class n1 skipped") >= 0);
+                assert.equals(JSON.parse(mithras.graph.render([g], "json")), [g]);
+                assert.throws(function() {
+                    mithras.graph.render([g], "png");
+                }, function(e) { return true; });
+            });
+            test('apply records the graph while capturing', function(){
+                mithras.graph.capture = true;
+                try {
+                    mithras.apply({}, resources, false);
+                    assert(mithras.graph.graphs.length === 1);
+                    assert.equals(mithras.graph.graphs[0].order, ["vpc", "subnet", "web"]);
+                } finally {
+                    mithras.graph.capture = false;
+                    mithras.graph.graphs = [];
+                }
+            });
+        });
+    }
+    
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
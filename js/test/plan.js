@@ -0,0 +1,182 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        suite('plan', function() {
+            test('mithras.plan.compare() proposes an action and the changes', function(){
+                var desired = {CidrBlock: "10.0.0.0/16", Tags: {Name: "main"}};
+
+                var p = mithras.plan.compare("present", desired);
+                assert(p.action === "create");
+                assert.equals(_.pluck(p.changes, "field"), ["CidrBlock", "Tags"]);
+                assert(p.changes[0].from === null && p.changes[0].to === "10.0.0.0/16");
+
+                p = mithras.plan.compare("present", desired, {
+                    VpcId: "vpc-1"
+                    CidrBlock: "10.0.0.0/16"
+                    Tags: {Name: "old", Owner: "ops"}
+                });
+                assert(p.action === "update");
+                assert(p.changes.length === 1);
+                assert(p.changes[0].field === "Tags.Name");
+                assert(p.changes[0].from === "old" && p.changes[0].to === "main");
+
+                p = mithras.plan.compare("present", desired, {
+                    CidrBlock: "10.0.0.0/16"
+                    Tags: {Name: "main"}
+                });
+                assert(p.action === "no-op" && p.changes.length === 0);
+
+                p = mithras.plan.compare("absent", desired, {CidrBlock: "10.1.0.0/16"});
+                assert(p.action === "delete");
+                assert(p.changes[0].from === "10.1.0.0/16" && p.changes[0].to === null);
+
+                p = mithras.plan.compare("absent", desired, []);
+                assert(p.action === "no-op");
+            });
+            test('dry runs record the plan of each resource', function(){
+                mithras.modules.handlers.register("testPlan", function(catalog, resources, r) {
+                    if (!r._target) {
+                        mithras.remote.shell("10.0.0.1", "root", "/dev/null", "make " + r.name);
+                    }
+                    return [r._target, true];
+                });
+                mithras.modules.plan.register("testPlan", function(catalog, resources, r) {
+                    return mithras.plan.compare(r.params.ensure, {Size: r.params.size}, r._target);
+                });
+                mithras.modules.handlers.register("testUnplanned", function(catalog, resources, r) {
+                    mithras.remote.shell("10.0.0.1", "root", "/dev/null", "true");
+                    return [null, true];
+                });
+                var resources = [
+                    {name: "new", module: "testPlan", params: {ensure: "present", size: 2}},
+                    {name: "bigger", module: "testPlan", _target: {Size: 1}, params: {ensure: "present", size: 2}},
+                    {name: "same", module: "testPlan", _target: {Size: 2}, params: {ensure: "present", size: 2}},
+                    {name: "gone", module: "testPlan", _target: {Size: 2}, params: {ensure: "absent", size: 2}},
+                    {name: "other", module: "testUnplanned", params: {}}
+                ];
+
+                mithras.plan.reset();
+                mithras.dryRun = true;
+                try {
+                    mithras.apply({}, resources, false);
+                } finally {
+                    mithras.dryRun = false;
+                }
+                var planned = _.indexBy(mithras.plan.actions(), "name");
+                mithras.plan.reset();
+
+                assert(planned["new"].action === "create");
+                assert(planned["new"].calls[0].call === "mithras.remote.shell");
+                assert(planned["bigger"].action === "update");
+                assert.equals(planned["bigger"].changes, [{field: "Size", from: 1, to: 2}]);
+                assert(planned["same"].action === "no-op");
+                assert(planned["same"].calls.length === 0);
+                assert(planned["gone"].action === "delete");
+                assert(planned["other"].action === undefined);
+                assert(planned["other"].calls.length === 1);
+            });
+            test('planned creates return placeholders for later resources to use', function(){
+                var catalog = {vpcs: [], gateways: [], instances: []};
+                var resources = [
+                    {
+                        name: "planVPC"
+                        module: "vpc"
+                        params: {
+                            region: "us-east-1"
+                            ensure: "present"
+                            vpc: {CidrBlock: "172.33.0.0/16"}
+                            gateway: true
+                            tags: {Name: "plan-vpc"}
+                        }
+                    },
+                    {
+                        name: "planInstance"
+                        module: "instance"
+                        dependsOn: ["planVPC"]
+                        params: {
+                            region: "us-east-1"
+                            ensure: "present"
+                            on_find: function(catalog) {
+                                return _.filter(catalog.instances, function(i) {
+                                    return mithras.tagMap(i.Tags).Name === "plan-instance";
+                                });
+                            }
+                            tags: {Name: "plan-instance"}
+                            instance: {
+                                ImageId: "ami-1"
+                                MinCount: 2
+                                MaxCount: 2
+                                SubnetId: mithras.watch("planVPC._target.VpcId")
+                            }
+                        }
+                    }
+                ];
+
+                mithras.plan.reset();
+                mithras.dryRun = true;
+                try {
+                    mithras.apply(catalog, resources, false);
+                } finally {
+                    mithras.dryRun = false;
+                }
+                var planned = _.indexBy(mithras.plan.actions(), "name");
+                var summary = mithras.plan.summary();
+                mithras.plan.reset();
+
+                assert(!planned["planVPC"].error, planned["planVPC"].error);
+                assert(!planned["planInstance"].error, planned["planInstance"].error);
+                assert(planned["planVPC"].action === "create");
+                assert(planned["planInstance"].action === "create");
+                assert(catalog.vpcs.length === 1 && catalog.gateways.length === 1);
+                var vpcId = catalog.vpcs[0].VpcId;
+                assert(vpcId.indexOf("vpc-planned") === 0);
+                assert(catalog.gateways[0].Attachments[0].VpcId === vpcId);
+                assert(catalog.instances.length === 2);
+                assert(catalog.instances[0].InstanceId !== catalog.instances[1].InstanceId);
+                assert(catalog.instances[0].SubnetId === vpcId);
+                assert(resources[1]._target.length === 2);
+                var create = _.findWhere(planned["planInstance"].calls, {call: "aws.instances.create"});
+                assert(create.args[1].SubnetId === vpcId);
+                assert(summary.indexOf("+ planVPC (vpc): create") >= 0);
+                assert(summary.indexOf("+ planInstance (instance): create") >= 0);
+                assert(summary.indexOf("could not be fully planned") < 0);
+            });
+            test('resources which could not be fully planned keep their action', function(){
+                mithras.plan.reset();
+                mithras.plan.resource("web", "testPlan");
+                mithras.plan.propose("web", mithras.plan.compare("present", {Size: 2}));
+                mithras.plan.error("web", "no such subnet");
+                mithras.plan.resource("broken", "testPlan");
+                mithras.plan.error("broken", "no such thing");
+                var summary = mithras.plan.summary();
+                mithras.plan.reset();
+
+                assert(summary.indexOf("+ web (testPlan): create (could not be fully planned)\n    no such subnet") >= 0);
+                assert(summary.indexOf("! broken (testPlan): error (could not be fully planned)") >= 0);
+                assert(summary.indexOf("1 to create, 0 to update, 0 to delete, 0 unchanged, 2 could not be fully planned") >= 0);
+            });
+            test('the summary shows changes, and which resources were planned from calls', function(){
+                mithras.plan.reset();
+                mithras.plan.resource("web", "testPlan");
+                mithras.plan.propose("web", mithras.plan.compare("present", {Size: 2}, {Size: 1}));
+                mithras.plan.resource("cmd", "testUnplanned");
+                var summary = mithras.plan.summary();
+                mithras.plan.reset();
+
+                assert(summary.indexOf("~ web (testPlan): update") >= 0);
+                assert(summary.indexOf("~ Size: 1 => 2") >= 0);
+                assert(summary.indexOf("cmd (testUnplanned): no-op (from calls)") >= 0);
+                assert(summary.indexOf("0 to create, 1 to update, 0 to delete, 1 unchanged") >= 0);
+                assert.throws(function() {
+                    mithras.plan.propose("web", {action: "rebuild"});
+                }, function(e) { return e.name === "MithrasError"; });
+            });
+        });
+    }
+
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
@@ -0,0 +1,534 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        suite('remote', function() {
+            var defaults = mithras.remote.config();
+            var dir = "/tmp/mithrastest-remote";
+            var key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIApndliGrKtPjIkIc3CSL1SLEBRAg6Oa17GDV/ztzp/S";
+            beforeEach(function() {
+                fs.removeAll(dir);
+            });
+            // A host stood in for by a local directory, with the
+            // wrapper; see main_test.go and js/test/ssh.
+            var testHost = function(name) {
+                var root = os.getenv("MITHRAS_TEST_REMOTE");
+                var host = name + ".mithras.test";
+                var bin = filepath.join(root, host, ".mithras", "bin");
+                fs.mkdirAll(bin, 0777);
+                fs.mkdirAll(filepath.join(root, host, ".mithras", "scripts"), 0777);
+                fs.copy(filepath.join(root, "wrapper"), filepath.join(bin, "wrapper"), 0755);
+                return host;
+            };
+            var instance = {
+                InstanceId: "i-1234"
+                PrivateIpAddress: "10.0.1.5"
+                PrivateDnsName: "ip-10-0-1-5.ec2.internal"
+            };
+            afterEach(function() {
+                delete mithras.remote.output;
+                mithras.remote.configure(defaults);
+                mithras.remote.route("10.0.1.5", null);
+                fs.removeAll(dir);
+            });
+            test('mithras.remote.configure() selects the transport', function(){
+                assert(mithras.remote.config().transport === "openssh");
+                mithras.remote.configure({transport: "native"});
+                assert(mithras.remote.config().transport === "native");
+            });
+            test('mithras.remote.configure() rejects unknown transports', function(){
+                assert.throws(function() {
+                    mithras.remote.configure({transport: "telnet"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("telnet") >= 0;
+                });
+                assert(mithras.remote.config().transport === "openssh");
+            });
+            test('the native transport reports unreachable hosts', function(){
+                mithras.remote.configure({transport: "native"});
+                var result = mithras.remote.shell("127.0.0.1:1", "nobody", "", "", "true");
+                assert(result[2] === false);
+                assert(result[3] === 255);
+            });
+            test('the openssh transport reports hosts it can\'t start a control master for', function(){
+                var result = mithras.remote.shell("unreachable.mithras.test", "nobody", "", "", "true", null,
+                                                  {retries: 1, backoff: 0.01});
+                assert(result[2] === false);
+                assert(result[3] === 255);
+                assert(result[1].indexOf("SSH control master start error") === 0);
+                assert(result.failure === "unreachable");
+                assert(result.attempts === 2);
+            });
+            test('mithras.remote.configure() sets timeouts and retries', function(){
+                assert(mithras.remote.config().connectTimeout === 10);
+                assert(mithras.remote.config().timeout === 0);
+                assert(mithras.remote.config().retries === 0);
+                mithras.remote.configure({timeout: 30, retries: 2, backoff: 0.5});
+                assert(mithras.remote.config().timeout === 30);
+                assert(mithras.remote.config().retries === 2);
+                assert(mithras.remote.config().backoff === 0.5);
+                assert.throws(function() {
+                    mithras.remote.configure({retries: -1});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("retries") >= 0;
+                });
+            });
+            test('unreachable hosts are classified, and retried', function(){
+                mithras.remote.configure({transport: "native"});
+                var result = mithras.remote.shell("127.0.0.1:1", "nobody", "", "", "true");
+                assert(result.failure === "unreachable");
+                assert(result.attempts === 1);
+                result = mithras.remote.shell("127.0.0.1:1", "nobody", "", "", "true", null,
+                                              {retries: 2, backoff: 0.01});
+                assert(result[3] === 255);
+                assert(result.failure === "unreachable");
+                assert(result.attempts === 3);
+                assert.throws(function() {
+                    mithras.remote.shell("127.0.0.1:1", "nobody", "", "", "true", null, {timeout: -1});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("timeout") >= 0;
+                });
+            });
+            test('only failures to connect are retried', function(){
+                var host = testHost("exit");
+                var result = mithras.remote.shell(host, "nobody", "", null, "exit 255", null,
+                                                  {retries: 2, backoff: 0.01});
+                assert(result[3] === 255);
+                assert(result.failure === "command");
+                assert(result.attempts === 1);
+
+                fs.mkdirAll(dir, 0755);
+                fs.write(filepath.join(dir, "f"), "f", 0644);
+                result = mithras.remote.scp(host, "nobody", "", filepath.join(dir, "f"), "f",
+                                            {retries: 2, backoff: 0.01});
+                assert(result[2] === true);
+                assert(result.failure === "" && result.attempts === 1);
+                var root = os.getenv("MITHRAS_TEST_REMOTE");
+                assert(fs.read(filepath.join(root, host, "f"))[0] === "f");
+            });
+            test('every remote call checks its timeout and retries before connecting', function(){
+                var bad = {retries: -1};
+                var calls = [
+                    function() { mithras.remote.scp("127.0.0.1:1", "nobody", "", dir, "/tmp/x", bad); },
+                    function() { mithras.remote.wrapper("127.0.0.1:1", "nobody", "", ["true"], null, {policy: bad}); },
+                    function() { mithras.remote.mithras("127.0.0.1:1", "nobody", "", "(function run() {})",
+                                                        false, "", "", bad); },
+                    function() { mithras.remote.put("127.0.0.1:1", "nobody", "", dir, "/tmp/x", bad); },
+                    function() { mithras.remote.get("127.0.0.1:1", "nobody", "", "/tmp/x", dir, bad); },
+                    function() { mithras.remote.each(["127.0.0.1:1"], {}, {mithras: "(function run() {})", retries: -1}); },
+                    function() { mithras.remote.each(["127.0.0.1:1"], {}, {wrapper: ["true"], options: {policy: bad}}); }
+                ];
+                _.each(calls, function(call) {
+                    assert.throws(call, function(e) {
+                        return e.name === "MithrasError" && e.message.indexOf("retries") >= 0;
+                    });
+                });
+            });
+            test('mithras.remote.configure() turns on streaming', function(){
+                assert(mithras.remote.config().stream === false);
+                mithras.remote.configure({stream: true});
+                assert(mithras.remote.config().stream === true);
+            });
+            test('results are unchanged when output is streamed', function(){
+                var host = testHost("stream");
+                var cmd = "echo one; echo two; echo three >&2; exit 3";
+                var shell = mithras.remote.shell(host, "nobody", "", null, cmd);
+                var wrapper = mithras.remote.wrapper(host, "nobody", "", ["sh", "-c", cmd]);
+                assert(shell[0] === "one\ntwo\n");
+                assert(shell[3] === 3);
+                assert(wrapper[0] === "one\ntwo\n");
+                assert(wrapper[1] === "three\n");
+
+                var lines = [];
+                mithras.remote.output = function(line, info) {
+                    lines.push([info.host, info.stream, line]);
+                };
+                mithras.remote.configure({stream: true});
+                var streamed = mithras.remote.shell(host, "nobody", "", null, cmd);
+                assert.equals(streamed, shell);
+                assert.equals(_.filter(lines, function(l) { return l[1] === "stdout"; }),
+                              [[host, "stdout", "one"], [host, "stdout", "two"]]);
+                assert.equals(_.filter(lines, function(l) { return l[1] === "stderr"; }),
+                              [[host, "stderr", "three"]]);
+
+                lines = [];
+                streamed = mithras.remote.wrapper(host, "nobody", "", ["sh", "-c", cmd]);
+                assert(streamed[0] === wrapper[0]);
+                assert(streamed[1] === wrapper[1]);
+                assert(streamed[3] === 3 && !streamed[2]);
+                assert.equals(_.map(lines, function(l) { return l[1] + ": " + l[2]; }).sort(),
+                              ["stderr: three", "stdout: one", "stdout: two"]);
+            });
+            test('jobs with options are refused by old wrappers before they run', function(){
+                var host = testHost("old");
+                var ran = filepath.join(os.getenv("MITHRAS_TEST_REMOTE"), host, "ran");
+                // Like wrappers from before the protocol was
+                // versioned, it ignores its args and what it doesn't
+                // understand in the job spec
+                fs.write(filepath.join(os.getenv("MITHRAS_TEST_REMOTE"), host, ".mithras", "bin", "wrapper"),
+                         "#!/bin/sh\n" +
+                         "test -n \"$(cat)\" && touch ran\n" +
+                         "echo '{\"Out\": \"\", \"Err\": \"\", \"Success\": true, \"Status\": 0}'\n",
+                         0755);
+
+                var result = mithras.remote.wrapper(host, "nobody", "", ["true"]);
+                assert(result[2] === true && result.version === 0);
+                assert(exec.run("test -e " + ran)[2] === true);
+                fs.remove(ran);
+
+                assert.throws(function() {
+                    mithras.remote.wrapper(host, "nobody", "", ["true"], null, {dir: "/tmp"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("too old") >= 0;
+                });
+                assert(exec.run("test -e " + ran)[2] === false);
+            });
+            test('mithras.remote.wrapper() rejects bad options', function(){
+                assert.throws(function() {
+                    mithras.remote.wrapper("127.0.0.1:1", "nobody", "", ["true"], null, "fast");
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("options") >= 0;
+                });
+                assert.throws(function() {
+                    mithras.remote.wrapper("127.0.0.1:1", "nobody", "", ["true"], null, {umask: 18});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("options") >= 0;
+                });
+            });
+            test('mithras.remote.put() checks its arguments before connecting', function(){
+                assert.throws(function() {
+                    mithras.remote.put("127.0.0.1:1", "nobody", "", dir, "/tmp/x", {mode: "999"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("999") >= 0;
+                });
+                assert.throws(function() {
+                    mithras.remote.put("127.0.0.1:1", "nobody", "", dir + "/nothing", "/tmp/x");
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("nothing") >= 0;
+                });
+            });
+            test('mithras.remote.put() and get() round trip files, setting modes and owners', function(){
+                var host = testHost("files");
+                var dest = filepath.join(os.getenv("MITHRAS_TEST_REMOTE"), host, "site");
+                var back = filepath.join(dir, "back");
+                var stat = function(p) {
+                    return exec.run("stat -c '%a %U %G' " + p)[0].trim();
+                };
+                // Only root can give files away
+                var owner = exec.run("id -u")[0].trim() === "0" ? "nobody" : exec.run("id -un")[0].trim();
+                var group = exec.run("id -gn " + owner)[0].trim();
+                fs.mkdirAll(filepath.join(dir, "src", "sub"), 0755);
+                fs.write(filepath.join(dir, "src", "a"), "a", 0644);
+                fs.write(filepath.join(dir, "src", "sub", "b"), "b", 0600);
+
+                var result = mithras.remote.put(host, "nobody", "", filepath.join(dir, "src"), "site",
+                                                {mode: "0640", owner: owner, group: group});
+                assert(result.changed === true);
+                assert.equals(_.pluck(_.where(result.files, {action: "create"}), "path").sort(),
+                              [".", "a", "sub", "sub/b"]);
+                assert(fs.read(filepath.join(dest, "sub", "b"))[0] === "b");
+                assert(stat(filepath.join(dest, "a")) === "640 " + owner + " " + group);
+                assert(stat(filepath.join(dest, "sub", "b")) === "640 " + owner + " " + group);
+                assert(stat(filepath.join(dest, "sub")) === "755 " + owner + " " + group);
+
+                result = mithras.remote.put(host, "nobody", "", filepath.join(dir, "src"), "site",
+                                            {mode: "0640", owner: owner, group: group});
+                assert(result.changed === false);
+                result = mithras.remote.put(host, "nobody", "", filepath.join(dir, "src"), "site",
+                                            {owner: owner, group: group});
+                assert.equals(_.pluck(_.where(result.files, {action: "attributes"}), "path").sort(),
+                              ["a", "sub/b"]);
+                assert(stat(filepath.join(dest, "a")) === "644 " + owner + " " + group);
+                assert(stat(filepath.join(dest, "sub", "b")) === "600 " + owner + " " + group);
+
+                result = mithras.remote.get(host, "nobody", "", "site", back, {mode: "0600"});
+                assert(result.changed === true);
+                assert(fs.read(filepath.join(back, "a"))[0] === "a");
+                assert(fs.read(filepath.join(back, "sub", "b"))[0] === "b");
+                assert(stat(filepath.join(back, "a")).indexOf("600 ") === 0);
+                assert(stat(filepath.join(back, "sub", "b")).indexOf("600 ") === 0);
+                result = mithras.remote.get(host, "nobody", "", "site", back, {mode: "0600"});
+                assert(result.changed === false);
+            });
+            test('mithras.remote.each() checks its arguments', function(){
+                assert.throws(function() {
+                    mithras.remote.each("127.0.0.1:1", {}, {shell: "true"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("array") >= 0;
+                });
+                assert.throws(function() {
+                    mithras.remote.each(["127.0.0.1:1"], {}, {});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("shell") >= 0;
+                });
+            });
+            test('mithras.remote.each() runs on each host, keyed by instance id', function(){
+                mithras.remote.configure({transport: "native"});
+                var other = {InstanceId: "i-5678"};
+                var resource = {params: {
+                    sshAddressForInstance: function(i) { return "127.0.0.1:1"; }
+                }};
+                var opts = {concurrency: 2, resource: resource};
+                var results = mithras.remote.each([instance, other], opts, function(host) {
+                    if (host.InstanceId === "i-5678") {
+                        return null;
+                    }
+                    return {shell: "true", user: "nobody"};
+                });
+                assert(_.keys(results).length === 2);
+                assert(results["i-5678"].skipped === true);
+                assert(results["i-1234"].skipped === false);
+                assert(results["i-1234"].success === false);
+                assert(results["i-1234"].failure === "unreachable");
+                assert(results["i-1234"].host === "127.0.0.1:1");
+            });
+            test('mithras.remote.each() stops once too many hosts fail', function(){
+                mithras.remote.configure({transport: "native"});
+                var results = mithras.remote.each(["127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"],
+                                                  {concurrency: 1, maxFailPercentage: 0},
+                                                  {shell: "true", user: "nobody"});
+                assert(results["127.0.0.1:1"].success === false);
+                assert(results["127.0.0.1:1"].status === 255);
+                assert(results["127.0.0.1:2"].skipped === true);
+                assert(results["127.0.0.1:3"].skipped === true);
+            });
+            test('mithras.remote.each() sends run functions as scripts', function(){
+                mithras.plan.reset();
+                mithras.dryRun = true;
+                try {
+                    mithras.remote.each(["10.0.0.1"], {user: "nobody", key: ""},
+                                        {mithras: function() { return 42; }});
+                } finally {
+                    mithras.dryRun = false;
+                }
+                var calls = mithras.plan.actions()[0].calls;
+                mithras.plan.reset();
+                assert(calls[0].call === "mithras.remote.each");
+                assert(calls[0].args[3].mithras.indexOf("var run = function") === 0);
+                assert(calls[0].args[3].mithras.indexOf("return 42") > 0);
+            });
+            test('shell resources run on each of their hosts', function(){
+                var shell = require("shell").init();
+                var hosts = [{InstanceId: "i-1"}, {InstanceId: "i-2"}, {InstanceId: "i-3"}];
+                var resource = {
+                    name: "whereami"
+                    module: "shell"
+                    params: {
+                        command: "basename $PWD"
+                        hosts: hosts
+                        concurrency: 2
+                        sshAddressForInstance: function(i) { return testHost(i.InstanceId); }
+                        skip: function() { return resource._currentHost.InstanceId === "i-3"; }
+                    }
+                };
+                var result = shell.handle({}, [resource], resource);
+                assert(result[1] === true);
+                assert.equals(result[0], {
+                    "i-1": "i-1.mithras.test\n"
+                    "i-1.mithras.test": "i-1.mithras.test\n"
+                    "i-2": "i-2.mithras.test\n"
+                    "i-2.mithras.test": "i-2.mithras.test\n"
+                });
+            });
+            test('remote scripts are sent with the modules they require, and only those', function(){
+                var host = testHost("bundle");
+                var root = filepath.join(os.getenv("MITHRAS_TEST_REMOTE"), host);
+                // Keeps the script it's given to run
+                fs.write(filepath.join(root, ".mithras", "bin", "runner"),
+                         "#!/bin/sh\ncp \"$5\" sent.js\n", 0755);
+                var script = "var sprintf = require(\"sprintf\").sprintf;\n" +
+                    "// var traverse = require(\"traverse\");\n" +
+                    "/* require(\"object_path\") */\n" +
+                    "var s = \"require('assert')\";\n" +
+                    "function run() {}\n";
+                var result = mithras.remote.mithras(host, "nobody", "", script);
+                assert(result[2] === true);
+
+                var sent = fs.read(filepath.join(root, "sent.js"))[0];
+                var first = sent.split("\n")[0];
+                var prefix = "require.bundle = ";
+                assert(first.indexOf(prefix) === 0);
+                var bundle = JSON.parse(first.substring(prefix.length, first.length - 1));
+                assert.equals(_.map(_.keys(bundle.modules), function(p) {
+                    return filepath.base(p);
+                }), ["sprintf.js"]);
+                assert(sent.indexOf(script) > 0);
+            });
+            test('require() finds modules in the bundle sent with remote scripts', function(){
+                // Remote scripts use the global require
+                var base = (function() { return this; })().require;
+                base.bundle = {
+                    modules: {
+                        "bundled/a.js": "module.exports = require('./b') + 1;"
+                        "bundled/b.js": "module.exports = 41;"
+                    }
+                    deps: {
+                        "": {"bundled-a": "bundled/a.js"}
+                        "bundled/a.js": {"./b": "bundled/b.js"}
+                    }
+                };
+                try {
+                    assert(base("bundled-a") === 42);
+                } finally {
+                    delete base.bundle;
+                }
+                assert.throws(function() {
+                    base("bundled-a");
+                }, function(e) {
+                    return e.name === "MithrasError";
+                });
+            });
+            test('mithras.remote.helpers.parse() reads helper versions', function(){
+                var out = "wrapper: wrapper version 1.0.0 protocol 3 build abc123\n" +
+                    "runner: mithras version 0.1.0\n";
+                var helpers = mithras.remote.helpers.parse(out);
+                assert(helpers.wrapper.version === "1.0.0");
+                assert(helpers.wrapper.protocol === 3);
+                assert(helpers.wrapper.build === "abc123");
+                assert(helpers.runner.version === "0.1.0");
+                assert(helpers.runner.build === "");
+            });
+            test('helpers missing from the cache are never stale', function(){
+                var cached = mithras.remote.helpers.cached("wrapper", "plan9", "mips");
+                assert(cached.cached === false);
+                assert(cached.path.indexOf("wrapper_plan9_mips") >= 0);
+                assert(mithras.remote.helpers.stale("", "wrapper", "plan9", "mips") === false);
+            });
+            test('mithras.remote.configure() sets the host key policy', function(){
+                assert(mithras.remote.config().hostKeys === "accept-new");
+                mithras.remote.configure({hostKeys: "strict"});
+                assert(mithras.remote.config().hostKeys === "strict");
+                assert(mithras.remote.config().transport === "openssh");
+            });
+            test('mithras.remote.configure() rejects unknown host key policies', function(){
+                assert.throws(function() {
+                    mithras.remote.configure({hostKeys: "maybe"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("maybe") >= 0;
+                });
+                assert(mithras.remote.config().hostKeys === "accept-new");
+            });
+            test('mithras.remote.hostKeys.seed() adds keys to known_hosts', function(){
+                mithras.remote.configure({knownHosts: dir + "/known_hosts"});
+                mithras.remote.hostKeys.seed("10.0.0.1", {keys: [key + " root@host"]});
+                mithras.remote.hostKeys.seed("10.0.0.2", {keys: [key]});
+                var content = fs.read(dir + "/known_hosts")[0];
+                assert(content === "10.0.0.1 " + key + "\n10.0.0.2 " + key + "\n");
+
+                // Seeding again replaces what was known
+                mithras.remote.hostKeys.seed("10.0.0.1", {keys: [key]});
+                content = fs.read(dir + "/known_hosts")[0];
+                assert(content === "10.0.0.2 " + key + "\n10.0.0.1 " + key + "\n");
+            });
+            test('mithras.remote.hostKeys.seed() rejects bad keys', function(){
+                mithras.remote.configure({knownHosts: dir + "/known_hosts"});
+                assert.throws(function() {
+                    mithras.remote.hostKeys.seed("10.0.0.1", {keys: ["ssh-ed25519 nonsense"]});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("10.0.0.1") >= 0;
+                });
+            });
+            test('host key fingerprints alone are only seeded for the native transport', function(){
+                var fingerprints = {fingerprints: ["SHA256:nothingToSeeHere"]};
+                mithras.remote.configure({knownHosts: dir + "/known_hosts"});
+                assert.throws(function() {
+                    mithras.remote.hostKeys.seed("10.0.0.3", fingerprints);
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("native transport") >= 0;
+                });
+
+                // Seeded for the native transport, the local ssh
+                // command refuses the host rather than trust it
+                mithras.remote.configure({knownHosts: dir + "/known_hosts", transport: "native"});
+                mithras.remote.hostKeys.seed("10.0.0.3", fingerprints);
+                mithras.remote.configure({transport: "openssh"});
+                assert.throws(function() {
+                    mithras.remote.shell("10.0.0.3", "nobody", "", "", "true");
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("'10.0.0.3'") >= 0;
+                });
+                mithras.remote.hostKeys.forget("10.0.0.3");
+            });
+            test('mithras.remote.hostKeys.forget() removes keys from known_hosts', function(){
+                mithras.remote.configure({knownHosts: dir + "/known_hosts"});
+                mithras.remote.hostKeys.seed("10.0.0.1", {keys: [key]});
+                mithras.remote.hostKeys.seed("host.example.com", {keys: [key]});
+                mithras.remote.hostKeys.forget("10.0.0.1");
+                assert(fs.read(dir + "/known_hosts")[0] === "host.example.com " + key + "\n");
+                mithras.remote.hostKeys.forget("nowhere");
+                assert(fs.read(dir + "/known_hosts")[0] === "host.example.com " + key + "\n");
+            });
+            test('mithras.remote.configure() sets jump hosts and address strategy', function(){
+                mithras.remote.configure({jump: "admin@bastion:2222", address: "private-ip"});
+                assert(mithras.remote.config().jump === "admin@bastion:2222");
+                assert(mithras.remote.config().address === "private-ip");
+                assert(mithras.remote.jumps("10.0.1.5") === "admin@bastion:2222");
+                assert.throws(function() {
+                    mithras.remote.configure({address: "carrier-pigeon"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("carrier-pigeon") >= 0;
+                });
+                assert.throws(function() {
+                    mithras.remote.configure({jump: "bastion,,other"});
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("bastion,,other") >= 0;
+                });
+            });
+            test('mithras.remote.route() overrides the configured jump hosts', function(){
+                mithras.remote.configure({jump: "bastion"});
+                mithras.remote.route("10.0.1.5", ["one", "ec2-user@two"]);
+                assert(mithras.remote.jumps("10.0.1.5") === "one,ec2-user@two");
+                assert(mithras.remote.jumps("10.0.1.6") === "bastion");
+                mithras.remote.route("10.0.1.5", "none");
+                assert(mithras.remote.jumps("10.0.1.5") === "none");
+                mithras.remote.route("10.0.1.5", null);
+                assert(mithras.remote.jumps("10.0.1.5") === "bastion");
+            });
+            test('mithras.remote.address() chooses an instance address', function(){
+                assert(mithras.remote.address(instance, "private-ip") === "10.0.1.5");
+                assert(mithras.remote.address(instance, "private-dns") === "ip-10-0-1-5.ec2.internal");
+                assert.throws(function() {
+                    mithras.remote.address(instance);
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("i-1234") >= 0;
+                });
+                mithras.remote.configure({address: "private-ip"});
+                assert(mithras.remote.address(instance) === "10.0.1.5");
+            });
+            test('mithras.sshHostForInstance() follows resource params', function(){
+                mithras.remote.configure({jump: "bastion"});
+                var resource = {params: {sshAddress: "private-ip"}};
+                assert(mithras.sshHostForInstance(resource, instance) === "10.0.1.5");
+                assert(mithras.remote.jumps("10.0.1.5") === "bastion");
+
+                resource.params.sshJump = ["admin@outer", "inner"];
+                assert(mithras.sshHostForInstance(resource, instance) === "10.0.1.5");
+                assert(mithras.remote.jumps("10.0.1.5") === "admin@outer,inner");
+
+                // Routes are never cleared, nor changed, in passing
+                assert(mithras.sshHostForInstance({params: {sshAddress: "private-ip"}},
+                                                  instance) === "10.0.1.5");
+                assert(mithras.remote.jumps("10.0.1.5") === "admin@outer,inner");
+                resource.params.sshJump = "other";
+                assert.throws(function() {
+                    mithras.sshHostForInstance(resource, instance);
+                }, function(e) { return e.name === "MithrasError"; });
+                assert(mithras.remote.jumps("10.0.1.5") === "admin@outer,inner");
+                mithras.remote.route("10.0.1.5", null);
+
+                resource = {params: {
+                    sshAddressForInstance: function(i) { return i.PrivateDnsName; }
+                    sshJumpForInstance: function(i) { return "none"; }
+                }};
+                assert(mithras.sshHostForInstance(resource, instance) === "ip-10-0-1-5.ec2.internal");
+                assert(mithras.remote.jumps("ip-10-0-1-5.ec2.internal") === "none");
+                mithras.remote.route("ip-10-0-1-5.ec2.internal", null);
+            });
+        });
+    }
+    
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
@@ -0,0 +1,58 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        var nothing = function() {};
+        suite('schedule', function() {
+            afterEach(function() {
+                _.each(schedule.list(), function(j) {
+                    schedule.cancel(j.id);
+                });
+            });
+            test('cron and every schedule jobs', function(){
+                var c = schedule.cron("0 */5 * * * *", nothing, {timezone: "UTC"});
+                var e = schedule.every("90s", nothing, {overlap: "queue", jitter: 2000});
+                var jobs = schedule.list();
+                assert(jobs.length === 2);
+                assert(jobs[0].id === c);
+                assert(jobs[0].kind === "cron");
+                assert(jobs[0].overlap === "skip");
+                assert(jobs[0].timezone === "UTC");
+                var next = new Date(jobs[0].next);
+                assert(next.getUTCSeconds() === 0);
+                assert(next.getUTCMinutes() % 5 === 0);
+                assert(next > new Date());
+                assert(jobs[1].id === e);
+                assert(jobs[1].kind === "every");
+                assert(jobs[1].spec === "1m30s");
+                assert(jobs[1].overlap === "queue");
+                assert(jobs[1].jitter === "2s");
+                assert(jobs[1].runs === 0);
+            });
+            test('cancel removes a job', function(){
+                var id = schedule.every(1000, nothing);
+                assert(schedule.cancel(id) === true);
+                assert(schedule.list().length === 0);
+                assert(schedule.cancel(id) === false);
+            });
+            test('bad schedules are refused', function(){
+                var refused = function(fn) {
+                    assert.throws(fn, function(e) { return e.name === "MithrasError"; });
+                };
+                refused(function() { schedule.cron("61 * * * *", nothing); });
+                refused(function() { schedule.cron("* * *", nothing); });
+                refused(function() { schedule.every("often", nothing); });
+                refused(function() { schedule.every("0s", nothing); });
+                refused(function() { schedule.every("1m", "not a function"); });
+                refused(function() { schedule.every("1m", nothing, {overlap: "maybe"}); });
+                refused(function() { schedule.cron("@daily", nothing, {timezone: "Nowhere/Special"}); });
+                assert(schedule.list().length === 0);
+            });
+        });
+    }
+
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
@@ -0,0 +1,131 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        var dir = "/tmp/mithrastest-state";
+        var seen = {};
+        mithras.modules.handlers.register("testState", function(catalog, resources, r) {
+            seen[r.name] = r._target;
+            if (r.params.ensure === "absent") {
+                return [null, true];
+            }
+            return [{Id: "id-" + r.name, Name: r.name}, true];
+        });
+        mithras.modules.refresh.register("testState", function(region, target, catalog) {
+            return mithras.catalogAdd(catalog, "testThings", target, "Id");
+        });
+        var resources = function(ensure) {
+            return [
+                {name: "one", module: "testState", params: {region: "us-east-1", ensure: ensure}},
+                {name: "two", module: "testState", params: {region: "us-west-2", ensure: "present"}}
+            ];
+        };
+        suite('state', function() {
+            beforeEach(function() {
+                fs.removeAll(dir);
+                fs.mkdirAll(dir, 0777);
+                mithras.state.configure({location: filepath.join(dir, "state.json")});
+                seen = {};
+            });
+            afterEach(function() {
+                mithras.state.configure({location: ""});
+            });
+            test('apply records targets in state', function(){
+                mithras.apply({}, resources("present"), false);
+                mithras.state.load();
+                var entry = mithras.state.get("two");
+                assert(entry.module === "testState");
+                assert(entry.region === "us-west-2");
+                assert(entry.target.Id === "id-two");
+                assert(entry.ids[0] === "id-two");
+            });
+            test('apply preloads targets from state', function(){
+                mithras.apply({}, resources("present"), false);
+                seen = {};
+                mithras.apply({}, resources("absent"), false);
+                assert(seen.one.Id === "id-one");
+                assert(!mithras.state.get("one"));
+                assert(mithras.state.get("two"));
+            });
+            test('mithras.run uses state instead of scanning AWS, if told to', function(){
+                var scanned = false;
+                var scan = aws.catalog.scan;
+                var regions = aws.regions.scan;
+                aws.catalog.scan = function(regions, targets) {
+                    scanned = true;
+                    return {catalog: {testThings: [{Id: "id-three", Name: "three"}]}, report: []};
+                };
+                aws.regions.scan = function() {
+                    return [{RegionName: "us-east-1"}];
+                };
+                try {
+                    mithras.apply({}, resources("present"), false);
+
+                    var catalog = mithras.run(["testThings"], {fromState: true});
+                    assert(!scanned);
+                    assert(catalog.testThings.length === 0);
+                    mithras.apply(catalog, resources("present"), false);
+                    assert(!scanned);
+                    assert(seen.one.Id === "id-one");
+                    assert.equals(_.pluck(catalog.testThings, "Id").sort(), ["id-one", "id-two"]);
+
+                    // A resource state doesn't know of needs the scan
+                    catalog = mithras.run(["testThings"], {fromState: true});
+                    mithras.apply(catalog, resources("present").concat([
+                        {name: "three", module: "testState", params: {region: "us-east-1", ensure: "present"}}
+                    ]), false);
+                    assert(scanned);
+                    assert(catalog.regions[0].RegionName === "us-east-1");
+                    assert(_.findWhere(catalog.testThings, {Id: "id-three"}));
+
+                    // Scripts which search the catalog get it whole
+                    scanned = false;
+                    catalog = mithras.run(["testThings"]);
+                    assert(scanned);
+                    assert(_.findWhere(catalog.testThings, {Id: "id-three"}));
+                } finally {
+                    aws.catalog.scan = scan;
+                    aws.regions.scan = regions;
+                }
+            });
+            test('targets from state win over what preflight finds', function(){
+                mithras.apply({}, resources("present"), false);
+                mithras.modules.preflight.register("testState", function(catalog, resources, r) {
+                    return [{Id: "found-" + r.name}, true];
+                });
+                try {
+                    mithras.apply({}, resources("present").concat([
+                        {name: "new", module: "testState", params: {region: "us-east-1", ensure: "present"}}
+                    ]), false);
+                } finally {
+                    delete mithras.modules.preflight.funcs.testState;
+                }
+                assert(seen.one.Id === "id-one");
+                assert(seen["new"].Id === "found-new");
+            });
+            test('resources of modules which can\'t refresh them are not kept', function(){
+                mithras.modules.handlers.register("testStateless", function(catalog, resources, r) {
+                    return [{Id: "id-" + r.name}, true];
+                });
+                mithras.apply({}, [{name: "stateless", module: "testStateless", params: {}}], false);
+                assert(!mithras.state.get("stateless"));
+            });
+            test('state entries can be moved and removed', function(){
+                mithras.apply({}, resources("present"), false);
+                mithras.state.move("one", "uno");
+                assert(!mithras.state.get("one"));
+                assert(mithras.state.get("uno").target.Id === "id-one");
+                mithras.state.remove("uno");
+                assert(!mithras.state.get("uno"));
+                assert.throws(function() {
+                    mithras.state.remove("uno");
+                }, function(e) { return e.name === "MithrasError"; });
+            });
+        });
+    }
+    
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
@@ -0,0 +1,126 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        suite('web', function() {
+            // Fresh ports for each test, so that no connection to a
+            // stopped server is reused
+            var port = 47810;
+            var one, two, urlOne, urlTwo;
+            // Routes shared by all servers outlive them, so tests add
+            // them with route(), and they are removed after each test
+            var routed = [];
+            var route = function(method, path, fn) {
+                web.route(method, path, fn);
+                routed.push([method, path]);
+            };
+            var get = function(url) {
+                return web.request("GET", url);
+            };
+            var post = function(url, body, headers) {
+                return web.request("POST", url, {body: body, headers: headers || {}});
+            };
+            beforeEach(function() {
+                port += 2;
+                urlOne = "http://127.0.0.1:" + port;
+                urlTwo = "http://127.0.0.1:" + (port + 1);
+                one = web.run("127.0.0.1:" + port);
+                two = web.run("127.0.0.1:" + (port + 1));
+            });
+            afterEach(function() {
+                web.stop(one);
+                web.stop(two);
+                _.each(routed, function(r) {
+                    web.unroute(r[0], r[1]);
+                });
+                routed = [];
+            });
+            test('routes pass params, query and headers', function(){
+                web.route("GET", "/hooks/:id", function(req) {
+                    return {body: {id: req.params.id, q: req.query.q, method: req.method,
+                                   path: req.path, agent: req.headers["user-agent"]}};
+                }, one);
+                var res = get(urlOne + "/hooks/42?q=x");
+                assert(res.status === 200);
+                assert(res.headers["content-type"] === "application/json");
+                var got = JSON.parse(res.body);
+                assert(got.id === "42");
+                assert(got.q === "x");
+                assert(got.method === "GET");
+                assert(got.path === "/hooks/42");
+                assert(got.agent === "mithras");
+                assert(web.get(urlOne + "/hooks/42", {q: "x"}) === res.body);
+            });
+            test('JSON bodies are parsed', function(){
+                web.route("POST", "/echo", function(req) {
+                    return {status: 201, headers: {"X-Seen": "yes"}, body: "seen " + req.json.a};
+                }, one);
+                var res = post(urlOne + "/echo", JSON.stringify({a: 7}), {"Content-Type": "application/json"});
+                assert(res.status === 201);
+                assert(res.headers["x-seen"] === "yes");
+                assert(res.headers["content-type"] === "text/plain; charset=utf-8");
+                assert(res.body === "seen 7");
+                res = post(urlOne + "/echo", "{not json", {"Content-Type": "application/json"});
+                assert(res.status === 400);
+            });
+            test('handlers choose the status, headers and content type', function(){
+                web.route("GET", "/nothing", function(req) {}, one);
+                web.route("GET", "/typed", function(req) {
+                    return {headers: {"Content-Type": "text/csv"}, body: "a,b"};
+                }, one);
+                web.route("GET", "/throws", function(req) { throw new Error("secret"); }, one);
+                var res = get(urlOne + "/nothing");
+                assert(res.status === 204);
+                assert(res.body === "");
+                res = get(urlOne + "/typed");
+                assert(res.status === 200);
+                assert(res.headers["content-type"] === "text/csv");
+                assert(res.body === "a,b");
+                res = get(urlOne + "/throws");
+                assert(res.status === 500);
+                assert(res.body.indexOf("secret") < 0);
+            });
+            test('paths routed for other methods are not allowed', function(){
+                web.route("PUT", "/item", function(req) { return "put"; }, one);
+                web.route("DELETE", "/item", function(req) { return "deleted"; }, one);
+                var res = get(urlOne + "/item");
+                assert(res.status === 405);
+                assert(res.headers["allow"] === "DELETE, PUT");
+                assert(web.request("PUT", urlOne + "/item").body === "put");
+            });
+            test('servers have routes of their own', function(){
+                web.route("GET", "/who", function(req) { return "one"; }, one);
+                web.route("GET", "/who", function(req) { return "two"; }, two);
+                route("GET", "/shared/*rest", function(req) { return "shared " + req.params.rest; });
+                assert(get(urlOne + "/who").body === "one");
+                assert(get(urlTwo + "/who").body === "two");
+                assert(get(urlTwo + "/shared/a/b").body === "shared a/b");
+            });
+            test('routes can be removed', function(){
+                route("GET", "/gone", function(req) { return "here"; });
+                web.route("GET", "/mine", function(req) { return "mine"; }, one);
+                assert(get(urlOne + "/gone").body === "here");
+                assert(web.unroute("GET", "/gone") === true);
+                assert(web.unroute("GET", "/gone") === false);
+                assert(get(urlOne + "/gone").status === 404);
+                assert(web.unroute("GET", "/mine") === false);
+                assert(web.unroute("GET", "/mine", one) === true);
+                assert(get(urlOne + "/mine").status === 404);
+            });
+            test('bad routes are refused', function(){
+                var refused = function(fn) {
+                    assert.throws(fn, function(e) { return e.name === "MithrasError"; });
+                };
+                refused(function() { web.route("GET", "no-slash", function() {}); });
+                refused(function() { web.route("GET", "/a/*/b", function() {}); });
+                refused(function() { web.route("GET", "/a", "not a function"); });
+                refused(function() { web.route("GET", "/a", function() {}, "not a server"); });
+            });
+        });
+    }
+
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
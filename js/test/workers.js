@@ -0,0 +1,94 @@
+(function() {
+
+    var Run = function() {
+        var assert = require('assert');
+        var echo = function(input) { return "got " + input; };
+        var fails = function(input) {
+            if (input === "bad") {
+                throw new Error("bad input");
+            }
+            return input;
+        };
+        suite('workers', function() {
+            afterEach(function() {
+                _.each(workers.list(), function(name) {
+                    workers.stop(name);
+                });
+            });
+            test('a pool handles values sent to it', function(){
+                workers.pool("testPool", 3, echo.toString(), {buffer: 10});
+                _.each(["a", "b", "c", "d"], function(v) {
+                    workers.send("testPool", v);
+                });
+                var got = [];
+                for (var i = 0; i < 4; i++) {
+                    got.push(workers.receive("testPool"));
+                }
+                got.sort();
+                assert(got.join(",") === "got a,got b,got c,got d");
+                var s = workers.status("testPool");
+                assert(s.size === 3);
+                assert(s.running === true);
+                assert(s.buffer === 10);
+                assert(s.received === 4);
+                assert(s.sent === 4);
+                assert(s.errors === 0);
+            });
+            test('errors are recorded without stopping the worker', function(){
+                workers.pool("testFails", 1, fails.toString(), {buffer: 2});
+                workers.send("testFails", "bad");
+                workers.send("testFails", "good");
+                assert(workers.receive("testFails") === "good");
+                var s = workers.status("testFails");
+                assert(s.running === true);
+                assert(s.errors === 1);
+                assert(s.lastError.indexOf("bad input") >= 0);
+                assert(s.lastErrorAt);
+                var errs = workers.errors("testFails");
+                assert(errs.length === 1);
+                assert(errs[0].input === "bad");
+                assert(workers.errors("testFails").length === 0);
+            });
+            test('receive gives up after its timeout', function(){
+                workers.pool("testQuiet", 1, echo.toString());
+                assert(workers.receive("testQuiet", 50) === undefined);
+                workers.send("testQuiet", "x");
+                assert(workers.receive("testQuiet", 1000) === "got x");
+            });
+            test('select reads whichever worker produces first', function(){
+                workers.pool("testFirst", 1, echo.toString(), {buffer: 1});
+                workers.pool("testSecond", 1, echo.toString(), {buffer: 1});
+                workers.send("testSecond", "y");
+                var got = workers.select(["testFirst", "testSecond"], 1000);
+                assert(got.name === "testSecond");
+                assert(got.value === "got y");
+                assert(workers.select(["testFirst", "testSecond"], 50) === undefined);
+                assert.throws(function() {
+                    workers.select([], 10);
+                }, function(e) { return e.name === "MithrasError"; });
+                assert.throws(function() {
+                    workers.select(["testFirst", "nope"], 10);
+                }, function(e) { return e.name === "MithrasError"; });
+            });
+            test('list and status describe workers', function(){
+                workers.create("testB", echo.toString());
+                workers.create("testA", echo.toString());
+                assert(_.isEqual(workers.list(), ["testA", "testB"]));
+                assert(workers.status("testA").running === false);
+                assert(workers.status("testA").size === 1);
+                workers.stop("testA");
+                assert(_.isEqual(workers.list(), ["testB"]));
+                assert.throws(function() {
+                    workers.status("testA");
+                }, function(e) {
+                    return e.name === "MithrasError" && e.message.indexOf("testA") >= 0;
+                });
+            });
+        });
+    }
+
+    // Export
+    if (typeof(exports) != 'undefined') {
+	exports.run = Run;
+    }
+})();
@@ -201,16 +201,20 @@
                     }
 
                     // Reload it to get tags, associations
-                    var newVPC = aws.vpcs.describe(params.region, newVPC.VpcId);
-                    newGW = aws.vpcs.gateways.describe(params.region, 
-                                                       newGW.InternetGatewayId);
-                    do {
+                    if (mithras.dryRun) {
+                        newVPC.Tags = mithras.tagList(params.tags);
+                    } else {
+                        var newVPC = aws.vpcs.describe(params.region, newVPC.VpcId);
                         newGW = aws.vpcs.gateways.describe(params.region, 
                                                            newGW.InternetGatewayId);
-                        time.sleep(10);
-                    } while ((newGW.InternetGatewayId == null) ||
-                             (newGW.Attachments == null));
-                    
+                        do {
+                            newGW = aws.vpcs.gateways.describe(params.region, 
+                                                               newGW.InternetGatewayId);
+                            time.sleep(10);
+                        } while ((newGW.InternetGatewayId == null) ||
+                                 (newGW.Attachments == null));
+                    }
+
 
                     // add both to catalog
                     catalog.vpcs.push(newVPC);
@@ -224,6 +228,25 @@
             }
             return [null, true];
         }
+        refresh: function(region, target, catalog) {
+            var vpc = aws.vpcs.describe(region, target.VpcId);
+            if (vpc && vpc.VpcId) {
+                _.each(aws.vpcs.gateways.scan(region), function(gw) {
+                    if (gw.Attachments && gw.Attachments[0].VpcId === vpc.VpcId) {
+                        mithras.catalogAdd(catalog, "gateways", gw, "InternetGatewayId");
+                    }
+                });
+                return mithras.catalogAdd(catalog, "vpcs", vpc, "VpcId");
+            }
+        }
+        plan: function(catalog, resources, resource) {
+            var params = resource.params;
+            var vpc = resource._target;
+            var desired = _.extend(_.pick(params.vpc, "CidrBlock", "InstanceTenancy"),
+                                   {Tags: params.tags});
+            var current = vpc && _.extend({}, vpc, {Tags: mithras.tagMap(vpc.Tags)});
+            return mithras.plan.compare(params.ensure, desired, current);
+        }
         preflight: function(catalog, resources, resource) {
             if (!_.find(handler.moduleNames, function(m) { 
                 return resource.module === m; 
@@ -243,6 +266,8 @@
     handler.init = function () {
         _.each(handler.moduleNames, function(name) {
             mithras.modules.preflight.register(name, handler.preflight);
+            mithras.modules.refresh.register(name, handler.refresh);
+            mithras.modules.plan.register(name, handler.plan);
             mithras.modules.handlers.register(name, handler.handle);
         });
         return handler;
@@ -19,6 +19,7 @@ package main
 import (
 	"github.com/cvillecsteele/mithras/modules/cli"
 	"github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/dag"
 
 	"github.com/cvillecsteele/mithras/modules/log"
 	"github.com/cvillecsteele/mithras/modules/peek"
@@ -48,8 +49,10 @@ import (
 	"github.com/cvillecsteele/mithras/modules/readline"
 	"github.com/cvillecsteele/mithras/modules/routetables"
 	"github.com/cvillecsteele/mithras/modules/s3"
+	"github.com/cvillecsteele/mithras/modules/schedule"
 	"github.com/cvillecsteele/mithras/modules/sns"
 	"github.com/cvillecsteele/mithras/modules/sqs"
+	"github.com/cvillecsteele/mithras/modules/state"
 	"github.com/cvillecsteele/mithras/modules/tag"
 	"github.com/cvillecsteele/mithras/modules/time"
 	"github.com/cvillecsteele/mithras/modules/user"
@@ -70,6 +73,9 @@ func main() {
 		core.ModuleVersion{Version: sns.Version, Module: sns.ModuleName},
 		core.ModuleVersion{Version: keypairs.Version, Module: keypairs.ModuleName},
 		core.ModuleVersion{Version: workers.Version, Module: workers.ModuleName},
+		core.ModuleVersion{Version: schedule.Version, Module: schedule.ModuleName},
+		core.ModuleVersion{Version: dag.Version, Module: dag.ModuleName},
+		core.ModuleVersion{Version: state.Version, Module: state.ModuleName},
 		core.ModuleVersion{Version: iam.Version, Module: iam.ModuleName},
 		core.ModuleVersion{Version: tag.Version, Module: tag.ModuleName},
 		core.ModuleVersion{Version: routetables.Version, Module: routetables.ModuleName},
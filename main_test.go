@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 
@@ -11,8 +14,25 @@ import (
 
 func TestMain(m *testing.M) {
 	cwd, _ := os.Getwd()
+
+	// Hosts named *.mithras.test are stood in for by directories
+	// here, where the ssh and scp in js/test/ssh run their commands
+	// and copies.  The wrapper is built for them to copy.
+	remote, err := ioutil.TempDir("", "mithrastest-hosts")
+	if err != nil {
+		log.Fatalf("Can't make test hosts: %s", err)
+	}
+
+	os.Setenv("MITHRAS_TEST_REMOTE", remote)
+	os.Setenv("PATH", filepath.Join(cwd, "js", "test", "ssh")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	build := exec.Command("go", "build", "-o", filepath.Join(remote, "wrapper"), "./modules/wrapper")
+	if out, err := build.CombinedOutput(); err != nil {
+		log.Fatalf("Can't build the wrapper: %s %s", err, out)
+	}
+
 	args := []string{"mithras", "-v", "run", "-f", "js/test.js"}
 	jsDir := filepath.Join(cwd, "js")
 	js := filepath.Join(cwd, "js", "test.js")
 	script.RunJS(js, jsDir, cwd, true, args, []core.ModuleVersion{}, Version, nil)
+	os.RemoveAll(remote)
 }
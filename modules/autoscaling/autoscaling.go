@@ -335,9 +335,7 @@ import (
 	"encoding/json"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/robertkrimen/otto"
 
@@ -348,12 +346,11 @@ var Version = "1.0.0"
 var ModuleName = "scaling"
 
 func createLaunchConfiguration(region string, params *autoscaling.CreateLaunchConfigurationInput) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	_, err := svc.CreateLaunchConfiguration(params)
 	if err != nil {
-		log.Fatalf("Error creating scaling launch config: %s", err)
+		mcore.Failf("Error creating scaling launch config: %s", err)
 	}
 	name := *params.LaunchConfigurationName
 
@@ -368,15 +365,14 @@ func createLaunchConfiguration(region string, params *autoscaling.CreateLaunchCo
 }
 
 func deleteLaunchConfiguration(region string, id string) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DeleteLaunchConfigurationInput{
 		LaunchConfigurationName: aws.String(id),
 	}
 	_, err := svc.DeleteLaunchConfiguration(params)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -390,8 +386,7 @@ func deleteLaunchConfiguration(region string, id string) {
 }
 
 func describeLaunchConfiguration(region string, name string) *autoscaling.LaunchConfiguration {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DescribeLaunchConfigurationsInput{
 		LaunchConfigurationNames: []*string{
@@ -401,7 +396,7 @@ func describeLaunchConfiguration(region string, name string) *autoscaling.Launch
 	}
 	resp, err := svc.DescribeLaunchConfigurations(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	if len(resp.LaunchConfigurations) > 0 {
@@ -411,8 +406,7 @@ func describeLaunchConfiguration(region string, name string) *autoscaling.Launch
 }
 
 func scanLaunchConfigurations(region string) []*autoscaling.LaunchConfiguration {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DescribeLaunchConfigurationsInput{
 		LaunchConfigurationNames: []*string{},
@@ -420,7 +414,7 @@ func scanLaunchConfigurations(region string) []*autoscaling.LaunchConfiguration
 	}
 	resp, err := svc.DescribeLaunchConfigurations(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	if len(resp.LaunchConfigurations) > 0 {
@@ -430,12 +424,11 @@ func scanLaunchConfigurations(region string) []*autoscaling.LaunchConfiguration
 }
 
 func createLifecycleHook(region string, params *autoscaling.PutLifecycleHookInput) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	_, err := svc.PutLifecycleHook(params)
 	if err != nil {
-		log.Fatalf("Error creating scaling lifecycle hook: %s", err)
+		mcore.Failf("Error creating scaling lifecycle hook: %s", err)
 	}
 	name := *params.LifecycleHookName
 
@@ -450,8 +443,7 @@ func createLifecycleHook(region string, params *autoscaling.PutLifecycleHookInpu
 }
 
 func deleteLifecycleHook(region string, groupName string, hookName string) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DeleteLifecycleHookInput{
 		AutoScalingGroupName: aws.String(groupName),
@@ -459,7 +451,7 @@ func deleteLifecycleHook(region string, groupName string, hookName string) {
 	}
 	_, err := svc.DeleteLifecycleHook(params)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -473,8 +465,7 @@ func deleteLifecycleHook(region string, groupName string, hookName string) {
 }
 
 func describeLifecycleHook(region string, groupName string, hookName string) *autoscaling.LifecycleHook {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DescribeLifecycleHooksInput{
 		AutoScalingGroupName: aws.String(groupName),
@@ -484,7 +475,7 @@ func describeLifecycleHook(region string, groupName string, hookName string) *au
 	}
 	resp, err := svc.DescribeLifecycleHooks(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	if len(resp.LifecycleHooks) > 0 {
@@ -494,8 +485,7 @@ func describeLifecycleHook(region string, groupName string, hookName string) *au
 }
 
 func scanLifecycleHooks(region string) []*autoscaling.LifecycleHook {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	groups := scanAutoScalingGroups(region)
 
@@ -507,7 +497,7 @@ func scanLifecycleHooks(region string) []*autoscaling.LifecycleHook {
 		}
 		resp, err := svc.DescribeLifecycleHooks(params)
 		if err != nil {
-			log.Fatal(err)
+			mcore.Failf("%s", err)
 		}
 		for _, h := range resp.LifecycleHooks {
 			hooks = append(hooks, h)
@@ -518,32 +508,29 @@ func scanLifecycleHooks(region string) []*autoscaling.LifecycleHook {
 }
 
 func completeLifecycleAction(region string, params *autoscaling.CompleteLifecycleActionInput) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	_, err := svc.CompleteLifecycleAction(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 }
 
 func recordLifecycleActionHeartbeat(region string, params *autoscaling.RecordLifecycleActionHeartbeatInput) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	_, err := svc.RecordLifecycleActionHeartbeat(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 }
 
 func createAutoScalingGroup(region string, params *autoscaling.CreateAutoScalingGroupInput) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	_, err := svc.CreateAutoScalingGroup(params)
 	if err != nil {
-		log.Fatalf("Error creating scaling group: %s", err)
+		mcore.Failf("Error creating scaling group: %s", err)
 	}
 	name := *params.AutoScalingGroupName
 
@@ -558,8 +545,7 @@ func createAutoScalingGroup(region string, params *autoscaling.CreateAutoScaling
 }
 
 func deleteAutoScalingGroup(region string, id string) {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DeleteAutoScalingGroupInput{
 		AutoScalingGroupName: aws.String(id),
@@ -567,7 +553,7 @@ func deleteAutoScalingGroup(region string, id string) {
 	}
 	_, err := svc.DeleteAutoScalingGroup(params)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -581,8 +567,7 @@ func deleteAutoScalingGroup(region string, id string) {
 }
 
 func describeAutoScalingGroup(region string, name string) *autoscaling.Group {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []*string{
@@ -592,7 +577,7 @@ func describeAutoScalingGroup(region string, name string) *autoscaling.Group {
 	}
 	resp, err := svc.DescribeAutoScalingGroups(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	if len(resp.AutoScalingGroups) > 0 {
@@ -602,8 +587,7 @@ func describeAutoScalingGroup(region string, name string) *autoscaling.Group {
 }
 
 func scanAutoScalingGroups(region string) []*autoscaling.Group {
-	svc := autoscaling.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := autoscaling.New(mcore.Session(autoscaling.ServiceName, region))
 
 	params := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []*string{},
@@ -611,7 +595,7 @@ func scanAutoScalingGroups(region string) []*autoscaling.Group {
 	}
 	resp, err := svc.DescribeAutoScalingGroups(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	if len(resp.AutoScalingGroups) > 0 {
@@ -621,6 +605,16 @@ func scanAutoScalingGroups(region string) []*autoscaling.Group {
 }
 
 func init() {
+	mcore.RegisterScanner("autoscalingGroups", func(region string) interface{} {
+		return scanAutoScalingGroups(region)
+	})
+	mcore.RegisterScanner("autoscalingLaunchConfigs", func(region string) interface{} {
+		return scanLaunchConfigurations(region)
+	})
+	mcore.RegisterScanner("autoscalingHooks", func(region string) interface{} {
+		return scanLifecycleHooks(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -645,36 +639,38 @@ func init() {
 		} else {
 			o2 = c.Object()
 		}
-		o2.Set("scan", func(call otto.FunctionCall) otto.Value {
+		o2.Set("scan", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			return f(scanLaunchConfigurations(region))
-		})
-		o2.Set("delete", deleteLaunchConfiguration)
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.autoscaling.launchConfigs.delete", deleteLaunchConfiguration)))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.autoscaling.launchConfigs.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input autoscaling.CreateLaunchConfigurationInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for autoscaling launch config create input: %s", err)
+				context.Throwf("Can't create json for autoscaling launch config create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall autoscaling launch config json: %s", err)
+				context.Throwf("Can't unmarshall autoscaling launch config json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			createLaunchConfiguration(region, &input)
 			return otto.Value{}
-		})
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeLaunchConfiguration(region, id))
-		})
+		}))
 
 		// Lifcycle Hooks
 		if c, err := o1.Get("hooks"); err != nil || c.IsUndefined() {
@@ -682,73 +678,75 @@ func init() {
 		} else {
 			o2 = c.Object()
 		}
-		o2.Set("scan", func(call otto.FunctionCall) otto.Value {
+		o2.Set("scan", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			return f(scanLifecycleHooks(region))
-		})
-		o2.Set("delete", deleteLifecycleHook)
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.autoscaling.hooks.delete", deleteLifecycleHook)))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.autoscaling.hooks.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input autoscaling.PutLifecycleHookInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for autoscaling hook create input: %s", err)
+				context.Throwf("Can't create json for autoscaling hook create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall autoscaling hook json: %s", err)
+				context.Throwf("Can't unmarshall autoscaling hook json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			createLifecycleHook(region, &input)
 			return otto.Value{}
-		})
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			group := call.Argument(1).String()
-			hook := call.Argument(1).String()
+			hook := call.Argument(2).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeLifecycleHook(region, group, hook))
-		})
-		o2.Set("complete", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("complete", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.autoscaling.hooks.complete", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input autoscaling.CompleteLifecycleActionInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for autoscaling hook complete input: %s", err)
+				context.Throwf("Can't create json for autoscaling hook complete input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall autoscaling hook complete json: %s", err)
+				context.Throwf("Can't unmarshall autoscaling hook complete json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			completeLifecycleAction(region, &input)
 			return otto.Value{}
-		})
-		o2.Set("recordHeartbeat", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("recordHeartbeat", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.autoscaling.hooks.recordHeartbeat", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input autoscaling.RecordLifecycleActionHeartbeatInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for autoscaling hook heartbeat input: %s", err)
+				context.Throwf("Can't create json for autoscaling hook heartbeat input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall autoscaling hook heatbeat json: %s", err)
+				context.Throwf("Can't unmarshall autoscaling hook heatbeat json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			recordLifecycleActionHeartbeat(region, &input)
 			return otto.Value{}
-		})
+		})))
 
 		// ASGs
 		if c, err := o1.Get("groups"); err != nil || c.IsUndefined() {
@@ -756,35 +754,37 @@ func init() {
 		} else {
 			o2 = c.Object()
 		}
-		o2.Set("scan", func(call otto.FunctionCall) otto.Value {
+		o2.Set("scan", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			return f(scanAutoScalingGroups(region))
-		})
-		o2.Set("delete", deleteAutoScalingGroup)
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.autoscaling.groups.delete", deleteAutoScalingGroup)))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.autoscaling.groups.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input autoscaling.CreateAutoScalingGroupInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for autoscaling group create input: %s", err)
+				context.Throwf("Can't create json for autoscaling group create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall autoscaling group json: %s", err)
+				context.Throwf("Can't unmarshall autoscaling group json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			createAutoScalingGroup(region, &input)
 			return otto.Value{}
-		})
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeAutoScalingGroup(region, id))
-		})
+		}))
 	})
 }
@@ -390,12 +390,11 @@ package beanstalk
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	eb "github.com/aws/aws-sdk-go/service/elasticbeanstalk"
 	"github.com/robertkrimen/otto"
 
@@ -410,12 +409,11 @@ var ModuleName = "elasticbeanstalk"
 //////////////////////////////////////////////////////////////////////
 
 func createApp(region string, params *eb.CreateApplicationInput) *eb.ApplicationDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	resp, err := svc.CreateApplication(params)
 	if err != nil {
-		log.Fatalf("Error creating application '%s': %s",
+		mcore.Failf("Error creating application '%s': %s",
 			*params.ApplicationName,
 			err)
 	}
@@ -433,7 +431,7 @@ func createApp(region string, params *eb.CreateApplicationInput) *eb.Application
 	}
 
 	if !avail {
-		log.Fatalf("Error creating application '%s'", name)
+		mcore.Failf("Error creating application '%s'", name)
 	}
 
 	// Describe it.
@@ -441,8 +439,7 @@ func createApp(region string, params *eb.CreateApplicationInput) *eb.Application
 }
 
 func deleteApp(region string, appName string, force bool) {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.DeleteApplicationInput{
 		ApplicationName:     aws.String(appName),
@@ -450,7 +447,7 @@ func deleteApp(region string, appName string, force bool) {
 	}
 	_, err := svc.DeleteApplication(params)
 	if err != nil {
-		log.Fatalf("Error deleting application '%s': %s",
+		mcore.Failf("Error deleting application '%s': %s",
 			appName,
 			err)
 	}
@@ -467,28 +464,26 @@ func deleteApp(region string, appName string, force bool) {
 	}
 
 	if avail {
-		log.Fatalf("Error deleting application '%s'", appName)
+		mcore.Failf("Error deleting application '%s'", appName)
 	}
 }
 
 func scanApps(region string) []*eb.ApplicationDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	in := eb.DescribeApplicationsInput{}
 
 	resp, err := svc.DescribeApplications(&in)
 
 	if err != nil {
-		log.Fatalf("Error describing beanstalk application: %s", err)
+		mcore.Failf("Error describing beanstalk application: %s", err)
 	}
 
 	return resp.Applications
 }
 
 func describeApp(region string, id string) *eb.ApplicationDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	in := eb.DescribeApplicationsInput{
 		ApplicationNames: []*string{
@@ -499,7 +494,7 @@ func describeApp(region string, id string) *eb.ApplicationDescription {
 	resp, err := svc.DescribeApplications(&in)
 
 	if err != nil {
-		log.Fatalf("Error describing beanstalk application: %s", err)
+		mcore.Failf("Error describing beanstalk application: %s", err)
 	}
 
 	if resp != nil && len(resp.Applications) > 0 {
@@ -513,8 +508,7 @@ func describeApp(region string, id string) *eb.ApplicationDescription {
 //////////////////////////////////////////////////////////////////////
 
 func deleteVersion(region string, params *eb.DeleteApplicationVersionInput) {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	appName := *params.ApplicationName
 	label := *params.VersionLabel
@@ -522,7 +516,7 @@ func deleteVersion(region string, params *eb.DeleteApplicationVersionInput) {
 	_, err := svc.DeleteApplicationVersion(params)
 
 	if err != nil {
-		log.Fatalf("Error deleting version '%s' v'%s': %s",
+		mcore.Failf("Error deleting version '%s' v'%s': %s",
 			appName,
 			label,
 			err)
@@ -540,7 +534,7 @@ func deleteVersion(region string, params *eb.DeleteApplicationVersionInput) {
 	}
 
 	if !avail {
-		log.Fatalf("Error deleting version '%s' v'%s': %s",
+		mcore.Failf("Error deleting version '%s' v'%s': %s",
 			appName,
 			label,
 			err)
@@ -548,8 +542,7 @@ func deleteVersion(region string, params *eb.DeleteApplicationVersionInput) {
 }
 
 func scanVersions(region string) []*eb.ApplicationVersionDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	apps := scanApps(region)
 
@@ -561,7 +554,7 @@ func scanVersions(region string) []*eb.ApplicationVersionDescription {
 		resp, err := svc.DescribeApplicationVersions(params)
 
 		if err != nil {
-			log.Fatalf("Error describing beanstalk application versions: %s", err)
+			mcore.Failf("Error describing beanstalk application versions: %s", err)
 		}
 
 		if resp != nil {
@@ -575,12 +568,11 @@ func scanVersions(region string) []*eb.ApplicationVersionDescription {
 }
 
 func createVersion(region string, params *eb.CreateApplicationVersionInput) *eb.ApplicationVersionDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	_, err := svc.CreateApplicationVersion(params)
 	if err != nil {
-		log.Fatalf("Error creating application version '%s' v '%s': %s",
+		mcore.Failf("Error creating application version '%s' v '%s': %s",
 			*params.ApplicationName,
 			*params.VersionLabel,
 			err)
@@ -600,7 +592,7 @@ func createVersion(region string, params *eb.CreateApplicationVersionInput) *eb.
 	}
 
 	if !avail {
-		log.Fatalf("Error creating application '%s'", name)
+		mcore.Failf("Error creating application '%s'", name)
 	}
 
 	// Describe it.
@@ -608,8 +600,7 @@ func createVersion(region string, params *eb.CreateApplicationVersionInput) *eb.
 }
 
 func describeVersions(region string, appName string) []*eb.ApplicationVersionDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.DescribeApplicationVersionsInput{
 		ApplicationName: aws.String(appName),
@@ -617,7 +608,7 @@ func describeVersions(region string, appName string) []*eb.ApplicationVersionDes
 	resp, err := svc.DescribeApplicationVersions(params)
 
 	if err != nil {
-		log.Fatalf("Error describing beanstalk application versions: %s", err)
+		mcore.Failf("Error describing beanstalk application versions: %s", err)
 	}
 
 	if resp != nil {
@@ -627,8 +618,7 @@ func describeVersions(region string, appName string) []*eb.ApplicationVersionDes
 }
 
 func describeVersion(region string, appName string, label string) *eb.ApplicationVersionDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.DescribeApplicationVersionsInput{
 		ApplicationName: aws.String(appName),
@@ -639,10 +629,10 @@ func describeVersion(region string, appName string, label string) *eb.Applicatio
 	resp, err := svc.DescribeApplicationVersions(params)
 
 	if err != nil {
-		log.Fatalf("Error describing beanstalk application versions: %s", err)
+		mcore.Failf("Error describing beanstalk application versions: %s", err)
 	}
 
-	if resp != nil {
+	if resp != nil && len(resp.ApplicationVersions) > 0 {
 		return resp.ApplicationVersions[0]
 	}
 	return nil
@@ -653,18 +643,16 @@ func describeVersion(region string, appName string, label string) *eb.Applicatio
 //////////////////////////////////////////////////////////////////////
 
 func rebuildEnvironment(region string, params *eb.RebuildEnvironmentInput) {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	_, err := svc.RebuildEnvironment(params)
 	if err != nil {
-		log.Fatalf("Error rebuilding environment '%s': %s", *params.EnvironmentName, err)
+		mcore.Failf("Error rebuilding environment '%s': %s", *params.EnvironmentName, err)
 	}
 }
 
 func scanEnvironments(region string) []*eb.EnvironmentDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	apps := scanApps(region)
 
@@ -676,7 +664,7 @@ func scanEnvironments(region string) []*eb.EnvironmentDescription {
 		}
 		resp, err := svc.DescribeEnvironments(params)
 		if err != nil {
-			log.Fatalf("Error describing environment '%s': %s", *app.ApplicationName, err)
+			mcore.Failf("Error describing environment '%s': %s", *app.ApplicationName, err)
 		}
 		if resp != nil {
 			for _, e := range resp.Environments {
@@ -689,8 +677,7 @@ func scanEnvironments(region string) []*eb.EnvironmentDescription {
 }
 
 func describeEnvironment(region string, appName string, envName string) *eb.EnvironmentDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.DescribeEnvironmentsInput{
 		ApplicationName: aws.String(appName),
@@ -702,7 +689,7 @@ func describeEnvironment(region string, appName string, envName string) *eb.Envi
 	resp, err := svc.DescribeEnvironments(params)
 
 	if err != nil {
-		log.Fatalf("Error describing environment '%s': %s", appName, err)
+		mcore.Failf("Error describing environment '%s': %s", appName, err)
 	}
 
 	if resp != nil && len(resp.Environments) > 0 {
@@ -712,13 +699,12 @@ func describeEnvironment(region string, appName string, envName string) *eb.Envi
 }
 
 func terminateEnvironment(region string, params *eb.TerminateEnvironmentInput) *eb.EnvironmentDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	resp, err := svc.TerminateEnvironment(params)
 
 	if err != nil {
-		log.Fatalf("Error terminating environment '%s': %s",
+		mcore.Failf("Error terminating environment '%s': %s",
 			*params.EnvironmentName,
 			err)
 	}
@@ -726,13 +712,12 @@ func terminateEnvironment(region string, params *eb.TerminateEnvironmentInput) *
 }
 
 func createEnvironment(region string, params *eb.CreateEnvironmentInput) *eb.EnvironmentDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	_, err := svc.CreateEnvironment(params)
 
 	if err != nil {
-		log.Fatalf("Error creating environment '%s': %s",
+		mcore.Failf("Error creating environment '%s': %s",
 			*params.ApplicationName,
 			err)
 	}
@@ -751,7 +736,7 @@ func createEnvironment(region string, params *eb.CreateEnvironmentInput) *eb.Env
 	}
 
 	if !avail {
-		log.Fatalf("Error creating environment '%s'", appName)
+		mcore.Failf("Error creating environment '%s'", appName)
 	}
 
 	// Describe it.
@@ -763,8 +748,7 @@ func createEnvironment(region string, params *eb.CreateEnvironmentInput) *eb.Env
 //////////////////////////////////////////////////////////////////////
 
 func scanConfigTemplates(region string) []*eb.ConfigurationSettingsDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	envs := scanEnvironments(region)
 	apps := scanApps(region)
@@ -778,7 +762,7 @@ func scanConfigTemplates(region string) []*eb.ConfigurationSettingsDescription {
 			}
 			resp, err := svc.DescribeConfigurationSettings(params)
 			if err != nil {
-				log.Fatalf("Error scanning config template for app '%s': %s", *app.ApplicationName, err)
+				mcore.Failf("Error scanning config template for app '%s': %s", *app.ApplicationName, err)
 			}
 			if resp != nil {
 				for _, c := range resp.ConfigurationSettings {
@@ -793,8 +777,7 @@ func scanConfigTemplates(region string) []*eb.ConfigurationSettingsDescription {
 }
 
 func describeConfigTemplate(region string, appName string, templateName string) *eb.ConfigurationSettingsDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.DescribeConfigurationSettingsInput{
 		ApplicationName: aws.String(appName),
@@ -810,7 +793,7 @@ func describeConfigTemplate(region string, appName string, templateName string)
 				return nil
 			}
 		}
-		log.Fatalf("Error describing config template '%s': %s", appName, err)
+		mcore.Failf("Error describing config template '%s': %s", appName, err)
 	}
 
 	if resp != nil && len(resp.ConfigurationSettings) > 0 {
@@ -820,8 +803,7 @@ func describeConfigTemplate(region string, appName string, templateName string)
 }
 
 func deleteConfigTemplate(region string, appName string, templateName string) {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.DeleteConfigurationTemplateInput{
 		ApplicationName: aws.String(appName),
@@ -830,7 +812,7 @@ func deleteConfigTemplate(region string, appName string, templateName string) {
 	_, err := svc.DeleteConfigurationTemplate(params)
 
 	if err != nil {
-		log.Fatalf("Error deleting config template '%s': %s",
+		mcore.Failf("Error deleting config template '%s': %s",
 			appName,
 			err)
 	}
@@ -847,18 +829,17 @@ func deleteConfigTemplate(region string, appName string, templateName string) {
 	}
 
 	if avail {
-		log.Fatalf("Error deleting config template '%s'", appName)
+		mcore.Failf("Error deleting config template '%s'", appName)
 	}
 }
 
 func createConfigTemplate(region string, params *eb.CreateConfigurationTemplateInput) *eb.ConfigurationSettingsDescription {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	_, err := svc.CreateConfigurationTemplate(params)
 
 	if err != nil {
-		log.Fatalf("Error creating config template '%s': %s",
+		mcore.Failf("Error creating config template '%s': %s",
 			*params.ApplicationName,
 			err)
 	}
@@ -877,7 +858,7 @@ func createConfigTemplate(region string, params *eb.CreateConfigurationTemplateI
 	}
 
 	if !avail {
-		log.Fatalf("Error creating config template '%s'", appName)
+		mcore.Failf("Error creating config template '%s'", appName)
 	}
 
 	// Describe it.
@@ -889,27 +870,25 @@ func createConfigTemplate(region string, params *eb.CreateConfigurationTemplateI
 //////////////////////////////////////////////////////////////////////
 
 func swapCNAMEs(region string, params *eb.SwapEnvironmentCNAMEsInput) {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	_, err := svc.SwapEnvironmentCNAMEs(params)
 	if err != nil {
-		log.Fatalf("Error swapping cnames for '%s': %s",
+		mcore.Failf("Error swapping cnames for '%s': %s",
 			*params.DestinationEnvironmentName,
 			err)
 	}
 }
 
 func checkDNS(region string, cname string) *eb.CheckDNSAvailabilityOutput {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	params := &eb.CheckDNSAvailabilityInput{
 		CNAMEPrefix: aws.String(cname),
 	}
 	resp, err := svc.CheckDNSAvailability(params)
 	if err != nil {
-		log.Fatalf("Error checking DNS availability for '%s': %s",
+		mcore.Failf("Error checking DNS availability for '%s': %s",
 			cname,
 			err)
 	}
@@ -918,14 +897,13 @@ func checkDNS(region string, cname string) *eb.CheckDNSAvailabilityOutput {
 }
 
 func createStorage(region string) string {
-	svc := eb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := eb.New(mcore.Session(eb.ServiceName, region))
 
 	var params *eb.CreateStorageLocationInput
 	resp, err := svc.CreateStorageLocation(params)
 
 	if err != nil {
-		log.Fatalf("Error creating storage location: %s",
+		mcore.Failf("Error creating storage location: %s",
 			err)
 	}
 
@@ -937,9 +915,21 @@ func createStorage(region string) string {
 //////////////////////////////////////////////////////////////////////
 
 func init() {
+	mcore.RegisterScanner("beanstalkApps", func(region string) interface{} {
+		return scanApps(region)
+	})
+	mcore.RegisterScanner("beanstalkVersions", func(region string) interface{} {
+		return scanVersions(region)
+	})
+	mcore.RegisterScanner("beanstalkEnvironments", func(region string) interface{} {
+		return scanEnvironments(region)
+	})
+	mcore.RegisterScanner("beanstalkConfigs", func(region string) interface{} {
+		return scanConfigTemplates(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
-		var o1 *otto.Object
 		var o2 *otto.Object
 		var awsObj *otto.Object
 		var ebObj *otto.Object
@@ -958,223 +948,224 @@ func init() {
 		if b, err := ebObj.Get("apps"); err != nil || b.IsUndefined() {
 			o2, _ = rt.Object(`aws.beanstalk.apps = {}`)
 		} else {
-			o1 = b.Object()
-			v, _ := o1.Get("apps")
-			o2 = v.Object()
+			o2 = b.Object()
 		}
-		o2.Set("scan", func(region string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanApps(region))
-		})
-		o2.Set("describe", func(region, id string) otto.Value {
+		}))
+		o2.Set("describe", context.Guard(func(region, id string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeApp(region, id))
-		})
-		o2.Set("delete", func(region, appName string, force bool) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.beanstalk.apps.delete", func(region, appName string, force bool) otto.Value {
 			deleteApp(region, appName, force)
 			return otto.Value{}
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.beanstalk.apps.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.CreateApplicationInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk create input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk create json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			f := mcore.Sanitizer(rt)
 			return f(createApp(region, &input))
-		})
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
 
 		// Environments
 		if b, err := ebObj.Get("environments"); err != nil || b.IsUndefined() {
 			o2, _ = rt.Object(`aws.beanstalk.environments = {}`)
 		} else {
-			o1 = b.Object()
-			v, _ := o1.Get("environments")
-			o2 = v.Object()
+			o2 = b.Object()
 		}
-		o2.Set("scan", func(region string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanEnvironments(region))
-		})
-		o2.Set("describe", func(region, appName, envName string) otto.Value {
+		}))
+		o2.Set("describe", context.Guard(func(region, appName, envName string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeEnvironment(region, appName, envName))
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.beanstalk.environments.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.CreateEnvironmentInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk create input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk create json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			f := mcore.Sanitizer(rt)
 			return f(createEnvironment(region, &input))
-		})
-		o2.Set("terminate", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"EnvironmentId": mcore.Plan.ID("e"),
+				"Status":        "Launching",
+			})
+		}))))
+		o2.Set("terminate", context.Guard(context.Plannable(mcore.PlanDelete, "aws.beanstalk.environments.terminate", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.TerminateEnvironmentInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk terminate env input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk terminate env input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk terminate env json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk terminate env json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			f := mcore.Sanitizer(rt)
 			return f(terminateEnvironment(region, &input))
-		})
+		})))
 
 		// Versions
 		if b, err := ebObj.Get("versions"); err != nil || b.IsUndefined() {
 			o2, _ = rt.Object(`aws.beanstalk.versions = {}`)
 		} else {
-			o1 = b.Object()
-			v, _ := o1.Get("versions")
-			o2 = v.Object()
+			o2 = b.Object()
 		}
-		o2.Set("scan", func(region string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanVersions(region))
-		})
-		o2.Set("describeForApp", func(region, appName string) otto.Value {
+		}))
+		o2.Set("describeForApp", context.Guard(func(region, appName string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeVersions(region, appName))
-		})
-		o2.Set("describe", func(region, appName, label string) otto.Value {
+		}))
+		o2.Set("describe", context.Guard(func(region, appName, label string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeVersion(region, appName, label))
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.beanstalk.versions.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.CreateApplicationVersionInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk create version input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk create version input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk create version json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk create version json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			f := mcore.Sanitizer(rt)
 			return f(createVersion(region, &input))
-		})
-		o2.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.beanstalk.versions.delete", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.DeleteApplicationVersionInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk delete version input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk delete version input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk delete version json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk delete version json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			deleteVersion(region, &input)
 			return otto.Value{}
-		})
+		})))
 
 		// Configs
 		if b, err := ebObj.Get("configs"); err != nil || b.IsUndefined() {
 			o2, _ = rt.Object(`aws.beanstalk.configs = {}`)
 		} else {
-			o1 = b.Object()
-			v, _ := o1.Get("configs")
-			o2 = v.Object()
+			o2 = b.Object()
 		}
-		o2.Set("scan", func(region string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanConfigTemplates(region))
-		})
-		o2.Set("describe", func(region, appName, configName string) otto.Value {
+		}))
+		o2.Set("describe", context.Guard(func(region, appName, configName string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeConfigTemplate(region, appName, configName))
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.beanstalk.configs.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.CreateConfigurationTemplateInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk create config input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk create config input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk create config json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk create config json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			f := mcore.Sanitizer(rt)
 			return f(createConfigTemplate(region, &input))
-		})
-		o2.Set("delete", func(region, appName, templateName string) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.beanstalk.configs.delete", func(region, appName, templateName string) otto.Value {
 			deleteConfigTemplate(region, appName, templateName)
 			return otto.Value{}
-		})
+		})))
 
 		// Other
 		if b, err := ebObj.Get("storage"); err != nil || b.IsUndefined() {
 			o2, _ = rt.Object(`aws.beanstalk.storage = {}`)
 		} else {
-			o1 = b.Object()
-			v, _ := o1.Get("storage")
-			o2 = v.Object()
+			o2 = b.Object()
 		}
-		ebObj.Set("check", func(region string, cname string) otto.Value {
+		ebObj.Set("check", context.Guard(func(region string, cname string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(checkDNS(region, cname))
-		})
-		ebObj.Set("swapCNAMEs", func(call otto.FunctionCall) otto.Value {
+		}))
+		ebObj.Set("swapCNAMEs", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.beanstalk.swapCNAMEs", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input eb.SwapEnvironmentCNAMEsInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticbeanstalk swap input: %s", err)
+				context.Throwf("Can't create json for elasticbeanstalk swap input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticbeanstalk swap json: %s", err)
+				context.Throwf("Can't unmarshall elasticbeanstalk swap json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			swapCNAMEs(region, &input)
 			return otto.Value{}
-		})
-		o2.Set("create", func(region string) otto.Value {
+		})))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.beanstalk.storage.create", func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(createStorage(region))
-		})
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return fmt.Sprintf("elasticbeanstalk-%v-planned", mcore.PlannedArg(args, 0))
+		}))))
 		if b, err := ebObj.Get("dns"); err != nil || b.IsUndefined() {
 			o2, _ = rt.Object(`aws.beanstalk.dns = {}`)
 		} else {
-			o1 = b.Object()
-			v, _ := o1.Get("dns")
-			o2 = v.Object()
+			o2 = b.Object()
 		}
 
 	})
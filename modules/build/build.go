@@ -17,8 +17,11 @@ package build
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -48,13 +51,30 @@ func BuildFor(op string, arch string) {
 
 	dest := filepath.Join(CachePath, fmt.Sprintf("wrapper_%s_%s", op, arch))
 	path := filepath.Join(os.Getenv("GOPATH"),
-		"src", "github.com", "cvillecsteele", "mithras", "modules", "wrapper", "wrapper.go")
+		"src", "github.com", "cvillecsteele", "mithras", "modules", "wrapper")
 	Build(path, dest, op, arch)
 
 	dest = filepath.Join(CachePath, fmt.Sprintf("runner_%s_%s", op, arch))
 	Build("", dest, op, arch)
 }
 
+// Hash returns the sha256 of a file's contents, hex encoded.  It is
+// the build hash of a binary: helpers report the same of themselves,
+// so stale copies on hosts can be told from those in the cache.  Both
+// ends of a file transfer compare files by it, too.
+func Hash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func Build(sourcePath string, destPath string, goos string, goarch string) *string {
 	var c *exec.Cmd
 	if sourcePath != "" {
@@ -17,17 +17,18 @@
 package cli
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/codegangsta/cli"
 	"github.com/robertkrimen/otto"
-	"github.com/robertkrimen/otto/repl"
 
 	"github.com/cvillecsteele/mithras/modules/build"
 	"github.com/cvillecsteele/mithras/modules/core"
 	"github.com/cvillecsteele/mithras/modules/daemon"
 	"github.com/cvillecsteele/mithras/modules/script"
+	"github.com/cvillecsteele/mithras/modules/state"
 )
 
 func buildIt(c *cli.Context) error {
@@ -40,14 +41,31 @@ func buildIt(c *cli.Context) error {
 	return nil
 }
 
-func runRepl(c *cli.Context) error {
-	repl.Run(otto.New())
-	return nil
+func stateAction(f func(*cli.Context)) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		script.ConfigureAWS(c)
+		script.ConfigureState(c)
+		f(c)
+		return nil
+	}
+}
+
+// Print the version with the build hash of this binary, which
+// bootstrap compares against the cached runner.
+func printVersion(c *cli.Context) {
+	hash := "unknown"
+	if exe, err := os.Executable(); err == nil {
+		if h, err := build.Hash(exe); err == nil {
+			hash = h
+		}
+	}
+	fmt.Fprintf(c.App.Writer, "%s version %s build %s\n", c.App.Name, c.App.Version, hash)
 }
 
 func Run(versions []core.ModuleVersion, version string) {
 
 	cli.VersionFlag.Name = "version, V"
+	cli.VersionPrinter = printVersion
 
 	linux := cli.StringSlice{"linux"}
 	arch := cli.StringSlice{"386", "amd64"}
@@ -67,6 +85,85 @@ func Run(versions []core.ModuleVersion, version string) {
 			Name:  "verbose, v",
 			Usage: "Verbose output",
 		},
+		cli.StringFlag{
+			Name:   "profile",
+			Value:  "",
+			Usage:  "AWS credentials profile",
+			EnvVar: "AWS_PROFILE",
+		},
+		cli.StringFlag{
+			Name:  "endpoint-url",
+			Value: "",
+			Usage: "Send all AWS calls to this endpoint",
+		},
+		cli.StringSliceFlag{
+			Name:  "endpoint",
+			Usage: "Send calls for one AWS service to an endpoint, as service=url",
+		},
+		cli.IntFlag{
+			Name:  "max-retries",
+			Value: 5,
+			Usage: "Maximum retries for failed AWS calls",
+		},
+		cli.BoolFlag{
+			Name:  "fatal-errors",
+			Usage: "Exit on any core function error instead of throwing a JS exception",
+		},
+		cli.StringFlag{
+			Name:  "ssh-transport",
+			Value: "openssh",
+			Usage: "Reach remote hosts with the local ssh commands (openssh) or mithras' own ssh client (native)",
+		},
+		cli.StringFlag{
+			Name:  "host-keys",
+			Value: "accept-new",
+			Usage: "Host key policy: strict, accept-new or off",
+		},
+		cli.StringFlag{
+			Name:  "known-hosts",
+			Value: "",
+			Usage: "known_hosts file managed by mithras (default ~/.mithras/known_hosts)",
+		},
+		cli.StringFlag{
+			Name:  "ssh-jump",
+			Value: "",
+			Usage: "Reach remote hosts through jump hosts, as [user@]host[:port],...",
+		},
+		cli.StringFlag{
+			Name:  "ssh-address",
+			Value: "public-ip",
+			Usage: "Address used to reach instances: public-ip, private-ip, public-dns or private-dns",
+		},
+		cli.BoolFlag{
+			Name:  "stream",
+			Usage: "Log output of remote commands as it arrives",
+		},
+		cli.Float64Flag{
+			Name:  "ssh-timeout",
+			Value: 0,
+			Usage: "Seconds a remote operation may take (default no limit)",
+		},
+		cli.Float64Flag{
+			Name:  "ssh-connect-timeout",
+			Value: 10,
+			Usage: "Seconds to wait for a connection to a remote host",
+		},
+		cli.IntFlag{
+			Name:  "ssh-retries",
+			Value: 0,
+			Usage: "Retry remote operations this many times while the host is unreachable",
+		},
+		cli.StringFlag{
+			Name:   "state",
+			Value:  "",
+			Usage:  "Keep resource state in this file or s3://bucket/key",
+			EnvVar: "MITHRAS_STATE",
+		},
+		cli.StringFlag{
+			Name:  "state-region",
+			Value: "us-east-1",
+			Usage: "Region of the S3 bucket holding resource state",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -88,6 +185,50 @@ func Run(versions []core.ModuleVersion, version string) {
 					Value: "",
 					Usage: "JS lib directory, defaults to $MITHRASHOME/js",
 				},
+				cli.IntFlag{
+					Name:  "parallel, p",
+					Value: 1,
+					Usage: "Handle up to this many resources at once",
+				},
+				cli.StringSliceFlag{
+					Name:  "target, t",
+					Usage: "Handle only this resource and those it depends on.  May be repeated.",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude, x",
+					Usage: "Don't handle this resource.  May be repeated.",
+				},
+			},
+		},
+
+		// plan
+		{
+			Name:    "plan",
+			Aliases: []string{"p"},
+			Usage:   "Show what a mithras script would change, without changing anything",
+			Action: func(c *cli.Context) error {
+				script.PlanCli(c, versions, version)
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "site.js",
+					Usage: "Plan this script",
+				},
+				cli.StringFlag{
+					Name:  "js, j",
+					Value: "",
+					Usage: "JS lib directory, defaults to $MITHRASHOME/js",
+				},
+				cli.StringSliceFlag{
+					Name:  "target, t",
+					Usage: "Handle only this resource and those it depends on.  May be repeated.",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude, x",
+					Usage: "Don't handle this resource.  May be repeated.",
+				},
 			},
 		},
 
@@ -130,6 +271,7 @@ func Run(versions []core.ModuleVersion, version string) {
 					}
 				}
 				args := []string(c.Args())
+				script.ConfigureAWS(c)
 				f := func(rt *otto.Otto) {
 					o, err := rt.Get("mithras")
 					if err != nil {
@@ -157,11 +299,92 @@ func Run(versions []core.ModuleVersion, version string) {
 			},
 		},
 
+		// state
+		{
+			Name:        "state",
+			Usage:       "Inspect and repair resource state",
+			Description: "Work with the state file named by the global --state flag",
+			Subcommands: []cli.Command{
+				{
+					Name:      "list",
+					Aliases:   []string{"ls"},
+					Usage:     "List resources in the state file",
+					ArgsUsage: " ",
+					Action:    stateAction(state.ListCli),
+				},
+				{
+					Name:      "show",
+					Usage:     "Show the state of resources",
+					ArgsUsage: "<name>...",
+					Action:    stateAction(state.ShowCli),
+				},
+				{
+					Name:      "rm",
+					Usage:     "Forget resources, leaving them in AWS",
+					ArgsUsage: "<name>...",
+					Action:    stateAction(state.RemoveCli),
+				},
+				{
+					Name:      "mv",
+					Usage:     "Rename a resource in the state file",
+					ArgsUsage: "<from> <to>",
+					Action:    stateAction(state.MoveCli),
+				},
+			},
+		},
+
+		// graph
+		{
+			Name:  "graph",
+			Usage: "Print the dependency graph of a mithras script's resources",
+			Action: func(c *cli.Context) error {
+				script.GraphCli(c, versions, version)
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "site.js",
+					Usage: "Graph this script",
+				},
+				cli.StringFlag{
+					Name:  "js, j",
+					Value: "",
+					Usage: "JS lib directory, defaults to $MITHRASHOME/js",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "dot",
+					Usage: "Output format: dot, json or mermaid",
+				},
+			},
+		},
+
 		// repl
 		{
-			Name:   "repl",
-			Usage:  "Run a Mithras JS repl",
-			Action: runRepl,
+			Name:  "repl",
+			Usage: "Run a Mithras JS repl",
+			Action: func(c *cli.Context) error {
+				script.ReplCli(c, versions, version)
+				return nil
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "",
+					Usage: "Load this script before starting",
+				},
+				cli.StringFlag{
+					Name:  "js, j",
+					Value: "",
+					Usage: "JS lib directory, defaults to $MITHRASHOME/js",
+				},
+				cli.StringFlag{
+					Name:  "history",
+					Value: "",
+					Usage: "History file, defaults to ~/.mithras_history",
+				},
+			},
 		},
 
 		// daemon
@@ -169,7 +392,7 @@ func Run(versions []core.ModuleVersion, version string) {
 			Name:        "daemon",
 			Aliases:     []string{"d", "demon"},
 			Usage:       "Run a Mithras daemon",
-			Description: "Start or stop the Mithras daemon using 'mithras daemon start' and 'mithras daemon stop'",
+			Description: "Start or stop the Mithras daemon using 'mithras daemon start' and 'mithras daemon stop', and ask it what it's doing with 'mithras daemon status'",
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "workdir",
@@ -189,6 +412,12 @@ func Run(versions []core.ModuleVersion, version string) {
 					Usage:  "Name of log file",
 					EnvVar: "LOGFILE",
 				},
+				cli.StringFlag{
+					Name:   "socket",
+					Value:  "control.sock",
+					Usage:  "Name of the daemon's control socket",
+					EnvVar: "SOCKET",
+				},
 			},
 			Subcommands: []cli.Command{
 				{
@@ -206,6 +435,10 @@ func Run(versions []core.ModuleVersion, version string) {
 							Value: "",
 							Usage: "JS lib directory, defaults to $MITHRASHOME/js",
 						},
+						cli.BoolFlag{
+							Name:  "reload",
+							Usage: "On SIGHUP, load the script again into a new runtime, instead of calling its reload()",
+						},
 					},
 					Action: func(c *cli.Context) error {
 						daemon.Run(c, versions, version)
@@ -234,6 +467,48 @@ func Run(versions []core.ModuleVersion, version string) {
 						return nil
 					},
 				},
+				{
+					Name:  "status",
+					Usage: "Show what the running Mithras daemon is doing",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the status as JSON",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						daemon.StatusCli(c)
+						return nil
+					},
+				},
+				{
+					Name:      "eval",
+					Usage:     "Evaluate JS in the running Mithras daemon",
+					ArgsUsage: "'<js>'",
+					Action: func(c *cli.Context) error {
+						daemon.EvalCli(c)
+						return nil
+					},
+				},
+				{
+					Name:  "logs",
+					Usage: "Show the running Mithras daemon's log",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "follow, f",
+							Usage: "Keep showing the log as it's written",
+						},
+						cli.IntFlag{
+							Name:  "lines, n",
+							Value: 20,
+							Usage: "Show this many lines from the end of the log",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						daemon.LogsCli(c)
+						return nil
+					},
+				},
 			},
 		},
 	}
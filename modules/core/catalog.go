@@ -0,0 +1,258 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+// # CORE FUNCTIONS: CATALOG
+//
+
+package core
+
+// @public
+//
+// This package exports several entry points into the JS environment,
+// including:
+//
+// > * [aws.catalog.scan](#scan)
+// > * [aws.catalog.scanners](#scanners)
+//
+// This API builds the catalog used by `mithras.run`.
+//
+// ## AWS.CATALOG.SCAN
+// <a name="scan"></a>
+// `aws.catalog.scan(regions, targets, options);`
+//
+// Scan `regions` (an array of region names) for the resources named
+// in `targets` (eg., `["instances", "vpcs"]`), running the scans
+// concurrently.  If `targets` is not supplied, every scanner is run.
+// The optional `options` object may set `concurrency`, the most
+// scans to run at once (default 8).
+//
+// Returns an object with two properties:
+//
+// > * `catalog`: an object mapping each target to an array of the resources found, in region order
+// > * `report`: an array with one entry for each scan run, giving its `scanner`, `region`, `count` of resources found, `duration` in seconds, and `error`, if it failed
+//
+// A failed scan contributes nothing to the catalog; the other scans
+// carry on.
+//
+// Example:
+//
+// ```
+//
+//  var result = aws.catalog.scan(["us-east-1", "us-west-2"],
+//                                ["instances", "vpcs"],
+//                                {concurrency: 4});
+//  _.each(result.report, function(r) {
+//    if (r.error) {
+//      log(sprintf("%s in %s: %s", r.scanner, r.region, r.error));
+//    }
+//  });
+//
+// ```
+//
+// ## AWS.CATALOG.SCANNERS
+// <a name="scanners"></a>
+// `aws.catalog.scanners();`
+//
+// Returns an array of the names of all scanners.
+//
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// A Scanner lists the resources of one kind found in a region.  It
+// returns a slice, and reports failure with Failf.
+type Scanner func(region string) interface{}
+
+// ScanReport describes one run of a Scanner.
+type ScanReport struct {
+	Scanner  string  `json:"scanner"`
+	Region   string  `json:"region"`
+	Count    int     `json:"count"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// DefaultScanConcurrency is the number of scans run at once when no
+// other limit is given.
+const DefaultScanConcurrency = 8
+
+var scannersMu sync.RWMutex
+var scanners = map[string]Scanner{}
+
+// RegisterScanner makes a scanner available for catalog building
+// under `name`, the catalog property it fills.
+func RegisterScanner(name string, s Scanner) {
+	scannersMu.Lock()
+	defer scannersMu.Unlock()
+	scanners[name] = s
+}
+
+// ScannerNames returns the names of all registered scanners.
+func ScannerNames() []string {
+	scannersMu.RLock()
+	defer scannersMu.RUnlock()
+	names := []string{}
+	for name := range scanners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runScanner(name string, s Scanner, region string) (found []interface{}, report ScanReport) {
+	report = ScanReport{Scanner: name, Region: region}
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start).Seconds()
+		if caught := recover(); caught != nil {
+			found = nil
+			report.Count = 0
+			if e, ok := caught.(*MithrasError); ok {
+				report.Error = e.Error()
+			} else {
+				report.Error = fmt.Sprintf("%v", caught)
+			}
+		}
+	}()
+
+	if s == nil {
+		Failf("No scanner for '%s'", name)
+	}
+	v := reflect.ValueOf(s(region))
+	if v.Kind() == reflect.Slice {
+		for i := 0; i < v.Len(); i++ {
+			found = append(found, v.Index(i).Interface())
+		}
+	}
+	report.Count = len(found)
+	return found, report
+}
+
+// Scan runs the named scanners in every region, at most
+// `concurrency` at a time.  Resources found are returned by target in
+// region order, along with a report for every scan.
+func Scan(regions []string, targets []string, concurrency int) (map[string][]interface{}, []ScanReport) {
+	if concurrency < 1 {
+		concurrency = DefaultScanConcurrency
+	}
+
+	type job struct {
+		target string
+		region int
+	}
+	jobs := []job{}
+	for _, t := range targets {
+		for r := range regions {
+			jobs = append(jobs, job{target: t, region: r})
+		}
+	}
+
+	scannersMu.RLock()
+	registered := map[string]Scanner{}
+	for name, s := range scanners {
+		registered[name] = s
+	}
+	scannersMu.RUnlock()
+
+	found := make([][]interface{}, len(jobs))
+	reports := make([]ScanReport, len(jobs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for idx, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, j job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			found[idx], reports[idx] = runScanner(j.target, registered[j.target], regions[j.region])
+		}(idx, j)
+	}
+	wg.Wait()
+
+	catalog := map[string][]interface{}{}
+	for _, t := range targets {
+		catalog[t] = []interface{}{}
+	}
+	for idx, j := range jobs {
+		catalog[j.target] = append(catalog[j.target], found[idx]...)
+	}
+	return catalog, reports
+}
+
+func init() {
+	RegisterInit(func(context *Context) {
+		rt := context.Runtime
+
+		if a, err := rt.Get("aws"); err != nil || a.IsUndefined() {
+			rt.Object(`aws = {}`)
+		}
+		o1, _ := rt.Object(`aws.catalog = {}`)
+
+		o1.Set("scan", context.Guard(func(call otto.FunctionCall) otto.Value {
+			regions := []string{}
+			targets := ScannerNames()
+			concurrency := DefaultScanConcurrency
+
+			if v, err := call.Argument(0).Export(); err == nil {
+				regions = stringList(v)
+			}
+			if arg := call.Argument(1); !arg.IsUndefined() && !arg.IsNull() {
+				if v, err := arg.Export(); err == nil {
+					targets = stringList(v)
+				}
+			}
+			if arg := call.Argument(2); arg.IsObject() {
+				if v, err := arg.Object().Get("concurrency"); err == nil && v.IsNumber() {
+					n, _ := v.ToInteger()
+					concurrency = int(n)
+				}
+			}
+
+			catalog, report := Scan(regions, targets, concurrency)
+			return Sanitize(rt, map[string]interface{}{
+				"catalog": catalog,
+				"report":  report,
+			})
+		}))
+		o1.Set("scanners", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return Sanitize(rt, ScannerNames())
+		}))
+	})
+}
+
+func stringList(v interface{}) []string {
+	result := []string{}
+	switch l := v.(type) {
+	case []string:
+		result = append(result, l...)
+	case []interface{}:
+		for _, s := range l {
+			result = append(result, fmt.Sprintf("%v", s))
+		}
+	}
+	return result
+}
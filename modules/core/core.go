@@ -50,11 +50,9 @@ package core
 
 import (
 	"encoding/json"
-	"fmt"
-	log "github.com/Sirupsen/logrus"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 )
@@ -69,42 +67,157 @@ type Context struct {
 	Args    []string
 	Modules []ModuleVersion
 	Version string
+	AWS     *SessionProvider
 }
 
 var InitFuncs []func(*Context)
 
 func (c *Context) Throw(str string) {
-	panic(c.Runtime.MakeCustomError("MithrasError", str))
+	c.throw(c.Runtime, &MithrasError{Code: ErrorCode, Message: str})
 }
 
 func (c *Context) Throwf(format string, a ...interface{}) {
-	panic(c.Runtime.MakeCustomError("MithrasError", fmt.Sprintf(format, a...)))
+	c.throw(c.Runtime, NewError(format, a...))
 }
 
 func RegisterInit(f func(*Context)) {
 	InitFuncs = append(InitFuncs, f)
 }
 
+// Copy makes a copy of the context's runtime for use on another
+// goroutine.  Core functions are registered again on the copy, so
+// that calls made through it never touch the original runtime.
+func (c *Context) Copy() *otto.Otto {
+	ctx := *c
+	ctx.Runtime = c.Runtime.Copy()
+	for idx, _ := range InitFuncs {
+		InitFuncs[idx](&ctx)
+	}
+	return ctx.Runtime
+}
+
+// RuntimeLock is held by Go code calling into the main runtime from
+// goroutines of its own, since the runtime isn't safe for concurrent
+// use.  Once a script's run() has returned, the daemon's signal
+// handlers and scheduled jobs take turns with it this way.
+var RuntimeLock sync.Mutex
+
+// The runtime whose script holds RuntimeLock while it runs, if any.
+var (
+	holderMu sync.Mutex
+	holder   *otto.Otto
+)
+
+// Holding records that rt's script runs holding RuntimeLock, as a
+// script run by `mithras run` does, so that web handlers and
+// scheduled jobs wait for it.  Call it with nil when the script is
+// done.
+func Holding(rt *otto.Otto) {
+	holderMu.Lock()
+	defer holderMu.Unlock()
+	holder = rt
+}
+
+// Unlocked calls f, which blocks without touching rt, such as a sleep
+// or a web request.  If rt's script holds RuntimeLock, it is released
+// meanwhile, so that others may call into rt, such as the handler of
+// a route the request is for.
+func Unlocked(rt *otto.Otto, f func()) {
+	holderMu.Lock()
+	held := rt != nil && holder == rt
+	if held {
+		holder = nil
+	}
+	holderMu.Unlock()
+	if !held {
+		f()
+		return
+	}
+
+	RuntimeLock.Unlock()
+	defer func() {
+		RuntimeLock.Lock()
+		Holding(rt)
+	}()
+	f()
+}
+
+// A runtime is staged while a reloaded script is loaded into it, until
+// it takes over from the running one.  Its script may schedule jobs
+// and add routes, which wait for it to take over, but mustn't start or
+// stop anything the running script may be using.
+var (
+	stagedMu sync.Mutex
+	staged   = map[*otto.Otto]bool{}
+)
+
+// Stage marks rt as staged.
+func Stage(rt *otto.Otto) {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	staged[rt] = true
+}
+
+// Unstage marks rt as taking over.
+func Unstage(rt *otto.Otto) {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	delete(staged, rt)
+}
+
+// IsStaged says whether rt is staged.
+func IsStaged(rt *otto.Otto) bool {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	return staged[rt]
+}
+
+// Unstaged throws if the context's runtime is staged, saying what it
+// can't yet do.
+func (c *Context) Unstaged(what string) {
+	if IsStaged(c.Runtime) {
+		c.Throwf("Can't call %s while the script is loaded for a reload; call it from run()", what)
+	}
+}
+
+// Called when a runtime is done with, to stop what it started.
+var retireFuncs []func(rt *otto.Otto, successor *otto.Otto)
+
+// RegisterRetire adds a function called when a runtime is retired.
+// If the runtime has a successor, what it left running for the
+// successor to take over should be handed over; everything else it
+// started should be stopped.
+func RegisterRetire(f func(rt *otto.Otto, successor *otto.Otto)) {
+	retireFuncs = append(retireFuncs, f)
+}
+
+// Retire a runtime, with the runtime taking over from it, if any.
+func Retire(rt *otto.Otto, successor *otto.Otto) {
+	for _, f := range retireFuncs {
+		f(rt, successor)
+	}
+	Unstage(rt)
+}
+
 func IsVerbose(rt *otto.Otto) bool {
 	js := `(function () { return mithras["verbose"]; })`
 	v, err := rt.Call(js, nil)
 	if err != nil {
-		log.Fatalf("Mithras object is missing: %s", err)
+		Failf("Mithras object is missing: %s", err)
 	}
 	if v.IsBoolean() {
 		verbose, err := v.ToBoolean()
 		if err != nil {
-			log.Fatalf("Mithras object error: %s", err)
+			Failf("Mithras object error: %s", err)
 		}
 		return verbose
 	}
-	log.Fatalf("Mithras object error: 'verbose' is not a boolean")
+	Failf("Mithras object error: 'verbose' is not a boolean")
 	return false
 }
 
 func Tag(rt *otto.Otto, tags otto.Object, id string, region string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(Session(ec2.ServiceName, region))
 
 	params := &ec2.CreateTagsInput{
 		Resources: []*string{aws.String(id)},
@@ -126,24 +239,24 @@ func Tag(rt *otto.Otto, tags otto.Object, id string, region string, verbose bool
 			return otto.FalseValue()
 		})
 	if err != nil {
-		log.Fatalf("Error obtaining tags from object.")
+		Failf("Error obtaining tags from object.")
 	}
 
 	_, err = svc.CreateTags(params)
 	if err != nil {
-		log.Fatalf("Error tagging '%s': %s", id, err)
+		Failf("Error tagging '%s': %s", id, err)
 	}
 }
 
 func Sanitize(rt *otto.Otto, o interface{}) otto.Value {
 	j, err := json.Marshal(o)
 	if err != nil {
-		log.Fatalf("Sanitize marhsall error:", err)
+		Failf("Sanitize marshal error: %s", err)
 	}
 	js := `(function (json) { return JSON.parse(json); })`
 	val, err := rt.Call(js, nil, string(j))
 	if err != nil {
-		log.Fatalf("Sanitize can't create object: %s", err)
+		Failf("Sanitize can't create object: %s", err)
 	}
 	return val
 }
@@ -154,7 +267,7 @@ func Sanitizer(rt *otto.Otto) func(objs ...interface{}) otto.Value {
 		for _, o := range objs {
 			j, err := json.Marshal(o)
 			if err != nil {
-				log.Fatalf("Sanitizer marhsall error:", err)
+				Failf("Sanitizer marshal error: %s", err)
 			}
 			marshalled = append(marshalled, string(j))
 		}
@@ -170,7 +283,7 @@ func Sanitizer(rt *otto.Otto) func(objs ...interface{}) otto.Value {
           })`
 		val, err := rt.Call(js, nil, marshalled)
 		if err != nil {
-			log.Fatalf("Sanitizer error sanitizing objects: %s", err)
+			Failf("Sanitizer error sanitizing objects: %s", err)
 		}
 
 		return val
@@ -180,12 +293,12 @@ func Sanitizer(rt *otto.Otto) func(objs ...interface{}) otto.Value {
 func init() {
 	RegisterInit(func(context *Context) {
 		rt := context.Runtime
-		rt.Set("sanitize", func(call otto.FunctionCall) otto.Value {
+		rt.Set("sanitize", context.Guard(func(call otto.FunctionCall) otto.Value {
 			val, err := call.Argument(0).Export()
 			if err != nil {
-				log.Fatalf("Sanitize export error: %s", err)
+				Failf("Sanitize export error: %s", err)
 			}
 			return Sanitize(rt, val)
-		})
+		}))
 	})
 }
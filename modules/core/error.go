@@ -0,0 +1,179 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+// # CORE FUNCTIONS: ERRORS
+//
+
+package core
+
+// @public
+//
+// When a core function fails, it throws a `MithrasError` which
+// scripts may catch.  In addition to `name` and `message`, the
+// thrown object has these properties:
+//
+// > * `code`: `"AWSError"` if AWS rejected a call, otherwise `"MithrasError"`
+// > * `awsCode`: the AWS error code, eg. `"InvalidInstanceID.NotFound"`
+// > * `requestId`: the AWS request id, if any
+// > * `statusCode`: the HTTP status of the failed AWS call, if any
+//
+// Example:
+//
+// ```
+//
+//  try {
+//    aws.instances.delete("us-east-1", "i-abcd");
+//  } catch (e) {
+//    if (e.awsCode === "InvalidInstanceID.NotFound") {
+//      log("Already gone.");
+//    } else {
+//      throw e;
+//    }
+//  }
+//
+// ```
+//
+// Older scripts which expect Mithras to exit on any failure can set
+// `mithras.fatalErrors = true`, or pass the `--fatal-errors` global
+// flag on the command line.
+//
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/robertkrimen/otto"
+)
+
+// Error codes carried by MithrasError.
+const (
+	ErrorCode    = "MithrasError"
+	AWSErrorCode = "AWSError"
+)
+
+// FatalErrors makes every MithrasError exit the process instead of
+// throwing into JS.
+var FatalErrors bool
+
+// MithrasError describes a failure in a core function.
+type MithrasError struct {
+	Code       string `json:"code"`
+	AWSCode    string `json:"awsCode,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Message    string `json:"message"`
+}
+
+func (e *MithrasError) Error() string {
+	if e.AWSCode != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.AWSCode)
+	}
+	return e.Message
+}
+
+// NewError builds a MithrasError.  If any of the args is an AWS
+// error, its code and request id are recorded.
+func NewError(format string, a ...interface{}) *MithrasError {
+	e := &MithrasError{
+		Code:    ErrorCode,
+		Message: fmt.Sprintf(format, a...),
+	}
+	for _, arg := range a {
+		if awsErr, ok := arg.(awserr.Error); ok {
+			e.Code = AWSErrorCode
+			e.AWSCode = awsErr.Code()
+			if reqErr, ok := awsErr.(awserr.RequestFailure); ok {
+				e.RequestID = reqErr.RequestID()
+				e.StatusCode = reqErr.StatusCode()
+			}
+			break
+		}
+	}
+	return e
+}
+
+// Failf aborts the current core function.  The failure surfaces in
+// JS as a thrown MithrasError, provided the function was exposed
+// with Guard.
+func Failf(format string, a ...interface{}) {
+	panic(NewError(format, a...))
+}
+
+// Guard wraps a Go function before it is exposed to JS, so that a
+// MithrasError raised inside it becomes a JS exception.
+func (c *Context) Guard(fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return fn
+	}
+	t := v.Type()
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		defer func() {
+			if caught := recover(); caught != nil {
+				if e, ok := caught.(*MithrasError); ok {
+					rt := c.Runtime
+					if len(args) > 0 {
+						if call, ok := args[0].Interface().(otto.FunctionCall); ok && call.Otto != nil {
+							rt = call.Otto
+						}
+					}
+					c.throw(rt, e)
+				}
+				panic(caught)
+			}
+		}()
+		if t.IsVariadic() {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	}).Interface()
+}
+
+func (c *Context) throw(rt *otto.Otto, e *MithrasError) {
+	if FatalErrors || isFatal(rt) {
+		log.Fatalf("%s", e)
+	}
+	val := rt.MakeCustomError(ErrorCode, e.Message)
+	o := val.Object()
+	o.Set("code", e.Code)
+	if e.AWSCode != "" {
+		o.Set("awsCode", e.AWSCode)
+	}
+	if e.RequestID != "" {
+		o.Set("requestId", e.RequestID)
+	}
+	if e.StatusCode != 0 {
+		o.Set("statusCode", e.StatusCode)
+	}
+	panic(val)
+}
+
+func isFatal(rt *otto.Otto) bool {
+	m, err := rt.Get("mithras")
+	if err != nil || !m.IsObject() {
+		return false
+	}
+	v, err := m.Object().Get("fatalErrors")
+	if err != nil || !v.IsBoolean() {
+		return false
+	}
+	fatal, _ := v.ToBoolean()
+	return fatal
+}
@@ -0,0 +1,654 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+// # CORE FUNCTIONS: PLAN
+//
+
+package core
+
+// @public
+//
+// When `mithras.dryRun` is `true`, core functions which would change
+// AWS resources or remote hosts do nothing.  Instead, each call is
+// recorded against the resource being handled by `mithras.apply`.
+//
+// Before a resource's handler is run, the plan function its module
+// registered with `mithras.modules.plan` compares the parameters the
+// resource asks for with its current `_target`.  The resource is
+// planned as a `"create"`, `"update"`, `"delete"` or `"no-op"`, with
+// the fields which would change.  Resources of modules without a plan
+// function, such as `shell`, are planned from the calls their
+// handlers would make.
+//
+// The `mithras plan` command sets `mithras.dryRun` and prints the
+// resulting plan.
+//
+// This package exports several entry points into the JS environment,
+// including:
+//
+// > * [mithras.plan.resource](#resource)
+// > * [mithras.plan.propose](#propose)
+// > * [mithras.plan.compare](#compare)
+// > * [mithras.plan.diff](#diff)
+// > * [mithras.plan.error](#error)
+// > * [mithras.plan.actions](#actions)
+// > * [mithras.plan.summary](#summary)
+// > * [mithras.plan.reset](#reset)
+//
+// ## MITHRAS.PLAN.RESOURCE
+// <a name="resource"></a>
+// `mithras.plan.resource(name, module);`
+//
+// Called by `mithras.apply` before a resource is handled.  Calls
+// recorded afterwards belong to this resource.
+//
+// ## MITHRAS.PLAN.PROPOSE
+// <a name="propose"></a>
+// `mithras.plan.propose(name, proposal);`
+//
+// Set the `action` and `changes` planned for the resource `name`.
+// Called by `mithras.apply` with what a module's plan function
+// returns.
+//
+// ## MITHRAS.PLAN.COMPARE
+// <a name="compare"></a>
+// `mithras.plan.compare(ensure, desired, current);`
+//
+// Returns the proposal for a resource, an object with an `action`
+// and the `changes` it makes.  If `ensure` is `"absent"`, a `current`
+// resource is deleted; otherwise a missing one is created, and one
+// which differs from `desired` is updated.  Each change has the
+// `field`, its current value (`from`) and its desired value (`to`).
+//
+// Example:
+//
+// ```
+//
+//  mithras.plan.compare("present",
+//                       {CidrBlock: "10.0.0.0/16"},
+//                       {VpcId: "vpc-123", CidrBlock: "10.1.0.0/16"});
+//
+// ```
+//
+// returns
+//
+// ```
+//
+//  {action: "update",
+//   changes: [{field: "CidrBlock", from: "10.1.0.0/16", to: "10.0.0.0/16"}]}
+//
+// ```
+//
+// ## MITHRAS.PLAN.DIFF
+// <a name="diff"></a>
+// `mithras.plan.diff(desired, current);`
+//
+// Returns the changes needed to make `current` match `desired`.
+// Only the fields in `desired` are compared; objects are compared
+// field by field, and anything else as a whole.
+//
+// ## MITHRAS.PLAN.ERROR
+// <a name="error"></a>
+// `mithras.plan.error(name, message);`
+//
+// Note that a resource could not be fully planned.  The summary keeps
+// whatever action was proposed for it, and shows `message` beneath.
+//
+// ## MITHRAS.PLAN.ACTIONS
+// <a name="actions"></a>
+// `mithras.plan.actions();`
+//
+// Returns an array of planned resources, each with its `name`,
+// `module`, `action`, `changes`, `error` and the `calls` its handler
+// would have made.  Every call has an `action` (`"create"`,
+// `"update"` or `"delete"`), the core function `call` and its `args`.
+//
+// ## MITHRAS.PLAN.SUMMARY
+// <a name="summary"></a>
+// `mithras.plan.summary();`
+//
+// Returns the plan as printable text.
+//
+// ## MITHRAS.PLAN.RESET
+// <a name="reset"></a>
+// `mithras.plan.reset();`
+//
+// Forget all planned actions.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+)
+
+// Kinds of planned action.
+const (
+	PlanCreate = "create"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+	PlanNoop   = "no-op"
+)
+
+// PlannedCall is a call that would have changed something.
+type PlannedCall struct {
+	Action string        `json:"action"`
+	Call   string        `json:"call"`
+	Args   []interface{} `json:"args"`
+}
+
+// PlannedChange is a field of a resource which would change.
+type PlannedChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// PlannedResource is what is proposed for one resource, and the
+// calls its handler would have made.
+type PlannedResource struct {
+	Name    string          `json:"name"`
+	Module  string          `json:"module"`
+	Action  string          `json:"action,omitempty"`
+	Changes []PlannedChange `json:"changes"`
+	Error   string          `json:"error,omitempty"`
+	Calls   []PlannedCall   `json:"calls"`
+}
+
+// Planner records planned actions.  It is safe for concurrent use.
+type Planner struct {
+	mu        sync.Mutex
+	resources []*PlannedResource
+	ids       int
+}
+
+// Plan is the planner used by all core modules.
+var Plan = &Planner{}
+
+// Resource starts recording actions for the named resource.
+func (p *Planner) Resource(name string, module string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resources = append(p.resources, &PlannedResource{
+		Name:    name,
+		Module:  module,
+		Changes: []PlannedChange{},
+		Calls:   []PlannedCall{},
+	})
+}
+
+// Propose sets the action and changes planned for the named resource.
+func (p *Planner) Propose(name string, action string, changes []PlannedChange) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.resources) - 1; i >= 0; i-- {
+		if p.resources[i].Name == name {
+			p.resources[i].Action = action
+			p.resources[i].Changes = changes
+			return
+		}
+	}
+}
+
+// Error notes that the named resource could not be fully planned.
+func (p *Planner) Error(name string, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.resources) - 1; i >= 0; i-- {
+		if p.resources[i].Name == name {
+			p.resources[i].Error = message
+			return
+		}
+	}
+	p.resources = append(p.resources, &PlannedResource{
+		Name:    name,
+		Error:   message,
+		Changes: []PlannedChange{},
+		Calls:   []PlannedCall{},
+	})
+}
+
+// Record adds a call to the current resource.
+func (p *Planner) Record(c PlannedCall) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.resources) == 0 {
+		p.resources = append(p.resources, &PlannedResource{
+			Changes: []PlannedChange{},
+			Calls:   []PlannedCall{},
+		})
+	}
+	r := p.resources[len(p.resources)-1]
+	r.Calls = append(r.Calls, c)
+}
+
+// ID makes up an id, starting with prefix, for something a planned
+// call would create.  Ids are unique within a plan.
+func (p *Planner) ID(prefix string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ids++
+	return fmt.Sprintf("%s-planned%d", prefix, p.ids)
+}
+
+// Resources returns a copy of everything planned so far.
+func (p *Planner) Resources() []PlannedResource {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := []PlannedResource{}
+	for _, r := range p.resources {
+		c := *r
+		c.Changes = append([]PlannedChange{}, r.Changes...)
+		c.Calls = append([]PlannedCall{}, r.Calls...)
+		result = append(result, c)
+	}
+	return result
+}
+
+// Reset forgets everything planned so far.
+func (p *Planner) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resources = nil
+	p.ids = 0
+}
+
+// Summary renders the plan as text.
+func (p *Planner) Summary() string {
+	var buf bytes.Buffer
+	counts := map[string]int{}
+	for _, r := range p.Resources() {
+		kind := r.Action
+		note := ""
+		switch {
+		case kind == "" && r.Error != "" && len(r.Calls) == 0:
+			kind = "error"
+		case kind == "":
+			kind = callsAction(r.Calls)
+			note = " (from calls)"
+		}
+		if r.Error != "" {
+			note += " (could not be fully planned)"
+			counts["error"]++
+		}
+		if kind != "error" {
+			counts[kind]++
+		}
+
+		fmt.Fprintf(&buf, "%s %s (%s): %s%s\n", planSymbol(kind), r.Name, r.Module, kind, note)
+		if r.Error != "" {
+			fmt.Fprintf(&buf, "    %s\n", r.Error)
+		}
+		for _, c := range r.Changes {
+			writeChange(&buf, c)
+		}
+		for _, c := range r.Calls {
+			writeCall(&buf, c)
+		}
+	}
+	fmt.Fprintf(&buf, "\nPlan: %d to create, %d to update, %d to delete, %d unchanged",
+		counts[PlanCreate], counts[PlanUpdate], counts[PlanDelete], counts[PlanNoop])
+	if counts["error"] > 0 {
+		fmt.Fprintf(&buf, ", %d could not be fully planned", counts["error"])
+	}
+	buf.WriteString(".\n")
+	return buf.String()
+}
+
+// What a resource with no plan function would do, going by the
+// calls its handler made.
+func callsAction(calls []PlannedCall) string {
+	if len(calls) == 0 {
+		return PlanNoop
+	}
+	kind := calls[0].Action
+	for _, c := range calls {
+		if c.Action != kind {
+			return PlanUpdate
+		}
+	}
+	return kind
+}
+
+func planSymbol(kind string) string {
+	switch kind {
+	case PlanCreate:
+		return "+"
+	case PlanUpdate:
+		return "~"
+	case PlanDelete:
+		return "-"
+	case PlanNoop:
+		return " "
+	}
+	return "!"
+}
+
+func writeChange(buf *bytes.Buffer, c PlannedChange) {
+	switch {
+	case c.From == nil:
+		fmt.Fprintf(buf, "    + %s: %s\n", c.Field, planValue(c.To))
+	case c.To == nil:
+		fmt.Fprintf(buf, "    - %s: %s\n", c.Field, planValue(c.From))
+	default:
+		fmt.Fprintf(buf, "    ~ %s: %s => %s\n", c.Field, planValue(c.From), planValue(c.To))
+	}
+}
+
+func writeCall(buf *bytes.Buffer, a PlannedCall) {
+	simple := []string{}
+	params := []map[string]interface{}{}
+	for _, arg := range a.Args {
+		if m, ok := arg.(map[string]interface{}); ok {
+			params = append(params, m)
+		} else {
+			simple = append(simple, planValue(arg))
+		}
+	}
+	fmt.Fprintf(buf, "    > %s %s(%s)\n", a.Action, a.Call, strings.Join(simple, ", "))
+	for _, m := range params {
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "        %s: %s\n", k, planValue(m[k]))
+		}
+	}
+}
+
+func planValue(v interface{}) string {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(j)
+}
+
+// Make a value exported from JS look like it would decoded from
+// JSON, so values of different Go types compare equal.
+func planNormal(v interface{}) interface{} {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err := json.Unmarshal(j, &n); err != nil {
+		return v
+	}
+	return n
+}
+
+// Diff returns the changes needed to make current match desired.
+// Only the fields of desired are compared.  Objects are compared field
+// by field; anything else as a whole.
+func Diff(desired interface{}, current interface{}) []PlannedChange {
+	changes := []PlannedChange{}
+	planDiff("", planNormal(desired), planNormal(current), &changes)
+	return changes
+}
+
+func planDiff(field string, desired interface{}, current interface{}, changes *[]PlannedChange) {
+	if d, ok := desired.(map[string]interface{}); ok {
+		c, _ := current.(map[string]interface{})
+		if c != nil || field == "" {
+			keys := []string{}
+			for k := range d {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				name := k
+				if field != "" {
+					name = field + "." + k
+				}
+				planDiff(name, d[k], c[k], changes)
+			}
+			return
+		}
+	}
+	if desired == nil || reflect.DeepEqual(desired, current) {
+		return
+	}
+	*changes = append(*changes, PlannedChange{Field: field, From: current, To: desired})
+}
+
+// Compare proposes an action for a resource: with ensure "absent", a
+// current resource is deleted; otherwise a missing one is created,
+// and one which differs from desired is updated.
+func Compare(ensure string, desired interface{}, current interface{}) (string, []PlannedChange) {
+	if current != nil {
+		if v := reflect.ValueOf(current); v.Kind() == reflect.Slice && v.Len() == 0 {
+			current = nil
+		}
+	}
+	switch {
+	case ensure == "absent" && current == nil:
+		return PlanNoop, []PlannedChange{}
+	case ensure == "absent":
+		changes := []PlannedChange{}
+		cur := planNormal(current)
+		for _, c := range Diff(desired, nil) {
+			from := c.To
+			if m, ok := cur.(map[string]interface{}); ok && m[c.Field] != nil {
+				from = m[c.Field]
+			}
+			changes = append(changes, PlannedChange{Field: c.Field, From: from})
+		}
+		return PlanDelete, changes
+	case current == nil:
+		return PlanCreate, Diff(desired, nil)
+	}
+	changes := Diff(desired, current)
+	if len(changes) == 0 {
+		return PlanNoop, changes
+	}
+	return PlanUpdate, changes
+}
+
+// DryRun reports whether `mithras.dryRun` is set in rt.
+func DryRun(rt *otto.Otto) bool {
+	m, err := rt.Get("mithras")
+	if err != nil || !m.IsObject() {
+		return false
+	}
+	v, err := m.Object().Get("dryRun")
+	if err != nil || !v.IsBoolean() {
+		return false
+	}
+	dry, _ := v.ToBoolean()
+	return dry
+}
+
+// Planned computes the dry result of a planned call from its
+// arguments, as exported from JS.
+type Planned func(args []interface{}) interface{}
+
+// PlannedArg returns the i'th argument of a planned call, or nil.
+func PlannedArg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// Placeholder stands in for what a planned call would create: a copy
+// of params, if it is an object, with fields set.  Fields set to nil
+// are left out.
+func Placeholder(params interface{}, fields map[string]interface{}) map[string]interface{} {
+	result, ok := planNormal(params).(map[string]interface{})
+	if !ok {
+		result = map[string]interface{}{}
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(result, k)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// Plannable wraps a Go function that changes AWS resources or remote
+// hosts before it is exposed to JS.  In dry-run mode the function is
+// not called; its arguments are recorded as a planned `action` and
+// it returns undefined, or `dryResult` if supplied.  A `dryResult`
+// which is Planned is called with the arguments, so that creates can
+// return placeholders shaped like what they would have made.
+func (c *Context) Plannable(action string, call string, fn interface{}, dryResult ...interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		rt := c.Runtime
+		if len(args) > 0 {
+			if fc, ok := args[0].Interface().(otto.FunctionCall); ok && fc.Otto != nil {
+				rt = fc.Otto
+			}
+		}
+		if !DryRun(rt) {
+			if t.IsVariadic() {
+				return v.CallSlice(args)
+			}
+			return v.Call(args)
+		}
+
+		Plan.Record(PlannedCall{
+			Action: action,
+			Call:   call,
+			Args:   planArgs(args),
+		})
+
+		results := make([]reflect.Value, t.NumOut())
+		for i := range results {
+			results[i] = reflect.Zero(t.Out(i))
+		}
+		if len(dryResult) > 0 && t.NumOut() == 1 && t.Out(0) == reflect.TypeOf(otto.Value{}) {
+			result := dryResult[0]
+			if planned, ok := result.(Planned); ok {
+				result = planned(planArgs(args))
+			}
+			results[0] = reflect.ValueOf(Sanitize(rt, result))
+		}
+		return results
+	}).Interface()
+}
+
+func planArgs(args []reflect.Value) []interface{} {
+	result := []interface{}{}
+	for _, a := range args {
+		if fc, ok := a.Interface().(otto.FunctionCall); ok {
+			for _, v := range fc.ArgumentList {
+				if v.IsFunction() {
+					continue
+				}
+				e, err := v.Export()
+				if err != nil {
+					continue
+				}
+				result = append(result, e)
+			}
+			continue
+		}
+		result = append(result, a.Interface())
+	}
+	return result
+}
+
+func init() {
+	RegisterInit(func(context *Context) {
+		rt := context.Runtime
+
+		if a, err := rt.Get("mithras"); err != nil || a.IsUndefined() {
+			rt.Object(`mithras = {}`)
+		}
+		o1, _ := rt.Object(`mithras.plan = {}`)
+
+		o1.Set("resource", context.Guard(func(name string, module string) otto.Value {
+			Plan.Resource(name, module)
+			return otto.Value{}
+		}))
+		o1.Set("propose", context.Guard(func(call otto.FunctionCall) otto.Value {
+			name := call.Argument(0).String()
+			var proposal struct {
+				Action  string          `json:"action"`
+				Changes []PlannedChange `json:"changes"`
+			}
+			v, _ := call.Argument(1).Export()
+			j, err := json.Marshal(v)
+			if err == nil {
+				err = json.Unmarshal(j, &proposal)
+			}
+			if err != nil {
+				context.Throwf("Invalid proposal for '%s': %s", name, err)
+			}
+			switch proposal.Action {
+			case PlanCreate, PlanUpdate, PlanDelete, PlanNoop:
+			default:
+				context.Throwf("Invalid action '%s' proposed for '%s'", proposal.Action, name)
+			}
+			if proposal.Changes == nil {
+				proposal.Changes = []PlannedChange{}
+			}
+			Plan.Propose(name, proposal.Action, proposal.Changes)
+			return otto.Value{}
+		}))
+		o1.Set("compare", context.Guard(func(call otto.FunctionCall) otto.Value {
+			desired, _ := call.Argument(1).Export()
+			var current interface{}
+			if c := call.Argument(2); c.IsDefined() && !c.IsNull() {
+				current, _ = c.Export()
+			}
+			action, changes := Compare(call.Argument(0).String(), desired, current)
+			return Sanitize(rt, map[string]interface{}{
+				"action":  action,
+				"changes": changes,
+			})
+		}))
+		o1.Set("diff", context.Guard(func(call otto.FunctionCall) otto.Value {
+			desired, _ := call.Argument(0).Export()
+			var current interface{}
+			if c := call.Argument(1); c.IsDefined() && !c.IsNull() {
+				current, _ = c.Export()
+			}
+			return Sanitize(rt, Diff(desired, current))
+		}))
+		o1.Set("error", context.Guard(func(name string, message string) otto.Value {
+			Plan.Error(name, message)
+			return otto.Value{}
+		}))
+		o1.Set("actions", context.Guard(func() otto.Value {
+			return Sanitize(rt, Plan.Resources())
+		}))
+		o1.Set("summary", context.Guard(func() otto.Value {
+			v, _ := rt.ToValue(Plan.Summary())
+			return v
+		}))
+		o1.Set("reset", context.Guard(func() otto.Value {
+			Plan.Reset()
+			return otto.Value{}
+		}))
+	})
+}
@@ -0,0 +1,272 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/aws/aws-sdk-go/private/signer/v4"
+	"github.com/go-ini/ini"
+)
+
+// ProfileProviderName names credentials from ProfileProvider.
+const ProfileProviderName = "ProfileProvider"
+
+// ProfileProvider retrieves credentials for a named profile the way
+// the AWS CLI does.  Settings are read from the shared credentials
+// file (`AWS_SHARED_CREDENTIALS_FILE`, or `~/.aws/credentials`) and
+// the shared config file (`AWS_CONFIG_FILE`, or `~/.aws/config`).  A
+// profile with a `role_arn` assumes that role, using credentials from
+// its `source_profile` or its `credential_source`.
+type ProfileProvider struct {
+	credentials.Expiry
+
+	Profile string
+
+	// Settings (region, endpoint, retries) for STS calls
+	STS *aws.Config
+
+	retrieved bool
+}
+
+// NewProfileCredentials returns credentials for `profile`, assuming
+// roles through STS with settings from `sts`.
+func NewProfileCredentials(profile string, sts *aws.Config) *credentials.Credentials {
+	return credentials.NewCredentials(&ProfileProvider{Profile: profile, STS: sts})
+}
+
+func (p *ProfileProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved = false
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return credentials.Value{ProviderName: ProfileProviderName}, err
+	}
+	v, expires, err := p.resolve(profiles, p.Profile, map[string]bool{})
+	if err != nil {
+		return credentials.Value{ProviderName: ProfileProviderName}, err
+	}
+	v.ProviderName = ProfileProviderName
+
+	p.retrieved = true
+	p.SetExpiration(expires, time.Minute)
+	return v, nil
+}
+
+// IsExpired is true until credentials are retrieved, and after
+// assumed role credentials expire.
+func (p *ProfileProvider) IsExpired() bool {
+	return !p.retrieved || p.Expiry.IsExpired()
+}
+
+// Long enough to never expire
+var forever = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (p *ProfileProvider) resolve(profiles map[string]map[string]string, name string, seen map[string]bool) (credentials.Value, time.Time, error) {
+	if seen[name] {
+		return credentials.Value{}, forever, fmt.Errorf("Profile '%s' is in a source_profile loop", name)
+	}
+	seen[name] = true
+
+	keys, ok := profiles[name]
+	if !ok {
+		return credentials.Value{}, forever, fmt.Errorf("Profile '%s' not found", name)
+	}
+
+	role := keys["role_arn"]
+	if role == "" {
+		return staticProfile(name, keys)
+	}
+	if keys["mfa_serial"] != "" {
+		return credentials.Value{}, forever, fmt.Errorf("Profile '%s' needs an MFA token, which is not supported", name)
+	}
+
+	var source credentials.Value
+	var err error
+	switch src := keys["source_profile"]; {
+	case src == name:
+		source, _, err = staticProfile(name, keys)
+	case src != "":
+		source, _, err = p.resolve(profiles, src, seen)
+	case keys["credential_source"] == "Environment":
+		source, err = (&credentials.EnvProvider{}).Retrieve()
+	case keys["credential_source"] == "Ec2InstanceMetadata":
+		source, err = ec2rolecreds.NewCredentials(session.New(p.STS)).Get()
+	case keys["credential_source"] != "":
+		err = fmt.Errorf("Profile '%s' has unknown credential_source '%s'", name, keys["credential_source"])
+	default:
+		err = fmt.Errorf("Profile '%s' has a role_arn, but no source_profile or credential_source", name)
+	}
+	if err != nil {
+		return credentials.Value{}, forever, err
+	}
+
+	return p.assumeRole(name, keys, source)
+}
+
+func staticProfile(name string, keys map[string]string) (credentials.Value, time.Time, error) {
+	if keys["aws_access_key_id"] == "" || keys["aws_secret_access_key"] == "" {
+		return credentials.Value{}, forever, fmt.Errorf("Profile '%s' has no aws_access_key_id and aws_secret_access_key", name)
+	}
+	return credentials.Value{
+		AccessKeyID:     keys["aws_access_key_id"],
+		SecretAccessKey: keys["aws_secret_access_key"],
+		SessionToken:    keys["aws_session_token"],
+	}, forever, nil
+}
+
+// STS shapes, as the AWS SDK would generate them
+type assumeRoleInput struct {
+	_ struct{} `type:"structure"`
+
+	DurationSeconds *int64  `type:"integer"`
+	ExternalId      *string `type:"string"`
+	RoleArn         *string `type:"string" required:"true"`
+	RoleSessionName *string `type:"string" required:"true"`
+}
+
+type assumeRoleOutput struct {
+	_ struct{} `type:"structure"`
+
+	Credentials *stsCredentials `type:"structure"`
+}
+
+type stsCredentials struct {
+	_ struct{} `type:"structure"`
+
+	AccessKeyId     *string    `type:"string" required:"true"`
+	Expiration      *time.Time `type:"timestamp" timestampFormat:"iso8601" required:"true"`
+	SecretAccessKey *string    `type:"string" required:"true"`
+	SessionToken    *string    `type:"string" required:"true"`
+}
+
+func (p *ProfileProvider) assumeRole(name string, keys map[string]string, source credentials.Value) (credentials.Value, time.Time, error) {
+	cfg := p.STS.Copy().WithCredentials(credentials.NewStaticCredentials(source.AccessKeyID, source.SecretAccessKey, source.SessionToken))
+	c := session.New(cfg).ClientConfig("sts")
+	svc := client.New(*c.Config,
+		metadata.ClientInfo{
+			ServiceName:   "sts",
+			SigningRegion: c.SigningRegion,
+			Endpoint:      c.Endpoint,
+			APIVersion:    "2011-06-15",
+		},
+		c.Handlers)
+	svc.Handlers.Sign.PushBack(v4.Sign)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+
+	sessionName := keys["role_session_name"]
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("mithras-%d", time.Now().UnixNano())
+	}
+	in := &assumeRoleInput{
+		RoleArn:         aws.String(keys["role_arn"]),
+		RoleSessionName: aws.String(sessionName),
+	}
+	if id := keys["external_id"]; id != "" {
+		in.ExternalId = aws.String(id)
+	}
+	if d := keys["duration_seconds"]; d != "" {
+		seconds, err := strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			return credentials.Value{}, forever, fmt.Errorf("Profile '%s' has a bad duration_seconds: %s", name, err)
+		}
+		in.DurationSeconds = aws.Int64(seconds)
+	}
+
+	out := &assumeRoleOutput{}
+	op := &request.Operation{Name: "AssumeRole", HTTPMethod: "POST", HTTPPath: "/"}
+	if err := svc.NewRequest(op, in, out).Send(); err != nil {
+		return credentials.Value{}, forever, fmt.Errorf("Can't assume role '%s' for profile '%s': %s", keys["role_arn"], name, err)
+	}
+	if out.Credentials == nil {
+		return credentials.Value{}, forever, fmt.Errorf("No credentials assuming role '%s' for profile '%s'", keys["role_arn"], name)
+	}
+
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(out.Credentials.SessionToken),
+	}, aws.TimeValue(out.Credentials.Expiration), nil
+}
+
+// loadProfiles reads the shared credentials and config files,
+// returning the settings of each profile.  Settings from the
+// credentials file win.
+func loadProfiles() (map[string]map[string]string, error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	path := func(env string, name string) string {
+		if p := os.Getenv(env); p != "" {
+			return p
+		}
+		return filepath.Join(home, ".aws", name)
+	}
+
+	profiles := map[string]map[string]string{}
+	load := func(file string, prefix string) error {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil
+		}
+		f, err := ini.Load(file)
+		if err != nil {
+			return fmt.Errorf("Can't load AWS profiles from '%s': %s", file, err)
+		}
+		for _, s := range f.Sections() {
+			name := s.Name()
+			if prefix != "" && name != "default" {
+				if !strings.HasPrefix(name, prefix) {
+					continue
+				}
+				name = strings.TrimPrefix(name, prefix)
+			}
+			if profiles[name] == nil {
+				profiles[name] = map[string]string{}
+			}
+			for k, v := range s.KeysHash() {
+				profiles[name][k] = v
+			}
+		}
+		return nil
+	}
+
+	// Config first, so the credentials file overrides it
+	if err := load(path("AWS_CONFIG_FILE", "config"), "profile "); err != nil {
+		return nil, err
+	}
+	if err := load(path("AWS_SHARED_CREDENTIALS_FILE", "credentials"), ""); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
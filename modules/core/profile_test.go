@@ -0,0 +1,132 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+[default]
+region = us-east-1
+
+[profile fromconfig]
+aws_access_key_id = CONFIGKEY
+aws_secret_access_key = configsecret
+
+[profile dev]
+role_arn = arn:aws:iam::123456789012:role/dev
+source_profile = base
+external_id = xyzzy
+
+[profile ops]
+role_arn = arn:aws:iam::123456789012:role/ops
+source_profile = dev
+
+[profile loop]
+role_arn = arn:aws:iam::123456789012:role/loop
+source_profile = loop2
+
+[profile loop2]
+role_arn = arn:aws:iam::123456789012:role/loop2
+source_profile = loop
+`
+
+const testCredentials = `
+[base]
+aws_access_key_id = BASEKEY
+aws_secret_access_key = basesecret
+
+[fromconfig]
+aws_access_key_id = CREDENTIALSKEY
+`
+
+// stsServer answers AssumeRole with keys named for the role, and
+// records which key signed each call.
+func stsServer(t *testing.T, signers *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRole" {
+			t.Errorf("unexpected STS action %q", r.Form.Get("Action"))
+		}
+		if r.Form.Get("RoleArn") == "arn:aws:iam::123456789012:role/dev" && r.Form.Get("ExternalId") != "xyzzy" {
+			t.Errorf("dev role assumed without its external id")
+		}
+		auth := r.Header.Get("Authorization")
+		i := strings.Index(auth, "Credential=")
+		j := strings.Index(auth[i:], "/")
+		*signers = append(*signers, auth[i+len("Credential="):i+j])
+
+		role := r.Form.Get("RoleArn")
+		role = strings.ToUpper(role[strings.LastIndex(role, "/")+1:])
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>%sKEY</AccessKeyId>
+      <SecretAccessKey>%ssecret</SecretAccessKey>
+      <SessionToken>%stoken</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, role, role, role, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+}
+
+func TestProfileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	creds := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(config, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(creds, []byte(testCredentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", config)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", creds)
+
+	var signers []string
+	sts := stsServer(t, &signers)
+	defer sts.Close()
+
+	for _, c := range []struct {
+		profile string
+		key     string
+		token   string
+		signers []string
+		err     string
+	}{
+		{"base", "BASEKEY", "", nil, ""},
+		{"fromconfig", "CREDENTIALSKEY", "", nil, ""},
+		{"dev", "DEVKEY", "DEVtoken", []string{"BASEKEY"}, ""},
+		{"ops", "OPSKEY", "OPStoken", []string{"BASEKEY", "DEVKEY"}, ""},
+		{"loop", "", "", nil, "source_profile loop"},
+		{"missing", "", "", nil, "'missing' not found"},
+	} {
+		signers = nil
+		p := NewSessionProvider()
+		p.Configure(AWSConfig{
+			Profile:    c.profile,
+			Endpoints:  map[string]string{"sts": sts.URL},
+			MaxRetries: 0,
+		})
+		v, err := p.Session("ec2", "us-east-1").Config.Credentials.Get()
+		switch {
+		case c.err != "":
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("profile %s: got error %v, want one with %q", c.profile, err, c.err)
+			}
+		case err != nil:
+			t.Errorf("profile %s: %s", c.profile, err)
+		case v.AccessKeyID != c.key || v.SessionToken != c.token:
+			t.Errorf("profile %s: got key %q token %q, want %q %q", c.profile, v.AccessKeyID, v.SessionToken, c.key, c.token)
+		case fmt.Sprint(signers) != fmt.Sprint(c.signers):
+			t.Errorf("profile %s: STS calls signed by %v, want %v", c.profile, signers, c.signers)
+		}
+	}
+}
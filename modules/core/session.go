@@ -0,0 +1,206 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+// # CORE FUNCTIONS: AWS SESSION
+//
+
+package core
+
+// @public
+//
+// Every core module that talks to AWS obtains its service clients
+// from a single session provider.  The provider is configured from
+// the global `mithras` command line flags:
+//
+// > * `--profile`: the profile to use from `~/.aws/credentials` and `~/.aws/config`.  A profile with a `role_arn` assumes that role, with credentials from its `source_profile` or `credential_source`.
+// > * `--endpoint-url`: send all AWS calls to this endpoint
+// > * `--endpoint service=url`: send calls for one service (eg., `ec2`, `s3`, `sqs`) to this endpoint.  May be repeated.
+// > * `--max-retries`: the number of times failed AWS calls are retried (default 5)
+//
+// Scripts may inspect and change these settings at runtime:
+//
+// > * [aws.session.configure](#configure)
+// > * [aws.session.config](#config)
+//
+// ## AWS.SESSION.CONFIGURE
+// <a name="configure"></a>
+// `aws.session.configure(settings);`
+//
+// Change session settings.  Only the properties supplied are
+// changed.  Per-service endpoints are merged with any already set.
+//
+// Example:
+//
+// ```
+//
+//  aws.session.configure({
+//    profile:    "ci"
+//    endpoint:   "http://localhost:4566"
+//    endpoints:  { s3: "http://localhost:4572" }
+//    maxRetries: 2
+//  });
+//
+// ```
+//
+// ## AWS.SESSION.CONFIG
+// <a name="config"></a>
+// `aws.session.config();`
+//
+// Returns the current session settings.
+//
+// Example:
+//
+// ```
+//
+//  var settings = aws.session.config();
+//
+// ```
+//
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/robertkrimen/otto"
+)
+
+// AWSConfig holds the settings used to build AWS service clients.
+type AWSConfig struct {
+	Profile    string            `json:"profile"`
+	Endpoint   string            `json:"endpoint"`
+	Endpoints  map[string]string `json:"endpoints"`
+	MaxRetries int               `json:"maxRetries"`
+}
+
+// SessionProvider hands out AWS sessions built from a shared
+// AWSConfig.  It is safe for concurrent use.
+type SessionProvider struct {
+	mu     sync.RWMutex
+	config AWSConfig
+	creds  *credentials.Credentials
+}
+
+// AWS is the session provider used by all core modules.
+var AWS = NewSessionProvider()
+
+func NewSessionProvider() *SessionProvider {
+	return &SessionProvider{
+		config: AWSConfig{
+			Endpoints:  map[string]string{},
+			MaxRetries: 5,
+		},
+	}
+}
+
+// Configure replaces the provider's settings.
+func (p *SessionProvider) Configure(cfg AWSConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cfg.Endpoints == nil {
+		cfg.Endpoints = map[string]string{}
+	}
+	// Assumed roles depend on the STS settings, too
+	p.creds = nil
+	p.config = cfg
+}
+
+// Config returns a copy of the provider's settings.
+func (p *SessionProvider) Config() AWSConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	cfg := p.config
+	cfg.Endpoints = map[string]string{}
+	for k, v := range p.config.Endpoints {
+		cfg.Endpoints[k] = v
+	}
+	return cfg
+}
+
+// Session returns a session for talking to `service` (eg.,
+// `ec2.ServiceName`) in `region`.
+func (p *SessionProvider) Session(service string, region string) *session.Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := p.serviceConfig(service, region)
+	if p.config.Profile != "" {
+		if p.creds == nil {
+			p.creds = NewProfileCredentials(p.config.Profile, p.serviceConfig("sts", region))
+		}
+		cfg = cfg.WithCredentials(p.creds)
+	}
+
+	return session.New(cfg)
+}
+
+// serviceConfig returns the settings, other than credentials, for
+// talking to `service` in `region`.
+func (p *SessionProvider) serviceConfig(service string, region string) *aws.Config {
+	cfg := aws.NewConfig().WithRegion(region).WithMaxRetries(p.config.MaxRetries)
+
+	endpoint := p.config.Endpoint
+	if e, ok := p.config.Endpoints[service]; ok && e != "" {
+		endpoint = e
+	}
+	if endpoint != "" {
+		// Local stand-ins for S3 rarely support virtual host buckets
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	return cfg
+}
+
+// Session returns a session from the default provider.
+func Session(service string, region string) *session.Session {
+	return AWS.Session(service, region)
+}
+
+func init() {
+	RegisterInit(func(context *Context) {
+		rt := context.Runtime
+		provider := context.AWS
+		if provider == nil {
+			provider = AWS
+		}
+
+		if a, err := rt.Get("aws"); err != nil || a.IsUndefined() {
+			rt.Object(`aws = {}`)
+		}
+		o1, _ := rt.Object(`aws.session = {}`)
+		o1.Set("configure", context.Guard(func(call otto.FunctionCall) otto.Value {
+			js := `(function (o) { return JSON.stringify(o); })`
+			s, err := rt.Call(js, nil, call.Argument(0))
+			if err != nil {
+				context.Throwf("Can't create json for session settings: %s", err)
+			}
+			cfg := provider.Config()
+			if err := json.Unmarshal([]byte(s.String()), &cfg); err != nil {
+				context.Throwf("Can't unmarshall session settings: %s", err)
+			}
+			provider.Configure(cfg)
+			return otto.Value{}
+		}))
+		o1.Set("config", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return Sanitize(rt, provider.Config())
+		}))
+	})
+}
@@ -0,0 +1,486 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+// A running daemon answers questions about itself on a Unix socket.
+// A client writes one request, a line of JSON, and the daemon answers
+// with a line of JSON, or, for logs, with lines of the log file until
+// the client hangs up.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/robertkrimen/otto"
+
+	"github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/schedule"
+	"github.com/cvillecsteele/mithras/modules/workers"
+)
+
+// The daemon is started in its working directory, so it's told where
+// its socket and log file are, as seen by whoever started it.
+const (
+	socketEnv = "MITHRAS_DAEMON_SOCKET"
+	logEnv    = "MITHRAS_DAEMON_LOG"
+)
+
+// How many errors the daemon remembers
+const recentErrors = 50
+
+// How often the log file is checked for more, when following it
+var followInterval = 250 * time.Millisecond
+
+// How long an eval may run before it is interrupted.  Nothing else
+// runs in the script while it does.
+var evalTimeout = 10 * time.Second
+
+// How much of the log file is read at a time, looking back from its
+// end for the lines asked for
+var tailBlock = 64 * 1024
+
+// Thrown in the runtime to stop an eval which has run too long
+var errEvalTimeout = errors.New("timed out")
+
+// Request is sent to the daemon's control socket.
+type Request struct {
+	// "status", "eval" or "logs"
+	Command string `json:"command"`
+	// JS to evaluate
+	Source string `json:"source,omitempty"`
+	// How many lines of the log to send, and whether to keep sending
+	// more as they are written
+	Lines  int  `json:"lines,omitempty"`
+	Follow bool `json:"follow,omitempty"`
+}
+
+// Response is the daemon's answer to a status or eval request.
+type Response struct {
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+	// The result of an eval, as JSON
+	Result string `json:"result,omitempty"`
+}
+
+// RecentError is an error logged by the daemon.
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Status describes a running daemon.
+type Status struct {
+	Pid     int                  `json:"pid"`
+	Version string               `json:"version"`
+	Script  string               `json:"script"`
+	Started time.Time            `json:"started"`
+	Uptime  string               `json:"uptime"`
+	Workers []workers.Status     `json:"workers"`
+	Jobs    []schedule.JobStatus `json:"jobs"`
+	Errors  []RecentError        `json:"errors"`
+}
+
+// Keeps the errors logged, for status requests.
+type errorHook struct {
+	mu     sync.Mutex
+	errors []RecentError
+}
+
+func (h *errorHook) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel, log.FatalLevel, log.PanicLevel}
+}
+
+func (h *errorHook) Fire(entry *log.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errors = append(h.errors, RecentError{Time: entry.Time, Message: entry.Message})
+	if len(h.errors) > recentErrors {
+		h.errors = h.errors[len(h.errors)-recentErrors:]
+	}
+	return nil
+}
+
+func (h *errorHook) recent() []RecentError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]RecentError{}, h.errors...)
+}
+
+// The control server of a running daemon.
+type controller struct {
+	listener net.Listener
+	socket   string
+	logFile  string
+	script   string
+	version  string
+	started  time.Time
+	errors   *errorHook
+}
+
+// Where a daemon file named by a flag is, relative to the current
+// directory.
+func daemonPath(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		log.Fatalf("Can't find '%s': %s", name, err)
+	}
+	return abs
+}
+
+// Tell the daemon about to be started where its socket and log are.
+func controlEnv(c *cli.Context) []string {
+	return append(os.Environ(),
+		fmt.Sprintf("%s=%s", socketEnv, daemonPath(c.Parent().String("socket"))),
+		fmt.Sprintf("%s=%s", logEnv, daemonPath(c.Parent().String("logfile"))))
+}
+
+// Start serving the control socket, if the daemon has one.
+func serveControl(script string, version string) *controller {
+	socket := os.Getenv(socketEnv)
+	if socket == "" {
+		return nil
+	}
+
+	// A socket left by a daemon which didn't stop cleanly is in the
+	// way; the pid file lock means no other daemon is using it.
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Errorf("Can't listen on control socket '%s': %s", socket, err)
+		return nil
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		log.Errorf("Can't set mode of control socket '%s': %s", socket, err)
+	}
+
+	ctl := &controller{
+		listener: l,
+		socket:   socket,
+		logFile:  os.Getenv(logEnv),
+		script:   script,
+		version:  version,
+		started:  time.Now(),
+		errors:   &errorHook{},
+	}
+	log.AddHook(ctl.errors)
+	go ctl.serve()
+	return ctl
+}
+
+func (ctl *controller) close() {
+	if ctl == nil {
+		return
+	}
+	ctl.listener.Close()
+	os.Remove(ctl.socket)
+}
+
+func (ctl *controller) serve() {
+	for {
+		conn, err := ctl.listener.Accept()
+		if err != nil {
+			// Closed
+			return
+		}
+		go ctl.handle(conn)
+	}
+}
+
+func (ctl *controller) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("Invalid request: %s", err)})
+		return
+	}
+
+	var resp Response
+	switch req.Command {
+	case "status":
+		resp.Status = ctl.status()
+	case "eval":
+		resp.Result, err = ctl.eval(req.Source)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "logs":
+		if err := ctl.logs(conn, req.Lines, req.Follow); err != nil {
+			fmt.Fprintf(conn, "%s\n", err)
+		}
+		return
+	default:
+		resp.Error = fmt.Sprintf("Unknown command '%s'", req.Command)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (ctl *controller) status() *Status {
+	return &Status{
+		Pid:     os.Getpid(),
+		Version: ctl.version,
+		Script:  ctl.script,
+		Started: ctl.started,
+		Uptime:  time.Since(ctl.started).Truncate(time.Second).String(),
+		Workers: workers.Statuses(),
+		Jobs:    schedule.List(),
+		Errors:  ctl.errors.recent(),
+	}
+}
+
+// Evaluate source in the daemon's runtime, returning the result as
+// JSON.  If it runs longer than evalTimeout, it is interrupted.
+func (ctl *controller) eval(source string) (result string, err error) {
+	core.RuntimeLock.Lock()
+	defer core.RuntimeLock.Unlock()
+
+	interrupt := make(chan func(), 1)
+	timer := time.AfterFunc(evalTimeout, func() {
+		interrupt <- func() { panic(errEvalTimeout) }
+	})
+	current.Interrupt = interrupt
+	defer func() {
+		timer.Stop()
+		current.Interrupt = nil
+		if caught := recover(); caught != nil {
+			if caught != errEvalTimeout {
+				panic(caught)
+			}
+			result, err = "", fmt.Errorf("Eval took longer than %s, and was interrupted", evalTimeout)
+		}
+	}()
+
+	v, err := current.Run(source)
+	if err == nil {
+		v, err = current.Call("JSON.stringify", nil, v, nil, 2)
+	}
+	if err != nil {
+		if ottoErr, ok := err.(*otto.Error); ok {
+			return "", fmt.Errorf("%s", ottoErr.String())
+		}
+		return "", err
+	}
+	if v.IsUndefined() {
+		return "undefined", nil
+	}
+	return v.String(), nil
+}
+
+// Send the last lines of the log, then, if following, what is written
+// to it after, until the client hangs up.
+func (ctl *controller) logs(conn net.Conn, lines int, follow bool) error {
+	if ctl.logFile == "" {
+		return fmt.Errorf("The daemon has no log file")
+	}
+	f, err := os.Open(ctl.logFile)
+	if err != nil {
+		return fmt.Errorf("Can't open log file '%s': %s", ctl.logFile, err)
+	}
+	defer f.Close()
+
+	tail, err := tail(f, lines)
+	if err != nil {
+		return fmt.Errorf("Can't read log file '%s': %s", ctl.logFile, err)
+	}
+	if _, err := conn.Write(tail); err != nil || !follow {
+		return nil
+	}
+
+	// Notice the client hanging up while there's nothing to send
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return nil
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Can't read log file '%s': %s", ctl.logFile, err)
+		}
+		select {
+		case <-gone:
+			return nil
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+// Read f, returning its last n lines, and leaving it at its end.  Only
+// as much of the end of f as holds them is read.
+func tail(f *os.File, n int) ([]byte, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+
+	// Read back from the end until there are more than n newlines,
+	// or the start is reached
+	data := []byte{}
+	for pos := size; pos > 0 && bytes.Count(data, []byte{'\n'}) <= n; {
+		block := int64(tailBlock)
+		if block > pos {
+			block = pos
+		}
+		pos -= block
+		buf := make([]byte, block)
+		if _, err := f.ReadAt(buf, pos); err != nil {
+			return nil, err
+		}
+		data = append(buf, data...)
+	}
+
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	start := 0
+	for i, seen := end-1, 0; i >= 0; i-- {
+		if data[i] == '\n' {
+			if seen++; seen == n {
+				start = i + 1
+				break
+			}
+		}
+	}
+	return data[start:], nil
+}
+
+// Send a request to the daemon named by the command line flags.
+func dial(c *cli.Context, req Request) net.Conn {
+	socket := daemonPath(c.Parent().String("socket"))
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Fatalf("Can't reach the daemon at '%s'; it may not be running: %s", socket, err)
+	}
+	b, _ := json.Marshal(req)
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		log.Fatalf("Can't send request to the daemon: %s", err)
+	}
+	return conn
+}
+
+func ask(c *cli.Context, req Request) Response {
+	conn := dial(c, req)
+	defer conn.Close()
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		log.Fatalf("Can't read the daemon's response: %s", err)
+	}
+	if resp.Error != "" {
+		log.Fatalf("%s", resp.Error)
+	}
+	return resp
+}
+
+// StatusCli prints what a running daemon is doing.
+func StatusCli(c *cli.Context) {
+	status := ask(c, Request{Command: "status"}).Status
+	if c.Bool("json") {
+		b, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	fmt.Print(formatStatus(status))
+}
+
+func formatStatus(s *Status) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "pid:     %d\n", s.Pid)
+	fmt.Fprintf(&buf, "version: %s\n", s.Version)
+	fmt.Fprintf(&buf, "script:  %s\n", s.Script)
+	fmt.Fprintf(&buf, "started: %s (up %s)\n", s.Started.Format(time.RFC3339), s.Uptime)
+
+	fmt.Fprintf(&buf, "\nworkers: %d\n", len(s.Workers))
+	for _, w := range s.Workers {
+		state := "stopped"
+		if w.Running {
+			state = "running"
+		}
+		fmt.Fprintf(&buf, "  %-20s %s x%d, %d queued, %d received, %d sent, %d errors\n",
+			w.Name, state, w.Size, w.Queued, w.Received, w.Sent, w.Errors)
+		if w.LastError != "" {
+			fmt.Fprintf(&buf, "  %-20s last error: %s\n", "", firstLine(w.LastError))
+		}
+	}
+
+	fmt.Fprintf(&buf, "\njobs: %d\n", len(s.Jobs))
+	for _, j := range s.Jobs {
+		fmt.Fprintf(&buf, "  %-4d %-6s %-20s next %s, %d runs, %d skipped, %d errors\n",
+			j.ID, j.Kind, j.Spec, j.Next.Format(time.RFC3339), j.Runs, j.Skipped, j.Errors)
+		if j.LastError != "" {
+			fmt.Fprintf(&buf, "       last error: %s\n", firstLine(j.LastError))
+		}
+	}
+
+	fmt.Fprintf(&buf, "\nrecent errors: %d\n", len(s.Errors))
+	for _, e := range s.Errors {
+		fmt.Fprintf(&buf, "  %s %s\n", e.Time.Format(time.RFC3339), firstLine(e.Message))
+	}
+	return buf.String()
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+// EvalCli evaluates JS in a running daemon, and prints the result.
+func EvalCli(c *cli.Context) {
+	source := strings.Join(c.Args(), " ")
+	if source == "" {
+		log.Fatalf("Nothing to evaluate")
+	}
+	fmt.Println(ask(c, Request{Command: "eval", Source: source}).Result)
+}
+
+// LogsCli prints the end of a running daemon's log, and, with
+// --follow, what it logs after.
+func LogsCli(c *cli.Context) {
+	conn := dial(c, Request{Command: "logs", Lines: c.Int("lines"), Follow: c.Bool("follow")})
+	defer conn.Close()
+	io.Copy(os.Stdout, conn)
+}
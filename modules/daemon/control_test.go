@@ -0,0 +1,205 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/robertkrimen/otto"
+)
+
+// Serve a control socket in a temporary directory, for a runtime
+// running the given script.
+func testController(t *testing.T, js string) (*controller, string) {
+	dir, err := ioutil.TempDir("", "mithrastest-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	current = otto.New()
+	if _, err := current.Run(js); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(socketEnv, filepath.Join(dir, "socket"))
+	os.Setenv(logEnv, filepath.Join(dir, "log"))
+	defer os.Unsetenv(socketEnv)
+	defer os.Unsetenv(logEnv)
+
+	ctl := serveControl("test.js", "1.2.3")
+	if ctl == nil {
+		t.Fatal("No control socket")
+	}
+	t.Cleanup(ctl.close)
+	return ctl, dir
+}
+
+// Send a request, returning the connection to read the answer from.
+func send(t *testing.T, ctl *controller, req Request) net.Conn {
+	conn, err := net.Dial("unix", ctl.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(req)
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func request(t *testing.T, ctl *controller, req Request) Response {
+	conn := send(t, ctl, req)
+	defer conn.Close()
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestControlStatus(t *testing.T) {
+	ctl, _ := testController(t, "")
+	log.Errorf("something broke\nwith detail")
+
+	resp := request(t, ctl, Request{Command: "status"})
+	if resp.Error != "" {
+		t.Fatalf("Status failed: %s", resp.Error)
+	}
+	s := resp.Status
+	if s.Pid != os.Getpid() || s.Version != "1.2.3" || s.Script != "test.js" {
+		t.Errorf("Wrong status: %+v", s)
+	}
+	if n := len(s.Errors); n == 0 || s.Errors[n-1].Message != "something broke\nwith detail" {
+		t.Errorf("Recent errors missing: %+v", s.Errors)
+	}
+	if out := formatStatus(s); !strings.Contains(out, "  "+s.Errors[len(s.Errors)-1].Time.Format(time.RFC3339)+" something broke\n") {
+		t.Errorf("Errors not shown by their first line:\n%s", out)
+	}
+
+	resp = request(t, ctl, Request{Command: "frobnicate"})
+	if resp.Error != "Unknown command 'frobnicate'" {
+		t.Errorf("Unknown command not refused: %+v", resp)
+	}
+}
+
+func TestControlEval(t *testing.T) {
+	ctl, _ := testController(t, "var answer = {n: 42};")
+
+	resp := request(t, ctl, Request{Command: "eval", Source: "answer.n"})
+	if resp.Error != "" || resp.Result != "42" {
+		t.Errorf("Wrong eval result: %+v", resp)
+	}
+	resp = request(t, ctl, Request{Command: "eval", Source: "undefined"})
+	if resp.Result != "undefined" {
+		t.Errorf("Wrong eval result: %+v", resp)
+	}
+	resp = request(t, ctl, Request{Command: "eval", Source: "nothing.here"})
+	if !strings.Contains(resp.Error, "ReferenceError") {
+		t.Errorf("Eval error not returned: %+v", resp)
+	}
+
+	// A runaway eval is stopped, and the runtime still works after
+	defer func(d time.Duration) { evalTimeout = d }(evalTimeout)
+	evalTimeout = 100 * time.Millisecond
+	resp = request(t, ctl, Request{Command: "eval", Source: "while (true) {}"})
+	if !strings.Contains(resp.Error, "interrupted") {
+		t.Errorf("Runaway eval not interrupted: %+v", resp)
+	}
+	resp = request(t, ctl, Request{Command: "eval", Source: "answer.n + 1"})
+	if resp.Error != "" || resp.Result != "43" {
+		t.Errorf("Runtime broken by interrupted eval: %+v", resp)
+	}
+	if current.Interrupt != nil {
+		t.Errorf("Interrupt left set")
+	}
+}
+
+func TestControlLogs(t *testing.T) {
+	ctl, dir := testController(t, "")
+	logFile := filepath.Join(dir, "log")
+	lines := []string{}
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	if err := ioutil.WriteFile(logFile, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Look back through the file a little at a time
+	defer func(n int) { tailBlock = n }(tailBlock)
+	tailBlock = 16
+
+	conn := send(t, ctl, Request{Command: "logs", Lines: 3})
+	got, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	if string(got) != "line 97\nline 98\nline 99\n" {
+		t.Errorf("Wrong log tail: %q", got)
+	}
+	conn = send(t, ctl, Request{Command: "logs", Lines: 1000})
+	got, _ = ioutil.ReadAll(conn)
+	conn.Close()
+	if string(got) != strings.Join(lines, "\n")+"\n" {
+		t.Errorf("Whole log not sent: %q", got)
+	}
+
+	// Following sends what is written after
+	conn = send(t, ctl, Request{Command: "logs", Lines: 1, Follow: true})
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if line, _ := r.ReadString('\n'); line != "line 99\n" {
+		t.Errorf("Wrong log tail: %q", line)
+	}
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "line 100")
+	f.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, _ := r.ReadString('\n'); line != "line 100\n" {
+		t.Errorf("Followed line not sent: %q", line)
+	}
+}
+
+func TestTail(t *testing.T) {
+	defer func(n int) { tailBlock = n }(tailBlock)
+	for _, block := range []int{1, 4, 1024} {
+		tailBlock = block
+		for _, c := range []struct {
+			data string
+			n    int
+			want string
+		}{
+			{"a\nb\nc\n", 2, "b\nc\n"},
+			{"a\nb\nc", 2, "b\nc"},
+			{"a\nb\nc\n", 5, "a\nb\nc\n"},
+			{"a\nb\nc\n", 0, ""},
+			{"", 3, ""},
+		} {
+			f, err := ioutil.TempFile("", "mithrastest-tail")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(c.data)
+			f.Seek(0, 0)
+			got, err := tail(f, c.n)
+			pos, _ := f.Seek(0, 1)
+			f.Close()
+			os.Remove(f.Name())
+			if err != nil || string(got) != c.want {
+				t.Errorf("tail(%q, %d) with blocks of %d = %q, %v; want %q", c.data, c.n, block, got, err, c.want)
+			}
+			if pos != int64(len(c.data)) {
+				t.Errorf("tail(%q, %d) left the file at %d", c.data, c.n, pos)
+			}
+		}
+	}
+}
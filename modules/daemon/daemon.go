@@ -22,10 +22,10 @@ import (
 	"syscall"
 
 	"github.com/codegangsta/cli"
-	"github.com/robertkrimen/otto"
 	"github.com/sevlyar/go-daemon"
 
 	"github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/schedule"
 	"github.com/cvillecsteele/mithras/modules/script"
 )
 
@@ -85,6 +85,7 @@ func Run(c *cli.Context, versions []core.ModuleVersion, version string) {
 	Context.PidFileName = c.Parent().String("pidfile")
 	Context.LogFileName = c.Parent().String("logfile")
 	Context.WorkDir = c.Parent().String("workdir")
+	Context.Env = controlEnv(c)
 
 	d, err := cntxt.Reborn()
 	if err != nil {
@@ -95,11 +96,19 @@ func Run(c *cli.Context, versions []core.ModuleVersion, version string) {
 	}
 	defer cntxt.Release()
 
-	rt := script.RunCli(c, versions, version)
+	// Web handlers wait until run() returns
+	current = script.RunCli(c, versions, version)
 
-	daemon.SetSigHandler(makeTermHandler(rt), syscall.SIGQUIT)
-	daemon.SetSigHandler(makeTermHandler(rt), syscall.SIGTERM)
-	daemon.SetSigHandler(makeReloadHandler(rt), syscall.SIGHUP)
+	ctl := serveControl(c.String("file"), version)
+	defer ctl.close()
+
+	// From here on, the runtime is shared by the signal handlers
+	// and scheduled jobs
+	schedule.Start()
+
+	daemon.SetSigHandler(makeTermHandler(), syscall.SIGQUIT)
+	daemon.SetSigHandler(makeTermHandler(), syscall.SIGTERM)
+	daemon.SetSigHandler(makeReloadHandler(c, versions, version), syscall.SIGHUP)
 
 	err = daemon.ServeSignals()
 	if err != nil {
@@ -108,45 +117,36 @@ func Run(c *cli.Context, versions []core.ModuleVersion, version string) {
 }
 
 // Shutdown handlers
-func makeTermHandler(rt *otto.Otto) func(os.Signal) error {
+func makeTermHandler() func(os.Signal) error {
 	return func(sig os.Signal) error {
-		// By convention we require scripts have a set entry point
-		result, err := rt.Call("stop", nil, sig)
-		if err != nil {
-			if ottoErr, ok := err.(*otto.Error); ok {
-				log.Fatalf("JS error calling 'stop' in script: %s", ottoErr.String())
-			}
-			log.Fatalf("Error calling 'stop' in script: %s", err)
-		}
+		// Let running jobs finish before stopping
+		schedule.Stop()
 
-		// If the js function did not return a bool error out because
-		// the script is invalid
-		_, err = result.ToBoolean()
-		if err != nil {
-			log.Fatalf("Error converting 'stop' return value to boolean: %s", err)
-		}
+		core.RuntimeLock.Lock()
+		defer core.RuntimeLock.Unlock()
 
+		// By convention we require scripts have a set entry point
+		if _, err := script.CallEntry(current, "stop", false, sig); err != nil {
+			log.Fatalf("%s", err)
+		}
 		return daemon.ErrStop
 	}
 }
 
-// Relaod
-func makeReloadHandler(rt *otto.Otto) func(os.Signal) error {
+// Reload
+func makeReloadHandler(c *cli.Context, versions []core.ModuleVersion, version string) func(os.Signal) error {
 	return func(sig os.Signal) error {
-		// By convention we require scripts have a set entry point
-		result, err := rt.Call("reload", nil, sig)
-		if err != nil {
-			if ottoErr, ok := err.(*otto.Error); ok {
-				log.Fatalf("JS error calling 'reload' in script: %s", ottoErr.String())
-			}
-			log.Fatalf("Error calling 'reload' in script: %s", err)
+		if c.Bool("reload") {
+			reload(c, versions, version, sig)
+			return nil
 		}
 
-		// If the js function did not return a bool error out because
-		// the script is invalid
-		_, err = result.ToBoolean()
-		if err != nil {
-			log.Fatalf("Error converting 'reload' return value to boolean: %s", err)
+		core.RuntimeLock.Lock()
+		defer core.RuntimeLock.Unlock()
+
+		// By convention we require scripts have a set entry point
+		if _, err := script.CallEntry(current, "reload", false, sig); err != nil {
+			log.Fatalf("%s", err)
 		}
 		return nil
 	}
@@ -0,0 +1,135 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+// With --reload, SIGHUP loads the daemon's script, and what it
+// requires, into a new runtime, and switches over to it:
+//
+//  1. Scheduled jobs are suspended, and the script is loaded into a
+//     staged runtime.  Its top level may schedule jobs and add routes,
+//     which wait until it takes over, but can't start or stop workers
+//     or web servers.  If it can't be loaded, the old one carries on.
+//  2. The old script's handover(), if it has one, is called.  What it
+//     returns is the state handed to the new script.
+//  3. The old script's stop(signal, true) is called.  It should leave
+//     running any workers it wants the new script to take over; they
+//     are found by name.  If it fails, the old script carries on.
+//  4. The new script's takeover(state), if it has one, and run() are
+//     called.
+//  5. If they fail, the new runtime is retired: its jobs are
+//     cancelled, and its routes, workers and web servers stopped.  The
+//     old script's jobs are cancelled, and it is started again the
+//     same way, with takeover(state) and run().
+//  6. Otherwise, the old runtime is retired: its jobs are cancelled,
+//     its routes and web servers stopped, and the workers it left
+//     running are handed over to the new one.
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/robertkrimen/otto"
+
+	"github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/schedule"
+	"github.com/cvillecsteele/mithras/modules/script"
+)
+
+// The runtime of the script the daemon is running.  Used while
+// holding the runtime lock.
+var current *otto.Otto
+
+func reload(c *cli.Context, versions []core.ModuleVersion, version string, sig os.Signal) {
+	file := c.String("file")
+	log.Infof("Reloading '%s'", file)
+	err := swap(func() (*otto.Otto, error) {
+		return script.ReloadCli(c, versions, version)
+	}, sig)
+	if err != nil {
+		log.Errorf("Can't reload '%s'; carrying on with the old script: %s", file, err)
+		return
+	}
+	log.Infof("Reloaded '%s'", file)
+}
+
+// Load a script with load, and switch the daemon over to it.  If that
+// fails, the old script carries on, and the error is returned.
+func swap(load func() (*otto.Otto, error), sig os.Signal) error {
+	// Jobs must not run while the runtime is switched
+	schedule.Suspend()
+	defer schedule.Start()
+
+	core.RuntimeLock.Lock()
+	defer core.RuntimeLock.Unlock()
+
+	rt, err := load()
+	if err != nil {
+		return err
+	}
+
+	old := current
+	state, err := handover(old)
+	if err != nil {
+		core.Retire(rt, nil)
+		return err
+	}
+	if _, err := script.CallEntry(old, "stop", false, sig, true); err != nil {
+		core.Retire(rt, nil)
+		return err
+	}
+
+	core.Unstage(rt)
+	if err := takeover(rt, state); err != nil {
+		core.Retire(rt, nil)
+		schedule.CancelAll(old)
+		if rerr := takeover(old, state); rerr != nil {
+			log.Errorf("Can't restart the old script: %s", rerr)
+		}
+		return fmt.Errorf("Can't start the new script: %s", err)
+	}
+	core.Retire(old, rt)
+	current = rt
+	return nil
+}
+
+// Call the script's handover(), if it has one, returning what it
+// returns as JSON.
+func handover(rt *otto.Otto) (string, error) {
+	if fn, err := rt.Get("handover"); err != nil || !fn.IsFunction() {
+		return "null", nil
+	}
+	js := `(function () { var s = handover(); return s === undefined ? "null" : JSON.stringify(s); })`
+	v, err := rt.Call(js, nil)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// Start a script, calling its takeover(state), if it has one, and its
+// run().
+func takeover(rt *otto.Otto, state string) error {
+	if fn, err := rt.Get("takeover"); err == nil && fn.IsFunction() {
+		if _, err := rt.Call(`(function (s) { takeover(JSON.parse(s)); })`, nil, state); err != nil {
+			return err
+		}
+	}
+	_, err := script.CallEntry(rt, "run", false)
+	return err
+}
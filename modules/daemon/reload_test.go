@@ -0,0 +1,193 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/robertkrimen/otto"
+
+	"github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/schedule"
+	"github.com/cvillecsteele/mithras/modules/script"
+	"github.com/cvillecsteele/mithras/modules/workers"
+)
+
+// The script the daemon runs before reloading.  It hands over how many
+// times it has been run, and leaves one of its workers running for the
+// new script.
+const oldScript = `
+var runs = 0;
+var restored = null;
+function run() {
+    runs++;
+    schedule.every("1h", function() {});
+    workers.pool("testHanded", 1, "function(x) { return x; }");
+    workers.create("testDropped", "function(x) { return x; }");
+    return true;
+}
+function handover() { return {runs: runs}; }
+function takeover(state) { restored = state; }
+function stop(signal, reloading) { return true; }
+`
+
+// Load a script from source, as the daemon does on reload.
+func loader(t *testing.T, js string) (func() (*otto.Otto, error), **otto.Otto) {
+	dir, err := ioutil.TempDir("", "mithrastest-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "daemon.js")
+	if err := ioutil.WriteFile(file, []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var loaded *otto.Otto
+	return func() (*otto.Otto, error) {
+		rt, err := script.StageScriptRuntime(file, "../../js", "", false, nil, nil, "test")
+		loaded = rt
+		return rt, err
+	}, &loaded
+}
+
+// Start the daemon with the old script.
+func startOld(t *testing.T) *otto.Otto {
+	load, _ := loader(t, oldScript)
+	rt, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.Unstage(rt)
+	if _, err := script.CallEntry(rt, "run", false); err != nil {
+		t.Fatal(err)
+	}
+	current = rt
+	schedule.Start()
+	t.Cleanup(func() {
+		core.Retire(current, nil)
+		schedule.Stop()
+	})
+	return rt
+}
+
+func specs() []string {
+	list := []string{}
+	for _, j := range schedule.List() {
+		list = append(list, j.Spec)
+	}
+	return list
+}
+
+func running(name string) bool {
+	for _, s := range workers.Statuses() {
+		if s.Name == name {
+			return s.Running
+		}
+	}
+	return false
+}
+
+func get(t *testing.T, rt *otto.Otto, js string) string {
+	v, err := rt.Run(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.String()
+}
+
+func TestReload(t *testing.T) {
+	old := startOld(t)
+	load, loaded := loader(t, `
+schedule.every("2h", function() {});
+var seen = null;
+function takeover(state) { seen = state.runs; }
+function run() { return true; }
+function stop(signal, reloading) { return true; }
+`)
+	if err := swap(load, syscall.SIGHUP); err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	if current != *loaded || current == old {
+		t.Fatalf("Not switched to the new script")
+	}
+	if core.IsStaged(current) {
+		t.Errorf("New script still staged")
+	}
+	if seen := get(t, current, "seen"); seen != "1" {
+		t.Errorf("State not handed over: %s", seen)
+	}
+	if got := strings.Join(specs(), ","); got != "2h0m0s" {
+		t.Errorf("Old jobs not cancelled, or new ones not kept: %s", got)
+	}
+	if !running("testHanded") {
+		t.Errorf("Worker left running not handed over")
+	}
+	for _, name := range workers.Names() {
+		if name == "testDropped" {
+			t.Errorf("Worker not left running was kept")
+		}
+	}
+}
+
+func TestReloadLoadFailure(t *testing.T) {
+	for js, want := range map[string]string{
+		"function run( {": "Unexpected",
+		`schedule.every("2h", function() {}); throw new Error("broken");`: "broken",
+		`workers.stop("testHanded");`:                                     "loaded for a reload",
+	} {
+		old := startOld(t)
+		load, _ := loader(t, js)
+		if err := swap(load, syscall.SIGHUP); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Reload of %q didn't fail with %q: %v", js, want, err)
+		}
+		if current != old {
+			t.Errorf("Reload of %q didn't carry on with the old script", js)
+		}
+		if got := strings.Join(specs(), ","); got != "1h0m0s" {
+			t.Errorf("Reload of %q changed the jobs: %s", js, got)
+		}
+		if !running("testHanded") || get(t, old, "runs") != "1" {
+			t.Errorf("Reload of %q disturbed the old script", js)
+		}
+		core.Retire(old, nil)
+		schedule.Stop()
+	}
+}
+
+func TestReloadTakeoverFailure(t *testing.T) {
+	old := startOld(t)
+	load, loaded := loader(t, `
+schedule.every("2h", function() {});
+function takeover(state) {}
+function run() {
+    workers.pool("testNew", 1, "function(x) { return x; }");
+    throw new Error("can't start");
+}
+function stop(signal, reloading) { return true; }
+`)
+	err := swap(load, syscall.SIGHUP)
+	if err == nil || !strings.Contains(err.Error(), "can't start") {
+		t.Fatalf("Reload didn't fail: %v", err)
+	}
+	if current != old {
+		t.Fatalf("Not switched back to the old script")
+	}
+	if core.IsStaged(*loaded) {
+		t.Errorf("Failed script left staged")
+	}
+	if runs := get(t, old, "runs"); runs != "2" {
+		t.Errorf("Old script not run again: %s", runs)
+	}
+	if restored := get(t, old, "JSON.stringify(restored)"); restored != `{"runs":1}` {
+		t.Errorf("Old script not given its state: %s", restored)
+	}
+	if got := strings.Join(specs(), ","); got != "1h0m0s" {
+		t.Errorf("Jobs not restored: %s", got)
+	}
+	if running("testNew") {
+		t.Errorf("Worker of the failed script left running")
+	}
+}
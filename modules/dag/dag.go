@@ -0,0 +1,255 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+//
+// # CORE FUNCTIONS: DAG
+//
+
+package dag
+
+// @public
+//
+// This package exports entry points into the JS environment:
+//
+// > * [mithras.dag.run](#run)
+//
+// This API runs a graph of tasks concurrently, starting each task
+// once all of the tasks it depends on have finished.
+//
+// ## MITHRAS.DAG.RUN
+// <a name="run"></a>
+// `mithras.dag.run(graph, task, done);`
+//
+// Run `task` once for every node in `graph`.  The `graph` object
+// has these properties:
+//
+// > * `order`: an array of node names.  When several nodes are ready, they are started in this order.
+// > * `deps`: an object mapping a node name to the names of the nodes it depends on
+// > * `parallelism`: the maximum number of tasks to run at once (default 1)
+//
+// Each task runs on its own goroutine, in its own copy of the JS
+// runtime, made just before the task starts.  The task is called
+// with the node name, and sees the state of the runtime at that
+// moment; changes it makes are lost unless they are returned.
+// Values returned by a task must survive conversion to JSON.
+//
+// As each task finishes, `done` is called in the calling runtime
+// with the node name and the task's return value.  `done` is the
+// place to merge results back.
+//
+// If a task or `done` throws, no more tasks are started.  Tasks
+// already running are allowed to finish, and then `mithras.dag.run`
+// throws.
+//
+// Example:
+//
+// ```
+//
+//  var results = {};
+//  mithras.dag.run({
+//                    order: ["a", "b", "c"]
+//                    deps: {c: ["a", "b"]}
+//                    parallelism: 2
+//                  },
+//                  function(name) { return name.toUpperCase(); },
+//                  function(name, value) { results[name] = value; });
+//
+// ```
+//
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/robertkrimen/otto"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+var Version = "1.0.0"
+var ModuleName = "dag"
+
+// Name of the global holding the task function while runtime copies
+// are made.
+const taskVar = "_mithrasDagTask"
+
+type Graph struct {
+	Order       []string            `json:"order"`
+	Deps        map[string][]string `json:"deps"`
+	Parallelism int                 `json:"parallelism"`
+}
+
+// A Task runs one node of the graph.
+type Task func() (interface{}, error)
+
+type result struct {
+	name  string
+	value interface{}
+	err   error
+}
+
+// Run starts the nodes of g in dependency order, keeping at most
+// g.Parallelism tasks running.  start is called on the caller's
+// goroutine to prepare each node's task, which then runs on its own
+// goroutine.  done is called on the caller's goroutine as each task
+// succeeds.  Once a task or done fails, no more tasks are started,
+// and Run returns the first failure when the running tasks finish.
+func Run(g Graph, start func(name string) Task, done func(name string, value interface{}) error) error {
+	parallelism := g.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	waiting := map[string]int{}
+	for _, n := range g.Order {
+		waiting[n] = 0
+	}
+	dependants := map[string][]string{}
+	for n, deps := range g.Deps {
+		if _, ok := waiting[n]; !ok {
+			return fmt.Errorf("Unknown node '%s'", n)
+		}
+		for _, d := range deps {
+			if _, ok := waiting[d]; !ok {
+				return fmt.Errorf("Node '%s' depends on unknown node '%s'", n, d)
+			}
+			waiting[n]++
+			dependants[d] = append(dependants[d], n)
+		}
+	}
+
+	// Buffered so that tasks never block if we stop early
+	results := make(chan result, len(g.Order))
+	started := map[string]bool{}
+	running := 0
+	finished := 0
+	var failure error
+
+	for finished < len(g.Order) {
+		if failure == nil {
+			for _, n := range g.Order {
+				if running >= parallelism {
+					break
+				}
+				if started[n] || waiting[n] > 0 {
+					continue
+				}
+				started[n] = true
+				running++
+				task := start(n)
+				go func(name string) {
+					value, err := task()
+					results <- result{name: name, value: value, err: err}
+				}(n)
+			}
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		finished++
+		if r.err != nil {
+			if failure == nil {
+				failure = fmt.Errorf("Task '%s' failed: %s", r.name, r.err)
+			}
+			continue
+		}
+		if err := done(r.name, r.value); err != nil {
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		for _, d := range dependants[r.name] {
+			waiting[d]--
+		}
+	}
+
+	if failure != nil {
+		return failure
+	}
+	if finished < len(g.Order) {
+		return fmt.Errorf("Dependency cycle among %d unfinished nodes", len(g.Order)-finished)
+	}
+	return nil
+}
+
+func init() {
+	mcore.RegisterInit(func(context *mcore.Context) {
+		rt := context.Runtime
+
+		if a, err := rt.Get("mithras"); err != nil || a.IsUndefined() {
+			rt.Object(`mithras = {}`)
+		}
+		o1, _ := rt.Object(`mithras.dag = {}`)
+
+		o1.Set("run", context.Guard(func(call otto.FunctionCall) otto.Value {
+			js := `(function (o) { return JSON.stringify(o); })`
+			s, err := rt.Call(js, nil, call.Argument(0))
+			if err != nil {
+				context.Throwf("Can't create json for dag graph: %s", err)
+			}
+			var g Graph
+			if err := json.Unmarshal([]byte(s.String()), &g); err != nil {
+				context.Throwf("Can't unmarshall dag graph: %s", err)
+			}
+
+			task := call.Argument(1)
+			if !task.IsFunction() {
+				context.Throwf("Dag task is not a function")
+			}
+			done := call.Argument(2)
+
+			// Copies of the runtime find the task here
+			rt.Set(taskVar, task)
+			defer rt.Run(`delete ` + taskVar)
+
+			start := func(name string) Task {
+				taskRT := context.Copy()
+
+				// Hide worker functions from tasks (thread protection)
+				taskRT.Set("workers", otto.NullValue())
+
+				fn, _ := taskRT.Get(taskVar)
+				return func() (interface{}, error) {
+					v, err := fn.Call(otto.NullValue(), name)
+					if err != nil {
+						return nil, err
+					}
+					return v.Export()
+				}
+			}
+			finish := func(name string, value interface{}) error {
+				if !done.IsFunction() {
+					return nil
+				}
+				if _, err := done.Call(otto.NullValue(), name, mcore.Sanitize(rt, value)); err != nil {
+					return fmt.Errorf("Error in dag done callback for '%s': %s", name, err)
+				}
+				return nil
+			}
+
+			if err := Run(g, start, finish); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+	})
+}
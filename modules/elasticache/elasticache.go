@@ -167,12 +167,10 @@ package elasticache
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elasticache"
 	"github.com/robertkrimen/otto"
 
@@ -183,8 +181,7 @@ var Version = "1.0.0"
 var ModuleName = "elasticache"
 
 func describe(region string, id string) *elasticache.CacheCluster {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	in := elasticache.DescribeCacheClustersInput{
 		CacheClusterId:    aws.String(id),
@@ -199,7 +196,7 @@ func describe(region string, id string) *elasticache.CacheCluster {
 				return nil
 			}
 		}
-		log.Fatalf("Error describing cache: %s", err)
+		mcore.Failf("Error describing cache: %s", err)
 	}
 
 	if resp != nil && len(resp.CacheClusters) > 0 {
@@ -209,8 +206,7 @@ func describe(region string, id string) *elasticache.CacheCluster {
 }
 
 func describeSubnetGroup(region string, id string) *elasticache.CacheSubnetGroup {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	params := &elasticache.DescribeCacheSubnetGroupsInput{
 		CacheSubnetGroupName: aws.String(id),
@@ -223,7 +219,7 @@ func describeSubnetGroup(region string, id string) *elasticache.CacheSubnetGroup
 				return nil
 			}
 		}
-		log.Fatalf("Error describing subnet group: %s", err)
+		mcore.Failf("Error describing subnet group: %s", err)
 	}
 
 	if len(resp.CacheSubnetGroups) > 0 {
@@ -233,13 +229,12 @@ func describeSubnetGroup(region string, id string) *elasticache.CacheSubnetGroup
 }
 
 func createSubnetGroup(region string, params *elasticache.CreateCacheSubnetGroupInput, verbose bool) *elasticache.CacheSubnetGroup {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	resp, err := svc.CreateCacheSubnetGroup(params)
 
 	if err != nil {
-		log.Fatalf("Error creating Cache Subnet Group '%s': %s",
+		mcore.Failf("Error creating Cache Subnet Group '%s': %s",
 			*params.CacheSubnetGroupName,
 			err)
 	}
@@ -256,19 +251,18 @@ func createSubnetGroup(region string, params *elasticache.CreateCacheSubnetGroup
 	}
 
 	if !avail {
-		log.Fatalf("Error creating Cache Subnet Group '%s'", *params.CacheSubnetGroupName)
+		mcore.Failf("Error creating Cache Subnet Group '%s'", *params.CacheSubnetGroupName)
 	}
 
 	return resp.CacheSubnetGroup
 }
 
 func create(region string, params *elasticache.CreateCacheClusterInput, wait bool, verbose bool) *elasticache.CacheCluster {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	resp, err := svc.CreateCacheCluster(params)
 	if err != nil {
-		log.Fatalf("Error creating Cache '%s': %s",
+		mcore.Failf("Error creating Cache '%s': %s",
 			*params.CacheClusterId,
 			err)
 	}
@@ -289,7 +283,7 @@ func create(region string, params *elasticache.CreateCacheClusterInput, wait boo
 		}
 
 		if !avail {
-			log.Fatalf("Error creating Cache Instance '%s'", id)
+			mcore.Failf("Error creating Cache Instance '%s'", id)
 		}
 	}
 
@@ -300,8 +294,7 @@ func create(region string, params *elasticache.CreateCacheClusterInput, wait boo
 }
 
 func deleteSubnetGroup(region string, id string, verbose bool) {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	params := &elasticache.DeleteCacheSubnetGroupInput{
 		CacheSubnetGroupName: aws.String(id),
@@ -309,20 +302,19 @@ func deleteSubnetGroup(region string, id string, verbose bool) {
 	_, err := svc.DeleteCacheSubnetGroup(params)
 
 	if err != nil {
-		log.Fatalf("Error deleting subnet group: %s", err)
+		mcore.Failf("Error deleting subnet group: %s", err)
 	}
 
 	// TODO: Wait for it.
 }
 
 func delete(region string, params *elasticache.DeleteCacheClusterInput, verbose bool) {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	_, err := svc.DeleteCacheCluster(params)
 
 	if err != nil {
-		log.Fatal("Error deleting cache: %s", err)
+		mcore.Failf("Error deleting cache: %s", err)
 	}
 
 	// Wait for it.
@@ -340,17 +332,16 @@ func delete(region string, params *elasticache.DeleteCacheClusterInput, verbose
 	}
 
 	if avail {
-		log.Fatalf("Error deleting cache '%s'", *params.CacheClusterId)
+		mcore.Failf("Error deleting cache '%s'", *params.CacheClusterId)
 	}
 }
 
-func scan(rt *otto.Otto, region string) otto.Value {
-	svc := elasticache.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scan(region string) []elasticache.CacheCluster {
+	svc := elasticache.New(mcore.Session(elasticache.ServiceName, region))
 
 	resp, err := svc.DescribeCacheClusters(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing cache clusters: %s", err)
 	}
 
 	caches := []elasticache.CacheCluster{}
@@ -358,10 +349,14 @@ func scan(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.CacheClusters {
 		caches = append(caches, *i)
 	}
-	return mcore.Sanitize(rt, caches)
+	return caches
 }
 
 func init() {
+	mcore.RegisterScanner("caches", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -383,49 +378,53 @@ func init() {
 			o2 = v.Object()
 		}
 
-		o1.Set("scan", func(region string) otto.Value {
-			return scan(rt, region)
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scan(region))
+		}))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describe(region, id))
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.elasticache.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input elasticache.CreateCacheClusterInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticache create input: %s", err)
+				context.Throwf("Can't create json for elasticache create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticache create json: %s", err)
+				context.Throwf("Can't unmarshall elasticache create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			wait, err := call.Argument(2).ToBoolean()
 			if err != nil {
-				log.Fatalf("Invalid gateway arg to elasticache create: %s", err)
+				context.Throwf("Invalid gateway arg to elasticache create: %s", err)
 			}
 			verbose := mcore.IsVerbose(rt)
 
 			f := mcore.Sanitizer(rt)
 			return f(create(region, &input, wait, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"CacheClusterStatus": "creating",
+			})
+		}))))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.elasticache.delete", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input elasticache.DeleteCacheClusterInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticache delete input: %s", err)
+				context.Throwf("Can't create json for elasticache delete input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticache delete json: %s", err)
+				context.Throwf("Can't unmarshall elasticache delete json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -433,25 +432,25 @@ func init() {
 
 			delete(region, &input, verbose)
 			return otto.Value{}
-		})
+		})))
 
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeSubnetGroup(region, id))
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.elasticache.subnetGroups.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input elasticache.CreateCacheSubnetGroupInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for elasticache subnet group create input: %s", err)
+				context.Throwf("Can't create json for elasticache subnet group create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall elasticache subnet group create json: %s", err)
+				context.Throwf("Can't unmarshall elasticache subnet group create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -459,13 +458,15 @@ func init() {
 
 			f := mcore.Sanitizer(rt)
 			return f(createSubnetGroup(region, &input, verbose))
-		})
-		o2.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.elasticache.subnetGroups.delete", func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			verbose := mcore.IsVerbose(rt)
 			deleteSubnetGroup(region, id, verbose)
 			return otto.Value{}
-		})
+		})))
 	})
 }
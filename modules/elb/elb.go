@@ -439,12 +439,11 @@ package elb
 //
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
 	"github.com/robertkrimen/otto"
 
@@ -455,28 +454,25 @@ var Version = "1.0.0"
 var ModuleName = "elb"
 
 func setHealth(region string, lbName string, input elb.ConfigureHealthCheckInput, verbose bool) {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	_, err := svc.ConfigureHealthCheck(&input)
 	if err != nil {
-		log.Fatalf("Can't configure elb health check: %s", err)
+		mcore.Failf("Can't configure elb health check: %s", err)
 	}
 }
 
 func setAttrs(region string, lbName string, input elb.ModifyLoadBalancerAttributesInput, verbose bool) {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	_, err := svc.ModifyLoadBalancerAttributes(&input)
 	if err != nil {
-		log.Fatalf("Can't set elb attributes: %s", err)
+		mcore.Failf("Can't set elb attributes: %s", err)
 	}
 }
 
 func describe(region string, id string) *elb.LoadBalancerDescription {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	params := &elb.DescribeLoadBalancersInput{
 		LoadBalancerNames: []*string{
@@ -491,19 +487,18 @@ func describe(region string, id string) *elb.LoadBalancerDescription {
 				return nil
 			}
 		}
-		log.Fatalf("Error describing elb: %s", err)
+		mcore.Failf("Error describing elb: %s", err)
 	}
 
 	return resp.LoadBalancerDescriptions[0]
 }
 
 func create(region string, params *elb.CreateLoadBalancerInput, verbose bool) *elb.LoadBalancerDescription {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	_, err := svc.CreateLoadBalancer(params)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 	id := *params.LoadBalancerName
 
@@ -521,8 +516,7 @@ func create(region string, params *elb.CreateLoadBalancerInput, verbose bool) *e
 }
 
 func delete(region string, id string, verbose bool) {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	i := &elb.DeleteLoadBalancerInput{
 		LoadBalancerName: aws.String(id),
@@ -530,7 +524,7 @@ func delete(region string, id string, verbose bool) {
 	_, err := svc.DeleteLoadBalancer(i)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -542,12 +536,11 @@ func delete(region string, id string, verbose bool) {
 		time.Sleep(time.Second * 10)
 	}
 
-	log.Fatal("Timeout waiting for elb deletion.")
+	mcore.Failf("Timeout waiting for elb deletion.")
 }
 
 func register(region string, lbName string, instances []*elb.Instance, verbose bool) {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	params := &elb.RegisterInstancesWithLoadBalancerInput{
 		Instances:        instances,
@@ -555,13 +548,12 @@ func register(region string, lbName string, instances []*elb.Instance, verbose b
 	}
 
 	if _, err := svc.RegisterInstancesWithLoadBalancer(params); err != nil {
-		log.Fatalf("Error adding instances to elb '%s': %s", lbName, err)
+		mcore.Failf("Error adding instances to elb '%s': %s", lbName, err)
 	}
 }
 
 func deRegister(region string, lbName string, instances []*elb.Instance, verbose bool) {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	params := &elb.DeregisterInstancesFromLoadBalancerInput{
 		Instances:        instances,
@@ -569,17 +561,16 @@ func deRegister(region string, lbName string, instances []*elb.Instance, verbose
 	}
 
 	if _, err := svc.DeregisterInstancesFromLoadBalancer(params); err != nil {
-		log.Fatalf("Error removing instances from elb '%s': %s", lbName, err)
+		mcore.Failf("Error removing instances from elb '%s': %s", lbName, err)
 	}
 }
 
-func scan(rt *otto.Otto, region string) otto.Value {
-	svc := elb.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scan(region string) []elb.LoadBalancerDescription {
+	svc := elb.New(mcore.Session(elb.ServiceName, region))
 
 	resp, err := svc.DescribeLoadBalancers(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing load balancers: %s", err)
 	}
 
 	// shove instances into jsland
@@ -587,10 +578,14 @@ func scan(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.LoadBalancerDescriptions {
 		lbs = append(lbs, *i)
 	}
-	return mcore.Sanitize(rt, lbs)
+	return lbs
 }
 
 func init() {
+	mcore.RegisterScanner("elbs", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -598,20 +593,20 @@ func init() {
 			rt.Object(`aws = {}`)
 		}
 		o1, _ := rt.Object(`aws.elbs = {}`)
-		o1.Set("scan", func(region string) otto.Value {
-			return scan(rt, region)
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scan(region))
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.elbs.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input elb.CreateLoadBalancerInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for ELB create input: %s", err)
+				context.Throwf("Can't create json for ELB create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall ELB create json: %s", err)
+				context.Throwf("Can't unmarshall ELB create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -619,31 +614,36 @@ func init() {
 
 			f := mcore.Sanitizer(rt)
 			return f(create(region, &input, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			params := mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+			return mcore.Placeholder(params, map[string]interface{}{
+				"DNSName": fmt.Sprintf("%v-planned.%v.elb.amazonaws.com", params["LoadBalancerName"], mcore.PlannedArg(args, 0)),
+			})
+		}))))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.elbs.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			delete(region, id, verbose)
 			return otto.Value{}
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			return f(describe(region, id))
-		})
-		o1.Set("register", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("register", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.elbs.register", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input []*elb.Instance
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(2))
 			if err != nil {
-				log.Fatalf("Can't create json for ELB register input: %s", err)
+				context.Throwf("Can't create json for ELB register input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall ELB register json: %s", err)
+				context.Throwf("Can't unmarshall ELB register json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -651,18 +651,18 @@ func init() {
 			verbose := mcore.IsVerbose(rt)
 			register(region, lbName, input, verbose)
 			return otto.Value{}
-		})
-		o1.Set("deRegister", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("deRegister", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.elbs.deRegister", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input []*elb.Instance
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(2))
 			if err != nil {
-				log.Fatalf("Can't create json for ELB deregister input: %s", err)
+				context.Throwf("Can't create json for ELB deregister input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall ELB deregister json: %s", err)
+				context.Throwf("Can't unmarshall ELB deregister json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -670,42 +670,42 @@ func init() {
 			verbose := mcore.IsVerbose(rt)
 			deRegister(region, lbName, input, verbose)
 			return otto.Value{}
-		})
-		o1.Set("setHealth", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("setHealth", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.elbs.setHealth", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input elb.ConfigureHealthCheckInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(2))
 			if err != nil {
-				log.Fatalf("Can't create json for ELB setHealth input: %s", err)
+				context.Throwf("Can't create json for ELB setHealth input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall ELB setHealth json: %s", err)
+				context.Throwf("Can't unmarshall ELB setHealth json: %s", err)
 			}
 			region := call.Argument(0).String()
 			lbName := call.Argument(1).String()
 			verbose := mcore.IsVerbose(rt)
 			setHealth(region, lbName, input, verbose)
 			return otto.Value{}
-		})
-		o1.Set("setAttrs", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("setAttrs", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.elbs.setAttrs", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input elb.ModifyLoadBalancerAttributesInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(2))
 			if err != nil {
-				log.Fatalf("Can't create json for ELB setAttrs input: %s", err)
+				context.Throwf("Can't create json for ELB setAttrs input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall ELB setAttrs json: %s", err)
+				context.Throwf("Can't unmarshall ELB setAttrs json: %s", err)
 			}
 			region := call.Argument(0).String()
 			lbName := call.Argument(1).String()
 			verbose := mcore.IsVerbose(rt)
 			setAttrs(region, lbName, input, verbose)
 			return otto.Value{}
-		})
+		})))
 	})
 }
@@ -104,7 +104,7 @@ func init() {
 		rt := context.Runtime
 
 		obj, _ := rt.Object(`exec = {}`)
-		obj.Set("run", func(call otto.FunctionCall) otto.Value {
+		obj.Set("run", context.Guard(func(call otto.FunctionCall) otto.Value {
 			cmd := call.Argument(0).String()
 			var input string
 			if !call.Argument(1).IsUndefined() && !call.Argument(1).IsNull() {
@@ -117,6 +117,6 @@ func init() {
 			}
 			f := core.Sanitizer(rt)
 			return f(Run(cmd, &input, &env))
-		})
+		}))
 	})
 }
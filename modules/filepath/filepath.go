@@ -263,7 +263,6 @@ package filepath
 //
 import (
 	"errors"
-	log "github.com/Sirupsen/logrus"
 	"os"
 	"path/filepath"
 	"time"
@@ -325,7 +324,7 @@ func init() {
 		rt := context.Runtime
 
 		obj, _ := rt.Object(`filepath = {}`)
-		obj.Set("walk", func(call otto.FunctionCall) otto.Value {
+		obj.Set("walk", context.Guard(func(call otto.FunctionCall) otto.Value {
 			cb := call.Argument(1)
 			f := core.Sanitizer(rt)
 			filepath.Walk(call.Argument(0).String(),
@@ -353,7 +352,7 @@ func init() {
 					}
 					result, oops := cb.Call(otto.Value{}, path, f(i), f(err))
 					if oops != nil {
-						log.Fatalf("Error in walk callback: %s", oops)
+						context.Throwf("Error in walk callback: %s", oops)
 					}
 					if result.IsUndefined() {
 						return nil
@@ -362,20 +361,19 @@ func init() {
 					} else {
 						return errors.New(result.String())
 					}
-					return nil
 				})
 			return otto.Value{}
-		})
-		obj.Set("abs", abs)
-		obj.Set("clean", clean)
-		obj.Set("rel", rel)
-		obj.Set("splitList", splitList)
-		obj.Set("split", split)
-		obj.Set("match", match)
-		obj.Set("glob", glob)
-		obj.Set("ext", ext)
-		obj.Set("dir", dir)
-		obj.Set("base", base)
-		obj.Set("join", join)
+		}))
+		obj.Set("abs", context.Guard(abs))
+		obj.Set("clean", context.Guard(clean))
+		obj.Set("rel", context.Guard(rel))
+		obj.Set("splitList", context.Guard(splitList))
+		obj.Set("split", context.Guard(split))
+		obj.Set("match", context.Guard(match))
+		obj.Set("glob", context.Guard(glob))
+		obj.Set("ext", context.Guard(ext))
+		obj.Set("dir", context.Guard(dir))
+		obj.Set("base", context.Guard(base))
+		obj.Set("join", context.Guard(join))
 	})
 }
@@ -546,45 +546,45 @@ func init() {
 		rt := context.Runtime
 
 		fsObj, _ := rt.Object(`fs = {}`)
-		fsObj.Set("tempDir", os.TempDir)
-		fsObj.Set("chtimes", func(call otto.FunctionCall) otto.Value {
+		fsObj.Set("tempDir", context.Guard(os.TempDir))
+		fsObj.Set("chtimes", context.Guard(func(call otto.FunctionCall) otto.Value {
 			result := chtimes(call.Argument(0).String())
 			return mcore.Sanitize(rt, result)
-		})
-		fsObj.Set("link", func(call otto.FunctionCall) otto.Value {
+		}))
+		fsObj.Set("link", context.Guard(func(call otto.FunctionCall) otto.Value {
 			result := link(call.Argument(0).String(), call.Argument(1).String())
 			return mcore.Sanitize(rt, result)
-		})
-		fsObj.Set("symlink", func(call otto.FunctionCall) otto.Value {
+		}))
+		fsObj.Set("symlink", context.Guard(func(call otto.FunctionCall) otto.Value {
 			result := symlink(call.Argument(0).String(), call.Argument(1).String())
 			return mcore.Sanitize(rt, result)
-		})
-		fsObj.Set("create", func(path string) (otto.Value, otto.Value) {
+		}))
+		fsObj.Set("create", context.Guard(func(path string) (otto.Value, otto.Value) {
 			f := mcore.Sanitizer(rt)
 			x, err := create(path)
 			val, err := rt.ToValue(x)
 			return val, f(err)
-		})
-		fsObj.Set("close", func(call otto.FunctionCall) otto.Value {
+		}))
+		fsObj.Set("close", context.Guard(func(call otto.FunctionCall) otto.Value {
 			val, _ := call.Argument(0).Export()
 			fp := val.(*os.File)
 			x := mcore.Sanitizer(rt)
 			return x(close(fp))
-		})
-		fsObj.Set("read", func(fileName string) otto.Value {
+		}))
+		fsObj.Set("read", context.Guard(func(fileName string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(read(fileName))
-		})
-		fsObj.Set("bread", bread)
-		fsObj.Set("write", func(fileName, data string, perm uint64) otto.Value {
+		}))
+		fsObj.Set("bread", context.Guard(bread))
+		fsObj.Set("write", context.Guard(func(fileName, data string, perm uint64) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(write(fileName, data, perm))
-		})
-		fsObj.Set("copy", copy)
-		fsObj.Set("chdir", chdir)
-		fsObj.Set("getwd", getwd)
-		fsObj.Set("mkdir", mkdir)
-		fsObj.Set("mkdirAll", func(call otto.FunctionCall) otto.Value {
+		}))
+		fsObj.Set("copy", context.Guard(copy))
+		fsObj.Set("chdir", context.Guard(chdir))
+		fsObj.Set("getwd", context.Guard(getwd))
+		fsObj.Set("mkdir", context.Guard(mkdir))
+		fsObj.Set("mkdirAll", context.Guard(func(call otto.FunctionCall) otto.Value {
 			if call.Argument(1).IsUndefined() {
 				context.Throwf("Invalid mode argument to 'mkdirAll'")
 			}
@@ -594,19 +594,19 @@ func init() {
 			}
 			result := mkdirAll(call.Argument(0).String(), uint64(mode))
 			return mcore.Sanitize(rt, result)
-		})
-		fsObj.Set("remove", remove)
-		fsObj.Set("removeAll", func(path string) otto.Value {
+		}))
+		fsObj.Set("remove", context.Guard(remove))
+		fsObj.Set("removeAll", context.Guard(func(path string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(removeAll(path))
-		})
-		fsObj.Set("rename", rename)
-		fsObj.Set("chown", chown)
-		fsObj.Set("lChown", lChown)
-		fsObj.Set("chmod", chmod)
-		fsObj.Set("dir", dir)
-		fsObj.Set("stat", func(name string) otto.Value {
+		}))
+		fsObj.Set("rename", context.Guard(rename))
+		fsObj.Set("chown", context.Guard(chown))
+		fsObj.Set("lChown", context.Guard(lChown))
+		fsObj.Set("chmod", context.Guard(chmod))
+		fsObj.Set("dir", context.Guard(dir))
+		fsObj.Set("stat", context.Guard(func(name string) otto.Value {
 			return stat(rt, name)
-		})
+		}))
 	})
 }
@@ -257,11 +257,10 @@ package iam
 //
 
 import (
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/robertkrimen/otto"
 
@@ -272,7 +271,7 @@ var Version = "1.0.0"
 var ModuleName = "iam"
 
 func createProfile(region string, name string, verbose bool) *iam.InstanceProfile {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.CreateInstanceProfileInput{
 		InstanceProfileName: aws.String(name),
@@ -280,7 +279,7 @@ func createProfile(region string, name string, verbose bool) *iam.InstanceProfil
 
 	resp, err := svc.CreateInstanceProfile(params)
 	if err != nil {
-		log.Fatalf("Error creating iam instance profile: %s", err)
+		mcore.Failf("Error creating iam instance profile: %s", err)
 	}
 	id := *resp.InstanceProfile.InstanceProfileId
 
@@ -297,7 +296,7 @@ func createProfile(region string, name string, verbose bool) *iam.InstanceProfil
 }
 
 func deleteProfile(region string, id string, verbose bool) {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.DeleteInstanceProfileInput{
 		InstanceProfileName: aws.String(id),
@@ -305,13 +304,13 @@ func deleteProfile(region string, id string, verbose bool) {
 	_, err := svc.DeleteInstanceProfile(params)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 }
 
 func describeProfile(region string, id string) *iam.InstanceProfile {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.GetInstanceProfileInput{
 		InstanceProfileName: aws.String(id),
@@ -319,27 +318,32 @@ func describeProfile(region string, id string) *iam.InstanceProfile {
 	resp, err := svc.GetInstanceProfile(params)
 
 	if err != nil {
-		return nil
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "NoSuchEntity" == awsErr.Code() {
+				return nil
+			}
+		}
+		mcore.Failf("Error describing IAM instance profile: %s", err)
 	}
 
 	return resp.InstanceProfile
 }
 
 func scanProfiles(region string) []*iam.InstanceProfile {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.ListInstanceProfilesInput{}
 	resp, err := svc.ListInstanceProfiles(params)
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error listing instance profiles: %s", err)
 	}
 
 	return resp.InstanceProfiles
 }
 
 func createRole(region string, name string, trustPolicy string, verbose bool) *iam.Role {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.CreateRoleInput{
 		AssumeRolePolicyDocument: aws.String(trustPolicy),
@@ -349,7 +353,7 @@ func createRole(region string, name string, trustPolicy string, verbose bool) *i
 
 	resp, err := svc.CreateRole(params)
 	if err != nil {
-		log.Fatalf("Error creating IAM role: %s", err)
+		mcore.Failf("Error creating IAM role: %s", err)
 	}
 	id := *resp.Role.RoleId
 
@@ -366,7 +370,7 @@ func createRole(region string, name string, trustPolicy string, verbose bool) *i
 }
 
 func deleteRole(region string, id string, verbose bool) {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.DeleteRoleInput{
 		RoleName: aws.String(id),
@@ -374,13 +378,13 @@ func deleteRole(region string, id string, verbose bool) {
 	_, err := svc.DeleteRole(params)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 }
 
 func describeRole(region string, id string) *iam.Role {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.GetRoleInput{
 		RoleName: aws.String(id),
@@ -388,27 +392,32 @@ func describeRole(region string, id string) *iam.Role {
 	resp, err := svc.GetRole(params)
 
 	if err != nil {
-		return nil
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "NoSuchEntity" == awsErr.Code() {
+				return nil
+			}
+		}
+		mcore.Failf("Error describing IAM role: %s", err)
 	}
 
 	return resp.Role
 }
 
 func scanRoles(region string) []*iam.Role {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.ListRolesInput{}
 	resp, err := svc.ListRoles(params)
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error listing roles: %s", err)
 	}
 
 	return resp.Roles
 }
 
 func putRolePolicy(region string, roleName string, policyName string, policy string) {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.PutRolePolicyInput{
 		PolicyDocument: aws.String(policy),
@@ -418,13 +427,13 @@ func putRolePolicy(region string, roleName string, policyName string, policy str
 	_, err := svc.PutRolePolicy(params)
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error putting role policy: %s", err)
 	}
 
 }
 
 func deleteRolePolicy(region string, roleName string, policyName string) {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.DeleteRolePolicyInput{
 		PolicyName: aws.String(policyName),
@@ -433,13 +442,13 @@ func deleteRolePolicy(region string, roleName string, policyName string) {
 	_, err := svc.DeleteRolePolicy(params)
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error deleting role policy: %s", err)
 	}
 
 }
 
 func addRoleToProfile(region string, profileName string, roleName string) {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.AddRoleToInstanceProfileInput{
 		InstanceProfileName: aws.String(profileName),
@@ -448,12 +457,12 @@ func addRoleToProfile(region string, profileName string, roleName string) {
 	_, err := svc.AddRoleToInstanceProfile(params)
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error adding role to instance profile: %s", err)
 	}
 }
 
 func removeRoleFromProfile(region string, profileName string, roleName string) {
-	svc := iam.New(session.New(), aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := iam.New(mcore.Session(iam.ServiceName, region))
 
 	params := &iam.RemoveRoleFromInstanceProfileInput{
 		InstanceProfileName: aws.String(profileName),
@@ -462,11 +471,18 @@ func removeRoleFromProfile(region string, profileName string, roleName string) {
 	_, err := svc.RemoveRoleFromInstanceProfile(params)
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error removing role from instance profile: %s", err)
 	}
 }
 
 func init() {
+	mcore.RegisterScanner("iamProfiles", func(region string) interface{} {
+		return scanProfiles(region)
+	})
+	mcore.RegisterScanner("iamRoles", func(region string) interface{} {
+		return scanRoles(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -491,24 +507,30 @@ func init() {
 		} else {
 			o2 = b.Object()
 		}
-		o2.Set("scan", func(region string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanProfiles(region))
-		})
-		o2.Set("delete", func(region, name string) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.iam.profiles.delete", func(region, name string) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			deleteProfile(region, name, verbose)
 			return otto.Value{}
-		})
-		o2.Set("create", func(region, name string) otto.Value {
+		})))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.iam.profiles.create", func(region, name string) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			f := mcore.Sanitizer(rt)
 			return f(createProfile(region, name, verbose))
-		})
-		o2.Set("describe", func(region, id string) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return map[string]interface{}{
+				"InstanceProfileName": mcore.PlannedArg(args, 1),
+				"InstanceProfileId":   mcore.Plan.ID("profile"),
+				"Roles":               []interface{}{},
+			}
+		}))))
+		o2.Set("describe", context.Guard(func(region, id string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeProfile(region, id))
-		})
+		}))
 
 		var o3 *otto.Object
 		if b, err := o1.Get("roles"); err != nil || b.IsUndefined() {
@@ -516,40 +538,46 @@ func init() {
 		} else {
 			o3 = b.Object()
 		}
-		o3.Set("scan", func(region string) otto.Value {
+		o3.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanRoles(region))
-		})
-		o3.Set("delete", func(region, id string) otto.Value {
+		}))
+		o3.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.iam.roles.delete", func(region, id string) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			deleteRole(region, id, verbose)
 			return otto.Value{}
-		})
-		o3.Set("create", func(region, name, trust string) otto.Value {
+		})))
+		o3.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.iam.roles.create", func(region, name, trust string) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			f := mcore.Sanitizer(rt)
 			return f(createRole(region, name, trust, verbose))
-		})
-		o3.Set("describe", func(region, name string) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return map[string]interface{}{
+				"RoleName":                 mcore.PlannedArg(args, 1),
+				"RoleId":                   mcore.Plan.ID("role"),
+				"AssumeRolePolicyDocument": mcore.PlannedArg(args, 2),
+			}
+		}))))
+		o3.Set("describe", context.Guard(func(region, name string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describeRole(region, name))
-		})
-		o3.Set("putRolePolicy", func(region, roleName string, policyName string, policy string) otto.Value {
+		}))
+		o3.Set("putRolePolicy", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.iam.roles.putRolePolicy", func(region, roleName string, policyName string, policy string) otto.Value {
 			putRolePolicy(region, roleName, policyName, policy)
 			return otto.Value{}
-		})
-		o3.Set("deleteRolePolicy", func(region, roleName string, policyName string) otto.Value {
+		})))
+		o3.Set("deleteRolePolicy", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.iam.roles.deleteRolePolicy", func(region, roleName string, policyName string) otto.Value {
 			deleteRolePolicy(region, roleName, policyName)
 			return otto.Value{}
-		})
-		o3.Set("addRoleToProfile", func(region, profileName string, roleName string) otto.Value {
+		})))
+		o3.Set("addRoleToProfile", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.iam.roles.addRoleToProfile", func(region, profileName string, roleName string) otto.Value {
 			addRoleToProfile(region, profileName, roleName)
 			return otto.Value{}
-		})
-		o3.Set("removeRoleFromProfile", func(region, profileName string, roleName string) otto.Value {
+		})))
+		o3.Set("removeRoleFromProfile", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.iam.roles.removeRoleFromProfile", func(region, profileName string, roleName string) otto.Value {
 			removeRoleFromProfile(region, profileName, roleName)
 			return otto.Value{}
-		})
+		})))
 		o3.Set("asgTrustPolicy", `{
       "Version": "2012-10-17",
       "Statement": [
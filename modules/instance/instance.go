@@ -31,6 +31,8 @@ package instance
 // > * [aws.instances.create](#create)
 // > * [aws.instances.delete](#delete)
 // > * [aws.instances.describe](#describe)
+// > * [aws.instances.consoleOutput](#consoleOutput)
+// > * [aws.instances.hostKeys](#hostKeys)
 //
 // This API allows resource handlers to manage EC2 instances.
 //
@@ -116,14 +118,50 @@ package instance
 //
 // ```
 //
+// ## AWS.INSTANCES.CONSOLEOUTPUT
+// <a name="consoleOutput"></a>
+// `aws.instances.consoleOutput(region, inst_id);`
+//
+// Get the console output of an instance, as a string.  It is empty
+// until the instance has been running for a few minutes.
+//
+// Example:
+//
+// ```
+//
+//  var out = aws.instances.consoleOutput("us-east-1", "i-abcd");
+//
+// ```
+//
+// ## AWS.INSTANCES.HOSTKEYS
+// <a name="hostKeys"></a>
+// `aws.instances.hostKeys(region, inst_id);`
+//
+// Get the SSH host keys an instance printed to its console when it
+// first booted.  Returns an object with `keys`, an array of public
+// keys, and `fingerprints`, an array of their fingerprints.  Either
+// may be empty, eg. if the console output isn't available yet.  The
+// result is suitable for `mithras.remote.hostKeys.seed`.
+//
+// Example:
+//
+// ```
+//
+//  var known = aws.instances.hostKeys("us-east-1", "i-abcd");
+//  mithras.remote.hostKeys.seed(instance.PublicIpAddress, known);
+//
+// ```
+//
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -134,8 +172,7 @@ var Version = "1.0.0"
 var ModuleName = "instance"
 
 func describe(region string, id string) *ec2.Instance {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{
@@ -145,7 +182,12 @@ func describe(region string, id string) *ec2.Instance {
 	resp, err := svc.DescribeInstances(params)
 
 	if err != nil {
-		return nil
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "InvalidInstanceID.NotFound" == awsErr.Code() {
+				return nil
+			}
+		}
+		mcore.Failf("Error describing instance: %s", err)
 	}
 	if len(resp.Reservations) > 0 && len(resp.Reservations[0].Instances) > 0 {
 		return resp.Reservations[0].Instances[0]
@@ -153,16 +195,70 @@ func describe(region string, id string) *ec2.Instance {
 	return nil
 }
 
+func consoleOutput(region string, id string) string {
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
+
+	params := &ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(id),
+	}
+	resp, err := svc.GetConsoleOutput(params)
+	if err != nil {
+		mcore.Failf("Error getting console output of '%s': %s", id, err)
+	}
+	if resp.Output == nil {
+		return ""
+	}
+	out, err := base64.StdEncoding.DecodeString(*resp.Output)
+	if err != nil {
+		mcore.Failf("Error decoding console output of '%s': %s", id, err)
+	}
+	return string(out)
+}
+
+type HostKeys struct {
+	Keys         []string `json:"keys"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+var hostKeyPattern = regexp.MustCompile(`(ssh-rsa|ssh-dss|ssh-ed25519|ecdsa-sha2-nistp[0-9]+) [A-Za-z0-9+/]+=*`)
+var fingerprintPattern = regexp.MustCompile(`SHA256:[A-Za-z0-9+/]+=*|(MD5:)?[0-9a-f]{2}(:[0-9a-f]{2}){15}`)
+
+// Find the host keys cloud-init prints to the console, between
+// "-----BEGIN SSH HOST KEY ...-----" and "-----END SSH HOST KEY ...-----"
+// lines.
+func parseHostKeys(output string) HostKeys {
+	found := HostKeys{Keys: []string{}, Fingerprints: []string{}}
+	block := ""
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, "-----BEGIN SSH HOST KEY KEYS-----"):
+			block = "keys"
+		case strings.Contains(line, "-----BEGIN SSH HOST KEY FINGERPRINTS-----"):
+			block = "fingerprints"
+		case strings.Contains(line, "-----END SSH HOST KEY"):
+			block = ""
+		case block == "keys":
+			if k := hostKeyPattern.FindString(line); k != "" {
+				found.Keys = append(found.Keys, k)
+			}
+		case block == "fingerprints":
+			if f := fingerprintPattern.FindString(line); f != "" {
+				found.Fingerprints = append(found.Fingerprints, f)
+			}
+		}
+	}
+	return found
+}
+
 func create(region string, params *ec2.RunInstancesInput, verbose bool) []*ec2.Instance {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.RunInstances(params)
 	if err != nil {
-		log.Fatalf("Error running instances: %s", err)
+		mcore.Failf("Error running instances: %s", err)
 	}
 	if len(resp.Instances) < 1 {
-		log.Fatal("Zero reservations returned")
+		mcore.Failf("Zero reservations returned")
 	}
 
 	instances := []*ec2.Instance{}
@@ -186,8 +282,7 @@ func create(region string, params *ec2.RunInstancesInput, verbose bool) []*ec2.I
 }
 
 func delete(region string, id string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.TerminateInstancesInput{
 		InstanceIds: []*string{
@@ -197,7 +292,7 @@ func delete(region string, id string, verbose bool) {
 	_, err := svc.TerminateInstances(params)
 
 	if err != nil {
-		log.Fatalf("Error terminating instances: %s", err)
+		mcore.Failf("Error terminating instances: %s", err)
 	}
 
 	// Wait for it.
@@ -211,13 +306,12 @@ func delete(region string, id string, verbose bool) {
 
 }
 
-func scan(rt *otto.Otto, region string) otto.Value {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scan(region string) []ec2.Instance {
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.DescribeInstances(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing instances: %s", err)
 	}
 
 	instances := []ec2.Instance{}
@@ -226,10 +320,14 @@ func scan(rt *otto.Otto, region string) otto.Value {
 			instances = append(instances, *i)
 		}
 	}
-	return mcore.Sanitize(rt, instances)
+	return instances
 }
 
 func init() {
+	mcore.RegisterScanner("instances", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -237,20 +335,20 @@ func init() {
 			rt.Object(`aws = {}`)
 		}
 		o1, _ := rt.Object(`aws.instances = {}`)
-		o1.Set("scan", func(region string) otto.Value {
-			return scan(rt, region)
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scan(region))
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.instances.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.RunInstancesInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for instance create input: %s", err)
+				context.Throwf("Can't create json for instance create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall instance create json: %s", err)
+				context.Throwf("Can't unmarshall instance create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -258,19 +356,39 @@ func init() {
 
 			f := mcore.Sanitizer(rt)
 			return f(create(region, &input, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			params := mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+			count, _ := params["MaxCount"].(float64)
+			instances := []interface{}{}
+			for i := 0; i < int(count); i++ {
+				instances = append(instances, mcore.Placeholder(params, map[string]interface{}{
+					"InstanceId": mcore.Plan.ID("i"),
+					"State":      map[string]interface{}{"Name": "pending"},
+					"MinCount":   nil,
+					"MaxCount":   nil,
+					"UserData":   nil,
+				}))
+			}
+			return instances
+		}))))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.instances.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			delete(region, id, verbose)
 			return otto.Value{}
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			return f(describe(region, id))
-		})
+		}))
+		o1.Set("consoleOutput", context.Guard(func(region string, id string) otto.Value {
+			return mcore.Sanitize(rt, consoleOutput(region, id))
+		}))
+		o1.Set("hostKeys", context.Guard(func(region string, id string) otto.Value {
+			return mcore.Sanitize(rt, parseHostKeys(consoleOutput(region, id)))
+		}))
 	})
 }
@@ -89,10 +89,9 @@ package keypairs
 //
 
 import (
-	log "github.com/Sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -103,8 +102,7 @@ var Version = "1.0.0"
 var ModuleName = "keypairs"
 
 func describe(region string, id string) *ec2.KeyPairInfo {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeKeyPairsInput{
 		KeyNames: []*string{
@@ -114,7 +112,12 @@ func describe(region string, id string) *ec2.KeyPairInfo {
 	resp, err := svc.DescribeKeyPairs(params)
 
 	if err != nil {
-		return nil
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "InvalidKeyPair.NotFound" == awsErr.Code() {
+				return nil
+			}
+		}
+		mcore.Failf("Error describing key pair: %s", err)
 	}
 	if len(resp.KeyPairs) > 0 {
 		return resp.KeyPairs[0]
@@ -123,23 +126,21 @@ func describe(region string, id string) *ec2.KeyPairInfo {
 }
 
 func create(region string, name string) string {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.CreateKeyPairInput{
 		KeyName: aws.String(name),
 	}
 	resp, err := svc.CreateKeyPair(params)
 	if err != nil {
-		log.Fatalf("Error creating key: %s", err)
+		mcore.Failf("Error creating key: %s", err)
 	}
 
 	return *resp.KeyMaterial
 }
 
 func delete(region string, id string) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DeleteKeyPairInput{
 		KeyName: aws.String(id),
@@ -147,25 +148,28 @@ func delete(region string, id string) {
 	_, err := svc.DeleteKeyPair(params)
 
 	if err != nil {
-		log.Fatalf("Error deleting key: %s", err)
+		mcore.Failf("Error deleting key: %s", err)
 	}
 }
 
 func scan(region string) []*ec2.KeyPairInfo {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeKeyPairsInput{}
 	resp, err := svc.DescribeKeyPairs(params)
 
 	if err != nil {
-		log.Fatalf("Error scanning keys: %s", err)
+		mcore.Failf("Error scanning keys: %s", err)
 	}
 
 	return resp.KeyPairs
 }
 
 func init() {
+	mcore.RegisterScanner("keypairs", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -173,21 +177,21 @@ func init() {
 			rt.Object(`aws = {}`)
 		}
 		o1, _ := rt.Object(`aws.keypairs = {}`)
-		o1.Set("scan", func(region string) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scan(region))
-		})
-		o1.Set("create", func(region, id string) otto.Value {
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.keypairs.create", func(region, id string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(create(region, id))
-		})
-		o1.Set("delete", func(region, id string) otto.Value {
+		}, "")))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.keypairs.delete", func(region, id string) otto.Value {
 			delete(region, id)
 			return otto.Value{}
-		})
-		o1.Set("describe", func(region, id string) otto.Value {
+		})))
+		o1.Set("describe", context.Guard(func(region, id string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describe(region, id))
-		})
+		}))
 	})
 }
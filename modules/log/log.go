@@ -129,30 +129,30 @@ func init() {
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
-		rt.Set("log", func(call otto.FunctionCall) otto.Value {
+		rt.Set("log", context.Guard(func(call otto.FunctionCall) otto.Value {
 			msg := call.Argument(0).String()
 			logMessage("  ---", msg)
 			return otto.Value{}
-		})
-		rt.Set("log0", func(call otto.FunctionCall) otto.Value {
+		}))
+		rt.Set("log0", context.Guard(func(call otto.FunctionCall) otto.Value {
 			msg := call.Argument(0).String()
 			logMessage("###", msg)
 			return otto.Value{}
-		})
-		rt.Set("log1", func(call otto.FunctionCall) otto.Value {
+		}))
+		rt.Set("log1", context.Guard(func(call otto.FunctionCall) otto.Value {
 			msg := call.Argument(0).String()
 			logMessage("  ---", msg)
 			return otto.Value{}
-		})
-		rt.Set("log2", func(call otto.FunctionCall) otto.Value {
+		}))
+		rt.Set("log2", context.Guard(func(call otto.FunctionCall) otto.Value {
 			msg := call.Argument(0).String()
 			logMessage("    ", msg)
 			return otto.Value{}
-		})
+		}))
 
 		var o1 *otto.Object
 		if a, err := rt.Get("log"); err != nil || a.IsUndefined() {
-			log.Fatalf("Can't find log object: %s", err)
+			context.Throwf("Can't find log object: %s", err)
 		} else {
 			o1 = a.Object()
 		}
@@ -170,16 +170,16 @@ func init() {
 		// > * "fatal"
 		// > * "panic"
 		//
-		o1.Set("setLevel", func(call otto.FunctionCall) otto.Value {
+		o1.Set("setLevel", context.Guard(func(call otto.FunctionCall) otto.Value {
 			level := call.Argument(0).String()
 			var l log.Level
 			var err error
 			if l, err = log.ParseLevel(strings.Title(level)); err != nil {
-				log.Fatalf("Log error: %s", err)
+				context.Throwf("Log error: %s", err)
 			}
 			log.SetLevel(l)
 			return otto.Value{}
-		})
+		}))
 		// @public
 		// ## jsonFormatter
 		// <a name="jsonFormatter"></a>
@@ -189,16 +189,16 @@ func init() {
 		//
 		// The `format` argument may be omitted, but if set, should be a string as documented [here](https://github.com/Sirupsen/logrus)
 		//
-		o1.Set("jsonFormatter", func(call otto.FunctionCall) otto.Value {
+		o1.Set("jsonFormatter", context.Guard(func(call otto.FunctionCall) otto.Value {
 			if !call.Argument(0).IsUndefined() {
-				formatter := &log.JSONFormatter{call.Argument(0).String()}
+				formatter := &log.JSONFormatter{TimestampFormat: call.Argument(0).String()}
 				log.SetFormatter(formatter)
 			} else {
 				formatter := &log.JSONFormatter{}
 				log.SetFormatter(formatter)
 			}
 			return otto.Value{}
-		})
+		}))
 		setup := func(obj *otto.Object, fl log.FieldLogger) {
 			// @public
 			// ## debug
@@ -207,12 +207,12 @@ func init() {
 			//
 			// Log a message at debug level.
 			//
-			obj.Set("debug", func(call otto.FunctionCall) otto.Value {
+			obj.Set("debug", context.Guard(func(call otto.FunctionCall) otto.Value {
 				if !call.Argument(0).IsUndefined() {
 					fl.Debug(call.Argument(0).String())
 				}
 				return otto.Value{}
-			})
+			}))
 			// @public
 			// ## info
 			// <a name="info"></a>
@@ -220,12 +220,12 @@ func init() {
 			//
 			// Log a message at info level.
 			//
-			obj.Set("info", func(call otto.FunctionCall) otto.Value {
+			obj.Set("info", context.Guard(func(call otto.FunctionCall) otto.Value {
 				if !call.Argument(0).IsUndefined() {
 					fl.Info(call.Argument(0).String())
 				}
 				return otto.Value{}
-			})
+			}))
 			// @public
 			// ## warn
 			// <a name="warn"></a>
@@ -233,12 +233,12 @@ func init() {
 			//
 			// Log a message at warning level.
 			//
-			obj.Set("warn", func(call otto.FunctionCall) otto.Value {
+			obj.Set("warn", context.Guard(func(call otto.FunctionCall) otto.Value {
 				if !call.Argument(0).IsUndefined() {
 					fl.Warn(call.Argument(0).String())
 				}
 				return otto.Value{}
-			})
+			}))
 			// @public
 			// ## error
 			// <a name="error"></a>
@@ -246,12 +246,12 @@ func init() {
 			//
 			// Log a message at error level.
 			//
-			obj.Set("error", func(call otto.FunctionCall) otto.Value {
+			obj.Set("error", context.Guard(func(call otto.FunctionCall) otto.Value {
 				if !call.Argument(0).IsUndefined() {
 					fl.Error(call.Argument(0).String())
 				}
 				return otto.Value{}
-			})
+			}))
 			// @public
 			// ## fatal
 			// <a name="fatal"></a>
@@ -259,12 +259,12 @@ func init() {
 			//
 			// Log a message at fatal level.
 			//
-			obj.Set("fatal", func(call otto.FunctionCall) otto.Value {
+			obj.Set("fatal", context.Guard(func(call otto.FunctionCall) otto.Value {
 				if !call.Argument(0).IsUndefined() {
 					fl.Fatal(call.Argument(0).String())
 				}
 				return otto.Value{}
-			})
+			}))
 			// @public
 			// ## panic
 			// <a name="panic"></a>
@@ -272,12 +272,12 @@ func init() {
 			//
 			// Log a message at panic level.
 			//
-			obj.Set("panic", func(call otto.FunctionCall) otto.Value {
+			obj.Set("panic", context.Guard(func(call otto.FunctionCall) otto.Value {
 				if !call.Argument(0).IsUndefined() {
 					fl.Panic(call.Argument(0).String())
 				}
 				return otto.Value{}
-			})
+			}))
 		}
 		var l log.FieldLogger
 		l = log.StandardLogger()
@@ -296,7 +296,7 @@ func init() {
 		//
 		// For more information see the [logrus](https://github.com/Sirupsen/logrus) docs.
 		//
-		o1.Set("withFields", func(call otto.FunctionCall) otto.Value {
+		o1.Set("withFields", context.Guard(func(call otto.FunctionCall) otto.Value {
 			var l log.FieldLogger
 			l = log.StandardLogger()
 			if !call.Argument(0).IsUndefined() {
@@ -304,7 +304,7 @@ func init() {
 				var err error
 				var val interface{}
 				if val, err = call.Argument(0).Export(); err != nil {
-					log.Fatalf("log.withFields() panic: %s", err)
+					context.Throwf("log.withFields() panic: %s", err)
 				}
 				fields = val.(map[string]interface{})
 				l = log.WithFields(fields)
@@ -312,7 +312,7 @@ func init() {
 			o, _ := rt.Object(`({})`)
 			setup(o, l)
 			return o.Value()
-		})
+		}))
 	})
 }
 
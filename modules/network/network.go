@@ -33,9 +33,13 @@ package network
 //
 // ## NETWORK.check
 // <a name="check"></a>
-// `network.check(host, port, timeout);`
+// `network.check(host, port, timeout, user, keypath);`
 //
-// Returns true if a TCP connection can be established.
+// Returns true if a TCP connection can be established within
+// `timeout` seconds.  If `host` is reached through jump hosts (see
+// `mithras.remote.route`), the connection is tried from the nearest
+// jump host, which is reached over SSH as `user` with the key at
+// `keypath`.
 //
 // Example:
 //
@@ -46,24 +50,32 @@ package network
 // ```
 //
 import (
-	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/robertkrimen/otto"
 
 	mcore "github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/remote"
 )
 
 var Version = "1.0.0"
 var ModuleName = "network"
 
-func check(host string, port int, timeout int, verbose bool) bool {
+func check(host string, port int, timeout int, user string, keypath string, verbose bool) bool {
 	d := &net.Dialer{Timeout: 3 * time.Second}
 	for i := 0; i < (timeout / 10); i++ {
-		conn, _ := d.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-		if conn != nil {
-			return true
+		if ok, routed := remote.Reachable(host, user, keypath, port); routed {
+			if ok {
+				return true
+			}
+		} else {
+			conn, _ := d.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if conn != nil {
+				conn.Close()
+				return true
+			}
 		}
 		time.Sleep(time.Second * 10)
 	}
@@ -82,10 +94,10 @@ func init() {
 			nobj = a.Object()
 		}
 
-		nobj.Set("check", func(host string, port int, timeout int) otto.Value {
+		nobj.Set("check", context.Guard(func(host string, port int, timeout int, user string, keypath string) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			f := mcore.Sanitizer(rt)
-			return f(check(host, port, timeout, verbose))
-		})
+			return f(check(host, port, timeout, user, keypath, verbose))
+		}))
 	})
 }
@@ -122,12 +122,12 @@ func init() {
 		rt := context.Runtime
 
 		obj, _ := rt.Object(`os = {}`)
-		obj.Set("exit", exit)
-		obj.Set("hostname", hostname)
-		obj.Set("getenv", getenv)
-		obj.Set("expandEnv", func(thing string) otto.Value {
+		obj.Set("exit", context.Guard(exit))
+		obj.Set("hostname", context.Guard(hostname))
+		obj.Set("getenv", context.Guard(getenv))
+		obj.Set("expandEnv", context.Guard(func(thing string) otto.Value {
 			f := core.Sanitizer(rt)
 			return f(os.ExpandEnv(thing))
-		})
+		}))
 	})
 }
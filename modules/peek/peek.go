@@ -29,15 +29,19 @@ package peek
 //
 // ## PEEK
 // <a name="peek"></a>
-// `peek(ip_or_hostname, callback);`
+// `peek(host, key, user, callback);`
 //
-// Calls the supplied callback with the results of `uname` on the remote host.
+// Calls the supplied callback with the results of `uname` on the
+// remote host.  The `host` may be an address, or an ec2 instance
+// object, reached at the address chosen by the remote settings.
+// Configured jump hosts are used.
 //
 // Example:
 //
 // ```
 //
-//  peek("189.76.33.2", function (data) { console.log(data) } );
+//  peek("189.76.33.2", "/home/user/.ssh/key.pem", "ec2-user",
+//       function (data) { console.log(data) } );
 //
 // ```
 //
@@ -77,12 +81,12 @@ func init() {
 	core.RegisterInit(func(context *core.Context) {
 		rt := context.Runtime
 
-		rt.Set("peek", func(call otto.FunctionCall) otto.Value {
-			ip, _ := call.Argument(0).ToString()
+		rt.Set("peek", context.Guard(func(call otto.FunctionCall) otto.Value {
+			ip := remote.HostArg(call.Argument(0))
 			key, _ := call.Argument(1).ToString()
 			user, _ := call.Argument(2).ToString()
 			peek(rt, ip, user, key, call.Argument(3))
 			return otto.Value{}
-		})
+		}))
 	})
 }
@@ -63,13 +63,13 @@ func init() {
 		rt := context.Runtime
 
 		obj, _ := rt.Object(`rand = {}`)
-		obj.Set("intN", func(n int) otto.Value {
+		obj.Set("intN", context.Guard(func(n int) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(rand.Intn(n))
-		})
-		obj.Set("seed", func(seed int) otto.Value {
+		}))
+		obj.Set("seed", context.Guard(func(seed int) otto.Value {
 			rand.Seed(int64(seed))
 			return otto.Value{}
-		})
+		}))
 	})
 }
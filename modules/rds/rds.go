@@ -177,11 +177,9 @@ package rds
 //
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/robertkrimen/otto"
 
@@ -192,13 +190,12 @@ var Version = "1.0.0"
 var ModuleName = "rds"
 
 func describe(region string, id string) *rds.DBInstance {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	resp, err := svc.DescribeDBInstances(nil)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	for _, i := range resp.DBInstances {
@@ -211,13 +208,12 @@ func describe(region string, id string) *rds.DBInstance {
 }
 
 func describeSubnetGroup(region string, id string) *rds.DBSubnetGroup {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	resp, err := svc.DescribeDBSubnetGroups(nil)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	for _, i := range resp.DBSubnetGroups {
@@ -230,13 +226,12 @@ func describeSubnetGroup(region string, id string) *rds.DBSubnetGroup {
 }
 
 func createSubnetGroup(region string, params *rds.CreateDBSubnetGroupInput, verbose bool) *rds.DBSubnetGroup {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	resp, err := svc.CreateDBSubnetGroup(params)
 
 	if err != nil {
-		log.Fatalf("Error creating DB Subnet Group '%s': %s",
+		mcore.Failf("Error creating DB Subnet Group '%s': %s",
 			*params.DBSubnetGroupName,
 			err)
 	}
@@ -254,19 +249,18 @@ func createSubnetGroup(region string, params *rds.CreateDBSubnetGroupInput, verb
 	}
 
 	if !avail {
-		log.Fatalf("Error creating DB Subnet Group '%s'", *params.DBSubnetGroupName)
+		mcore.Failf("Error creating DB Subnet Group '%s'", *params.DBSubnetGroupName)
 	}
 
 	return resp.DBSubnetGroup
 }
 
 func create(region string, params *rds.CreateDBInstanceInput, wait bool, verbose bool) *rds.DBInstance {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	resp, err := svc.CreateDBInstance(params)
 	if err != nil {
-		log.Fatalf("Error creating DB Instance '%s': %s",
+		mcore.Failf("Error creating DB Instance '%s': %s",
 			*params.DBInstanceIdentifier,
 			err)
 	}
@@ -287,7 +281,7 @@ func create(region string, params *rds.CreateDBInstanceInput, wait bool, verbose
 		}
 
 		if !avail {
-			log.Fatalf("Error creating DB Instance '%s'", id)
+			mcore.Failf("Error creating DB Instance '%s'", id)
 		}
 	}
 
@@ -298,8 +292,7 @@ func create(region string, params *rds.CreateDBInstanceInput, wait bool, verbose
 }
 
 func deleteSubnetGroup(region string, id string, verbose bool) {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	params := &rds.DeleteDBSubnetGroupInput{
 		DBSubnetGroupName: aws.String(id),
@@ -307,20 +300,19 @@ func deleteSubnetGroup(region string, id string, verbose bool) {
 	_, err := svc.DeleteDBSubnetGroup(params)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// TODO: Wait for it.
 }
 
 func delete(region string, params *rds.DeleteDBInstanceInput, verbose bool) {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	_, err := svc.DeleteDBInstance(params)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -335,17 +327,16 @@ func delete(region string, params *rds.DeleteDBInstanceInput, verbose bool) {
 	}
 
 	if avail {
-		log.Fatalf("Error deleting DB Instance '%s'", *params.DBInstanceIdentifier)
+		mcore.Failf("Error deleting DB Instance '%s'", *params.DBInstanceIdentifier)
 	}
 }
 
-func scan(rt *otto.Otto, region string) otto.Value {
-	svc := rds.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scan(region string) []rds.DBInstance {
+	svc := rds.New(mcore.Session(rds.ServiceName, region))
 
 	resp, err := svc.DescribeDBInstances(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing db instances: %s", err)
 	}
 
 	dbs := []rds.DBInstance{}
@@ -353,10 +344,14 @@ func scan(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.DBInstances {
 		dbs = append(dbs, *i)
 	}
-	return mcore.Sanitize(rt, dbs)
+	return dbs
 }
 
 func init() {
+	mcore.RegisterScanner("dbs", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -378,49 +373,54 @@ func init() {
 			o2 = v.Object()
 		}
 
-		o1.Set("scan", func(region string) otto.Value {
-			return scan(rt, region)
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scan(region))
+		}))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describe(region, id))
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.rds.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input rds.CreateDBInstanceInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for RDS create input: %s", err)
+				context.Throwf("Can't create json for RDS create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall RDS create json: %s", err)
+				context.Throwf("Can't unmarshall RDS create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			wait, err := call.Argument(2).ToBoolean()
 			if err != nil {
-				log.Fatalf("Invalid gateway arg to RDS create: %s", err)
+				context.Throwf("Invalid gateway arg to RDS create: %s", err)
 			}
 			verbose := mcore.IsVerbose(rt)
 
 			f := mcore.Sanitizer(rt)
 			return f(create(region, &input, wait, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"DBInstanceStatus":   "creating",
+				"MasterUserPassword": nil,
+			})
+		}))))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.rds.delete", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input rds.DeleteDBInstanceInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for RDS delete input: %s", err)
+				context.Throwf("Can't create json for RDS delete input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall RDS delete json: %s", err)
+				context.Throwf("Can't unmarshall RDS delete json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -428,25 +428,25 @@ func init() {
 
 			delete(region, &input, verbose)
 			return otto.Value{}
-		})
+		})))
 
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeSubnetGroup(region, id))
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.rds.subnetGroups.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input rds.CreateDBSubnetGroupInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for RDS create input: %s", err)
+				context.Throwf("Can't create json for RDS create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall RDS create json: %s", err)
+				context.Throwf("Can't unmarshall RDS create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
@@ -454,13 +454,15 @@ func init() {
 
 			f := mcore.Sanitizer(rt)
 			return f(createSubnetGroup(region, &input, verbose))
-		})
-		o2.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+		}))))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.rds.subnetGroups.delete", func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			verbose := mcore.IsVerbose(rt)
 			deleteSubnetGroup(region, id, verbose)
 			return otto.Value{}
-		})
+		})))
 	})
 }
@@ -59,10 +59,10 @@ func init() {
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
-		rt.Set("readline", func(prompt string) otto.Value {
+		rt.Set("readline", context.Guard(func(prompt string) otto.Value {
 			rl, err := readline.New(prompt)
 			if err != nil {
-				panic(err)
+				context.Throwf("Can't start readline: %s", err)
 			}
 			defer rl.Close()
 
@@ -72,6 +72,6 @@ func init() {
 			}
 			f := mcore.Sanitizer(rt)
 			return f(line)
-		})
+		}))
 	})
 }
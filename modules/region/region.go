@@ -47,8 +47,6 @@ package region
 //
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -59,11 +57,11 @@ var Version = "1.0.0"
 var ModuleName = "region"
 
 func scan(rt *otto.Otto) otto.Value {
-	svc := ec2.New(session.New(), aws.NewConfig().WithRegion("us-east-1").WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, "us-east-1"))
 
 	resp, err := svc.DescribeRegions(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing regions: %s", err)
 	}
 
 	regions := []ec2.Region{}
@@ -79,8 +77,8 @@ func init() {
 
 		rt.Object(`aws = aws || {}`)
 		o2, _ := rt.Object(`aws.regions = {}`)
-		o2.Set("scan", func() otto.Value {
+		o2.Set("scan", context.Guard(func() otto.Value {
 			return scan(rt)
-		})
+		}))
 	})
 }
@@ -0,0 +1,145 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Ways of reaching remote hosts.
+const (
+	// Run the local ssh and scp commands
+	TransportOpenSSH = "openssh"
+	// Use the SSH client built into mithras
+	TransportNative = "native"
+)
+
+// Config holds the settings used for all remote operations.
+type Config struct {
+	Transport string `json:"transport"`
+	// Host key policy: strict, accept-new or off
+	HostKeys string `json:"hostKeys"`
+	// The known_hosts file managed by mithras
+	KnownHosts string `json:"knownHosts"`
+	// Jump hosts to go through, as "[user@]host[:port],..."
+	Jump string `json:"jump"`
+	// How the address of an instance is chosen
+	Address string `json:"address"`
+	// Log output of remote commands as it arrives
+	Stream bool `json:"stream"`
+	// Seconds to wait for a connection
+	ConnectTimeout float64 `json:"connectTimeout"`
+	// Seconds a remote operation may take; 0 for no limit
+	Timeout float64 `json:"timeout"`
+	// Times an operation is retried while its host is unreachable
+	Retries int `json:"retries"`
+	// Seconds to wait before the first retry, doubling after
+	Backoff float64 `json:"backoff"`
+}
+
+// Defaults for connection timeout and retry backoff, in seconds
+const (
+	defaultConnectTimeout = 10
+	defaultBackoff        = 1
+)
+
+var configMu sync.RWMutex
+var config = Config{
+	Transport:  TransportOpenSSH,
+	HostKeys:   HostKeysAcceptNew,
+	KnownHosts: DefaultKnownHosts(),
+	Address:    AddressPublicIP,
+
+	ConnectTimeout: defaultConnectTimeout,
+	Backoff:        defaultBackoff,
+}
+
+// Configure replaces the remote settings.
+func Configure(cfg Config) error {
+	if cfg.Transport == "" {
+		cfg.Transport = TransportOpenSSH
+	}
+	switch cfg.Transport {
+	case TransportOpenSSH, TransportNative:
+	default:
+		return fmt.Errorf("Unknown ssh transport '%s'", cfg.Transport)
+	}
+	if cfg.HostKeys == "" {
+		cfg.HostKeys = HostKeysAcceptNew
+	}
+	switch cfg.HostKeys {
+	case HostKeysStrict, HostKeysAcceptNew, HostKeysOff:
+	default:
+		return fmt.Errorf("Unknown host key policy '%s'", cfg.HostKeys)
+	}
+	if cfg.KnownHosts == "" {
+		cfg.KnownHosts = DefaultKnownHosts()
+	}
+	if _, err := parseJumps(cfg.Jump, ""); err != nil {
+		return err
+	}
+	if cfg.Address == "" {
+		cfg.Address = AddressPublicIP
+	}
+	switch cfg.Address {
+	case AddressPublicIP, AddressPrivateIP, AddressPublicDNS, AddressPrivateDNS:
+	default:
+		return fmt.Errorf("Unknown address strategy '%s'", cfg.Address)
+	}
+
+	if cfg.ConnectTimeout < 0 {
+		return fmt.Errorf("Invalid connect timeout %g", cfg.ConnectTimeout)
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = defaultConnectTimeout
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = defaultBackoff
+	}
+	if err := cfg.Policy().validate(); err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = cfg
+	return nil
+}
+
+// CurrentConfig returns a copy of the remote settings.
+func CurrentConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// Policy is the timeout and retries for remote operations, unless a
+// caller gives its own.
+func (c Config) Policy() Policy {
+	return Policy{Timeout: c.Timeout, Retries: c.Retries, Backoff: c.Backoff}
+}
+
+// The ssh option for the connect timeout, in whole seconds
+func connectTimeoutOption() string {
+	return fmt.Sprintf("ConnectTimeout=%d", int(math.Ceil(CurrentConfig().ConnectTimeout)))
+}
+
+func native() bool {
+	return CurrentConfig().Transport == TransportNative
+}
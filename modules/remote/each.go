@@ -0,0 +1,403 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// A remote operation is fanned out across many hosts at once, in
+// rolling batches, stopping when too many hosts have failed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// EachOptions control how a job is run across hosts.
+type EachOptions struct {
+	// Hosts to run on at once
+	Concurrency int `json:"concurrency"`
+	// Hosts in each batch; a batch finishes before the next starts.
+	// Zero means all hosts in one batch.
+	Batch int `json:"batch"`
+	// No more hosts are started once more than this percentage of
+	// hosts have failed.  Defaults to 100.
+	MaxFailPercentage *float64 `json:"maxFailPercentage"`
+}
+
+// The number of hosts run on at once, unless given
+const defaultConcurrency = 10
+
+// EachJob is a job for one host.
+type EachJob struct {
+	// What the result is keyed by
+	Key  string
+	Host string
+	// Whether the job is not to be run at all
+	Skip bool
+	Run  func(Sink) (*string, *string, bool, int)
+}
+
+// EachResult is the result of a job on one host.
+type EachResult struct {
+	Host    string `json:"host"`
+	Out     string `json:"out"`
+	Err     string `json:"err"`
+	Success bool   `json:"success"`
+	Status  int    `json:"status"`
+	// Why the job failed, as Classify says
+	Failure string `json:"failure"`
+	// Why the job couldn't be run
+	Error string `json:"error,omitempty"`
+	// Whether the job wasn't run, because it was skipped or too many
+	// hosts failed
+	Skipped bool `json:"skipped"`
+}
+
+// Run a job, turning a panic into an error result.
+func runJob(job EachJob, sink Sink) (result *EachResult) {
+	result = &EachResult{Host: job.Host}
+	defer func() {
+		if r := recover(); r != nil {
+			if err, ok := r.(error); ok {
+				result.Error = err.Error()
+			} else {
+				result.Error = fmt.Sprint(r)
+			}
+			result.Success = false
+		}
+	}()
+	o, e, ok, status := job.Run(sink)
+	result.Out = *o
+	result.Err = *e
+	result.Success = ok && status == 0
+	result.Status = status
+	result.Failure = Classify(result.Success, status, *e)
+	return result
+}
+
+// Each runs jobs across hosts, following opts, and returns their
+// results keyed by the jobs' keys.  Each line of output from a host is
+// passed to the sink sinkFor returns for it, which may be nil.
+func Each(jobs []EachJob, opts EachOptions, sinkFor func(host string) Sink) map[string]*EachResult {
+	results := map[string]*EachResult{}
+	runnable := []EachJob{}
+	for _, job := range jobs {
+		if job.Skip {
+			results[job.Key] = &EachResult{Host: job.Host, Skipped: true}
+		} else {
+			runnable = append(runnable, job)
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultConcurrency
+	}
+	batch := opts.Batch
+	if batch < 1 {
+		batch = len(runnable)
+	}
+	maxFailures := len(runnable)
+	if opts.MaxFailPercentage != nil {
+		maxFailures = int(math.Floor(*opts.MaxFailPercentage / 100 * float64(len(runnable))))
+	}
+
+	var mu sync.Mutex
+	failures := 0
+	aborted := false
+	sem := make(chan struct{}, concurrency)
+
+	for start := 0; start < len(runnable); start += batch {
+		end := start + batch
+		if end > len(runnable) {
+			end = len(runnable)
+		}
+		var wg sync.WaitGroup
+		for _, job := range runnable[start:end] {
+			sem <- struct{}{}
+			mu.Lock()
+			stop := aborted
+			mu.Unlock()
+			if stop {
+				<-sem
+				mu.Lock()
+				results[job.Key] = &EachResult{Host: job.Host, Skipped: true}
+				mu.Unlock()
+				continue
+			}
+			wg.Add(1)
+			go func(job EachJob) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				result := runJob(job, sinkFor(job.Host))
+				mu.Lock()
+				defer mu.Unlock()
+				results[job.Key] = result
+				if !result.Success {
+					failures++
+					if failures > maxFailures {
+						aborted = true
+					}
+				}
+			}(job)
+		}
+		wg.Wait()
+	}
+	return results
+}
+
+// What to run on each host for `mithras.remote.each`: one of shell,
+// wrapper or mithras.
+type eachSpec struct {
+	Shell   *string           `json:"shell"`
+	Input   *string           `json:"input"`
+	Env     map[string]string `json:"env"`
+	Control *bool             `json:"control"`
+	policyOverride
+
+	Wrapper []string       `json:"wrapper"`
+	Options wrapperOptions `json:"options"`
+
+	Mithras      *string `json:"mithras"`
+	Become       bool    `json:"become"`
+	BecomeUser   string  `json:"becomeUser"`
+	BecomeMethod string  `json:"becomeMethod"`
+
+	User string `json:"user"`
+	Key  string `json:"key"`
+}
+
+// Convert a JS value into a Go one, by way of JSON.
+func jsonInto(rt *otto.Otto, v otto.Value, target interface{}) error {
+	js := `(function (o) { return JSON.stringify(o); })`
+	s, err := rt.Call(js, nil, v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(s.String()), target)
+}
+
+func eachBinding(context *mcore.Context, call otto.FunctionCall) otto.Value {
+	rt := context.Runtime
+	hosts := call.Argument(0)
+	if hosts.Class() != "Array" {
+		context.Throwf("Hosts for mithras.remote.each must be an array.")
+	}
+
+	opts := EachOptions{}
+	var resource, userArg, keyArg otto.Value
+	if o := call.Argument(1); o.IsObject() {
+		// Leave out the resource, which may be large
+		picked, err := rt.Call(`(function (o) {
+                  return _.pick(o, "concurrency", "batch", "maxFailPercentage");
+                })`, nil, o)
+		if err != nil {
+			context.Throwf("Invalid mithras.remote.each options: %s", err)
+		}
+		if err := jsonInto(rt, picked, &opts); err != nil {
+			context.Throwf("Invalid mithras.remote.each options: %s", err)
+		}
+		resource, _ = o.Object().Get("resource")
+		userArg, _ = o.Object().Get("user")
+		keyArg, _ = o.Object().Get("key")
+	}
+	spec := call.Argument(2)
+	if !spec.IsObject() {
+		context.Throwf("Spec for mithras.remote.each must be an object or function.")
+	}
+	verbose := mcore.IsVerbose(rt)
+	dryRun := mcore.DryRun(rt)
+
+	// A setting for a host: from a string, or a function of the
+	// host, or from the resource
+	str := func(v otto.Value) string {
+		if !v.IsDefined() || v.IsNull() {
+			return ""
+		}
+		return v.String()
+	}
+	setting := func(v otto.Value, host otto.Value, fromResource string) string {
+		if v.IsFunction() {
+			r, err := v.Call(otto.NullValue(), host)
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			return str(r)
+		}
+		if v.IsDefined() && !v.IsNull() {
+			return v.String()
+		}
+		if resource.IsObject() && fromResource != "" {
+			r, err := rt.Call(fromResource, nil, resource, host)
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			return str(r)
+		}
+		return ""
+	}
+
+	jobs := []EachJob{}
+	planned := map[string]*EachResult{}
+	length, _ := hosts.Object().Get("length")
+	n, _ := length.ToInteger()
+	for i := int64(0); i < n; i++ {
+		host, _ := hosts.Object().Get(strconv.FormatInt(i, 10))
+
+		s := spec
+		if spec.IsFunction() {
+			var err error
+			if s, err = spec.Call(otto.NullValue(), host); err != nil {
+				context.Throwf("%s", err)
+			}
+		}
+
+		id := ""
+		if host.IsObject() {
+			if v, err := host.Object().Get("InstanceId"); err == nil && v.IsString() {
+				id = v.String()
+			}
+		}
+		// Skipped hosts needn't have an address
+		if !s.IsObject() && id != "" {
+			jobs = append(jobs, EachJob{Key: id, Skip: true})
+			continue
+		}
+
+		var addr string
+		if resource.IsObject() {
+			addr = setting(otto.UndefinedValue(), host, "mithras.sshHostForInstance")
+		} else {
+			addr = HostArg(host)
+		}
+		if id == "" {
+			id = addr
+		}
+		if !s.IsObject() {
+			jobs = append(jobs, EachJob{Key: id, Host: addr, Skip: true})
+			continue
+		}
+		var es eachSpec
+		if err := jsonInto(rt, s, &es); err != nil {
+			context.Throwf("Invalid mithras.remote.each spec: %s", err)
+		}
+		// A run function would be lost as JSON
+		if m, _ := s.Object().Get("mithras"); m.IsFunction() {
+			js := mithrasScript(m)
+			es.Mithras = &js
+		}
+		user := es.User
+		if user == "" {
+			user = setting(userArg, host, "mithras.sshUserForInstance")
+		}
+		keypath := es.Key
+		if keypath == "" {
+			keypath = setting(keyArg, host, "mithras.sshKeyPathForInstance")
+		}
+
+		// The wrapper's own policy option goes over the spec's
+		policy := es.apply(CurrentConfig().Policy())
+		if es.Wrapper != nil {
+			policy = es.Options.Policy.apply(policy)
+		}
+		if err := policy.validate(); err != nil {
+			context.Throwf("%s", err)
+		}
+
+		var run func(Sink) (*string, *string, bool, int)
+		switch {
+		case es.Shell != nil:
+			control := true
+			if es.Control != nil {
+				control = *es.Control
+			}
+			// Without an env, ssh runs in ours
+			var env *map[string]string
+			if es.Env != nil {
+				env = &es.Env
+			}
+			run = func(sink Sink) (*string, *string, bool, int) {
+				return RemoteShellPolicy(addr, user, keypath, es.Input, *es.Shell, env, control, sink, policy).Results()
+			}
+		case es.Wrapper != nil:
+			job := es.Options.jobSpec(es.Wrapper, es.Env)
+			options := es.Options
+			run = func(sink Sink) (*string, *string, bool, int) {
+				r := RemoteJobPolicy(addr, user, keypath, job, options.Become, options.BecomeUser,
+					options.BecomeMethod, verbose, sink, policy)
+				return &r.Out, &r.Err, r.Success, r.Status
+			}
+		case es.Mithras != nil:
+			method := es.BecomeMethod
+			if method == "" {
+				method = "sudo"
+			}
+			run = func(sink Sink) (*string, *string, bool, int) {
+				return RemoteMithrasPolicy(addr, user, keypath, *es.Mithras, es.Become, es.BecomeUser,
+					method, verbose, sink, policy)
+			}
+		default:
+			context.Throwf("Spec for mithras.remote.each needs one of shell, wrapper or mithras.")
+		}
+
+		if dryRun {
+			export, _ := s.Export()
+			if m, ok := export.(map[string]interface{}); ok && es.Mithras != nil {
+				m["mithras"] = *es.Mithras
+			}
+			mcore.Plan.Record(mcore.PlannedCall{
+				Action: mcore.PlanUpdate,
+				Call:   "mithras.remote.each",
+				Args:   []interface{}{addr, user, keypath, export},
+			})
+			planned[id] = &EachResult{Host: addr, Success: true}
+			continue
+		}
+		jobs = append(jobs, EachJob{Key: id, Host: addr, Run: run})
+	}
+
+	if dryRun {
+		for _, job := range jobs {
+			planned[job.Key] = &EachResult{Host: job.Host, Skipped: true}
+		}
+		return mcore.Sanitize(rt, planned)
+	}
+
+	out := outputFor(rt)
+	if !out.callback() {
+		return mcore.Sanitize(rt, Each(jobs, opts, func(host string) Sink {
+			return out.sink(host, nil)
+		}))
+	}
+
+	// Call back with output on this goroutine
+	lines := make(chan Line, 64)
+	done := make(chan map[string]*EachResult, 1)
+	go func() {
+		defer close(lines)
+		done <- Each(jobs, opts, func(host string) Sink {
+			return out.sink(host, lines)
+		})
+	}()
+	out.drain(lines)
+	return mcore.Sanitize(rt, <-done)
+}
@@ -0,0 +1,131 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// Bootstrap copies helper binaries, the wrapper and runner, to
+// hosts.  Each reports its version and build hash, so that copies
+// left on hosts by an older mithras can be found and replaced.
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+
+	"github.com/cvillecsteele/mithras/modules/build"
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// The helper binaries bootstrap puts in .mithras/bin
+var HelperNames = []string{"wrapper", "runner"}
+
+// HelperVersionCommand is run on a host to report the version of each
+// helper there, a line per helper, as "name: output of --version".
+// Helpers which aren't there aren't reported.  Old helpers which don't
+// understand --version report something without a build hash.
+var HelperVersionCommand = "for h in " + strings.Join(HelperNames, " ") + "; do " +
+	"if test -x .mithras/bin/$h; then " +
+	"echo \"$h: $(.mithras/bin/$h --version </dev/null 2>&1 | head -n 1)\"; " +
+	"fi; done; true"
+
+// Helper describes a helper binary, on a host or in the local cache.
+type Helper struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+	// The sha256 of the binary
+	Build string `json:"build"`
+	// For cached helpers, where the binary is, and whether it's there
+	Path   string `json:"path,omitempty"`
+	Cached bool   `json:"cached"`
+}
+
+// ParseHelpers reads the output of HelperVersionCommand.  A helper's
+// --version output looks like:
+//
+//   wrapper version 1.0.0 protocol 3 build 9f86d0...
+func ParseHelpers(out string) map[string]Helper {
+	helpers := map[string]Helper{}
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		h := Helper{Name: strings.TrimSpace(line[:i])}
+		fields := strings.Fields(line[i+1:])
+		for j := 0; j+1 < len(fields); j++ {
+			switch fields[j] {
+			case "version":
+				h.Version = fields[j+1]
+			case "protocol":
+				h.Protocol, _ = strconv.Atoi(fields[j+1])
+			case "build":
+				h.Build = fields[j+1]
+			}
+		}
+		helpers[h.Name] = h
+	}
+	return helpers
+}
+
+// CachedHelper describes the build of a helper in the local cache for
+// goos and goarch.
+func CachedHelper(name string, goos string, goarch string) Helper {
+	path, ok := build.InCache(name, goos, goarch)
+	h := Helper{Name: name, Path: path}
+	if !ok {
+		return h
+	}
+	hash, err := build.Hash(path)
+	if err != nil {
+		mcore.Failf("Can't hash helper '%s': %s", path, err)
+	}
+	h.Build = hash
+	h.Cached = true
+	return h
+}
+
+// HelperStale reports whether the helper on a host, as described by
+// the output of HelperVersionCommand there, is missing or differs from
+// the cached build for the host's goos and goarch.  A helper which
+// isn't cached can't be replaced, and so isn't stale.
+func HelperStale(out string, name string, goos string, goarch string) bool {
+	cached := CachedHelper(name, goos, goarch)
+	if !cached.Cached {
+		return false
+	}
+	found, ok := ParseHelpers(out)[name]
+	return !ok || found.Build != cached.Build
+}
+
+func helpersObject(context *mcore.Context, remote *otto.Object) {
+	rt := context.Runtime
+	o, _ := rt.Object(`({})`)
+	remote.Set("helpers", o)
+
+	o.Set("names", HelperNames)
+	o.Set("command", HelperVersionCommand)
+	o.Set("parse", context.Guard(func(out string) otto.Value {
+		return mcore.Sanitize(rt, ParseHelpers(out))
+	}))
+	o.Set("cached", context.Guard(func(name string, goos string, goarch string) otto.Value {
+		return mcore.Sanitize(rt, CachedHelper(name, goos, goarch))
+	}))
+	o.Set("stale", context.Guard(func(out string, name string, goos string, goarch string) bool {
+		return HelperStale(out, name, goos, goarch)
+	}))
+}
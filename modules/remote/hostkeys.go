@@ -0,0 +1,319 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// Host keys are checked against a known_hosts file managed by
+// mithras, kept apart from the user's own.  How unknown hosts are
+// treated depends on the host key policy.
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// Host key policies.
+const (
+	// Only connect to hosts whose keys are already known
+	HostKeysStrict = "strict"
+	// Remember the keys of new hosts; refuse changed keys
+	HostKeysAcceptNew = "accept-new"
+	// Don't check host keys
+	HostKeysOff = "off"
+)
+
+// HostKeyError reports a host whose key is unknown under the strict
+// policy, or whose key has changed.
+type HostKeyError struct {
+	Host string
+	// Fingerprint of the key the host presented
+	Got string
+	// Fingerprints of the keys we expected, if any
+	Want []string
+	Path string
+}
+
+func (e *HostKeyError) Error() string {
+	if len(e.Want) == 0 {
+		return fmt.Sprintf("Host key %s for '%s' is not known, and the host key policy is strict.  "+
+			"Seed it with mithras.remote.hostKeys.seed, or add it to %s.",
+			e.Got, e.Host, e.Path)
+	}
+	return fmt.Sprintf("HOST KEY FOR '%s' HAS CHANGED: expected %s, got %s.  "+
+		"Someone may be impersonating the host, or it may have been replaced.  "+
+		"If it was replaced, forget the old key with mithras.remote.hostKeys.forget(\"%s\").",
+		e.Host, strings.Join(e.Want, " or "), e.Got, e.Host)
+}
+
+var knownHostsMu sync.Mutex
+
+// Fingerprints we were told to expect, by normalized host, for hosts
+// seeded without full keys.  Only the native transport can check
+// them; once it has, the host's key is in known_hosts.
+var seeded = map[string][]string{}
+
+// DefaultKnownHosts is the known_hosts file used unless another is
+// configured.
+func DefaultKnownHosts() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+	}
+	return filepath.Join(home, ".mithras", "known_hosts")
+}
+
+func ensureKnownHosts(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Can't create directory for known hosts '%s': %s", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Can't create known hosts '%s': %s", path, err)
+	}
+	return f.Close()
+}
+
+func appendHostKey(path string, host string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Can't open known hosts '%s': %s", path, err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{host}, key))
+	return err
+}
+
+func matchesFingerprint(key ssh.PublicKey, prints []string) bool {
+	sha := ssh.FingerprintSHA256(key)
+	md5 := ssh.FingerprintLegacyMD5(key)
+	for _, p := range prints {
+		p = strings.TrimPrefix(p, "MD5:")
+		if p == sha || p == md5 {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHostKey decides whether to trust the key presented by host,
+// following the policy in cfg.  Under the accept-new policy, keys of
+// new hosts are added to the known_hosts file.
+func CheckHostKey(cfg Config, host string, key ssh.PublicKey) error {
+	if cfg.HostKeys == HostKeysOff {
+		return nil
+	}
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	if err := ensureKnownHosts(cfg.KnownHosts); err != nil {
+		return err
+	}
+	check, err := knownhosts.New(cfg.KnownHosts)
+	if err != nil {
+		return fmt.Errorf("Can't read known hosts '%s': %s", cfg.KnownHosts, err)
+	}
+
+	err = check(hostPort(host), &net.TCPAddr{}, key)
+	if err == nil {
+		return nil
+	}
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return err
+	}
+
+	got := ssh.FingerprintSHA256(key)
+	if len(keyErr.Want) > 0 {
+		want := []string{}
+		for _, k := range keyErr.Want {
+			want = append(want, ssh.FingerprintSHA256(k.Key))
+		}
+		return &HostKeyError{Host: host, Got: got, Want: want, Path: cfg.KnownHosts}
+	}
+
+	// A new host; trust it if it matches what we were told to expect
+	if prints, ok := seeded[knownhosts.Normalize(host)]; ok {
+		if !matchesFingerprint(key, prints) {
+			return &HostKeyError{Host: host, Got: got, Want: prints, Path: cfg.KnownHosts}
+		}
+		delete(seeded, knownhosts.Normalize(host))
+	} else if cfg.HostKeys == HostKeysStrict {
+		return &HostKeyError{Host: host, Got: got, Path: cfg.KnownHosts}
+	}
+
+	log.Infof("Adding host key %s for '%s' to %s", got, host, cfg.KnownHosts)
+	return appendHostKey(cfg.KnownHosts, host, key)
+}
+
+// SeedHostKeys records what we know of a host's keys before we
+// connect to it, eg. from the EC2 console output of an instance.
+// Full public keys (as found in `authorized_keys` files) replace any
+// keys already known for the host.  Without keys, fingerprints are
+// checked the first time we connect, which only the native transport
+// can do.
+func SeedHostKeys(host string, keys []string, fingerprints []string) error {
+	parsed := []ssh.PublicKey{}
+	for _, k := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return fmt.Errorf("Can't parse host key for '%s': %s", host, err)
+		}
+		parsed = append(parsed, key)
+	}
+
+	if len(parsed) == 0 {
+		if len(fingerprints) == 0 {
+			return nil
+		}
+		if CurrentConfig().Transport != TransportNative {
+			return fmt.Errorf("Can't seed host key fingerprints for '%s': the %s transport "+
+				"can only check full keys.  Seed keys, or use the native transport.",
+				host, CurrentConfig().Transport)
+		}
+		knownHostsMu.Lock()
+		seeded[knownhosts.Normalize(host)] = append([]string{}, fingerprints...)
+		knownHostsMu.Unlock()
+		return nil
+	}
+
+	path := CurrentConfig().KnownHosts
+	if err := ForgetHostKeys(host); err != nil {
+		return err
+	}
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	if err := ensureKnownHosts(path); err != nil {
+		return err
+	}
+	for _, key := range parsed {
+		if err := appendHostKey(path, host, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForgetHostKeys removes every key known for host, eg. after the
+// instance behind an address has been replaced.
+func ForgetHostKeys(host string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	name := knownhosts.Normalize(host)
+	delete(seeded, name)
+
+	path := CurrentConfig().KnownHosts
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Can't open known hosts '%s': %s", path, err)
+	}
+	kept := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) > 1 && !strings.HasPrefix(fields[0], "#") && !strings.HasPrefix(fields[0], "@") {
+			found := false
+			for _, h := range strings.Split(fields[0], ",") {
+				if h == name {
+					found = true
+				}
+			}
+			if found {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Can't read known hosts '%s': %s", path, err)
+	}
+
+	content := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		content += "\n"
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return fmt.Errorf("Can't write known hosts '%s': %s", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Options for the local ssh and scp commands, following the host key
+// policy.  Hosts seeded with only fingerprints can't be checked by
+// the local commands, so they are refused rather than trusted.
+func openSSHHostKeyArgs(host string) []string {
+	cfg := CurrentConfig()
+
+	knownHostsMu.Lock()
+	_, unchecked := seeded[knownhosts.Normalize(host)]
+	knownHostsMu.Unlock()
+	if unchecked && cfg.HostKeys != HostKeysOff {
+		mcore.Failf("Host key fingerprints seeded for '%s' can only be checked by the native transport.  "+
+			"Seed its keys, or use the native transport.", host)
+	}
+
+	switch cfg.HostKeys {
+	case HostKeysOff:
+		return []string{
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "UserKnownHostsFile=/dev/null",
+		}
+	case HostKeysStrict:
+		return []string{
+			"-o", "StrictHostKeyChecking=yes",
+			"-o", "UserKnownHostsFile=" + cfg.KnownHosts,
+		}
+	}
+	return []string{
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile=" + cfg.KnownHosts,
+	}
+}
+
+// The local ssh command reports host key trouble on stderr
+func openSSHHostKeyFailure(ip string, errOut string) {
+	if strings.Contains(errOut, "REMOTE HOST IDENTIFICATION HAS CHANGED") {
+		mcore.Failf("HOST KEY FOR '%s' HAS CHANGED.  Someone may be impersonating the host, "+
+			"or it may have been replaced.  If it was replaced, forget the old key "+
+			"with mithras.remote.hostKeys.forget(\"%s\").", ip, ip)
+	}
+	if strings.Contains(errOut, "Host key verification failed") {
+		mcore.Failf("Host key for '%s' could not be verified against %s: %s",
+			ip, CurrentConfig().KnownHosts, strings.TrimSpace(errOut))
+	}
+}
@@ -0,0 +1,275 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// Hosts without a public address are reached through one or more jump
+// hosts (bastions), as with ssh's ProxyJump.  A chain of jump hosts is
+// written as ProxyJump writes it: "[user@]host[:port],...", nearest
+// first.  "none" means connect directly.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/robertkrimen/otto"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// Ways of choosing the address of an instance.
+const (
+	AddressPublicIP   = "public-ip"
+	AddressPrivateIP  = "private-ip"
+	AddressPublicDNS  = "public-dns"
+	AddressPrivateDNS = "private-dns"
+)
+
+// The chain meaning "no jump hosts"
+const noJump = "none"
+
+type hop struct {
+	user string
+	host string
+}
+
+func (h hop) String() string {
+	return h.user + "@" + h.host
+}
+
+// Jump host chains for particular hosts, overriding the configured one
+var routesMu sync.RWMutex
+var routes = map[string]string{}
+
+// SetRoute makes remote operations on host go through the chain of
+// jump hosts given.  An empty chain reverts to the configured one.
+func SetRoute(host string, jump string) error {
+	if _, err := parseJumps(jump, ""); err != nil {
+		return err
+	}
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	if jump == "" {
+		delete(routes, host)
+	} else {
+		routes[host] = jump
+	}
+	return nil
+}
+
+// ClaimRoute makes remote operations on host go through the chain of
+// jump hosts given, unless it already goes through a different one,
+// which is an error.  An empty chain changes nothing.  Unlike
+// SetRoute, it can't undo what others, running at the same time,
+// rely on.
+func ClaimRoute(host string, jump string) error {
+	if jump == "" {
+		return nil
+	}
+	if _, err := parseJumps(jump, ""); err != nil {
+		return err
+	}
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	if old, ok := routes[host]; ok && old != jump {
+		return fmt.Errorf("'%s' is already reached through '%s', not '%s'", host, old, jump)
+	}
+	routes[host] = jump
+	return nil
+}
+
+// Route returns the chain of jump hosts used to reach host.
+func Route(host string) string {
+	routesMu.RLock()
+	jump, ok := routes[host]
+	routesMu.RUnlock()
+	if ok {
+		return jump
+	}
+	return CurrentConfig().Jump
+}
+
+func parseJumps(spec string, user string) ([]hop, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == noJump {
+		return nil, nil
+	}
+	hops := []hop{}
+	for _, s := range strings.Split(spec, ",") {
+		h := hop{user: user, host: strings.TrimSpace(s)}
+		if i := strings.LastIndex(h.host, "@"); i >= 0 {
+			h.user = h.host[:i]
+			h.host = h.host[i+1:]
+		}
+		if h.host == "" {
+			return nil, fmt.Errorf("Invalid jump host chain '%s'", spec)
+		}
+		hops = append(hops, h)
+	}
+	return hops, nil
+}
+
+// The jump hosts between us and host.  Unless given, a jump host's
+// user is the one used for host.  A jump host is never reached
+// through itself.
+func jumpsFor(user string, host string) []hop {
+	hops, err := parseJumps(Route(host), user)
+	if err != nil {
+		mcore.Failf("%s", err)
+	}
+	for i, h := range hops {
+		if h.host == host || hostPort(h.host) == hostPort(host) {
+			return hops[:i]
+		}
+	}
+	return hops
+}
+
+// AddressOf chooses the address used to reach an instance, following
+// strategy, or the configured strategy if it is empty.
+func AddressOf(inst *ec2.Instance, strategy string) string {
+	if strategy == "" {
+		strategy = CurrentConfig().Address
+	}
+	var addr *string
+	switch strategy {
+	case AddressPublicIP:
+		addr = inst.PublicIpAddress
+	case AddressPrivateIP:
+		addr = inst.PrivateIpAddress
+	case AddressPublicDNS:
+		addr = inst.PublicDnsName
+	case AddressPrivateDNS:
+		addr = inst.PrivateDnsName
+	default:
+		mcore.Failf("Unknown address strategy '%s'", strategy)
+	}
+	id := ""
+	if inst.InstanceId != nil {
+		id = *inst.InstanceId
+	}
+	if addr == nil || *addr == "" {
+		mcore.Failf("Instance '%s' has no %s address.  Instances in private subnets "+
+			"are reached with the private-ip strategy and a jump host.", id, strategy)
+	}
+	return *addr
+}
+
+// HostArg takes the host argument of a JS call: either an address, or
+// an ec2 instance object, whose address is chosen with the configured
+// strategy.
+func HostArg(v otto.Value) string {
+	if !v.IsObject() {
+		return v.String()
+	}
+	return AddressOf(instanceArg(v), "")
+}
+
+func instanceArg(v otto.Value) *ec2.Instance {
+	export, err := v.Export()
+	if err != nil {
+		mcore.Failf("Can't export host: %s", err)
+	}
+	marshalled, err := json.Marshal(export)
+	if err != nil {
+		mcore.Failf("Can't marshal host: %s", err)
+	}
+	var inst ec2.Instance
+	if err = json.Unmarshal(marshalled, &inst); err != nil {
+		mcore.Failf("Can't unmarshall host instance: %s", err)
+	}
+	return &inst
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Options for the local ssh and scp commands to reach ip through its
+// jump hosts.  Each jump host is reached with the same key, so a
+// ProxyCommand is built for each rather than using ProxyJump.  The
+// command for each hop is run by the ssh command of the next, which
+// expands %-tokens in it; inner commands are escaped once for each
+// level they are nested.
+func openSSHJumpArgs(ip string, user string, keypath string) []string {
+	hops := jumpsFor(user, ip)
+	if len(hops) == 0 {
+		return nil
+	}
+
+	proxy := ""
+	for _, h := range hops {
+		args := []string{
+			"ssh",
+			"-o", "IdentityFile=" + strings.Replace(keypath, "%", "%%", -1),
+			"-o", "KbdInteractiveAuthentication=no",
+			"-o", "PasswordAuthentication=no",
+			"-o", "User=" + h.user,
+			"-o", connectTimeoutOption(),
+		}
+		for _, a := range openSSHHostKeyArgs(h.host) {
+			args = append(args, strings.Replace(a, "%", "%%", -1))
+		}
+		if proxy != "" {
+			args = append(args, "-o", "ProxyCommand="+strings.Replace(proxy, "%", "%%", -1))
+		}
+		host := h.host
+		if hostOnly, port, err := net.SplitHostPort(h.host); err == nil {
+			host = hostOnly
+			args = append(args, "-p", port)
+		}
+		args = append(args, "-W", "%h:%p", host)
+
+		quoted := []string{}
+		for _, a := range args {
+			quoted = append(quoted, shellQuote(a))
+		}
+		proxy = strings.Join(quoted, " ")
+	}
+	return []string{"-o", "ProxyCommand=" + proxy}
+}
+
+// Reachable reports whether a TCP connection can be made to port on a
+// host behind jump hosts, by trying it from the nearest jump host.
+// The second result is false if host isn't behind jump hosts.
+func Reachable(host string, user string, keypath string, port int) (bool, bool) {
+	hops := jumpsFor(user, host)
+	if len(hops) == 0 {
+		return false, false
+	}
+
+	// Reach the nearest jump host through the others
+	last := hops[len(hops)-1]
+	via := []string{}
+	for _, h := range hops[:len(hops)-1] {
+		via = append(via, h.String())
+	}
+	if len(via) == 0 {
+		via = append(via, noJump)
+	}
+	if err := ClaimRoute(last.host, strings.Join(via, ",")); err != nil {
+		mcore.Failf("%s", err)
+	}
+
+	target := shellQuote(fmt.Sprintf("exec 3<>/dev/tcp/%s/%d", host, port))
+	empty := ""
+	_, _, ok, _ := RemoteShell(last.host, last.user, keypath, &empty, "timeout 3 bash -c "+target, nil, true)
+	return ok, true
+}
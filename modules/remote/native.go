@@ -0,0 +1,472 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// The native transport talks to remote hosts with an SSH client built
+// into mithras, instead of running the local ssh and scp commands.
+// Connections are kept open and reused, one for each user@host.
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// Status reported when a host can't be reached, as ssh does
+const connectFailed = 255
+
+// Pool holds open connections to remote hosts.
+type Pool struct {
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+// Connections is the pool used by the native transport.
+var Connections = &Pool{clients: map[string]*ssh.Client{}}
+
+func poolKey(user string, host string, via []hop) string {
+	key := user + "@" + host
+	for i := len(via) - 1; i >= 0; i-- {
+		key += " via " + via[i].String()
+	}
+	return key
+}
+
+// Get returns an open connection to host as user, dialing one if
+// needed.  The connection goes through the jump hosts configured for
+// host.
+func (p *Pool) Get(user string, host string, keypath string) (*ssh.Client, error) {
+	return p.get(user, host, keypath, jumpsFor(user, host))
+}
+
+func (p *Pool) get(user string, host string, keypath string, via []hop) (*ssh.Client, error) {
+	key := poolKey(user, host, via)
+	p.mu.Lock()
+	c, ok := p.clients[key]
+	p.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	// Dial without the lock, so slow hosts don't hold up others
+	c, err := p.dial(user, host, keypath, via)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.clients[key]; ok {
+		c.Close()
+		return existing, nil
+	}
+	p.clients[key] = c
+	return c, nil
+}
+
+// Dial host, through the last of the jump hosts, which is itself
+// reached through those before it.
+func (p *Pool) dial(user string, host string, keypath string, via []hop) (*ssh.Client, error) {
+	if len(via) == 0 {
+		return dial(user, host, keypath, nil)
+	}
+	last := via[len(via)-1]
+	jump, err := p.get(last.user, last.host, keypath, via[:len(via)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	// The pooled jump host connection may have gone away
+	if _, _, err := jump.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		p.Drop(jump)
+		if jump, err = p.get(last.user, last.host, keypath, via[:len(via)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return dial(user, host, keypath, jump)
+}
+
+// Drop closes and forgets a connection, if it is still pooled.
+func (p *Pool) Drop(c *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, existing := range p.clients {
+		if existing == c {
+			delete(p.clients, key)
+		}
+	}
+	c.Close()
+}
+
+// CloseAll closes every pooled connection.
+func (p *Pool) CloseAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, c := range p.clients {
+		c.Close()
+		delete(p.clients, key)
+	}
+}
+
+// Keys lists the user@host of every pooled connection, followed by
+// the jump hosts it goes through, nearest last.
+func (p *Pool) Keys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := []string{}
+	for key := range p.clients {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func hostPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// Connect to host, directly or through an open connection to a jump
+// host.
+func dial(user string, host string, keypath string, jump *ssh.Client) (*ssh.Client, error) {
+	signers := []ssh.Signer{}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+
+	if keypath != "" {
+		pem, err := ioutil.ReadFile(keypath)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read ssh key '%s': %s", keypath, err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			// Encrypted keys may still be usable through the agent
+			if sock == "" {
+				return nil, fmt.Errorf("Can't parse ssh key '%s': %s", keypath, err)
+			}
+			log.Debugf("Can't parse ssh key '%s', relying on agent: %s", keypath, err)
+		} else {
+			signers = append(signers, signer)
+		}
+	}
+
+	if sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Debugf("Can't reach ssh agent at '%s': %s", sock, err)
+		} else {
+			defer conn.Close()
+			if more, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, more...)
+			}
+		}
+	}
+
+	// The ssh package doesn't pass our error back, so keep it
+	var keyErr error
+	settings := CurrentConfig()
+	cfg := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			keyErr = CheckHostKey(settings, host, key)
+			return keyErr
+		},
+		Timeout: seconds(settings.ConnectTimeout),
+	}
+	var client *ssh.Client
+	var err error
+	if jump == nil {
+		client, err = ssh.Dial("tcp", hostPort(host), cfg)
+	} else {
+		client, err = dialVia(jump, host, cfg)
+	}
+	if err != nil {
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		return nil, fmt.Errorf("Can't connect to '%s' as '%s': %s", host, user, err)
+	}
+
+	if sock != "" {
+		if err := agent.ForwardToRemote(client, sock); err != nil {
+			log.Debugf("Can't forward ssh agent to '%s': %s", host, err)
+		}
+	}
+	return client, nil
+}
+
+func dialVia(jump *ssh.Client, host string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := jump.Dial("tcp", hostPort(host))
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, hostPort(host), cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Open a session, redialing once if the pooled connection has gone
+// away.
+func session(user string, host string, keypath string) (*ssh.Client, *ssh.Session, error) {
+	client, err := Connections.Get(user, host, keypath)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := client.NewSession()
+	if err == nil {
+		return client, s, nil
+	}
+
+	Connections.Drop(client)
+	client, err = Connections.Get(user, host, keypath)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err = client.NewSession()
+	if err != nil {
+		Connections.Drop(client)
+		return nil, nil, fmt.Errorf("Can't open ssh session on '%s': %s", host, err)
+	}
+	return client, s, nil
+}
+
+func failed(err error, status int) (*string, *string, bool, int) {
+	// Host key trouble must not be mistaken for an unreachable host
+	if _, ok := err.(*HostKeyError); ok {
+		mcore.Failf("%s", err)
+	}
+	out := ""
+	e := err.Error()
+	return &out, &e, false, status
+}
+
+// NativeShell runs cmd in a shell on a remote host, with the same
+// results as RemoteShell.  With no input, a pty is requested, as
+// with `ssh -tt`.
+func NativeShell(ip string, user string, keypath string, input *string, cmd string) (*string, *string, bool, int) {
+	return NativeShellStream(ip, user, keypath, input, cmd, nil)
+}
+
+// NativeShellStream is NativeShell, passing each line of output to
+// sink as it arrives, if sink isn't nil.
+func NativeShellStream(ip string, user string, keypath string, input *string, cmd string, sink Sink) (*string, *string, bool, int) {
+	return nativeShell(ip, user, keypath, input, cmd, sink, nil)
+}
+
+// When d expires, the connection is dropped, ending whatever is
+// using it.
+func nativeShell(ip string, user string, keypath string, input *string, cmd string, sink Sink, d *deadline) (*string, *string, bool, int) {
+	client, s, err := session(user, ip, keypath)
+	if err != nil {
+		return failed(err, connectFailed)
+	}
+	defer s.Close()
+	d.onExpiry(func() { Connections.Drop(client) })
+
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		if err := agent.RequestAgentForwarding(s); err != nil {
+			log.Debugf("Can't request agent forwarding on '%s': %s", ip, err)
+		}
+	}
+
+	out := newLineWriter("stdout", sink)
+	errOut := newLineWriter("stderr", sink)
+	s.Stdout = out
+	s.Stderr = errOut
+	if input != nil {
+		s.Stdin = strings.NewReader(*input)
+	} else {
+		modes := ssh.TerminalModes{ssh.ECHO: 0}
+		if err := s.RequestPty("xterm", 24, 200, modes); err != nil {
+			return failed(fmt.Errorf("Can't get a pty on '%s': %s", ip, err), connectFailed)
+		}
+	}
+
+	status := 0
+	ok := true
+	err = s.Run(cmd)
+	out.Flush()
+	errOut.Flush()
+	if err != nil {
+		ok = false
+		if exit, isExit := err.(*ssh.ExitError); isExit {
+			status = exit.ExitStatus()
+		} else {
+			status = connectFailed
+			errOut.Write([]byte(err.Error()))
+		}
+	}
+
+	resultOut := out.String()
+	resultErr := errOut.String()
+	return &resultOut, &resultErr, ok, status
+}
+
+// NativeCopy copies a local file or directory to a remote host over
+// SFTP, preserving modes and times, as `scp -p -r` does.
+func NativeCopy(ip string, user string, keypath string, src string, dest string) (*string, *string, bool, int) {
+	return nativeCopy(ip, user, keypath, src, dest, nil)
+}
+
+func nativeCopy(ip string, user string, keypath string, src string, dest string, d *deadline) (*string, *string, bool, int) {
+	client, err := Connections.Get(user, ip, keypath)
+	if err != nil {
+		return failed(err, connectFailed)
+	}
+	d.onExpiry(func() { Connections.Drop(client) })
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		Connections.Drop(client)
+		return failed(fmt.Errorf("Can't start sftp on '%s': %s", ip, err), connectFailed)
+	}
+	defer sc.Close()
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return failed(err, 1)
+	}
+
+	// Like scp, copy into an existing directory
+	target := dest
+	if fi, err := sc.Stat(dest); err == nil && fi.IsDir() {
+		target = path.Join(dest, filepath.Base(src))
+	}
+
+	if !info.IsDir() {
+		if err := sftpPut(sc, src, target, info); err != nil {
+			return failed(err, 1)
+		}
+		out := ""
+		return &out, &out, true, 0
+	}
+
+	err = filepath.Walk(src, func(local string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, local)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(target, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			if existing, err := sc.Stat(remote); err != nil || !existing.IsDir() {
+				if err := sc.Mkdir(remote); err != nil {
+					return fmt.Errorf("Can't create remote directory '%s': %s", remote, err)
+				}
+			}
+			return sc.Chmod(remote, fi.Mode().Perm())
+		}
+		return sftpPut(sc, local, remote, fi)
+	})
+	if err != nil {
+		return failed(err, 1)
+	}
+	out := ""
+	return &out, &out, true, 0
+}
+
+// NativeFetch copies a file from a remote host over SFTP, preserving
+// its mode and times, as `scp -p` does.
+func NativeFetch(ip string, user string, keypath string, src string, dest string) (*string, *string, bool, int) {
+	return nativeFetch(ip, user, keypath, src, dest, nil)
+}
+
+func nativeFetch(ip string, user string, keypath string, src string, dest string, d *deadline) (*string, *string, bool, int) {
+	client, err := Connections.Get(user, ip, keypath)
+	if err != nil {
+		return failed(err, connectFailed)
+	}
+	d.onExpiry(func() { Connections.Drop(client) })
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		Connections.Drop(client)
+		return failed(fmt.Errorf("Can't start sftp on '%s': %s", ip, err), connectFailed)
+	}
+	defer sc.Close()
+
+	rf, err := sc.Open(src)
+	if err != nil {
+		return failed(fmt.Errorf("Can't open remote file '%s': %s", src, err), 1)
+	}
+	defer rf.Close()
+	info, err := rf.Stat()
+	if err != nil {
+		return failed(err, 1)
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return failed(err, 1)
+	}
+	if _, err := io.Copy(f, rf); err != nil {
+		f.Close()
+		return failed(fmt.Errorf("Can't read remote file '%s': %s", src, err), 1)
+	}
+	if err := f.Close(); err != nil {
+		return failed(err, 1)
+	}
+	if err := os.Chmod(dest, info.Mode().Perm()); err != nil {
+		return failed(err, 1)
+	}
+	if err := os.Chtimes(dest, info.ModTime(), info.ModTime()); err != nil {
+		return failed(err, 1)
+	}
+	out := ""
+	return &out, &out, true, 0
+}
+
+func sftpPut(sc *sftp.Client, local string, remote string, info os.FileInfo) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rf, err := sc.Create(remote)
+	if err != nil {
+		return fmt.Errorf("Can't create remote file '%s': %s", remote, err)
+	}
+	if _, err := io.Copy(rf, f); err != nil {
+		rf.Close()
+		return fmt.Errorf("Can't write remote file '%s': %s", remote, err)
+	}
+	if err := rf.Close(); err != nil {
+		return err
+	}
+	if err := sc.Chmod(remote, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return sc.Chtimes(remote, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,285 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// Remote operations are given a time limit, and retried with backoff
+// when the host can't be reached.  When they fail, why is worked out
+// from what ssh said, so callers can tell a host which is down from
+// a command which failed.  Only failures to connect are retried: once
+// a command may have started, running it again mightn't be safe.
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Why a remote operation failed
+const (
+	// The host couldn't be reached, so nothing was run
+	FailureUnreachable = "unreachable"
+	// The host wouldn't let us log in
+	FailureAuth = "auth"
+	// The command ran, and failed, or ssh failed once it may have
+	// started
+	FailureCommand = "command"
+	// The operation took longer than its timeout
+	FailureTimeout = "timeout"
+)
+
+// The longest wait between retries
+const maxBackoff = 60 * time.Second
+
+// Policy bounds the time a remote operation may take, and says how it
+// is retried.
+type Policy struct {
+	// Seconds each attempt may take, from here, connecting included;
+	// 0 for no limit.  Not to be confused with the timeout of a
+	// wrapper job, which limits the command on the remote host.
+	Timeout float64 `json:"timeout"`
+	// How many times an operation is retried while the host is
+	// unreachable
+	Retries int `json:"retries"`
+	// Seconds to wait before the first retry, doubling for each
+	// after
+	Backoff float64 `json:"backoff"`
+}
+
+func (p Policy) validate() error {
+	if p.Timeout < 0 {
+		return fmt.Errorf("Invalid remote timeout %g", p.Timeout)
+	}
+	if p.Retries < 0 {
+		return fmt.Errorf("Invalid remote retries %d", p.Retries)
+	}
+	if p.Backoff < 0 {
+		return fmt.Errorf("Invalid remote backoff %g", p.Backoff)
+	}
+	return nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// How long to wait before retry number n, counting from 1
+func (p Policy) backoff(n int) time.Duration {
+	wait := seconds(p.Backoff)
+	for i := 1; i < n && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// Settings overriding those of a policy, for one call
+type policyOverride struct {
+	Timeout *float64 `json:"timeout"`
+	Retries *int     `json:"retries"`
+	Backoff *float64 `json:"backoff"`
+}
+
+// The configured policy, with o's settings.
+func (o policyOverride) resolve() (Policy, error) {
+	p := o.apply(CurrentConfig().Policy())
+	return p, p.validate()
+}
+
+func (o policyOverride) apply(p Policy) Policy {
+	if o.Timeout != nil {
+		p.Timeout = *o.Timeout
+	}
+	if o.Retries != nil {
+		p.Retries = *o.Retries
+	}
+	if o.Backoff != nil {
+		p.Backoff = *o.Backoff
+	}
+	return p
+}
+
+// Outcome is the result of a remote operation, with why it failed, if
+// it did, and how many attempts were made.
+type Outcome struct {
+	Out      string
+	Err      string
+	Ok       bool
+	Status   int
+	Failure  string
+	Attempts int
+}
+
+// Results returns the outcome as RemoteShell does.
+func (o *Outcome) Results() (*string, *string, bool, int) {
+	return &o.Out, &o.Err, o.Ok, o.Status
+}
+
+// Added to stderr of operations which time out, so callers only
+// seeing their results can tell
+const timedOutMarker = "mithras: timed out after "
+
+// What ssh, and the native transport, say when they can't log in
+var authFailures = []string{
+	"Permission denied",
+	"Too many authentication failures",
+	"unable to authenticate",
+	"no supported methods remain",
+	"Can't read ssh key",
+	"Can't parse ssh key",
+	"Load key",
+}
+
+// What ssh, and the native transport, say when they can't connect,
+// before anything is run
+var connectFailures = []string{
+	"ssh: connect to host",
+	"ssh: Could not resolve hostname",
+	"kex_exchange_identification",
+	"ssh_exchange_identification",
+	"Connection timed out during banner exchange",
+	"Connection closed by",
+	"Can't connect to '",
+	"Can't open ssh session on",
+}
+
+// Classify works out why a remote operation failed from its results,
+// returning "" if it didn't.  Status 255 means ssh itself failed, as
+// it does elsewhere in mithras; it is only taken to mean the host is
+// unreachable if ssh says it couldn't connect.  Otherwise the
+// command, which may itself exit 255, may have run.
+func Classify(ok bool, status int, stderr string) string {
+	switch {
+	case strings.Contains(stderr, timedOutMarker):
+		return FailureTimeout
+	case ok && status == 0:
+		return ""
+	case status != connectFailed:
+		return FailureCommand
+	}
+	for _, s := range authFailures {
+		if strings.Contains(stderr, s) {
+			return FailureAuth
+		}
+	}
+	for _, s := range connectFailures {
+		if strings.Contains(stderr, s) {
+			return FailureUnreachable
+		}
+	}
+	return FailureCommand
+}
+
+// A deadline for one attempt at an operation.  Operations register
+// how to abandon what they are doing when it expires.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	expired bool
+	aborts  []func()
+}
+
+// Start a deadline, or return nil if there is no timeout.
+func startDeadline(timeout time.Duration) *deadline {
+	if timeout <= 0 {
+		return nil
+	}
+	d := &deadline{timeout: timeout}
+	d.timer = time.AfterFunc(timeout, d.expire)
+	return d
+}
+
+func (d *deadline) expire() {
+	d.mu.Lock()
+	d.expired = true
+	aborts := d.aborts
+	d.aborts = nil
+	d.mu.Unlock()
+	for _, f := range aborts {
+		f()
+	}
+}
+
+// Call abort when the deadline expires, or now if it has.  A nil
+// deadline never expires.
+func (d *deadline) onExpiry(abort func()) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.expired {
+		d.aborts = append(d.aborts, abort)
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	abort()
+}
+
+func (d *deadline) stop() {
+	if d != nil {
+		d.timer.Stop()
+	}
+}
+
+// Mark the results of an attempt which ran out of time.
+func (d *deadline) mark(out *string, errOut *string, ok bool, status int) (*string, *string, bool, int) {
+	if d == nil {
+		return out, errOut, ok, status
+	}
+	d.mu.Lock()
+	expired := d.expired
+	d.mu.Unlock()
+	if !expired {
+		return out, errOut, ok, status
+	}
+	e := strings.TrimRight(*errOut, "\n")
+	if e != "" {
+		e += "\n"
+	}
+	e += fmt.Sprintf("%s%s", timedOutMarker, d.timeout)
+	return out, &e, false, connectFailed
+}
+
+// Run an operation on host following policy.  Each attempt is given a
+// deadline, which the operation must honor.
+func withPolicy(host string, policy Policy, op func(d *deadline) (*string, *string, bool, int)) *Outcome {
+	for attempt := 1; ; attempt++ {
+		d := startDeadline(seconds(policy.Timeout))
+		out, errOut, ok, status := d.mark(op(d))
+		d.stop()
+
+		o := &Outcome{
+			Out:      *out,
+			Err:      *errOut,
+			Ok:       ok,
+			Status:   status,
+			Failure:  Classify(ok, status, *errOut),
+			Attempts: attempt,
+		}
+		if o.Failure != FailureUnreachable || attempt > policy.Retries {
+			return o
+		}
+		wait := policy.backoff(attempt)
+		log.Infof("Can't reach '%s'; retrying in %s (%d of %d)", host, wait, attempt, policy.Retries)
+		time.Sleep(wait)
+	}
+}
@@ -27,18 +27,81 @@ package remote
 // including:
 //
 // > * [mithras.remote.scp](#scp)
+// > * [mithras.remote.put](#put)
+// > * [mithras.remote.get](#get)
 // > * [mithras.remote.shell](#shell)
 // > * [mithras.remote.wrapper](#wrapper)
 // > * [mithras.remote.mithras](#mithras)
+// > * [mithras.remote.each](#each)
+// > * [mithras.remote.helpers](#helpers)
+// > * [mithras.remote.configure](#configure)
+// > * [mithras.remote.config](#config)
+// > * [mithras.remote.hostKeys.seed](#seed)
+// > * [mithras.remote.hostKeys.forget](#forget)
+// > * [mithras.remote.route](#route)
+// > * [mithras.remote.jumps](#jumps)
+// > * [mithras.remote.address](#address)
+// > * [mithras.remote.output](#output)
 //
 // This API allows resource handlers to execute tasks on remote hosts
 // in a variety of ways.
 //
+// Remote hosts are reached with one of two transports:
+//
+// > * `openssh` (the default): the local `ssh` and `scp` commands are run under `ssh-agent`, sharing a control master connection for each host
+// > * `native`: an SSH client built into mithras.  Connections are kept open and reused, one for each user@host.  Files are copied with SFTP.
+//
+// Both use the ssh key supplied, and any keys held by `ssh-agent`,
+// and forward the agent to the remote host.  Results are the same
+// whichever transport is used.  The transport is chosen with the
+// global `--ssh-transport` command line flag, or
+// [mithras.remote.configure](#configure).
+//
+// Host keys are checked against a `known_hosts` file kept by mithras,
+// `~/.mithras/known_hosts` unless configured otherwise.  The host key
+// policy decides what happens when a host's key isn't in it:
+//
+// > * `strict`: refuse to connect
+// > * `accept-new` (the default): add the key to the file and connect
+// > * `off`: don't check host keys at all
+//
+// Under `strict` and `accept-new`, a host whose key has changed is
+// refused, and the remote call throws an error saying so.  Keys can
+// be learned ahead of time with
+// [mithras.remote.hostKeys.seed](#seed); `aws.instances.hostKeys`
+// reads them from the console output of an EC2 instance.  The policy
+// is chosen with the global `--host-keys` flag, and the file with
+// `--known-hosts`.
+//
+// Hosts in private subnets are reached through jump hosts (bastions).
+// A chain of jump hosts is written as for ssh's `ProxyJump`:
+// `"[user@]host[:port],..."`, nearest first, or `"none"` for a direct
+// connection.  Jump hosts are reached with the same key as the host
+// behind them, and, unless given, the same user.  The chain used for
+// all hosts is set with the global `--ssh-jump` flag, or the `jump`
+// setting of [mithras.remote.configure](#configure), and may be
+// changed for particular hosts with [mithras.remote.route](#route).
+//
+// Where a function takes an instance object rather than an address,
+// the address is chosen by the `address` setting: `"public-ip"` (the
+// default), `"private-ip"`, `"public-dns"` or `"private-dns"`.
+//
+// The output of `shell`, `wrapper` and `mithras` is normally returned
+// only when the remote command finishes.  It can be streamed a line at
+// a time as it arrives as well, to the log (the `stream` setting, or
+// the global `--stream` flag), or to a function set as
+// [mithras.remote.output](#output).  Either way, the results returned
+// are the same.
+//
 // ## MITHRAS.REMOTE.SCP
 // <a name="scp"></a>
-// `mithras.remote.scp(ip, user, keypath, src, dest);`
+// `mithras.remote.scp(ip, user, keypath, src, dest, options);`
 //
-// Copy a file to a remote host.
+// Copy a file to a remote host.  The optional `options` object may
+// have `timeout`, `retries` and `backoff`, overriding the settings of
+// [mithras.remote.configure](#configure) for this call.  Like
+// `mithras.remote.shell`, it returns `[stdout, stderr, success,
+// status]`, with `failure` and `attempts`.
 //
 // Example:
 //
@@ -51,18 +114,93 @@ package remote
 //                      "/etc/hosts");
 // ```
 //
+// ## MITHRAS.REMOTE.PUT
+// <a name="put"></a>
+// `mithras.remote.put(host, user, keypath, src, dest, options);`
+//
+// Make the file or directory `dest` on a remote host the same as the
+// local `src`, copying only the files whose contents differ.  Files
+// are compared by their SHA-256 checksums, worked out on the remote
+// host by the wrapper installed by `mithras.bootstrap`.  If `src` is a
+// file and `dest` an existing directory, the file is put in it.
+// Files are replaced whole, so a reader never sees half a file.
+// Symlinks are skipped.
+//
+// The optional `options` object may have:
+//
+// > * `delete`: if `true`, remove files under `dest` which aren't under `src`
+// > * `mode`: octal mode for files, eg. `"0644"`.  By default, files and directories get the mode of their source.
+// > * `owner`, `group`: owner and group, by name or number, for everything transferred
+// > * `become`, `becomeUser`, `becomeMethod`: install files with escalated privileges, as with `mithras.remote.mithras`.  Needed to set owners, or to write where the remote user can't.
+// > * `timeout`, `retries`, `backoff`: override the settings of [mithras.remote.configure](#configure) for each step of the transfer
+//
+// Files whose mode or owner is wrong are fixed without copying them.
+// Returns an object with a `changed` property, `true` if anything
+// changed, and `files`, an array with the `path` of each file
+// (relative to `dest`, which is `"."`), the `action` taken
+// (`"create"`, `"update"`, `"attributes"`, `"delete"` or
+// `"unchanged"`), and whether it `changed`.
+//
+// Example:
+//
+// ```
+//
+//  var result = mithras.remote.put(instance,
+//                                  "ec2-user",
+//                                  "/home/user/.ssh/key.pem",
+//                                  "site/",
+//                                  "/var/www/html",
+//                                  {delete: true, owner: "nginx", become: true});
+//  if (result.changed) {
+//      ...
+//  }
+//
+// ```
+//
+// ## MITHRAS.REMOTE.GET
+// <a name="get"></a>
+// `mithras.remote.get(host, user, keypath, src, dest, options);`
+//
+// The reverse of [mithras.remote.put](#put): make the local file or
+// directory `dest` the same as `src` on a remote host, copying only
+// the files whose contents differ.  The options and result are the
+// same; `owner` and `group` are set locally, and `become` only
+// affects how the remote files are described.  Files are copied as
+// the remote user.
+//
 // ## MITHRAS.REMOTE.SHELL
 // <a name="shell"></a>
-// `mithras.remote.shell(ip, user, keypath, input, cmd, env);`
+// `mithras.remote.shell(ip, user, keypath, input, cmd, env, options);`
 //
 // Execute command(s) in a shell on a remote system.  The arg `env`
 // specifies an object mapping environment variables to values for the
-// *local* execution of the ssh command.  If the `input` arg is a
+// *local* execution of the ssh command; without it, ssh runs in
+// mithras' own environment.  If the `input` arg is a
 // string, the stdin of the locally-executed ssh command will be set
 // to the contents of the argument and the locally executed ssh
 // command will not use the `-tt` command line option for setting a
 // tty.
 //
+// The optional `options` may be `false`, to not use an ssh control
+// master, or an object with:
+//
+// > * `control`: whether to use an ssh control master; `true` by default
+// > * `timeout`, `retries`, `backoff`: override the settings of [mithras.remote.configure](#configure) for this call
+//
+// Returns `[stdout, stderr, success, status]`.  The array also has
+// the property `attempts`, the number of times the command was tried,
+// and `failure`, saying why it failed:
+//
+// > * `"unreachable"`: the host couldn't be reached, so nothing was run.  Only these failures are retried.
+// > * `"auth"`: the host refused to let us log in
+// > * `"command"`: the command ran, and exited with a non-zero status, or ssh failed once the command may have started
+// > * `"timeout"`: the command took longer than the timeout allows
+//
+// If it didn't fail, `failure` is `""`.  As ever, status `255` means
+// ssh itself failed.  The results of `mithras.remote.scp`,
+// `mithras.remote.wrapper` and `mithras.remote.mithras` have
+// `failure` too.
+//
 // Example:
 //
 // ```
@@ -74,32 +212,76 @@ package remote
 //                        "cat > /tmp/foo",
 //                        {"envVar": "value"});
 //
+//   var result = mithras.remote.shell(ip, user, key, null, "yum -y update", null,
+//                                     {timeout: 600, retries: 3});
+//   if (result.failure === "unreachable") {
+//     ...
+//   }
+//
 // ```
 //
 // ## MITHRAS.REMOTE.WRAPPER
 // <a name="wrapper"></a>
-// `mithras.remote.wrapper(ip, user, keypath, args, env);`
+// `mithras.remote.wrapper(host, user, keypath, args, env, options);`
 //
 // Execute a single command in a shell on a remote system.  The arg `env`
 // specifies an object mapping environment variables to values for the
-// *remote* execution of the caller-supplied command.
+// *remote* execution of the caller-supplied command.  The `host` is an
+// address, or an ec2 instance object.
+//
+// The optional `options` object may have:
+//
+// > * `stdin`: a string given to the command as its stdin
+// > * `dir`: the working directory of the command
+// > * `umask`: the command's umask, as an octal string, eg. `"022"`
+// > * `timeout`: seconds the command may run before it is killed
+// > * `signal`: the signal sent on timeout, eg. `"TERM"`; `"KILL"` by default.  If the command is still running 5 seconds later, it is sent `KILL`.
+// > * `uid`, `gid`: numeric user and group to run the command as.  Switching to them needs privilege, so use `become`.
+// > * `become`, `becomeUser`, `becomeMethod`: run the wrapper with escalated privileges, as with `mithras.remote.mithras`.  `becomeMethod` defaults to `"sudo"`.
+// > * `policy`: an object with `timeout`, `retries` and `backoff`, overriding the settings of [mithras.remote.configure](#configure) for each step of the call.  Unlike the `timeout` above, which limits the command on the remote host, its `timeout` limits each local ssh or scp that mithras runs, and on expiry abandons it.
+//
+// Like `mithras.remote.shell`, it returns `[stdout, stderr, success,
+// status]`.  The array also has the properties `start` and `end`
+// (timestamps), `duration` (seconds), `signaled` and `signal` (whether,
+// and by which signal, the command was killed), `timedOut`, and
+// `version`, the version of the job protocol spoken by the wrapper on
+// the remote system.  Wrappers installed by mithras versions before
+// the protocol was versioned report `0`, and don't supply timing.
+// Before a job using any of `options` is sent, the wrapper is asked
+// which version it speaks; if it is too old to honor them, an error
+// is thrown, asking for the host to be bootstrapped again, and the
+// command isn't run.
 //
 // Example:
 //
 // ```
 //
-//   mithras.remote.wrapper("52.90.244.101",
-//                          "ec2-user",
-//                          "/home/user/.ssh/key.pem",
-//                          ["ls", "-l"],
-//                          {"envVar": "value"});
+//   var result = mithras.remote.wrapper("52.90.244.101",
+//                                       "ec2-user",
+//                                       "/home/user/.ssh/key.pem",
+//                                       ["ls", "-l"],
+//                                       {"envVar": "value"},
+//                                       {dir: "/var/log", timeout: 30});
+//   log(sprintf("took %f seconds", result.duration));
 //
 // ```
 // ## MITHRAS.REMOTE.MITHRAS
 //
 // <a name="mithras"></a>
-// `mithras.remote.mithras(instance, user, keypath, js, become, becomeUser, becomeMethod);`
+// `mithras.remote.mithras(host, user, keypath, js, become, becomeUser, becomeMethod, options);`
+//
+// Run `js` with mithras on a remote system.  The `host` is an
+// address, or an ec2 instance object.  The script's `run` function
+// is called there; `js` may be that function itself.  The optional
+// `options` object may have `timeout`, `retries` and `backoff`,
+// overriding the settings of [mithras.remote.configure](#configure)
+// for each step of the call.
 //
+// Modules the script requires, and the modules they require in turn,
+// are found here and sent along with it, bundled into the script.  On
+// the remote system, `require` finds them in the bundle, so they
+// needn't be there.  Only requires of string literals are found;
+// modules which can't be found here are looked for there, as usual.
 //
 // Example:
 //
@@ -115,6 +297,210 @@ package remote
 //
 // ```
 //
+// ## MITHRAS.REMOTE.EACH
+// <a name="each"></a>
+// `mithras.remote.each(hosts, options, spec);`
+//
+// Run a shell command, wrapper job or mithras script on many hosts at
+// once.  `hosts` is an array of ec2 instance objects or addresses.
+// `spec` is an object saying what to run, or a function called with
+// each host in turn, returning one.  A function may return `null` to
+// skip a host.  The spec has one of:
+//
+// > * `shell`: a command, as for [mithras.remote.shell](#shell), with optional `input`, `env`, `control`, `timeout`, `retries` and `backoff`
+// > * `wrapper`: an array of args, as for [mithras.remote.wrapper](#wrapper), with optional `env` and `options`.  The `policy` of `options` goes over the spec's `timeout`, `retries` and `backoff`.
+// > * `mithras`: a script, or its `run` function, as for [mithras.remote.mithras](#mithras), with optional `become`, `becomeUser`, `becomeMethod`, `timeout`, `retries` and `backoff`
+//
+// and may give the `user` and `key` (path) to use for the host.  The
+// `options` may have:
+//
+// > * `concurrency`: the number of hosts to run on at once; 10 by default
+// > * `batch`: run hosts in batches of this size, each finishing before the next starts.  By default, there is one batch.
+// > * `maxFailPercentage`: once more than this percentage of hosts have failed, no more are started.  By default, all hosts are run.
+// > * `user`, `key`: the user and key path, or functions of the host returning them
+// > * `resource`: a resource whose params choose the address, user and key for each host, as with `mithras.sshHostForInstance`
+//
+// Returns an object keyed by each host's instance id (or address, if
+// given one), whose values have the `host` address, `out`, `err`,
+// `success` and `status` of the job, `failure`, as for
+// [mithras.remote.shell](#shell), `error`, if it couldn't be run at
+// all, and `skipped`, `true` if it wasn't run.  A job succeeds if
+// its status is 0.  The functions are called before any job starts;
+// output is streamed as for the other functions, labelled with each
+// host.  In dry-run mode, a planned action is recorded for each host.
+//
+// Example:
+//
+// ```
+//
+//  var results = mithras.remote.each(instances,
+//                                    {concurrency: 5, batch: 10, maxFailPercentage: 20,
+//                                     user: "ec2-user", key: "/home/user/.ssh/key.pem"},
+//                                    {shell: "sudo yum -y update"});
+//  _.each(results, function(r, id) {
+//      if (!r.success) {
+//          log(sprintf("%s failed: %s", id, r.error || r.err));
+//      }
+//  });
+//
+// ```
+//
+// ## MITHRAS.REMOTE.HELPERS
+// <a name="helpers"></a>
+// `mithras.remote.helpers`
+//
+// Bootstrap copies the helper binaries named in
+// `mithras.remote.helpers.names`, the `wrapper` and `runner`, from
+// the local build cache to `.mithras/bin` on each host.  Each helper
+// reports its version and build hash, the sha256 of the binary, when
+// run with `--version`.
+//
+// > * `command`: a shell command reporting the helpers on a host, a line per helper
+// > * `parse(out)`: reads the output of `command` into an object keyed by helper name, with `name`, `version`, `protocol` and `build`
+// > * `cached(name, os, arch)`: describes the cached build of a helper, with `path`, `cached` (whether it's there) and `build`
+// > * `stale(out, name, os, arch)`: whether a helper, as reported by `command`, is missing or differs from its cached build
+//
+// Helpers which aren't in the cache are never stale.
+//
+// Example:
+//
+// ```
+//
+//  var result = mithras.remote.shell(ip, user, key, null, mithras.remote.helpers.command);
+//  if (mithras.remote.helpers.stale(result[0], "wrapper", "linux", "amd64")) {
+//    mithras.remote.scp(ip, user, key,
+//                       mithras.remote.helpers.cached("wrapper", "linux", "amd64").path,
+//                       ".mithras/bin/wrapper");
+//  }
+//
+// ```
+//
+// ## MITHRAS.REMOTE.CONFIGURE
+// <a name="configure"></a>
+// `mithras.remote.configure(settings);`
+//
+// Change remote settings.  Only the properties supplied are changed.
+//
+// > * `transport`: `"openssh"` or `"native"`
+// > * `hostKeys`: the host key policy, `"strict"`, `"accept-new"` or `"off"`
+// > * `knownHosts`: path to the `known_hosts` file managed by mithras
+// > * `jump`: the chain of jump hosts to go through, eg. `"ec2-user@bastion.example.com"`
+// > * `address`: how the address of an instance is chosen: `"public-ip"`, `"private-ip"`, `"public-dns"` or `"private-dns"`
+// > * `stream`: if `true`, log each line of output of remote commands as it arrives, labelled `[host resource]`
+// > * `connectTimeout`: seconds to wait for a connection; 10 by default
+// > * `timeout`: seconds each remote operation may take before it is abandoned; `0`, the default, for no limit
+// > * `retries`: how many times an operation is retried when its host can't be connected to; `0` by default.  Once ssh has connected, the command may have run, so it is not tried again.
+// > * `backoff`: seconds to wait before the first retry, doubling before each after, up to a minute; 1 by default
+//
+// Timeouts and retries apply to every remote operation, including
+// each step of `mithras.remote.wrapper`, `mithras.remote.mithras`
+// and the transfers, unless the call gives its own.  The `timeout`
+// limits what mithras runs locally, ssh or scp, and is not the
+// `timeout` option of `mithras.remote.wrapper`, which limits the
+// command on the remote host.
+//
+// Example:
+//
+// ```
+//
+//  mithras.remote.configure({transport: "native"});
+//
+// ```
+//
+// ## MITHRAS.REMOTE.CONFIG
+// <a name="config"></a>
+// `mithras.remote.config();`
+//
+// Returns the current remote settings.
+//
+// ## MITHRAS.REMOTE.HOSTKEYS.SEED
+// <a name="seed"></a>
+// `mithras.remote.hostKeys.seed(host, known);`
+//
+// Tell mithras about a host's keys before connecting to it.  The
+// `known` object may have:
+//
+// > * `keys`: an array of public keys in `authorized_keys` format, eg. `"ssh-ed25519 AAAA..."`.  They replace any keys already known for `host`.
+// > * `fingerprints`: an array of key fingerprints, eg. `"SHA256:..."`.  The first key the host presents must match one of them, whatever the policy.  Fingerprints are only used without `keys`, and only the native transport can check them, so seeding them alone fails with the OpenSSH transport.
+//
+// Example:
+//
+// ```
+//
+//  var known = aws.instances.hostKeys("us-east-1", "i-0123456789abcdef0");
+//  mithras.remote.hostKeys.seed("52.90.244.101", known);
+//
+// ```
+//
+// ## MITHRAS.REMOTE.HOSTKEYS.FORGET
+// <a name="forget"></a>
+// `mithras.remote.hostKeys.forget(host);`
+//
+// Forget every key known for `host`, eg. after the instance behind
+// an address has been replaced.
+//
+// ## MITHRAS.REMOTE.ROUTE
+// <a name="route"></a>
+// `mithras.remote.route(host, jump, options);`
+//
+// Reach `host` through the chain of jump hosts `jump`, given as a
+// string or an array of hops, instead of the configured chain.  Use
+// `"none"` to connect directly, and `null` to use the configured
+// chain again.
+//
+// Routes are shared by everything running, including resources
+// handled at the same time.  If `options` sets `replace` to `false`,
+// a route is only added: a `null` chain changes nothing, and a chain
+// different from the one already set for `host` throws an error.
+// This is how [mithras.sshHostForInstance](mithras.html#sshHostForInstance)
+// sets routes.
+//
+// Example:
+//
+// ```
+//
+//  mithras.remote.route("10.0.1.5", ["bastion.example.com", "admin@10.0.0.7"]);
+//
+// ```
+//
+// ## MITHRAS.REMOTE.JUMPS
+// <a name="jumps"></a>
+// `mithras.remote.jumps(host);`
+//
+// Returns the chain of jump hosts used to reach `host`.
+//
+// ## MITHRAS.REMOTE.ADDRESS
+// <a name="address"></a>
+// `mithras.remote.address(instance, strategy);`
+//
+// Returns the address of an ec2 instance, chosen by `strategy`
+// (`"public-ip"`, `"private-ip"`, `"public-dns"` or `"private-dns"`),
+// or the `address` setting if it is not given.  Throws if the
+// instance has no such address.
+//
+// ## MITHRAS.REMOTE.OUTPUT
+// <a name="output"></a>
+// `mithras.remote.output = function(line, info) {...};`
+//
+// Not a function mithras supplies, but one a script may set.  If
+// `mithras.remote.output` is a function, it is called with each line
+// of output of `shell`, `wrapper` and `mithras` as it arrives.  The
+// `info` object has the `host` the line came from, the `resource`
+// being handled (see `mithras.resource`), and the `stream`,
+// `"stdout"` or `"stderr"`.  When no input is given, remote commands
+// run with a tty, so their stderr arrives as stdout.  Errors thrown
+// by the function are logged and otherwise ignored.
+//
+// Example:
+//
+// ```
+//
+//  mithras.remote.output = function(line, info) {
+//      console.log(sprintf("%s %s: %s", info.host, info.resource, line));
+//  };
+//
+// ```
+//
 
 import (
 	"bufio"
@@ -128,25 +514,144 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
 	mcore "github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/require"
+)
+
+// The version of the JobSpec and Results exchanged with wrapper.
+// Wrappers before versioning report none, and so version 0.
+const WrapperProtocol = 3
+
+// The versions which added job options and timing, and file
+// operations
+const (
+	protocolJobOptions = 2
+	protocolFiles      = 3
 )
 
 // Wrapper runs programs and captures the results in this structure.
 type Results struct {
-	Out     string
-	Err     string
-	Success bool
-	Status  int
+	Version  int
+	Out      string
+	Err      string
+	Success  bool
+	Status   int
+	Start    time.Time
+	End      time.Time
+	Duration float64
+	Signaled bool
+	Signal   string
+	TimedOut bool
+	Files    []FileStat
 }
 
 // JobSpec is used to tell wrapper what to run
 type JobSpec struct {
-	Cmd []string
-	Env map[string]string
+	Version int
+	Cmd     []string
+	Env     map[string]string
+	Stream  bool
+	Stdin   string
+	Dir     string
+	Umask   string
+	Timeout float64
+	Signal  string
+	Uid     *uint32
+	Gid     *uint32
+	Op      string
+	Path    string
+	From    string
+	Changes []FileChange
+	Owner   string
+	Group   string
+}
+
+// The version of the protocol a wrapper must speak to run spec.
+func (spec *JobSpec) needs() int {
+	if spec.Op != "" {
+		return protocolFiles
+	}
+	if spec.Stdin != "" || spec.Dir != "" || spec.Umask != "" ||
+		spec.Timeout > 0 || spec.Signal != "" || spec.Uid != nil || spec.Gid != nil {
+		return protocolJobOptions
+	}
+	return 0
+}
+
+// Options for `mithras.remote.wrapper`
+type wrapperOptions struct {
+	Stdin   string  `json:"stdin"`
+	Dir     string  `json:"dir"`
+	Umask   string  `json:"umask"`
+	Timeout float64 `json:"timeout"`
+	Signal  string  `json:"signal"`
+	Uid     *uint32 `json:"uid"`
+	Gid     *uint32 `json:"gid"`
+	// Run the wrapper with escalated privileges
+	Become       bool   `json:"become"`
+	BecomeUser   string `json:"becomeUser"`
+	BecomeMethod string `json:"becomeMethod"`
+	// The timeout and retries of each step from here; Timeout is the
+	// command's, on the remote host
+	Policy policyOverride `json:"policy"`
+}
+
+func (opts *wrapperOptions) jobSpec(cmd []string, env map[string]string) JobSpec {
+	return JobSpec{
+		Cmd:     cmd,
+		Env:     env,
+		Stdin:   opts.Stdin,
+		Dir:     opts.Dir,
+		Umask:   opts.Umask,
+		Timeout: opts.Timeout,
+		Signal:  opts.Signal,
+		Uid:     opts.Uid,
+		Gid:     opts.Gid,
+	}
+}
+
+// Remote calls report no output and success in dry-run mode
+var dryRunResults = []interface{}{"", "", true, 0}
+
+// Options for `mithras.remote.shell`
+type shellOptions struct {
+	Control bool `json:"control"`
+	policyOverride
+}
+
+// Say why an operation failed on its `[stdout, stderr, success,
+// status]` results.
+func withFailure(v otto.Value) otto.Value {
+	o := v.Object()
+	e, _ := o.Get("1")
+	ok, _ := o.Get("2")
+	status, _ := o.Get("3")
+	success, _ := ok.ToBoolean()
+	code, _ := status.ToInteger()
+	o.Set("failure", Classify(success, int(code), e.String()))
+	return v
+}
+
+// The policy for a call: the configured one, with the timeout,
+// retries and backoff given in options, if it is an object.
+func callPolicy(context *mcore.Context, options otto.Value) Policy {
+	var o policyOverride
+	if options.IsObject() {
+		if err := jsonInto(context.Runtime, options, &o); err != nil {
+			context.Throwf("Invalid remote options: %s", err)
+		}
+	} else if options.IsDefined() && !options.IsNull() {
+		context.Throwf("Remote options must be an object.")
+	}
+	policy, err := o.resolve()
+	if err != nil {
+		context.Throwf("%s", err)
+	}
+	return policy
 }
 
 // A map of SSH masters
@@ -168,102 +673,210 @@ func doBecome(cmd string, become bool, becomeUser string, becomeMethod string) s
 
 // Run mithras on a remote system, perhaps with escalated privileges,
 // using the supplied javascript as the file mithras will read in and
-// call the `run()` function on.
-func RemoteMithras(inst *ec2.Instance, user string, keypath string, js string, become bool, becomeUser string, becomeMethod string, verbose bool) (*string, *string, bool, int) {
+// call the `run()` function on.  Output of the remote run is passed a
+// line at a time to sink, if it isn't nil.
+func RemoteMithras(host string, user string, keypath string, js string, become bool, becomeUser string, becomeMethod string, verbose bool, sink Sink) (*string, *string, bool, int) {
+	return RemoteMithrasPolicy(host, user, keypath, js, become, becomeUser, becomeMethod, verbose, sink, CurrentConfig().Policy())
+}
+
+// RemoteMithrasPolicy is RemoteMithras, following policy rather than
+// the configured timeout and retries in each of its steps.
+func RemoteMithrasPolicy(host string, user string, keypath string, js string, become bool, becomeUser string, becomeMethod string, verbose bool, sink Sink, policy Policy) (*string, *string, bool, int) {
+
+	// Take along the modules it requires
+	js = require.Script(js)
 
 	// Copy caller's file to remote temporary file
-	o, e, success, status := RemoteShell(*inst.PublicIpAddress,
+	o, e, success, status := RemoteShellPolicy(host,
 		user,
 		keypath,
 		&js,
 		`export foo=$(mktemp ./.mithras/scripts/runXXXXXX); dd of=$foo oflag=append conv=notrunc >/dev/null 2>&1 > /dev/null; echo $foo`,
 		nil,
-		true)
+		true,
+		nil,
+		policy).Results()
 	if !success {
-		log.Fatalf("Error moving script to remote system '%s': success: %t; %s %s",
-			*inst.PublicIpAddress, status, *o, *e)
+		mcore.Failf("Error moving script to remote system '%s': status: %d; %s %s",
+			host, status, *o, *e)
 	}
 	remoteFile := strings.TrimSpace(*o)
 
-	// Run it via ssh
-	cmd := doBecome("./.mithras/bin/runner -m .mithras run -f "+remoteFile, become, becomeUser, becomeMethod)
-	o, e, success, status = RemoteWrapper(inst, user, keypath, strings.Fields(cmd), nil, verbose)
-
-	// Dump the temporary file
+	// Dump the temporary file, however the job goes
 	defer func() {
-		o, e, success, status = RemoteShell(*inst.PublicIpAddress, user, keypath, nil, fmt.Sprintf(`rm %s`, remoteFile), nil, true)
+		o, e, success, status := RemoteShellPolicy(host, user, keypath, nil, fmt.Sprintf(`rm %s`, remoteFile), nil, true, nil, policy).Results()
 		if !success {
-			log.Fatalf("Error removing script on remote system '%s': success: %t; %s %s",
-				*inst.PublicIpAddress, status, *o, *e)
+			log.Warnf("Error removing script on remote system '%s': status: %d; %s %s",
+				host, status, *o, *e)
 		}
 	}()
 
-	return o, e, success, status
+	// Run it via ssh
+	cmd := doBecome("./.mithras/bin/runner -m .mithras run -f "+remoteFile, become, becomeUser, becomeMethod)
+	results := RemoteJobPolicy(host, user, keypath, JobSpec{Cmd: strings.Fields(cmd)}, false, "", "", verbose, sink, policy)
+
+	return &results.Out, &results.Err, results.Success, results.Status
 }
 
 // Callers use `RemoteWrapper` to run a single program on a remote
 // system, supplying a set of args and an environment, capturing the
-// results in a consistent way.
-func RemoteWrapper(inst *ec2.Instance, user string, keypath string, cmd []string, env *map[string]string, verbose bool) (*string, *string, bool, int) {
-
-	// Create spec
+// results in a consistent way.  If sink isn't nil, the wrapper
+// streams output as it arrives, and each line is passed to sink.
+func RemoteWrapper(host string, user string, keypath string, cmd []string, env *map[string]string, verbose bool, sink Sink) (*string, *string, bool, int) {
 	spec := JobSpec{
 		Cmd: cmd,
 	}
 	if env != nil {
 		spec.Env = *env
 	}
+	results := RemoteJob(host, user, keypath, spec, false, "", "", verbose, sink)
+	return &results.Out, &results.Err, results.Success, results.Status
+}
+
+// The script to run remotely given v, a script or its run function.
+func mithrasScript(v otto.Value) string {
+	if v.IsFunction() {
+		return fmt.Sprintf("var run = %s;\n", v.String())
+	}
+	return v.String()
+}
+
+// The newest wrapper protocol found on each host, so that a host
+// isn't asked again for jobs it's new enough for
+var wrapperProtocols = struct {
+	sync.Mutex
+	found map[string]int
+}{found: map[string]int{}}
+
+// Ask the wrapper on host which protocol it speaks, unless it's
+// already known to speak need.  A wrapper which isn't there, or is
+// too old to report one, speaks 0.
+func wrapperProtocol(host string, user string, keypath string, need int, policy Policy) int {
+	wrapperProtocols.Lock()
+	found, ok := wrapperProtocols.found[host]
+	wrapperProtocols.Unlock()
+	if ok && found >= need {
+		return found
+	}
+
+	o, e, success, status := RemoteShellPolicy(host, user, keypath, nil, HelperVersionCommand, nil, true, nil, policy).Results()
+	if !success {
+		mcore.Failf("Error asking the wrapper on remote system '%s' for its version: status: %d; %s %s",
+			host, status, *o, *e)
+	}
+	found = ParseHelpers(*o)["wrapper"].Protocol
+
+	wrapperProtocols.Lock()
+	defer wrapperProtocols.Unlock()
+	wrapperProtocols.found[host] = found
+	return found
+}
+
+// RemoteJob runs the job described by spec on a remote system with
+// wrapper, returning all of its results.  Jobs needing more than a
+// command and environment fail, before anything is sent, if the
+// wrapper on the remote system is too old to understand them; an old
+// wrapper would run the command without them.  The wrapper is run
+// with escalated privileges if become is true, so that it can run the
+// job as another user.
+func RemoteJob(host string, user string, keypath string, spec JobSpec, become bool, becomeUser string, becomeMethod string, verbose bool, sink Sink) *Results {
+	return RemoteJobPolicy(host, user, keypath, spec, become, becomeUser, becomeMethod, verbose, sink, CurrentConfig().Policy())
+}
+
+// RemoteJobPolicy is RemoteJob, following policy rather than the
+// configured timeout and retries in each of its steps.  The policy
+// bounds each step from here; the job's own Timeout bounds the
+// command on the remote host.
+func RemoteJobPolicy(host string, user string, keypath string, spec JobSpec, become bool, becomeUser string, becomeMethod string, verbose bool, sink Sink, policy Policy) *Results {
+	// Specs say which version they need, so older wrappers can run
+	// what they understand
+	spec.Version = spec.needs()
+	spec.Stream = sink != nil
+	cmd := spec.Cmd
+	tooOld := func(found int) {
+		job := spec.Op
+		if job == "" {
+			job = strings.Join(cmd, " ")
+		}
+		mcore.Failf("The wrapper on '%s' is too old to run '%s' (protocol %d; need %d).  Bootstrap the host again.",
+			host, job, found, spec.Version)
+	}
+	if spec.Version > 0 {
+		if found := wrapperProtocol(host, user, keypath, spec.Version, policy); found < spec.Version {
+			tooOld(found)
+		}
+	}
 
 	// Render to JSON
 	j, err := json.Marshal(spec)
 	if err != nil {
-		log.Fatalf("RemoteWrapper marshal error %s:", err)
+		mcore.Failf("RemoteWrapper marshal error %s:", err)
 	}
 
 	// Copy JSON to remote temporary file
 	specJSON := string(j)
-	o, e, success, status := RemoteShell(*inst.PublicIpAddress,
+	o, e, success, status := RemoteShellPolicy(host,
 		user,
 		keypath,
 		&specJSON,
 		`export foo=$(mktemp ./.mithras/scripts/wrapperXXXXXX); dd of=$foo oflag=append conv=notrunc >/dev/null 2>&1 > /dev/null; echo $foo`,
 		nil,
-		true)
+		true,
+		nil,
+		policy).Results()
 	if !success {
-		log.Fatalf("Error moving script to remote system '%s': success: %t; %s %s",
-			*inst.PublicIpAddress, status, *o, *e)
+		mcore.Failf("Error moving script to remote system '%s': status: %d; %s %s",
+			host, status, *o, *e)
 	}
 	remoteFile := strings.TrimSpace(*o)
 
 	// Run it via ssh
-	o, e, success, status = RemoteShell(*inst.PublicIpAddress, user, keypath, nil, ".mithras/bin/wrapper < "+remoteFile, nil, true)
+	o, e, success, status = RemoteShellPolicy(host, user, keypath, nil, doBecome(".mithras/bin/wrapper", become, becomeUser, becomeMethod)+" < "+remoteFile, nil, true, wrapperSink(sink), policy).Results()
 	if !success {
-		log.Fatalf("Error running wrapper '%s' on remote system '%s': success: %t; %s %s",
-			cmd, *inst.PublicIpAddress, status, *o, *e)
+		mcore.Failf("Error running wrapper '%s' on remote system '%s': status: %d; %s %s",
+			cmd, host, status, *o, *e)
 	}
-	remoteOut := strings.TrimSpace(*o)
+	remoteOut := wrapperResults(*o)
 
 	// Read in results
 	var results Results
 	if err := json.Unmarshal([]byte(remoteOut), &results); err != nil {
-		log.Fatalf("Can't unmarshall remote run output: %s (%s)", err, remoteOut)
+		mcore.Failf("Can't unmarshall remote run output: %s (%s)", err, remoteOut)
+	}
+	if results.Version < spec.Version {
+		tooOld(results.Version)
 	}
 
 	// Dump the temporary file
 	defer func() {
-		o, e, success, status = RemoteShell(*inst.PublicIpAddress, user, keypath, nil, fmt.Sprintf(`rm %s`, remoteFile), nil, true)
+		o, e, success, status := RemoteShellPolicy(host, user, keypath, nil, fmt.Sprintf(`rm %s`, remoteFile), nil, true, nil, policy).Results()
 		if !success {
-			log.Fatalf("Error removing script on remote system '%s': success: %t; %s %s",
-				*inst.PublicIpAddress, status, *o, *e)
+			mcore.Failf("Error removing script on remote system '%s': status: %d; %s %s",
+				host, status, *o, *e)
 		}
 	}()
 
-	return &results.Out, &results.Err, results.Success, results.Status
+	return &results
 }
 
 // This function copies a file from the local machine to a remote
 // host, and captures the output in a sturctured format.
 func CopyToRemote(ip string, user string, keypath string, src string, dest string) (*string, *string, bool, int) {
+	return CopyToRemotePolicy(ip, user, keypath, src, dest, CurrentConfig().Policy()).Results()
+}
+
+// CopyToRemotePolicy is CopyToRemote, following policy rather than
+// the configured timeout and retries, and saying why it failed.
+func CopyToRemotePolicy(ip string, user string, keypath string, src string, dest string, policy Policy) *Outcome {
+	return withPolicy(ip, policy, func(d *deadline) (*string, *string, bool, int) {
+		return copyToRemote(ip, user, keypath, src, dest, d)
+	})
+}
+
+func copyToRemote(ip string, user string, keypath string, src string, dest string, d *deadline) (*string, *string, bool, int) {
+	if native() {
+		return nativeCopy(ip, user, keypath, src, dest, d)
+	}
 
 	args := []string{
 		"-p", // preserve
@@ -273,21 +886,68 @@ func CopyToRemote(ip string, user string, keypath string, src string, dest strin
 		"-o", "ControlPath=" + ctlPath(),
 		"-o", "IdentityFile=" + keypath,
 		"-o", "KbdInteractiveAuthentication=no",
-		"-o", "StrictHostKeyChecking=no",
 		"-o", "PasswordAuthentication=no",
 		"-o", "User=" + user,
-		"-o", "ConnectTimeout=10",
+		"-o", connectTimeoutOption(),
 		"-o", "PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey",
-		src,
-		ip + ":" + dest}
+	}
+	args = append(args, openSSHHostKeyArgs(ip)...)
+	args = append(args, openSSHJumpArgs(ip, user, keypath)...)
+	args = append(args, src, ip+":"+dest)
 
-	return Exec("scp", args, nil, nil)
+	out, errOut, ok, status := execStream("scp", args, nil, nil, nil, d)
+	if !ok {
+		openSSHHostKeyFailure(ip, *errOut)
+	}
+	return out, errOut, ok, status
+}
+
+// CopyFromRemote copies a file from a remote host to the local
+// machine, preserving its mode and times.
+func CopyFromRemote(ip string, user string, keypath string, src string, dest string) (*string, *string, bool, int) {
+	return CopyFromRemotePolicy(ip, user, keypath, src, dest, CurrentConfig().Policy()).Results()
+}
+
+// CopyFromRemotePolicy is CopyFromRemote, following policy rather
+// than the configured timeout and retries, and saying why it failed.
+func CopyFromRemotePolicy(ip string, user string, keypath string, src string, dest string, policy Policy) *Outcome {
+	return withPolicy(ip, policy, func(d *deadline) (*string, *string, bool, int) {
+		return copyFromRemote(ip, user, keypath, src, dest, d)
+	})
+}
+
+func copyFromRemote(ip string, user string, keypath string, src string, dest string, d *deadline) (*string, *string, bool, int) {
+	if native() {
+		return nativeFetch(ip, user, keypath, src, dest, d)
+	}
+
+	args := []string{
+		"-p", // preserve
+		"-o", "ControlPersist=10m",
+		"-o", "ControlMaster=no",
+		"-o", "ControlPath=" + ctlPath(),
+		"-o", "IdentityFile=" + keypath,
+		"-o", "KbdInteractiveAuthentication=no",
+		"-o", "PasswordAuthentication=no",
+		"-o", "User=" + user,
+		"-o", connectTimeoutOption(),
+		"-o", "PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey",
+	}
+	args = append(args, openSSHHostKeyArgs(ip)...)
+	args = append(args, openSSHJumpArgs(ip, user, keypath)...)
+	args = append(args, ip+":"+src, dest)
+
+	out, errOut, ok, status := execStream("scp", args, nil, nil, nil, d)
+	if !ok {
+		openSSHHostKeyFailure(ip, *errOut)
+	}
+	return out, errOut, ok, status
 }
 
 func ctlDir() string {
 	cwd, err := os.Getwd()
 	if err != nil {
-		log.Fatalf("Can't get working directory: %s", err)
+		mcore.Failf("Can't get working directory: %s", err)
 	}
 	return filepath.Join(cwd, ".ssh", "ctl")
 }
@@ -295,19 +955,22 @@ func ctlDir() string {
 func ctlPath() string {
 	cwd, err := os.Getwd()
 	if err != nil {
-		log.Fatalf("Can't get working directory: %s", err)
+		mcore.Failf("Can't get working directory: %s", err)
 	}
 	ctlPath, err := filepath.Rel(cwd, filepath.Join(ctlDir(), "%r@%h:%p"))
 	if err != nil {
-		log.Fatalf("Can't get relative path: %s", err)
+		mcore.Failf("Can't get relative path: %s", err)
 	}
 	return ctlPath
 }
 
-func startMaster(ip string, user string, keypath string, input *string, cmd string, env *map[string]string) {
+// Start a control master for the host.  Once connected, ssh puts the
+// master in the background and exits, so if it fails, it couldn't
+// connect, and its results say why.
+func startMaster(ip string, user string, keypath string, env *map[string]string, d *deadline) (*string, *string, bool, int) {
 	err := os.MkdirAll(ctlDir(), 0777)
 	if err != nil {
-		log.Fatalf("Can't create ssh control master directory: %s", err)
+		mcore.Failf("Can't create ssh control master directory: %s", err)
 	}
 
 	args := []string{
@@ -320,31 +983,21 @@ func startMaster(ip string, user string, keypath string, input *string, cmd stri
 		"-o", "ForwardAgent=yes",
 		"-o", "IdentityFile=" + keypath,
 		"-o", "KbdInteractiveAuthentication=no",
-		"-o", "StrictHostKeyChecking=no",
 		"-o", "PasswordAuthentication=no",
 		"-o", "User=" + user,
-		"-o", "ConnectTimeout=10",
+		"-o", connectTimeoutOption(),
 		"-o", "PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey",
 	}
+	args = append(args, openSSHHostKeyArgs(ip)...)
+	args = append(args, openSSHJumpArgs(ip, user, keypath)...)
 	args = append(args, ip)
 
-	master := make(chan struct{})
-	go func(c chan struct{}) {
-		var out bytes.Buffer
-		var err bytes.Buffer
-		cmd, _, _, e := Start("ssh-agent", args, nil, env, &out, &err)
-		if e != nil {
-			log.Fatalf("SSH control master start error: %s %s %s", e, out.String(), err.String())
-		}
-		c <- struct{}{}
-		go func() {
-			e := cmd.Wait()
-			if e != nil {
-				log.Fatalf("SSH control master wait error: %s %s %s", e, out.String(), err.String())
-			}
-		}()
-	}(master)
-	<-master
+	out, errOut, ok, status := execStream("ssh-agent", args, nil, env, nil, d)
+	if !ok {
+		e := fmt.Sprintf("SSH control master start error: %s", *errOut)
+		errOut = &e
+	}
+	return out, errOut, ok, status
 }
 
 func checkMaster(ip string, user string, keypath string, input *string, cmd string, env *map[string]string) bool {
@@ -358,13 +1011,14 @@ func checkMaster(ip string, user string, keypath string, input *string, cmd stri
 		"-o", "ForwardAgent=yes",
 		"-o", "IdentityFile=" + keypath,
 		"-o", "KbdInteractiveAuthentication=no",
-		"-o", "StrictHostKeyChecking=no",
 		"-o", "PasswordAuthentication=no",
 		"-o", "User=" + user,
-		"-o", "ConnectTimeout=10",
+		"-o", connectTimeoutOption(),
 		"-o", "PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey",
 		"-O", "check",
 	}
+	args = append(args, openSSHHostKeyArgs(ip)...)
+	args = append(args, openSSHJumpArgs(ip, user, keypath)...)
 	args = append(args, ip)
 
 	_, _, _, status := Exec("ssh-agent", args, nil, env)
@@ -376,10 +1030,35 @@ func checkMaster(ip string, user string, keypath string, input *string, cmd stri
 // hostname) in string form, the appropriate remote user and a path to
 // the SSH key, a shell command and an environment.
 //
-// `RemoteShell` runs the local `ssh` command under `ssh-agent`.
+// With the OpenSSH transport, `RemoteShell` runs the local `ssh`
+// command under `ssh-agent`, and `env` is its environment.  The
+// native transport ignores `env` and `useControl`.
 func RemoteShell(ip string, user string, keypath string, input *string, cmd string, env *map[string]string, useControl bool) (*string, *string, bool, int) {
+	return RemoteShellStream(ip, user, keypath, input, cmd, env, useControl, nil)
+}
+
+// RemoteShellStream is RemoteShell, passing each line of output to
+// sink as it arrives, if sink isn't nil.
+func RemoteShellStream(ip string, user string, keypath string, input *string, cmd string, env *map[string]string, useControl bool, sink Sink) (*string, *string, bool, int) {
+	return RemoteShellPolicy(ip, user, keypath, input, cmd, env, useControl, sink, CurrentConfig().Policy()).Results()
+}
+
+// RemoteShellPolicy is RemoteShellStream, following policy rather than
+// the configured timeout and retries, and saying why it failed.
+func RemoteShellPolicy(ip string, user string, keypath string, input *string, cmd string, env *map[string]string, useControl bool, sink Sink, policy Policy) *Outcome {
+	return withPolicy(ip, policy, func(d *deadline) (*string, *string, bool, int) {
+		return remoteShell(ip, user, keypath, input, cmd, env, useControl, sink, d)
+	})
+}
+
+func remoteShell(ip string, user string, keypath string, input *string, cmd string, env *map[string]string, useControl bool, sink Sink, d *deadline) (*string, *string, bool, int) {
+	if native() {
+		return nativeShell(ip, user, keypath, input, cmd, sink, d)
+	}
 	if running := checkMaster(ip, user, keypath, input, cmd, env); running == false {
-		startMaster(ip, user, keypath, input, cmd, env)
+		if out, errOut, ok, status := startMaster(ip, user, keypath, env, d); !ok {
+			return out, errOut, ok, status
+		}
 	}
 
 	args := []string{
@@ -388,11 +1067,12 @@ func RemoteShell(ip string, user string, keypath string, input *string, cmd stri
 		"-o", "ForwardAgent=yes",
 		"-o", "IdentityFile=" + keypath,
 		"-o", "KbdInteractiveAuthentication=no",
-		"-o", "StrictHostKeyChecking=no",
 		"-o", "PasswordAuthentication=no",
 		"-o", "User=" + user,
-		"-o", "ConnectTimeout=10",
+		"-o", connectTimeoutOption(),
 		"-o", "PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey"}
+	args = append(args, openSSHHostKeyArgs(ip)...)
+	args = append(args, openSSHJumpArgs(ip, user, keypath)...)
 	if input == nil {
 		args = append(args, "-tt")
 	}
@@ -409,18 +1089,33 @@ func RemoteShell(ip string, user string, keypath string, input *string, cmd stri
 	// For debugging:
 	// log.Println(strings.Join(args, " "))
 
-	return Exec("ssh-agent", args, input, env)
+	out, errOut, ok, status := execStream("ssh-agent", args, input, env, sink, d)
+	if !ok {
+		openSSHHostKeyFailure(ip, *errOut)
+	}
+	return out, errOut, ok, status
 }
 
 // Exec gives the caller a way to run a program locally by forking and
 // exec'ing it.
 func Exec(cmd string, args []string, input *string, env *map[string]string) (*string, *string, bool, int) {
+	return ExecStream(cmd, args, input, env, nil)
+}
+
+// ExecStream is Exec, passing each line of output to sink as it
+// arrives, if sink isn't nil.
+func ExecStream(cmd string, args []string, input *string, env *map[string]string, sink Sink) (*string, *string, bool, int) {
+	return execStream(cmd, args, input, env, sink, nil)
+}
+
+// When d expires, the command and everything it started are killed.
+func execStream(cmd string, args []string, input *string, env *map[string]string, sink Sink, d *deadline) (*string, *string, bool, int) {
 	c := exec.Command(cmd, args...)
 
-	var out bytes.Buffer
-	var err bytes.Buffer
-	c.Stdout = &out
-	c.Stderr = &err
+	out := newLineWriter("stdout", sink)
+	err := newLineWriter("stderr", sink)
+	c.Stdout = out
+	c.Stderr = err
 	if input != nil {
 		c.Stdin = bufio.NewReader(bytes.NewBufferString(*input))
 	}
@@ -434,7 +1129,20 @@ func Exec(cmd string, args []string, input *string, env *map[string]string) (*st
 		c.Env = newEnv
 	}
 
-	e := c.Run()
+	var e error
+	if d == nil {
+		e = c.Run()
+	} else {
+		// ssh-agent runs ssh as its child, so kill the group
+		c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if e = c.Start(); e == nil {
+			pid := c.Process.Pid
+			d.onExpiry(func() { syscall.Kill(-pid, syscall.SIGKILL) })
+			e = c.Wait()
+		}
+	}
+	out.Flush()
+	err.Flush()
 
 	var status int
 	if e1, ok := e.(*exec.ExitError); ok {
@@ -444,7 +1152,7 @@ func Exec(cmd string, args []string, input *string, env *map[string]string) (*st
 	resultErr := err.String()
 	resultOut := out.String()
 	ok := true
-	if e != nil || !c.ProcessState.Success() {
+	if e != nil || c.ProcessState == nil || !c.ProcessState.Success() {
 		ok = false
 	}
 
@@ -490,76 +1198,60 @@ func init() {
 		}
 
 		// Expose CopyToRemote
-		o1.Set("scp", func(ip string, user string, keypath string, src string, dest string) otto.Value {
+		o1.Set("scp", context.Guard(context.Plannable(mcore.PlanUpdate, "mithras.remote.scp", func(call otto.FunctionCall) otto.Value {
+			policy := callPolicy(context, call.Argument(5))
+			outcome := CopyToRemotePolicy(call.Argument(0).String(), call.Argument(1).String(), call.Argument(2).String(),
+				call.Argument(3).String(), call.Argument(4).String(), policy)
 			f := mcore.Sanitizer(rt)
-			return f(CopyToRemote(ip, user, keypath, src, dest))
-		})
+			val := f(outcome.Results())
+			val.Object().Set("failure", outcome.Failure)
+			val.Object().Set("attempts", outcome.Attempts)
+			return val
+		}, dryRunResults)))
 
 		// Expose RemoteMithras
 		f := func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
-
-			var instance ec2.Instance
-			var export interface{}
-			export, err := call.Argument(0).Export()
-			if err != nil {
-				log.Fatalf("Can't export first arg to remote: %s", err)
-			}
-			marshalled, err := json.Marshal(export)
-			if err != nil {
-				log.Fatalf("Can't marshal first arg to remote: %s", err)
-			}
-			if err = json.Unmarshal(marshalled, &instance); err != nil {
-				log.Fatalf("Can't unmarshall remote run instance: %s", err)
-			}
+			host := HostArg(call.Argument(0))
 
 			user := call.Argument(1).String()
 			key := call.Argument(2).String()
-			js := call.Argument(3).String()
+			js := mithrasScript(call.Argument(3))
 			become := false
 			var becomeUser, becomeMethod string
+			var err error
 			if len(call.ArgumentList) > 4 {
 				become, err = call.Argument(4).ToBoolean()
 				if err != nil {
-					log.Fatalf("Error remote run become arg: %s", err)
+					context.Throwf("Error remote run become arg: %s", err)
 				}
 			}
 			if len(call.ArgumentList) > 5 {
 				becomeUser = call.Argument(5).String()
 				if err != nil {
-					log.Fatalf("Error remote run become arg: %s", err)
+					context.Throwf("Error remote run become arg: %s", err)
 				}
 			}
 			if len(call.ArgumentList) > 6 {
 				becomeMethod = call.Argument(6).String()
 				if err != nil {
-					log.Fatalf("Error remote run become arg: %s", err)
+					context.Throwf("Error remote run become arg: %s", err)
 				}
 			}
+			policy := callPolicy(context, call.Argument(7))
 
 			f := mcore.Sanitizer(rt)
-			return f(RemoteMithras(&instance, user, key, js, become, becomeUser, becomeMethod, verbose))
+			return withFailure(f(streaming(rt, host, func(sink Sink) (*string, *string, bool, int) {
+				return RemoteMithrasPolicy(host, user, key, js, become, becomeUser, becomeMethod, verbose, sink, policy)
+			})))
 		}
-		o1.Set("mithras", f)
+		o1.Set("mithras", context.Guard(context.Plannable(mcore.PlanUpdate, "mithras.remote.mithras", f, dryRunResults)))
 
 		// Expose RemoteWrapper
 		f = func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 
-			// Translate first arg into instance
-			var instance ec2.Instance
-			var export interface{}
-			export, err := call.Argument(0).Export()
-			if err != nil {
-				log.Fatalf("Can't export first arg to remote: %s", err)
-			}
-			marshalled, err := json.Marshal(export)
-			if err != nil {
-				log.Fatalf("Can't marshal first arg to remote: %s", err)
-			}
-			if err = json.Unmarshal(marshalled, &instance); err != nil {
-				log.Fatalf("Can't unmarshall remote wrapper instance: %s", err)
-			}
+			host := HostArg(call.Argument(0))
 
 			user := call.Argument(1).String()
 			key := call.Argument(2).String()
@@ -567,16 +1259,16 @@ func init() {
 			// We need a slice of strings for this arg
 			var cmd []string
 			if call.Argument(3).Class() != "Array" {
-				log.Fatalf("Remote wrapper command arg must be an array.")
+				context.Throwf("Remote wrapper command arg must be an array.")
 			}
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(3))
 			if err != nil {
-				log.Fatalf("Can't create json for remote wrapper: %s", err)
+				context.Throwf("Can't create json for remote wrapper: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &cmd)
 			if err != nil {
-				log.Fatalf("Can't unmarshall remote wrapper json: %s", err)
+				context.Throwf("Can't unmarshall remote wrapper json: %s", err)
 			}
 
 			// The env is a map of string -> string
@@ -584,25 +1276,71 @@ func init() {
 			if call.Argument(4).Class() != "Object" &&
 				!call.Argument(4).IsUndefined() &&
 				!call.Argument(4).IsNull() {
-				log.Fatalf("Remote wrapper env arg must be an object.")
+				context.Throwf("Remote wrapper env arg must be an object.")
 			}
 			if !call.Argument(4).IsUndefined() && !call.Argument(4).IsNull() {
 				js := `(function (o) { return JSON.stringify(o); })`
 				s, err := rt.Call(js, nil, call.Argument(4))
 				if err != nil {
-					log.Fatalf("Can't create json for remote wrapper: %s", err)
+					context.Throwf("Can't create json for remote wrapper: %s", err)
 				}
 				err = json.Unmarshal([]byte(s.String()), &env)
 				if err != nil {
-					log.Fatalf("Can't unmarshall remote wrapper json: %s", err)
+					context.Throwf("Can't unmarshall remote wrapper json: %s", err)
 				}
 			}
 
+			// Options for the job
+			opts := wrapperOptions{BecomeMethod: "sudo"}
+			if call.Argument(5).Class() != "Object" &&
+				!call.Argument(5).IsUndefined() &&
+				!call.Argument(5).IsNull() {
+				context.Throwf("Remote wrapper options arg must be an object.")
+			}
+			if !call.Argument(5).IsUndefined() && !call.Argument(5).IsNull() {
+				js := `(function (o) { return JSON.stringify(o); })`
+				s, err := rt.Call(js, nil, call.Argument(5))
+				if err != nil {
+					context.Throwf("Can't create json for remote wrapper: %s", err)
+				}
+				err = json.Unmarshal([]byte(s.String()), &opts)
+				if err != nil {
+					context.Throwf("Invalid remote wrapper options: %s", err)
+				}
+			}
+			spec := opts.jobSpec(cmd, env)
+			policy, err := opts.Policy.resolve()
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+
 			verbose = mcore.IsVerbose(rt)
+			var results *Results
 			f := mcore.Sanitizer(rt)
-			return f(RemoteWrapper(&instance, user, key, cmd, &env, verbose))
+			val := f(streaming(rt, host, func(sink Sink) (*string, *string, bool, int) {
+				results = RemoteJobPolicy(host, user, key, spec, opts.Become, opts.BecomeUser, opts.BecomeMethod, verbose, sink, policy)
+				return &results.Out, &results.Err, results.Success, results.Status
+			}))
+
+			// Timing and how the command ended
+			o := val.Object()
+			failure := Classify(results.Success, results.Status, results.Err)
+			if results.TimedOut {
+				failure = FailureTimeout
+			}
+			o.Set("failure", failure)
+			o.Set("version", results.Version)
+			if results.Version >= protocolJobOptions {
+				o.Set("start", results.Start.Format(time.RFC3339Nano))
+				o.Set("end", results.End.Format(time.RFC3339Nano))
+				o.Set("duration", results.Duration)
+				o.Set("signaled", results.Signaled)
+				o.Set("signal", results.Signal)
+				o.Set("timedOut", results.TimedOut)
+			}
+			return val
 		}
-		o1.Set("wrapper", f)
+		o1.Set("wrapper", context.Guard(context.Plannable(mcore.PlanUpdate, "mithras.remote.wrapper", f, dryRunResults)))
 
 		// Expose RemoteShell
 		f = func(call otto.FunctionCall) otto.Value {
@@ -624,29 +1362,192 @@ func init() {
 			if call.Argument(5).Class() != "Object" &&
 				!call.Argument(5).IsUndefined() &&
 				!call.Argument(5).IsNull() {
-				log.Fatalf("Remote wrapper env arg must be an object.")
+				context.Throwf("Remote wrapper env arg must be an object.")
 			}
 			if !call.Argument(5).IsUndefined() && !call.Argument(5).IsNull() {
 				js := `(function (o) { return JSON.stringify(o); })`
 				s, err := rt.Call(js, nil, call.Argument(5))
 				if err != nil {
-					log.Fatalf("Can't create json for remote wrapper: %s", err)
+					context.Throwf("Can't create json for remote wrapper: %s", err)
 				}
 				err = json.Unmarshal([]byte(s.String()), &env)
 				if err != nil {
-					log.Fatalf("Can't unmarshall remote wrapper json: %s", err)
+					context.Throwf("Can't unmarshall remote wrapper json: %s", err)
 				}
 			}
 
-			control := true
-			if !call.Argument(6).IsUndefined() && !call.Argument(6).IsNull() {
-				control, _ = call.Argument(6).ToBoolean()
+			// Whether to use a control master, or options
+			opts := shellOptions{Control: true}
+			if call.Argument(6).Class() == "Object" {
+				js := `(function (o) { return JSON.stringify(o); })`
+				s, err := rt.Call(js, nil, call.Argument(6))
+				if err != nil {
+					context.Throwf("Can't create json for remote shell options: %s", err)
+				}
+				if err := json.Unmarshal([]byte(s.String()), &opts); err != nil {
+					context.Throwf("Invalid remote shell options: %s", err)
+				}
+			} else if !call.Argument(6).IsUndefined() && !call.Argument(6).IsNull() {
+				opts.Control, _ = call.Argument(6).ToBoolean()
+			}
+			policy := opts.apply(CurrentConfig().Policy())
+			if err := policy.validate(); err != nil {
+				context.Throwf("%s", err)
+			}
+
+			// Without an env, ssh runs in ours
+			envp := &env
+			if env == nil {
+				envp = nil
 			}
 
+			var outcome *Outcome
 			f := mcore.Sanitizer(rt)
-			return f(RemoteShell(ip, user, key, input, cmd, &env, control))
+			val := f(streaming(rt, ip, func(sink Sink) (*string, *string, bool, int) {
+				outcome = RemoteShellPolicy(ip, user, key, input, cmd, envp, opts.Control, sink, policy)
+				return outcome.Results()
+			}))
+			o := val.Object()
+			o.Set("failure", outcome.Failure)
+			o.Set("attempts", outcome.Attempts)
+			return val
 		}
-		o1.Set("shell", f)
+		o1.Set("shell", context.Guard(context.Plannable(mcore.PlanUpdate, "mithras.remote.shell", f, dryRunResults)))
+
+		// Expose Put and Get
+		transferOptions := func(v otto.Value) TransferOptions {
+			opts := TransferOptions{BecomeMethod: "sudo"}
+			if v.IsUndefined() || v.IsNull() {
+				return opts
+			}
+			if v.Class() != "Object" {
+				context.Throwf("Transfer options arg must be an object.")
+			}
+			js := `(function (o) { return JSON.stringify(o); })`
+			s, err := rt.Call(js, nil, v)
+			if err != nil {
+				context.Throwf("Can't create json for transfer options: %s", err)
+			}
+			if err := json.Unmarshal([]byte(s.String()), &opts); err != nil {
+				context.Throwf("Invalid transfer options: %s", err)
+			}
+			opts.mode()
+			opts.policy()
+			return opts
+		}
+		dryTransfer := Transfer{Files: []FileResult{}}
+		o1.Set("put", context.Guard(context.Plannable(mcore.PlanUpdate, "mithras.remote.put", func(call otto.FunctionCall) otto.Value {
+			host := HostArg(call.Argument(0))
+			opts := transferOptions(call.Argument(5))
+			t := Put(host, call.Argument(1).String(), call.Argument(2).String(),
+				call.Argument(3).String(), call.Argument(4).String(), opts)
+			return mcore.Sanitize(rt, t)
+		}, dryTransfer)))
+		o1.Set("get", context.Guard(context.Plannable(mcore.PlanUpdate, "mithras.remote.get", func(call otto.FunctionCall) otto.Value {
+			host := HostArg(call.Argument(0))
+			opts := transferOptions(call.Argument(5))
+			t := Get(host, call.Argument(1).String(), call.Argument(2).String(),
+				call.Argument(3).String(), call.Argument(4).String(), opts)
+			return mcore.Sanitize(rt, t)
+		}, dryTransfer)))
+
+		// Expose Each
+		o1.Set("each", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return eachBinding(context, call)
+		}))
+
+		// Helper binaries
+		helpersObject(context, o1)
+
+		// Settings
+		o1.Set("configure", context.Guard(func(call otto.FunctionCall) otto.Value {
+			js := `(function (o) { return JSON.stringify(o); })`
+			s, err := rt.Call(js, nil, call.Argument(0))
+			if err != nil {
+				context.Throwf("Can't create json for remote settings: %s", err)
+			}
+			cfg := CurrentConfig()
+			if err := json.Unmarshal([]byte(s.String()), &cfg); err != nil {
+				context.Throwf("Can't unmarshall remote settings: %s", err)
+			}
+			if err := Configure(cfg); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		o1.Set("config", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return mcore.Sanitize(rt, CurrentConfig())
+		}))
+
+		// Jump hosts and addresses
+		o1.Set("route", context.Guard(func(call otto.FunctionCall) otto.Value {
+			host := call.Argument(0).String()
+			jump := ""
+			if v := call.Argument(1); v.Class() == "Array" {
+				js := `(function (a) { return a.join(","); })`
+				s, err := rt.Call(js, nil, v)
+				if err != nil {
+					context.Throwf("Can't join jump hosts: %s", err)
+				}
+				jump = s.String()
+			} else if !v.IsUndefined() && !v.IsNull() {
+				jump = v.String()
+			}
+			set := SetRoute
+			if opts := call.Argument(2); opts.IsObject() {
+				if v, err := opts.Object().Get("replace"); err == nil && v.IsBoolean() {
+					if replace, _ := v.ToBoolean(); !replace {
+						set = ClaimRoute
+					}
+				}
+			}
+			if err := set(host, jump); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		o1.Set("jumps", context.Guard(func(host string) otto.Value {
+			return mcore.Sanitize(rt, Route(host))
+		}))
+		o1.Set("address", context.Guard(func(call otto.FunctionCall) otto.Value {
+			if !call.Argument(0).IsObject() {
+				context.Throwf("Remote address arg must be an instance.")
+			}
+			strategy := ""
+			if v := call.Argument(1); !v.IsUndefined() && !v.IsNull() {
+				strategy = v.String()
+			}
+			return mcore.Sanitize(rt, AddressOf(instanceArg(call.Argument(0)), strategy))
+		}))
+
+		// Host keys
+		hk, _ := rt.Object(`({})`)
+		o1.Set("hostKeys", hk)
+		hk.Set("seed", context.Guard(func(call otto.FunctionCall) otto.Value {
+			host := call.Argument(0).String()
+			js := `(function (o) { return JSON.stringify(o || {}); })`
+			s, err := rt.Call(js, nil, call.Argument(1))
+			if err != nil {
+				context.Throwf("Can't create json for host keys: %s", err)
+			}
+			known := struct {
+				Keys         []string `json:"keys"`
+				Fingerprints []string `json:"fingerprints"`
+			}{}
+			if err := json.Unmarshal([]byte(s.String()), &known); err != nil {
+				context.Throwf("Can't unmarshall host keys: %s", err)
+			}
+			if err := SeedHostKeys(host, known.Keys, known.Fingerprints); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		hk.Set("forget", context.Guard(func(call otto.FunctionCall) otto.Value {
+			if err := ForgetHostKeys(call.Argument(0).String()); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
 
 	})
 }
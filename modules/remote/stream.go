@@ -0,0 +1,237 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// Output of remote commands can be streamed a line at a time as it
+// arrives, as well as being returned when the command finishes.
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+)
+
+// Line is a line of output from a remote command.
+type Line struct {
+	Host     string
+	Resource string
+	// "stdout" or "stderr"
+	Stream string
+	Text   string
+}
+
+// Sink receives lines of output as they arrive.  It may be called
+// from several goroutines at once.
+type Sink func(stream string, text string)
+
+// Markers the wrapper puts before each line it streams, to tell them
+// from its results.
+const (
+	streamOut = "mithras-stdout: "
+	streamErr = "mithras-stderr: "
+)
+
+// A Writer capturing all that is written to it, and passing each
+// complete line to a sink.
+type lineWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	pending []byte
+	stream  string
+	sink    Sink
+}
+
+func newLineWriter(stream string, sink Sink) *lineWriter {
+	return &lineWriter{stream: stream, sink: sink}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	if w.sink == nil {
+		return len(p), nil
+	}
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.sink(w.stream, strings.TrimRight(string(w.pending[:i]), "\r"))
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush passes on a final line with no newline.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sink != nil && len(w.pending) > 0 {
+		w.sink(w.stream, strings.TrimRight(string(w.pending), "\r"))
+	}
+	w.pending = nil
+}
+
+func (w *lineWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// A sink for the output of the wrapper, passing on the lines it
+// streams and dropping its results.
+func wrapperSink(sink Sink) Sink {
+	if sink == nil {
+		return nil
+	}
+	return func(stream string, text string) {
+		if strings.HasPrefix(text, streamOut) {
+			sink("stdout", strings.TrimPrefix(text, streamOut))
+		} else if strings.HasPrefix(text, streamErr) {
+			sink("stderr", strings.TrimPrefix(text, streamErr))
+		}
+	}
+}
+
+// Remove streamed lines from the output of the wrapper, leaving its
+// results.
+func wrapperResults(out string) string {
+	kept := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, streamOut) || strings.HasPrefix(line, streamErr) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+type remoteResult struct {
+	out    *string
+	err    *string
+	ok     bool
+	status int
+}
+
+// Where a script wants output of remote commands to go: to a JS
+// callback, set as `mithras.remote.output`, and/or the log.
+type output struct {
+	rt       *otto.Otto
+	cb       otto.Value
+	resource string
+	log      bool
+}
+
+func outputFor(rt *otto.Otto) *output {
+	o := &output{rt: rt, log: CurrentConfig().Stream}
+	if v, err := rt.Run(`(typeof(mithras) === "object" ? mithras : {})`); err == nil && v.IsObject() {
+		if r, err := v.Object().Get("resource"); err == nil && r.IsString() {
+			o.resource = r.String()
+		}
+		if rem, err := v.Object().Get("remote"); err == nil && rem.IsObject() {
+			o.cb, _ = rem.Object().Get("output")
+		}
+	}
+	return o
+}
+
+// Whether output is to be called back to JS, and so must be drained
+// on the goroutine running the script.
+func (o *output) callback() bool {
+	return o.cb.IsFunction()
+}
+
+func (o *output) logLine(l Line) {
+	if l.Resource != "" {
+		log.Infof("[%s %s] %s", l.Host, l.Resource, l.Text)
+	} else {
+		log.Infof("[%s] %s", l.Host, l.Text)
+	}
+}
+
+// A sink for output from host, or nil if output isn't wanted.  Lines
+// for a JS callback are sent to lines, to be drained.
+func (o *output) sink(host string, lines chan<- Line) Sink {
+	if o.callback() {
+		return func(stream string, text string) {
+			lines <- Line{Host: host, Resource: o.resource, Stream: stream, Text: text}
+		}
+	}
+	if o.log {
+		return func(stream string, text string) {
+			o.logLine(Line{Host: host, Resource: o.resource, Stream: stream, Text: text})
+		}
+	}
+	return nil
+}
+
+// Pass lines to the JS callback until lines is closed.
+func (o *output) drain(lines <-chan Line) {
+	for l := range lines {
+		if o.log {
+			o.logLine(l)
+		}
+		// Keep draining even if the callback fails
+		info, _ := o.rt.ToValue(map[string]interface{}{
+			"host":     l.Host,
+			"resource": l.Resource,
+			"stream":   l.Stream,
+		})
+		if _, err := o.cb.Call(otto.NullValue(), l.Text, info); err != nil {
+			log.Warnf("Error in mithras.remote.output: %s", err)
+		}
+	}
+}
+
+// Run a remote operation from JS, streaming its output if the script
+// has set `mithras.remote.output` to a function, or the stream
+// setting is on.  The JS callback is only called from this
+// goroutine, since the runtime isn't safe for concurrent use.
+func streaming(rt *otto.Otto, host string, run func(Sink) (*string, *string, bool, int)) (*string, *string, bool, int) {
+	o := outputFor(rt)
+	if !o.callback() {
+		return run(o.sink(host, nil))
+	}
+
+	lines := make(chan Line, 64)
+	done := make(chan remoteResult, 1)
+	failed := make(chan interface{}, 1)
+	go func() {
+		defer close(lines)
+		defer func() {
+			if r := recover(); r != nil {
+				failed <- r
+			}
+		}()
+		out, e, ok, status := run(o.sink(host, lines))
+		done <- remoteResult{out, e, ok, status}
+	}()
+	o.drain(lines)
+
+	select {
+	case r := <-failed:
+		panic(r)
+	case r := <-done:
+		return r.out, r.err, r.ok, r.status
+	}
+}
@@ -0,0 +1,505 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remote
+
+// Files are transferred to and from remote hosts only if they differ.
+// Both ends are described, with SHA-256 checksums of their files, by
+// wrapper on the remote host and by us locally.  Uploaded files are
+// staged on the remote host and put in place by wrapper, which may be
+// run with escalated privileges to set their owners.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cvillecsteele/mithras/modules/build"
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// FileStat describes a file or directory under a path.  The path
+// itself is ".".
+type FileStat struct {
+	Path   string
+	Dir    bool
+	Mode   uint32
+	Size   int64
+	Sha256 string
+	Uid    uint32
+	Gid    uint32
+	Owner  string
+	Group  string
+}
+
+// FileChange is a change to make to a file or directory under a path.
+type FileChange struct {
+	Path   string
+	Action string
+	Dir    bool
+	Mode   uint32
+	// Name of the new content in the staging directory
+	Staged string
+}
+
+// Actions taken on files
+const (
+	FileCreate     = "create"
+	FileUpdate     = "update"
+	FileAttributes = "attributes"
+	FileDelete     = "delete"
+	FileUnchanged  = "unchanged"
+)
+
+// TransferOptions control how files are transferred.
+type TransferOptions struct {
+	// Remove files at the destination which aren't at the source
+	Delete bool `json:"delete"`
+	// Octal mode for files, eg. "0644", instead of the source's
+	Mode string `json:"mode"`
+	// Owner and group, by name or number, for what is transferred
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+	// Run wrapper with escalated privileges on the remote host
+	Become       bool   `json:"become"`
+	BecomeUser   string `json:"becomeUser"`
+	BecomeMethod string `json:"becomeMethod"`
+	// The timeout and retries of each step
+	policyOverride
+}
+
+// FileResult reports what was done to one file.
+type FileResult struct {
+	Path    string `json:"path"`
+	Action  string `json:"action"`
+	Changed bool   `json:"changed"`
+}
+
+// Transfer reports the results of a transfer.
+type Transfer struct {
+	Changed bool         `json:"changed"`
+	Files   []FileResult `json:"files"`
+}
+
+// The policy for each step of a transfer.
+func (opts *TransferOptions) policy() Policy {
+	p, err := opts.resolve()
+	if err != nil {
+		mcore.Failf("%s", err)
+	}
+	return p
+}
+
+func (opts *TransferOptions) mode() (uint32, bool) {
+	if opts.Mode == "" {
+		return 0, false
+	}
+	m, err := strconv.ParseUint(opts.Mode, 8, 32)
+	if err != nil || m > 07777 {
+		mcore.Failf("Invalid file mode '%s'", opts.Mode)
+	}
+	return uint32(m) & uint32(os.ModePerm), true
+}
+
+// Names of local users and groups, by id.  Transfers may run
+// concurrently, so they are guarded.
+var localNames = struct {
+	sync.Mutex
+	owners map[uint32]string
+	groups map[uint32]string
+}{owners: map[uint32]string{}, groups: map[uint32]string{}}
+
+func localOwner(uid uint32) string {
+	localNames.Lock()
+	defer localNames.Unlock()
+	if name, ok := localNames.owners[uid]; ok {
+		return name
+	}
+	name := strconv.Itoa(int(uid))
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	localNames.owners[uid] = name
+	return name
+}
+
+func localGroup(gid uint32) string {
+	localNames.Lock()
+	defer localNames.Unlock()
+	if name, ok := localNames.groups[gid]; ok {
+		return name
+	}
+	name := strconv.Itoa(int(gid))
+	if g, err := user.LookupGroupId(name); err == nil {
+		name = g.Name
+	}
+	localNames.groups[gid] = name
+	return name
+}
+
+// Describe the local files and directories under root, as wrapper
+// does on remote hosts.
+func localManifest(root string) []FileStat {
+	files := []FileStat{}
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return files
+	}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		stat := FileStat{
+			Path: filepath.ToSlash(rel),
+			Dir:  fi.IsDir(),
+			Mode: uint32(fi.Mode().Perm()),
+			Size: fi.Size(),
+		}
+		if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+			stat.Uid = sys.Uid
+			stat.Gid = sys.Gid
+			stat.Owner = localOwner(sys.Uid)
+			stat.Group = localGroup(sys.Gid)
+		}
+		if !fi.IsDir() {
+			if stat.Sha256, err = build.Hash(p); err != nil {
+				return err
+			}
+		}
+		files = append(files, stat)
+		return nil
+	})
+	if err != nil {
+		mcore.Failf("Can't read '%s': %s", root, err)
+	}
+	return files
+}
+
+// Describe the files and directories under root on a remote host.
+func remoteManifest(host string, user string, keypath string, root string, opts *TransferOptions) []FileStat {
+	spec := JobSpec{Op: "manifest", Path: root}
+	results := RemoteJobPolicy(host, user, keypath, spec, opts.Become, opts.BecomeUser, opts.BecomeMethod, false, nil, opts.policy())
+	if !results.Success {
+		mcore.Failf("Can't read '%s' on remote system '%s': %s", root, host, results.Err)
+	}
+	return results.Files
+}
+
+// Whether a file's owner or group is the one wanted.
+func owned(want string, name string, id uint32) bool {
+	return want == "" || want == name || want == strconv.Itoa(int(id))
+}
+
+// The changes making the files at the destination match those at the
+// source.
+func fileChanges(src []FileStat, dst []FileStat, opts *TransferOptions) []FileChange {
+	mode, setMode := opts.mode()
+	existing := map[string]FileStat{}
+	for _, d := range dst {
+		existing[d.Path] = d
+	}
+	wanted := map[string]bool{}
+
+	changes := []FileChange{}
+	for _, s := range src {
+		wanted[s.Path] = true
+		c := FileChange{Path: s.Path, Dir: s.Dir, Mode: s.Mode}
+		if setMode && !s.Dir {
+			c.Mode = mode
+		}
+		d, ok := existing[s.Path]
+		switch {
+		case !ok:
+			c.Action = FileCreate
+		case d.Dir != s.Dir || (!s.Dir && d.Sha256 != s.Sha256):
+			c.Action = FileUpdate
+		case d.Mode != c.Mode || !owned(opts.Owner, d.Owner, d.Uid) || !owned(opts.Group, d.Group, d.Gid):
+			c.Action = FileAttributes
+		default:
+			c.Action = FileUnchanged
+		}
+		changes = append(changes, c)
+	}
+	if opts.Delete {
+		for _, d := range dst {
+			if !wanted[d.Path] && !within(d.Path, changes) {
+				changes = append(changes, FileChange{Path: d.Path, Action: FileDelete, Dir: d.Dir})
+			}
+		}
+	}
+	return changes
+}
+
+// Whether p is under a directory which is replaced by a file, and so
+// goes with it.
+func within(p string, changes []FileChange) bool {
+	for _, c := range changes {
+		if c.Action == FileUpdate && !c.Dir && c.Path != "." && strings.HasPrefix(p, c.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func report(changes []FileChange) *Transfer {
+	t := &Transfer{Files: []FileResult{}}
+	for _, c := range changes {
+		changed := c.Action != FileUnchanged
+		t.Changed = t.Changed || changed
+		t.Files = append(t.Files, FileResult{Path: c.Path, Action: c.Action, Changed: changed})
+	}
+	return t
+}
+
+// Put makes the file or directory dest on a remote host the same as
+// the local src, copying only files whose contents differ.  If src is
+// a file and dest a directory, the file is put in it.
+func Put(host string, user string, keypath string, src string, dest string, opts TransferOptions) *Transfer {
+	policy := opts.policy()
+	local := localManifest(src)
+	if len(local) == 0 {
+		mcore.Failf("No such file or directory '%s'", src)
+	}
+	remote := remoteManifest(host, user, keypath, dest, &opts)
+	if !local[0].Dir && len(remote) > 0 && remote[0].Dir {
+		dest = path.Join(dest, filepath.Base(src))
+		remote = remoteManifest(host, user, keypath, dest, &opts)
+	}
+
+	changes := fileChanges(local, remote, &opts)
+	result := report(changes)
+	if !result.Changed {
+		return result
+	}
+
+	// Stage new content locally, then on the remote host
+	stage, err := ioutil.TempDir("", "mithras")
+	if err != nil {
+		mcore.Failf("Can't create staging directory: %s", err)
+	}
+	defer os.RemoveAll(stage)
+	staged := 0
+	pending := []FileChange{}
+	for _, c := range changes {
+		if c.Action == FileUnchanged {
+			continue
+		}
+		if !c.Dir && (c.Action == FileCreate || c.Action == FileUpdate) {
+			c.Staged = strconv.Itoa(staged)
+			staged++
+			from := filepath.Join(src, filepath.FromSlash(c.Path))
+			if err := copyLocal(from, filepath.Join(stage, c.Staged), 0600); err != nil {
+				mcore.Failf("Can't stage '%s': %s", from, err)
+			}
+		}
+		pending = append(pending, c)
+	}
+
+	empty := ""
+	o, e, ok, status := RemoteShellPolicy(host, user, keypath, &empty,
+		`mktemp -d ./.mithras/scripts/putXXXXXX`, nil, true, nil, policy).Results()
+	if !ok {
+		mcore.Failf("Can't create staging directory on remote system '%s': status: %d; %s %s",
+			host, status, *o, *e)
+	}
+	remoteStage := strings.TrimSpace(*o)
+	defer func() {
+		o, e, ok, status := RemoteShellPolicy(host, user, keypath, &empty, "rm -rf "+shellQuote(remoteStage), nil, true, nil, policy).Results()
+		if !ok {
+			log.Warnf("Error removing staging directory on remote system '%s': status: %d; %s %s",
+				host, status, *o, *e)
+		}
+	}()
+	from := remoteStage + "/files"
+	if staged > 0 {
+		o, e, ok, status = CopyToRemotePolicy(host, user, keypath, stage, from, policy).Results()
+		if !ok {
+			mcore.Failf("Can't copy files to remote system '%s': status: %d; %s %s",
+				host, status, *o, *e)
+		}
+	}
+
+	spec := JobSpec{
+		Op:      "install",
+		Path:    dest,
+		From:    from,
+		Changes: pending,
+		Owner:   opts.Owner,
+		Group:   opts.Group,
+	}
+	results := RemoteJobPolicy(host, user, keypath, spec, opts.Become, opts.BecomeUser, opts.BecomeMethod, false, nil, policy)
+	if !results.Success {
+		mcore.Failf("Can't install files in '%s' on remote system '%s': %s", dest, host, results.Err)
+	}
+	return result
+}
+
+// Get makes the local file or directory dest the same as src on a
+// remote host, copying only files whose contents differ.  If src is a
+// file and dest a directory, the file is put in it.
+func Get(host string, user string, keypath string, src string, dest string, opts TransferOptions) *Transfer {
+	policy := opts.policy()
+	remote := remoteManifest(host, user, keypath, src, &opts)
+	if len(remote) == 0 {
+		mcore.Failf("No such file or directory '%s' on remote system '%s'", src, host)
+	}
+	local := localManifest(dest)
+	if !remote[0].Dir && len(local) > 0 && local[0].Dir {
+		dest = filepath.Join(dest, path.Base(src))
+		local = localManifest(dest)
+	}
+
+	changes := fileChanges(remote, local, &opts)
+	result := report(changes)
+	if !result.Changed {
+		return result
+	}
+
+	uid, gid := -1, -1
+	if opts.Owner != "" {
+		uid = localId(opts.Owner, false)
+	}
+	if opts.Group != "" {
+		gid = localId(opts.Group, true)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		mcore.Failf("Can't create '%s': %s", filepath.Dir(dest), err)
+	}
+
+	// Deletions first, deepest first
+	deletes := []string{}
+	for _, c := range changes {
+		if c.Action == FileDelete {
+			deletes = append(deletes, c.Path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(deletes)))
+	for _, p := range deletes {
+		if err := os.RemoveAll(filepath.Join(dest, filepath.FromSlash(p))); err != nil {
+			mcore.Failf("Can't remove '%s': %s", p, err)
+		}
+	}
+
+	for _, c := range changes {
+		target := filepath.Join(dest, filepath.FromSlash(c.Path))
+		mode := os.FileMode(c.Mode).Perm()
+		switch c.Action {
+		case FileUnchanged, FileDelete:
+			continue
+		case FileCreate, FileUpdate:
+			if c.Dir {
+				if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+					os.Remove(target)
+				}
+				if err := os.MkdirAll(target, mode); err != nil {
+					mcore.Failf("Can't create '%s': %s", target, err)
+				}
+			} else {
+				fetch(host, user, keypath, path.Join(src, c.Path), target, policy)
+			}
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			mcore.Failf("Can't set mode of '%s': %s", target, err)
+		}
+		if uid >= 0 || gid >= 0 {
+			if err := os.Lchown(target, uid, gid); err != nil {
+				mcore.Failf("Can't set owner of '%s': %s", target, err)
+			}
+		}
+	}
+	return result
+}
+
+// Copy a remote file over a local one, replacing it only once the copy
+// is complete.
+func fetch(host string, user string, keypath string, src string, dest string, policy Policy) {
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".mithras")
+	if err != nil {
+		mcore.Failf("Can't create '%s': %s", dest, err)
+	}
+	tmp.Close()
+	o, e, ok, status := CopyFromRemotePolicy(host, user, keypath, src, tmp.Name(), policy).Results()
+	if !ok {
+		os.Remove(tmp.Name())
+		mcore.Failf("Can't copy '%s' from remote system '%s': status: %d; %s %s",
+			src, host, status, *o, *e)
+	}
+	if fi, err := os.Lstat(dest); err == nil && fi.IsDir() {
+		os.RemoveAll(dest)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+		mcore.Failf("Can't replace '%s': %s", dest, err)
+	}
+}
+
+func copyLocal(src string, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// A local user or group id, given by name or number.
+func localId(name string, group bool) int {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			mcore.Failf("Unknown group '%s': %s", name, err)
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			mcore.Failf("Unknown user '%s': %s", name, err)
+		}
+		id = u.Uid
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		mcore.Failf("Invalid id '%s' for '%s'", id, name)
+	}
+	return n
+}
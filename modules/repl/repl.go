@@ -0,0 +1,190 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package repl
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	"gopkg.in/readline.v1"
+)
+
+type Options struct {
+	// Shown before each line; defaults to "mithras> "
+	Prompt string
+	// Where history is kept between sessions; no history if empty
+	HistoryFile string
+	// Printed before the first prompt
+	Prelude string
+}
+
+// Run reads JS from the terminal and evaluates it in rt until the
+// user types .exit or Ctrl-D.
+func Run(rt *otto.Otto, opts Options) error {
+	prompt := opts.Prompt
+	if prompt == "" {
+		prompt = "mithras> "
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       prompt,
+		HistoryFile:  opts.HistoryFile,
+		AutoComplete: &completer{rt},
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	if opts.Prelude != "" {
+		fmt.Fprintln(rl.Stderr(), opts.Prelude)
+	}
+
+	var lines []string
+	for {
+		l, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			// Ctrl-C abandons a partial statement, or quits
+			if lines != nil {
+				lines = nil
+				rl.SetPrompt(prompt)
+				continue
+			}
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if lines == nil {
+			switch strings.TrimSpace(l) {
+			case "":
+				continue
+			case ".exit":
+				return nil
+			}
+		}
+		lines = append(lines, l)
+
+		// Keep reading until we have a whole statement
+		s, more, err := compile(rt, lines)
+		if more {
+			rl.SetPrompt(strings.Repeat(" ", len(prompt)))
+			continue
+		}
+		lines = nil
+		rl.SetPrompt(prompt)
+		if err != nil {
+			fmt.Fprintln(rl.Stdout(), err)
+			continue
+		}
+
+		v, err := rt.Eval(s)
+		if err != nil {
+			if oerr, ok := err.(*otto.Error); ok {
+				fmt.Fprint(rl.Stdout(), oerr.String())
+			} else {
+				fmt.Fprintln(rl.Stdout(), err)
+			}
+			continue
+		}
+		fmt.Fprintln(rl.Stdout(), Format(rt, v))
+	}
+}
+
+// Compile lines read so far.  If they are only the start of a
+// statement, more is set.
+func compile(rt *otto.Otto, lines []string) (s *otto.Script, more bool, err error) {
+	s, err = rt.Compile("repl", strings.Join(lines, "\n"))
+	if err != nil && strings.Contains(err.Error(), "Unexpected end of input") {
+		return nil, true, nil
+	}
+	return s, false, err
+}
+
+// Format renders a value the way the repl prints it: objects and
+// arrays as indented JSON, strings quoted.
+func Format(rt *otto.Otto, v otto.Value) string {
+	if v.IsUndefined() {
+		return "undefined"
+	}
+	if v.IsFunction() {
+		return "[Function]"
+	}
+	js := `(function (v) {
+  return JSON.stringify(v, function (k, x) {
+    return typeof(x) === "function" ? "[Function]" : x;
+  }, 2);
+})`
+	s, err := rt.Call(js, nil, v)
+	if err != nil || !s.IsString() {
+		// Cycles, native objects and the like
+		return v.String()
+	}
+	return s.String()
+}
+
+type completer struct {
+	rt *otto.Otto
+}
+
+var lastExpression = regexp.MustCompile(`[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*\.?$`)
+
+// Do completes the property path ending at pos, eg. "mithras.ru"
+// offers "n" for "mithras.run".
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	expr := lastExpression.FindString(string(line[:pos]))
+	bits := strings.Split(expr, ".")
+	parent := bits[:len(bits)-1]
+	last := bits[len(bits)-1]
+
+	names := []string{}
+	if len(parent) == 0 {
+		for k := range c.rt.Context().Symbols {
+			names = append(names, k)
+		}
+	} else {
+		// Only dotted names reach here, so this has no side effects
+		// beyond those of getters.
+		v, err := c.rt.Eval(strings.Join(parent, "."))
+		if err != nil || !v.IsObject() {
+			return nil, 0
+		}
+		for _, keys := range v.Object().KeysByParent() {
+			names = append(names, keys...)
+		}
+	}
+	sort.Strings(names)
+
+	found := [][]rune{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] || !strings.HasPrefix(name, last) {
+			continue
+		}
+		seen[name] = true
+		found = append(found, []rune(strings.TrimPrefix(name, last)))
+	}
+	return found, len(last)
+}
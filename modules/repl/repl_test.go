@@ -0,0 +1,98 @@
+package repl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/robertkrimen/otto"
+)
+
+func TestCompile(t *testing.T) {
+	rt := otto.New()
+	for _, c := range []struct {
+		lines []string
+		more  bool
+		err   string
+	}{
+		{[]string{"1 + 2"}, false, ""},
+		{[]string{"function f() {"}, true, ""},
+		{[]string{"function f() {", "  return 1;", "}"}, false, ""},
+		{[]string{"[1,"}, true, ""},
+		{[]string{"var x = ;"}, false, "Unexpected token ;"},
+		{[]string{"function f() {", "  )"}, false, "Unexpected token )"},
+	} {
+		s, more, err := compile(rt, c.lines)
+		if more != c.more {
+			t.Errorf("compile(%q) more = %v, want %v", c.lines, more, c.more)
+		}
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("compile(%q) failed: %s", c.lines, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("compile(%q) = %v, want an error with %q", c.lines, err, c.err)
+		case c.err == "" && !c.more && s == nil:
+			t.Errorf("compile(%q) returned no script", c.lines)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	rt := otto.New()
+	if _, err := rt.Run(`var cyclic = {}; cyclic.self = cyclic;`); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		js   string
+		want string
+	}{
+		{"undefined", "undefined"},
+		{"null", "null"},
+		{"42", "42"},
+		{"'hi'", `"hi"`},
+		{"[1, 2]", "[\n  1,\n  2\n]"},
+		{"({a: 1, f: function() {}})", "{\n  \"a\": 1,\n  \"f\": \"[Function]\"\n}"},
+		{"(function() {})", "[Function]"},
+		{"cyclic", "[object Object]"},
+	} {
+		v, err := rt.Run(c.js)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Format(rt, v); got != c.want {
+			t.Errorf("Format(%s) = %q, want %q", c.js, got, c.want)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	rt := otto.New()
+	if _, err := rt.Run(`var mithras = {run: 1, remote: {shell: 1}, verbose: false}; var mystery = 2;`); err != nil {
+		t.Fatal(err)
+	}
+	c := &completer{rt}
+	for _, tc := range []struct {
+		line   string
+		want   []string
+		length int
+	}{
+		{"mithras.r", []string{"emote", "un"}, 1},
+		{"x = mithras.remote.s", []string{"hell"}, 1},
+		{"mithras.", []string{"remote", "run", "verbose"}, 0},
+		{"m", []string{"ithras", "ystery"}, 1},
+		{"mithras.nothing.x", nil, 0},
+		{"mithras.q", []string{}, 1},
+	} {
+		found, length := c.Do([]rune(tc.line), len(tc.line))
+		var got []string
+		if found != nil {
+			got = []string{}
+			for _, f := range found {
+				got = append(got, string(f))
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) || length != tc.length {
+			t.Errorf("Do(%q) = %q, %d; want %q, %d", tc.line, got, length, tc.want, tc.length)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package require
+
+// Scripts run on other hosts take the modules they require with
+// them, in a bundle.  The bundle is found by walking the `require`
+// calls in a script, and in the modules they load, resolving each as
+// `require` does here.  On the other host, `require` looks in the
+// bundle before looking for files.
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+
+	"github.com/robertkrimen/otto"
+	"github.com/robertkrimen/otto/ast"
+	"github.com/robertkrimen/otto/parser"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+// Bundle holds the source of modules, keyed by the path they were
+// loaded from here, and what each module's `require` calls resolve
+// to.  Calls from the script itself are keyed by "".
+type Bundle struct {
+	Modules map[string]string            `json:"modules"`
+	Deps    map[string]map[string]string `json:"deps"`
+}
+
+// Names of the modules required by src: the string literal arguments
+// of its calls to `require`.  Calls in comments, or in strings, aren't
+// calls.  A script which can't be parsed requires nothing here; it
+// fails where it is run.
+func requires(src string) []string {
+	names := []string{}
+	program, err := parser.ParseFile(nil, "", src, 0)
+	if err != nil {
+		return names
+	}
+	walkNodes(reflect.ValueOf(program), func(n ast.Node) {
+		call, ok := n.(*ast.CallExpression)
+		if !ok || len(call.ArgumentList) == 0 {
+			return
+		}
+		if callee, ok := call.Callee.(*ast.Identifier); !ok || callee.Name != "require" {
+			return
+		}
+		if name, ok := call.ArgumentList[0].(*ast.StringLiteral); ok {
+			names = append(names, name.Value)
+		}
+	})
+	return names
+}
+
+// The ast package has no walker, so its nodes are found by reflection.
+var astPackage = reflect.TypeOf(ast.Program{}).PkgPath()
+
+func walkNodes(v reflect.Value, visit func(ast.Node)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		if !v.CanInterface() {
+			return
+		}
+		if n, ok := v.Interface().(ast.Node); ok {
+			visit(n)
+		}
+		walkNodes(v.Elem(), visit)
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkNodes(v.Elem(), visit)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkNodes(v.Index(i), visit)
+		}
+	case reflect.Struct:
+		if v.Type().PkgPath() != astPackage {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			walkNodes(v.Field(i), visit)
+		}
+	}
+}
+
+// NewBundle walks the modules required by a script.  Modules which
+// can't be found here are left out, to be found, if they can be, on
+// the host running the script.
+func NewBundle(src string) *Bundle {
+	b := &Bundle{Modules: map[string]string{}, Deps: map[string]map[string]string{}}
+	b.walk("", "", src)
+	return b
+}
+
+func (b *Bundle) walk(key string, dir string, src string) {
+	for _, name := range requires(src) {
+		if _, ok := b.Deps[key][name]; ok {
+			continue
+		}
+		path, buf, ok := findSource(dir, name)
+		if !ok {
+			continue
+		}
+		if b.Deps[key] == nil {
+			b.Deps[key] = map[string]string{}
+		}
+		b.Deps[key][name] = path
+		if _, ok := b.Modules[path]; ok {
+			continue
+		}
+		b.Modules[path] = buf.String()
+		if filepath.Ext(path) != ".json" {
+			b.walk(path, filepath.Dir(path), buf.String())
+		}
+	}
+}
+
+// Script returns src with its bundle, if it requires any modules which
+// can be found here.
+func Script(src string) string {
+	b := NewBundle(src)
+	if len(b.Modules) == 0 {
+		return src
+	}
+	j, err := json.Marshal(b)
+	if err != nil {
+		mcore.Failf("Can't marshal bundle: %s", err)
+	}
+	return "require.bundle = " + string(j) + ";\n" + src
+}
+
+// Look for a module in the bundle set on `require`, returning its path
+// and source.
+func fromBundle(rt *otto.Otto, baseRequire otto.Value, parentPath string, filename string) (string, string, bool) {
+	if !baseRequire.IsObject() {
+		return "", "", false
+	}
+	bundle, err := baseRequire.Object().Get("bundle")
+	if err != nil || !bundle.IsObject() {
+		return "", "", false
+	}
+	js := `(function (b, parent, name) {
+                 var deps = b.deps[parent];
+                 if (deps && deps.hasOwnProperty(name)) {
+                   return [deps[name], b.modules[deps[name]]];
+                 }
+               })`
+	found, err := rt.Call(js, nil, bundle, parentPath, filename)
+	if err != nil {
+		mcore.Failf("Bad require bundle: %s", err)
+	}
+	if !found.IsObject() {
+		return "", "", false
+	}
+	path, _ := found.Object().Get("0")
+	src, _ := found.Object().Get("1")
+	return path.String(), src.String(), true
+}
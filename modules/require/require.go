@@ -37,6 +37,10 @@ package require
 //
 // Require a Javascript module.
 //
+// Scripts run on other hosts with
+// [mithras.remote.mithras](core_remote.html#mithras) carry the modules
+// they require in `require.bundle`, which is searched first.
+//
 // Example:
 //
 // ```
@@ -49,7 +53,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"os"
 	"path/filepath"
 	"strings"
@@ -91,13 +94,24 @@ func loadSource(rt *otto.Otto, parent *otto.Value, filename string) (string, str
 	var err error
 	if parent != nil && !parent.IsUndefined() {
 		if parentPath, err = parent.Object().Get("filename"); err != nil {
-			log.Fatal(err)
+			mcore.Failf("%s", err)
 		}
 		if !parentPath.IsUndefined() && parentPath.IsString() {
 			parentDir, _ = filepath.Split(parentPath.String())
 		}
 	}
 
+	if path, buf, ok := findSource(parentDir, filename); ok {
+		return path, parentPath.String(), buf
+	}
+	mcore.Failf("Can't load '%s'", filename)
+	return "", "", nil
+}
+
+// Find the source of a module, looking in the current directory, the
+// JS lib directory, and the directory of the module requiring it,
+// parentDir.
+func findSource(parentDir string, filename string) (string, *bytes.Buffer, bool) {
 	ext := filepath.Ext(filename)
 	replaced := strings.Replace(filename, "-", "_", -1)
 	tryThese := []string{}
@@ -121,7 +135,7 @@ func loadSource(rt *otto.Otto, parent *otto.Value, filename string) (string, str
 			// Load source verbatim from dir
 			path := filepath.Join(dir, p)
 			if buf, _ := LoadScript(path); buf != nil {
-				return path, parentPath.String(), buf
+				return path, buf, true
 			}
 
 			// Look for package.json
@@ -133,13 +147,13 @@ func loadSource(rt *otto.Otto, parent *otto.Value, filename string) (string, str
 					_, err := os.Stat(path)
 					if err == nil {
 						// load package.json, then try its 'Main'
-						pkg := loadPackage(rt, path)
+						pkg := loadPackage(path)
 						main := pkg.Main
 						if main == "" {
 							main = "index.js"
 						}
 						path := filepath.Join(dir, p, main)
-						return loadSource(rt, parent, path)
+						return findSource(parentDir, path)
 					}
 				}
 			}
@@ -148,18 +162,15 @@ func loadSource(rt *otto.Otto, parent *otto.Value, filename string) (string, str
 			info, err := os.Stat(filepath.Join(dir, p))
 			if err == nil && info.IsDir() {
 				path := filepath.Join(dir, p, "index.js")
-				return loadSource(rt, parent, path)
+				return findSource(parentDir, path)
 			}
 
 		}
 	}
-
-	log.Fatalf("Can't load '%s'", filename)
-	return "", "", nil
-
+	return "", nil, false
 }
 
-func loadPackage(rt *otto.Otto, path string) *Package {
+func loadPackage(path string) *Package {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil
@@ -174,15 +185,26 @@ func loadPackage(rt *otto.Otto, path string) *Package {
 	var pkg Package
 	err = json.Unmarshal([]byte(buff.String()), &pkg)
 	if err != nil {
-		log.Fatalf("Can't unmarshall package json: %s", err)
+		mcore.Failf("Can't unmarshall package json: %s", err)
 	}
 	return &pkg
 }
 
 func require(rt *otto.Otto, baseRequire otto.Value, parent *otto.Value, filename string) otto.Value {
 
-	// Find it and load it
-	path, parentPath, buf := loadSource(rt, parent, filename)
+	// Find it in the bundle, if there is one, or else load it
+	var path, parentPath string
+	var buf *bytes.Buffer
+	if parent != nil && parent.IsObject() {
+		if p, err := parent.Object().Get("filename"); err == nil && p.IsString() {
+			parentPath = p.String()
+		}
+	}
+	if p, src, ok := fromBundle(rt, baseRequire, parentPath, filename); ok {
+		path, buf = p, bytes.NewBufferString(src)
+	} else {
+		path, parentPath, buf = loadSource(rt, parent, filename)
+	}
 
 	// Handle JSON files
 	if ext := filepath.Ext(path); ext == ".json" {
@@ -193,7 +215,7 @@ func require(rt *otto.Otto, baseRequire otto.Value, parent *otto.Value, filename
 		var val otto.Value
 		var err error
 		if val, err = rt.Call(js, nil, buf.String()); err != nil {
-			log.Fatal(err)
+			mcore.Failf("%s", err)
 		}
 		return val
 	}
@@ -222,11 +244,11 @@ func require(rt *otto.Otto, baseRequire otto.Value, parent *otto.Value, filename
 	var err error
 	if parent != nil {
 		if val, err = rt.Call(js, nil, baseRequire, path, *parent); err != nil {
-			log.Fatalf("Error loading '%s' from '%s': %s", path, parentPath, err)
+			mcore.Failf("Error loading '%s' from '%s': %s", path, parentPath, err)
 		}
 	} else {
 		if val, err = rt.Call(js, nil, baseRequire, path); err != nil {
-			log.Fatalf("Error loading '%s' from '%s': %s", path, parentPath, err)
+			mcore.Failf("Error loading '%s' from '%s': %s", path, parentPath, err)
 		}
 	}
 
@@ -237,7 +259,10 @@ func require(rt *otto.Otto, baseRequire otto.Value, parent *otto.Value, filename
 func init() {
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
-		rt.Set("require", func(call otto.FunctionCall) otto.Value {
+		rt.Set("require", context.Guard(func(call otto.FunctionCall) otto.Value {
+			// Modules keep a reference to this function, so use
+			// whichever runtime is calling it (see Context.Copy)
+			rt := call.Otto
 			base, _ := rt.Get("require")
 			filename := call.Argument(0).String()
 			if len(call.ArgumentList) > 1 {
@@ -246,6 +271,6 @@ func init() {
 			} else {
 				return require(rt, base, nil, filename)
 			}
-		})
+		}))
 	})
 }
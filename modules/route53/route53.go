@@ -121,12 +121,10 @@ package route53
 //
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	// "github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/robertkrimen/otto"
 
@@ -137,12 +135,11 @@ var Version = "1.0.0"
 var ModuleName = "route53"
 
 func allRRSs(region string) []*route53.ResourceRecordSet {
-	svc := route53.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := route53.New(mcore.Session(route53.ServiceName, region))
 
 	resp, err := svc.ListHostedZones(nil)
 	if err != nil {
-		log.Fatal("Can't list zones: %s", err)
+		mcore.Failf("Can't list zones: %s", err)
 	}
 
 	all := []*route53.ResourceRecordSet{}
@@ -154,7 +151,7 @@ func allRRSs(region string) []*route53.ResourceRecordSet {
 		}
 		resp, err := svc.ListResourceRecordSets(params)
 		if err != nil {
-			log.Fatal("Can't list resource set in zone '%s': %s", id, err)
+			mcore.Failf("Can't list resource set in zone '%s': %s", *id, err)
 		}
 
 		all = append(all, resp.ResourceRecordSets...)
@@ -164,8 +161,7 @@ func allRRSs(region string) []*route53.ResourceRecordSet {
 }
 
 func describe(region string, zoneId string, rName string, rType string) *route53.ResourceRecordSet {
-	svc := route53.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := route53.New(mcore.Session(route53.ServiceName, region))
 
 	params := &route53.ListResourceRecordSetsInput{
 		HostedZoneId:    aws.String(zoneId),
@@ -176,7 +172,7 @@ func describe(region string, zoneId string, rName string, rType string) *route53
 	resp, err := svc.ListResourceRecordSets(params)
 
 	if err != nil {
-		log.Fatalf("Error describing route53 resources: %s", err)
+		mcore.Failf("Error describing route53 resources: %s", err)
 	}
 
 	if len(resp.ResourceRecordSets) > 0 {
@@ -186,12 +182,11 @@ func describe(region string, zoneId string, rName string, rType string) *route53
 }
 
 func modify(region string, rrs *route53.ChangeResourceRecordSetsInput, zoneId string, verbose bool) *route53.ResourceRecordSet {
-	svc := route53.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := route53.New(mcore.Session(route53.ServiceName, region))
 
 	_, err := svc.ChangeResourceRecordSets(rrs)
 	if err != nil {
-		log.Fatalf("Error creating resource record: %s", err)
+		mcore.Failf("Error creating resource record: %s", err)
 	}
 
 	rName := rrs.ChangeBatch.Changes[0].ResourceRecordSet.Name
@@ -210,32 +205,38 @@ func modify(region string, rrs *route53.ChangeResourceRecordSetsInput, zoneId st
 	return target
 }
 
-func scanZones(rt *otto.Otto, region string) otto.Value {
-	svc := route53.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scanZones(region string) []route53.HostedZone {
+	svc := route53.New(mcore.Session(route53.ServiceName, region))
 
 	resp, err := svc.ListHostedZones(nil)
 	if err != nil {
-		log.Fatal("Can't list zones: %s", err)
+		mcore.Failf("Can't list zones: %s", err)
 	}
 
 	zones := []route53.HostedZone{}
 	for _, z := range resp.HostedZones {
 		zones = append(zones, *z)
 	}
-	return mcore.Sanitize(rt, zones)
+	return zones
 }
 
-func scanResources(rt *otto.Otto, region string) otto.Value {
+func scanResources(region string) []route53.ResourceRecordSet {
 	all := allRRSs(region)
 	rrs := []route53.ResourceRecordSet{}
 	for _, r := range all {
 		rrs = append(rrs, *r)
 	}
-	return mcore.Sanitize(rt, rrs)
+	return rrs
 }
 
 func init() {
+	mcore.RegisterScanner("zones", func(region string) interface{} {
+		return scanZones(region)
+	})
+	mcore.RegisterScanner("rrs", func(region string) interface{} {
+		return scanResources(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -245,9 +246,9 @@ func init() {
 		rt.Object(`aws.route53 = {}`)
 
 		o1, _ := rt.Object(`aws.route53.zones = {}`)
-		o1.Set("scan", func(region string) otto.Value {
-			return scanZones(rt, region)
-		})
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scanZones(region))
+		}))
 
 		o2, _ := rt.Object(`aws.route53.rrs = {}`)
 		gimmieChange := func(action string) func(otto.FunctionCall) otto.Value {
@@ -257,11 +258,11 @@ func init() {
 				js := `(function (o) { return JSON.stringify(o); })`
 				s, err := rt.Call(js, nil, call.Argument(2))
 				if err != nil {
-					log.Fatalf("Can't create json for route53 resource input: %s", err)
+					context.Throwf("Can't create json for route53 resource input: %s", err)
 				}
 				err = json.Unmarshal([]byte(s.String()), &input)
 				if err != nil {
-					log.Fatalf("Can't unmarshall route53 resource json: %s", err)
+					context.Throwf("Can't unmarshall route53 resource json: %s", err)
 				}
 
 				verbose := mcore.IsVerbose(rt)
@@ -286,15 +287,17 @@ func init() {
 			}
 		}
 
-		o2.Set("scan", func(region string) otto.Value {
-			return scanResources(rt, region)
-		})
-		o2.Set("create", gimmieChange("CREATE"))
-		o2.Set("delete", gimmieChange("DELETE"))
-		o2.Set("describe", func(region string, zoneId string, rName string, rType string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scanResources(region))
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.route53.rrs.create", gimmieChange("CREATE"), mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 2), nil)
+		}))))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.route53.rrs.delete", gimmieChange("DELETE"))))
+		o2.Set("describe", context.Guard(func(region string, zoneId string, rName string, rType string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(describe(region, zoneId, rName, rType))
-		})
+		}))
 
 	})
 }
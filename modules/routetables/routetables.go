@@ -151,12 +151,10 @@ package routetables
 // ```
 //
 import (
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -167,8 +165,7 @@ var Version = "1.0.0"
 var ModuleName = "routetables"
 
 func associate(region string, routeTableId string, subnetId string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	// Associate the subnet with the route table
 	_, err := svc.AssociateRouteTable(&ec2.AssociateRouteTableInput{
@@ -176,33 +173,31 @@ func associate(region string, routeTableId string, subnetId string, verbose bool
 		SubnetId:     aws.String(subnetId),
 	})
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 }
 
 func disassociate(region string, associationId string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{
 		AssociationId: aws.String(associationId),
 	})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 }
 
 func deleteRouteTable(region string, id string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.DeleteRouteTable(&ec2.DeleteRouteTableInput{
 		RouteTableId: aws.String(id),
 	})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -216,8 +211,7 @@ func deleteRouteTable(region string, id string, verbose bool) {
 }
 
 func describe(region string, id string) []*ec2.RouteTable {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeRouteTablesInput{
 		RouteTableIds: []*string{
@@ -234,37 +228,35 @@ func describe(region string, id string) []*ec2.RouteTable {
 				return []*ec2.RouteTable{}
 			}
 		}
-		log.Fatalf("Error listing bucket: %s", err)
+		mcore.Failf("Error listing bucket: %s", err)
 	}
 
 	return rtResp.RouteTables
 }
 
 func DescribeRouteTables(region string) []*ec2.RouteTable {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	// Get route table info
 	rtResp, err := svc.DescribeRouteTables(&ec2.DescribeRouteTablesInput{})
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing route tables: %s", err)
 	}
 
 	return rtResp.RouteTables
 }
 
-func scan(rt *otto.Otto, region string) otto.Value {
+func scan(region string) []ec2.RouteTable {
 	tables := []ec2.RouteTable{}
 	for _, t := range DescribeRouteTables(region) {
 		tables = append(tables, *t)
 	}
-	return mcore.Sanitize(rt, tables)
+	return tables
 }
 
 func describeForSubnet(region string, subnetId string) []*ec2.RouteTable {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	// Get route table info
 	rtResp, err := svc.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
@@ -277,41 +269,43 @@ func describeForSubnet(region string, subnetId string) []*ec2.RouteTable {
 	})
 
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing route tables: %s", err)
 	}
 
 	return rtResp.RouteTables
 }
 
 func deleteAssociation(region string, id string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{
 		AssociationId: aws.String(id),
 	})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 }
 
 func CreateRouteTable(region string, vpcId string, verbose bool) *ec2.RouteTable {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	// Create a route table
 	rtResp, err := svc.CreateRouteTable(&ec2.CreateRouteTableInput{
 		VpcId: aws.String(vpcId),
 	})
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	return rtResp.RouteTable
 }
 
 func init() {
+	mcore.RegisterScanner("routeTables", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -322,60 +316,65 @@ func init() {
 			if b, err := a.Object().Get("routeTables"); err != nil || b.IsUndefined() {
 				o1, _ = rt.Object(`aws.routeTables = {}`)
 			} else {
-				log.Fatal("Logic error: aws.routeTables already set.")
+				o1 = b.Object()
 			}
 		}
 
-		o1.Set("scan", func(region string) otto.Value {
-			return scan(rt, region)
-		})
-		o1.Set("describeForSubnet", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scan(region))
+		}))
+		o1.Set("describeForSubnet", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			subnetId := call.Argument(1).String()
 			return f(describeForSubnet(region, subnetId))
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			return f(describe(region, id))
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.routeTables.create", func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			vpcId := call.Argument(1).String()
 			return f(CreateRouteTable(region, vpcId, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return map[string]interface{}{
+				"RouteTableId": mcore.Plan.ID("rtb"),
+				"VpcId":        mcore.PlannedArg(args, 1),
+			}
+		}))))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.routeTables.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			deleteRouteTable(region, id, verbose)
 			return otto.Value{}
-		})
-		o1.Set("associate", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("associate", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.routeTables.associate", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			subnetId := call.Argument(1).String()
 			rtId := call.Argument(2).String()
 			associate(region, rtId, subnetId, verbose)
 			return otto.Value{}
-		})
-		o1.Set("disassociate", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("disassociate", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.routeTables.disassociate", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			associationId := call.Argument(1).String()
 			disassociate(region, associationId, verbose)
 			return otto.Value{}
-		})
-		o1.Set("deleteAssociation", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("deleteAssociation", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.routeTables.deleteAssociation", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			associationId := call.Argument(1).String()
 			deleteAssociation(region, associationId, verbose)
 			return otto.Value{}
-		})
+		})))
 	})
 }
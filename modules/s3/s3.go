@@ -312,14 +312,13 @@ package s3
 import (
 	"bytes"
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/robertkrimen/otto"
 
@@ -330,8 +329,7 @@ var Version = "1.0.0"
 var ModuleName = "s3"
 
 func getObject(region string, bucket string, key string) s3.GetObjectOutput {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
@@ -345,15 +343,14 @@ func getObject(region string, bucket string, key string) s3.GetObjectOutput {
 				return *resp
 			}
 		}
-		log.Fatalf("Error getting object: %s", err)
+		mcore.Failf("Error getting object: %s", err)
 	}
 
 	return *resp
 }
 
 func readObject(region string, bucket string, key string) []byte {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
@@ -367,12 +364,12 @@ func readObject(region string, bucket string, key string) []byte {
 				return []byte{}
 			}
 		}
-		log.Fatalf("Error getting object: %s", err)
+		mcore.Failf("Error getting object: %s", err)
 	}
 
 	buf := make([]byte, *resp.ContentLength)
 	if _, err := io.ReadFull(resp.Body, buf); err != nil {
-		log.Fatalf("Error reading object: %s", err)
+		mcore.Failf("Error reading object: %s", err)
 	}
 
 	return buf
@@ -384,8 +381,7 @@ func writeInto(region, bucket, key, path string, perm uint64) error {
 }
 
 func describeObject(region string, bucket string, prefix string) []*s3.Object {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	// TODO: paginate
 	params := &s3.ListObjectsInput{
@@ -404,15 +400,14 @@ func describeObject(region string, bucket string, prefix string) []*s3.Object {
 				return resp.Contents
 			}
 		}
-		log.Fatalf("Error listing objects: %s", err)
+		mcore.Failf("Error listing objects: %s", err)
 	}
 
 	return resp.Contents
 }
 
 func describeBucket(region string, bucket string) []*s3.Bucket {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	var params *s3.ListBucketsInput
 	resp, err := svc.ListBuckets(params)
@@ -423,7 +418,7 @@ func describeBucket(region string, bucket string) []*s3.Bucket {
 				return []*s3.Bucket{}
 			}
 		}
-		log.Fatalf("Error listing bucket: %s", err)
+		mcore.Failf("Error listing bucket: %s", err)
 	}
 
 	if bucket != "*" {
@@ -438,55 +433,50 @@ func describeBucket(region string, bucket string) []*s3.Bucket {
 }
 
 func listObjects(region string, params *s3.ListObjectsInput) []*s3.Object {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	resp, err := svc.ListObjects(params)
 
 	if err != nil {
-		log.Fatalf("Error listing objects: %s", err)
+		mcore.Failf("Error listing objects: %s", err)
 	}
 
 	return resp.Contents
 }
 
 func putACL(region string, params s3.PutBucketAclInput) {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	_, err := svc.PutBucketAcl(&params)
 	if err != nil {
-		log.Fatalf("Error putting bucket acl: %s", err)
+		mcore.Failf("Error putting bucket acl: %s", err)
 	}
 }
 
 func createBucket(region string, params s3.CreateBucketInput) string {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	resp, err := svc.CreateBucket(&params)
 	if err != nil {
-		log.Fatalf("Error creating bucket: %s", err)
+		mcore.Failf("Error creating bucket: %s", err)
 	}
 
 	return *resp.Location
 }
 
 func createObject(region string, params s3.PutObjectInput) s3.PutObjectOutput {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	resp, err := svc.PutObject(&params)
 	if err != nil {
-		log.Fatalf("Error creating object: %s", err)
+		mcore.Failf("Error creating object: %s", err)
 	}
 
 	return *resp
 }
 
 func deleteBucket(region, id string) {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	params := &s3.DeleteBucketInput{
 		Bucket: aws.String(id),
@@ -494,13 +484,12 @@ func deleteBucket(region, id string) {
 	_, err := svc.DeleteBucket(params)
 
 	if err != nil {
-		log.Fatalf("Error deleting bucket: %s", err)
+		mcore.Failf("Error deleting bucket: %s", err)
 	}
 }
 
 func deleteObject(region, key, bucket string) {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
@@ -512,29 +501,27 @@ func deleteObject(region, key, bucket string) {
 	_, err := svc.DeleteObject(params)
 
 	if err != nil {
-		log.Fatalf("Error deleting bucket: %s", err)
+		mcore.Failf("Error deleting bucket: %s", err)
 	}
 }
 
 func putWebsite(region string, params s3.PutBucketWebsiteInput) {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	_, err := svc.PutBucketWebsite(&params)
 
 	if err != nil {
-		log.Fatalf("Error putting bucket website configuration: %s", err)
+		mcore.Failf("Error putting bucket website configuration: %s", err)
 	}
 }
 
 func putNotification(region string, params s3.PutBucketNotificationConfigurationInput) {
-	svc := s3.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := s3.New(mcore.Session(s3.ServiceName, region))
 
 	_, err := svc.PutBucketNotificationConfiguration(&params)
 
 	if err != nil {
-		log.Fatalf("Error putting bucket notification configuration: %s", err)
+		mcore.Failf("Error putting bucket notification configuration: %s", err)
 	}
 }
 
@@ -550,91 +537,94 @@ func init() {
 		o3, _ := rt.Object(`aws.s3.objects = {}`)
 
 		// Buckets
-		o2.Set("delete", deleteBucket)
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.s3.buckets.delete", deleteBucket)))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.s3.buckets.create", func(call otto.FunctionCall) otto.Value {
 			// Translate target into a struct
 			var input s3.CreateBucketInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for S3 createbucket input: %s", err)
+				context.Throwf("Can't create json for S3 createbucket input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall s3 createbucket json: %s", err)
+				context.Throwf("Can't unmarshall s3 createbucket json: %s", err)
 			}
 			region := call.Argument(0).String()
 			return mcore.Sanitize(rt, createBucket(region, input))
-		})
-		o2.Set("putACL", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			params := mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+			return fmt.Sprintf("/%v", params["Bucket"])
+		}))))
+		o2.Set("putACL", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.s3.buckets.putACL", func(call otto.FunctionCall) otto.Value {
 			// Translate target into a struct
 			var input s3.PutBucketAclInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for S3 putACL input: %s", err)
+				context.Throwf("Can't create json for S3 putACL input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall s3 putACL json: %s", err)
+				context.Throwf("Can't unmarshall s3 putACL json: %s", err)
 			}
 			region := call.Argument(0).String()
 			putACL(region, input)
 			return otto.Value{}
-		})
-		o2.Set("describe", describeBucket)
-		o2.Set("website", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("describe", context.Guard(describeBucket))
+		o2.Set("website", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.s3.buckets.website", func(call otto.FunctionCall) otto.Value {
 			// Translate target into a struct
 			var input s3.PutBucketWebsiteInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for S3 website input: %s", err)
+				context.Throwf("Can't create json for S3 website input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall s3 website json: %s", err)
+				context.Throwf("Can't unmarshall s3 website json: %s", err)
 			}
 			region := call.Argument(0).String()
 			putWebsite(region, input)
 			return otto.Value{}
-		})
-		o2.Set("notification", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("notification", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.s3.buckets.notification", func(call otto.FunctionCall) otto.Value {
 			// Translate target into a struct
 			var input s3.PutBucketNotificationConfigurationInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for S3 notification input: %s", err)
+				context.Throwf("Can't create json for S3 notification input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall s3 notification json: %s", err)
+				context.Throwf("Can't unmarshall s3 notification json: %s", err)
 			}
 			region := call.Argument(0).String()
 			putNotification(region, input)
 			return otto.Value{}
-		})
-		o2.Set("list", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("list", context.Guard(func(call otto.FunctionCall) otto.Value {
 			// Translate target into a struct
 			var input s3.ListObjectsInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for S3 list objects input: %s", err)
+				context.Throwf("Can't create json for S3 list objects input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall S3 list objects json: %s", err)
+				context.Throwf("Can't unmarshall S3 list objects json: %s", err)
 			}
 			region := call.Argument(0).String()
 			f := mcore.Sanitizer(rt)
 			return f(listObjects(region, &input))
-		})
+		}))
 
 		// Objects
-		o3.Set("delete", deleteObject)
-		o3.Set("create", func(call otto.FunctionCall) otto.Value {
+		o3.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.s3.objects.delete", deleteObject)))
+		o3.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.s3.objects.create", func(call otto.FunctionCall) otto.Value {
 			// Translate target into a struct
 			var input s3.PutObjectInput
 			body, err := call.Argument(1).Object().Get("Body")
@@ -642,11 +632,11 @@ func init() {
 			js := `(function (o) { return JSON.stringify(_.omit(o, "Body")); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for S3 putobject input: %s", err)
+				context.Throwf("Can't create json for S3 putobject input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall s3 putobject json: %s", err)
+				context.Throwf("Can't unmarshall s3 putobject json: %s", err)
 			}
 			if body.IsString() {
 				input.Body = bytes.NewReader([]byte(body.String()))
@@ -659,22 +649,24 @@ func init() {
 			region := call.Argument(0).String()
 
 			return mcore.Sanitize(rt, createObject(region, input))
-		})
-		o3.Set("describe", describeObject)
-		o3.Set("get", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return map[string]interface{}{"ETag": mcore.Plan.ID("etag")}
+		}))))
+		o3.Set("describe", context.Guard(describeObject))
+		o3.Set("get", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			bucket := call.Argument(1).String()
 			key := call.Argument(2).String()
 			return mcore.Sanitize(rt, getObject(region, bucket, key))
-		})
-		o3.Set("read", func(call otto.FunctionCall) otto.Value {
+		}))
+		o3.Set("read", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			bucket := call.Argument(1).String()
 			key := call.Argument(2).String()
 			return mcore.Sanitize(rt, readObject(region, bucket, key))
-		})
-		o3.Set("writeInto", func(region, bucket, key, path string, perm uint64) otto.Value {
+		}))
+		o3.Set("writeInto", context.Guard(func(region, bucket, key, path string, perm uint64) otto.Value {
 			return mcore.Sanitize(rt, writeInto(region, bucket, key, path, perm))
-		})
+		}))
 	})
 }
@@ -0,0 +1,612 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+//
+// # CORE FUNCTIONS: SCHEDULE
+//
+
+package schedule
+
+// @public
+//
+// This package exports entry points into the JS environment:
+//
+// > * [schedule.cron](#cron)
+// > * [schedule.every](#every)
+// > * [schedule.cancel](#cancel)
+// > * [schedule.list](#list)
+//
+// This API allows daemon scripts to run functions periodically.
+//
+// Scheduled functions run in the script's own runtime, so they may use
+// anything the script has set up.  They only start running once the
+// script's `run()` function has returned, under `mithras daemon
+// start`, and take turns with the daemon's signal handlers: a `stop`
+// or `reload` never runs at the same time as a scheduled function.
+// On SIGTERM or SIGQUIT, scheduled functions which are running are
+// allowed to finish, and no more are run, before the script's `stop`
+// is called.
+//
+// Since they share the runtime, only one scheduled function runs at a
+// time; one which takes a long time holds up the others.  Hand long
+// work to a [worker](core_workers.html) instead.
+//
+// An error thrown by a scheduled function is logged, and kept as the
+// job's `lastError`; the job carries on.
+//
+// Both `schedule.cron` and `schedule.every` take an optional object
+// of options:
+//
+// > * `overlap`: what to do when the function is due while it's still running from last time.  `"skip"`, the default, doesn't run it; `"queue"` runs it again as soon as it finishes.
+// > * `jitter`: a duration, as for [schedule.every](#every).  Each run is delayed by a random amount of time up to this, to spread out work started by many daemons on the same schedule.
+// > * `timezone`: the name of the timezone in which a cron expression is read, such as `"America/New_York"`.  By default, local time.
+//
+// ## SCHEDULE.CRON
+// <a name="cron"></a>
+// `schedule.cron(expression, fn, options);`
+//
+// Run `fn` at the times matched by the cron `expression`, returning
+// an id for the job.
+//
+// The expression has six fields: second, minute, hour, day of month,
+// month and day of week.  It may also have five, without the seconds,
+// as in crontab.  Each field is `*`, a number, a range (`1-5`), a
+// step (`*/15` or `0-30/10`), or a comma separated list of those.
+// Months and days of the week may be given by name (`jan`, `mon`).
+// The shorthands `@yearly`, `@monthly`, `@weekly`, `@daily` and
+// `@hourly` are also understood.
+//
+// Example:
+//
+// ```
+//  // Every five minutes, on the minute
+//  schedule.cron("0 */5 * * * *", function() {
+//    mithras.run();
+//  });
+//
+//  // 2am each weekday, New York time
+//  schedule.cron("0 2 * * mon-fri", backup, {timezone: "America/New_York"});
+//
+// ```
+//
+// ## SCHEDULE.EVERY
+// <a name="every"></a>
+// `schedule.every(interval, fn, options);`
+//
+// Run `fn` every `interval`, returning an id for the job.  The
+// interval is a duration such as `"90s"`, `"5m"` or `"1h30m"`, or a
+// number of milliseconds.  Runs are spaced from when the job was
+// scheduled, not from when the last run finished, so a function
+// taking a while doesn't make the schedule drift.
+//
+// Example:
+//
+// ```
+//  schedule.every("90s", poll, {overlap: "queue", jitter: "10s"});
+//
+// ```
+//
+// ## SCHEDULE.CANCEL
+// <a name="cancel"></a>
+// `schedule.cancel(id);`
+//
+// Stop running a job.  If it's running now, it finishes.  Returns
+// `false` if there is no job with the id.
+//
+// Example:
+//
+// ```
+//  var id = schedule.every("1m", heartbeat);
+//  ...
+//  schedule.cancel(id);
+//
+// ```
+//
+// ## SCHEDULE.LIST
+// <a name="list"></a>
+// `schedule.list();`
+//
+// Returns an array describing the scheduled jobs, ordered by id.
+// Each has `id`, `kind` (`"cron"` or `"every"`), `spec`, `overlap`,
+// `jitter`, `timezone`, `next` (when it is next due, before jitter),
+// `running`, `runs`, `skipped`, `errors` and, if there has been one,
+// `lastError`.
+//
+// Example:
+//
+// ```
+//  _.each(schedule.list(), function(j) {
+//    log(sprintf("%d %s next at %s", j.id, j.spec, j.next));
+//  });
+//
+// ```
+//
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+var Version = "1.0.0"
+var ModuleName = "schedule"
+
+// What to do when a job is due while it's still running
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+)
+
+// Options are the settings of a job.
+type Options struct {
+	Overlap  string
+	Jitter   time.Duration
+	Location *time.Location
+}
+
+// Job is a function run on a schedule.
+type Job struct {
+	ID      int
+	Kind    string
+	Spec    string
+	Options Options
+
+	fn otto.Value
+	// The runtime which scheduled the job
+	rt    *otto.Otto
+	cron  *Cron
+	every time.Duration
+	// Closed to stop the job's loop
+	quit chan struct{}
+
+	mu sync.Mutex
+	// When the job was last due, and is next due
+	last      time.Time
+	upcoming  time.Time
+	looping   bool
+	cancelled bool
+	running   bool
+	pending   int
+	runs      int64
+	skipped   int64
+	errors    int64
+	lastError string
+}
+
+// JobStatus describes a job.
+type JobStatus struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Spec      string    `json:"spec"`
+	Overlap   string    `json:"overlap"`
+	Jitter    string    `json:"jitter"`
+	Timezone  string    `json:"timezone"`
+	Next      time.Time `json:"next"`
+	Running   bool      `json:"running"`
+	Runs      int64     `json:"runs"`
+	Skipped   int64     `json:"skipped"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	jobs    = map[int]*Job{}
+	lastID  int
+	started bool
+	wg      sync.WaitGroup
+)
+
+func newJob(rt *otto.Otto, kind string, spec string, fn otto.Value, opts Options) *Job {
+	if opts.Overlap == "" {
+		opts.Overlap = OverlapSkip
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	return &Job{
+		Kind:    kind,
+		Spec:    spec,
+		Options: opts,
+		fn:      fn,
+		rt:      rt,
+		last:    time.Now(),
+	}
+}
+
+// CronJob schedules fn, a function of rt, at the times matched by a
+// cron expression.
+func CronJob(rt *otto.Otto, expr string, fn otto.Value, opts Options) (*Job, error) {
+	c, err := ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	j := newJob(rt, "cron", expr, fn, opts)
+	j.cron = c
+	add(j)
+	return j, nil
+}
+
+// Every schedules fn, a function of rt, at a fixed interval.
+func Every(rt *otto.Otto, interval time.Duration, fn otto.Value, opts Options) (*Job, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("Invalid schedule interval '%s'", interval)
+	}
+	j := newJob(rt, "every", interval.String(), fn, opts)
+	j.every = interval
+	add(j)
+	return j, nil
+}
+
+func add(j *Job) {
+	mu.Lock()
+	defer mu.Unlock()
+	lastID++
+	j.ID = lastID
+	jobs[j.ID] = j
+	if started {
+		j.start()
+	}
+}
+
+// Start running jobs, those scheduled so far and any scheduled after.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	started = true
+	for _, j := range jobs {
+		j.start()
+	}
+}
+
+// Suspend stops running jobs, without cancelling them, until Start is
+// called again.  Like Stop, it waits for those running to finish.
+func Suspend() {
+	mu.Lock()
+	for _, j := range jobs {
+		j.halt()
+	}
+	started = false
+	mu.Unlock()
+	wg.Wait()
+}
+
+// Stop cancels all jobs, waiting for those running to finish.  It must
+// not be called while holding the runtime lock, unless jobs are
+// suspended.
+func Stop() {
+	mu.Lock()
+	for id, j := range jobs {
+		j.stop()
+		delete(jobs, id)
+	}
+	started = false
+	mu.Unlock()
+	wg.Wait()
+}
+
+// Cancel a job, returning false if there is no job with the id.  If it
+// is running, it finishes.
+func Cancel(id int) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	j, ok := jobs[id]
+	if !ok {
+		return false
+	}
+	j.stop()
+	delete(jobs, id)
+	return true
+}
+
+// CancelAll cancels the jobs scheduled by rt.  Like Cancel, it lets
+// those running finish.
+func CancelAll(rt *otto.Otto) {
+	mu.Lock()
+	defer mu.Unlock()
+	for id, j := range jobs {
+		if j.rt == rt {
+			j.stop()
+			delete(jobs, id)
+		}
+	}
+}
+
+// List describes the jobs, ordered by id.
+func List() []JobStatus {
+	mu.Lock()
+	ids := []int{}
+	for id := range jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	list := []JobStatus{}
+	for _, id := range ids {
+		list = append(list, jobs[id].Status())
+	}
+	mu.Unlock()
+	return list
+}
+
+// Status describes the job.
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	next := j.upcoming
+	if !j.looping {
+		next = j.next(time.Now())
+	}
+	return JobStatus{
+		ID:        j.ID,
+		Kind:      j.Kind,
+		Spec:      j.Spec,
+		Overlap:   j.Options.Overlap,
+		Jitter:    j.Options.Jitter.String(),
+		Timezone:  j.Options.Location.String(),
+		Next:      next,
+		Running:   j.running,
+		Runs:      j.runs,
+		Skipped:   j.skipped,
+		Errors:    j.errors,
+		LastError: j.lastError,
+	}
+}
+
+// When the job is next due after now, or the zero time if never.
+func (j *Job) next(now time.Time) time.Time {
+	if j.cron != nil {
+		return j.cron.Next(now.In(j.Options.Location))
+	}
+	due := j.last.Add(j.every)
+	if due.Before(now) {
+		// Fell behind; skip the runs missed
+		missed := now.Sub(due) / j.every
+		due = due.Add((missed + 1) * j.every)
+	}
+	return due
+}
+
+func (j *Job) start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.looping || j.cancelled {
+		return
+	}
+	j.looping = true
+	j.quit = make(chan struct{})
+	j.upcoming = j.next(time.Now())
+	wg.Add(1)
+	go j.loop(j.quit)
+}
+
+func (j *Job) stop() {
+	j.mu.Lock()
+	j.cancelled = true
+	j.mu.Unlock()
+	j.halt()
+}
+
+// Stop the job's loop.
+func (j *Job) halt() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.looping {
+		j.looping = false
+		close(j.quit)
+	}
+}
+
+func (j *Job) loop(quit chan struct{}) {
+	defer wg.Done()
+	for {
+		j.mu.Lock()
+		due := j.next(time.Now())
+		j.upcoming = due
+		j.mu.Unlock()
+		if due.IsZero() {
+			log.Errorf("Scheduled job %d ('%s') will never run again", j.ID, j.Spec)
+			return
+		}
+
+		wait := due.Sub(time.Now())
+		if j.Options.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(j.Options.Jitter)))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+			j.mu.Lock()
+			j.last = due
+			j.mu.Unlock()
+			j.fire()
+		}
+	}
+}
+
+// The job is due: run it, unless it's running already.
+func (j *Job) fire() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		if j.Options.Overlap == OverlapQueue {
+			j.pending++
+		} else {
+			j.skipped++
+			log.Infof("Scheduled job %d ('%s') still running; skipped", j.ID, j.Spec)
+		}
+		return
+	}
+	j.running = true
+	wg.Add(1)
+	go j.run()
+}
+
+func (j *Job) run() {
+	defer wg.Done()
+	for {
+		j.call()
+		j.mu.Lock()
+		if j.pending > 0 && !j.cancelled {
+			j.pending--
+			j.mu.Unlock()
+			continue
+		}
+		j.running = false
+		j.pending = 0
+		j.mu.Unlock()
+		return
+	}
+}
+
+func (j *Job) call() {
+	_, err := func() (otto.Value, error) {
+		mcore.RuntimeLock.Lock()
+		defer mcore.RuntimeLock.Unlock()
+		return j.fn.Call(otto.Value{})
+	}()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runs++
+	if err != nil {
+		msg := err.Error()
+		if ottoErr, ok := err.(*otto.Error); ok {
+			msg = ottoErr.String()
+		}
+		j.errors++
+		j.lastError = msg
+		log.Errorf("Error in scheduled job %d ('%s'): %s", j.ID, j.Spec, msg)
+	}
+}
+
+// A duration given to a binding: a string such as "90s", or a number
+// of milliseconds
+func duration(v otto.Value) (time.Duration, error) {
+	if v.IsNumber() {
+		ms, err := v.ToFloat()
+		if err != nil || !(ms >= 0) {
+			return 0, fmt.Errorf("Invalid duration '%s'", v.String())
+		}
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+	d, err := time.ParseDuration(v.String())
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid duration '%s'", v.String())
+	}
+	return d, nil
+}
+
+func options(v otto.Value) (Options, error) {
+	opts := Options{}
+	if v.IsUndefined() || v.IsNull() {
+		return opts, nil
+	}
+	if !v.IsObject() {
+		return opts, fmt.Errorf("Schedule options must be an object")
+	}
+	o := v.Object()
+	if ov, _ := o.Get("overlap"); ov.IsDefined() && !ov.IsNull() {
+		opts.Overlap = ov.String()
+		if opts.Overlap != OverlapSkip && opts.Overlap != OverlapQueue {
+			return opts, fmt.Errorf("Invalid schedule overlap '%s'; expected 'skip' or 'queue'", opts.Overlap)
+		}
+	}
+	if jv, _ := o.Get("jitter"); jv.IsDefined() && !jv.IsNull() {
+		d, err := duration(jv)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid schedule jitter: %s", err)
+		}
+		opts.Jitter = d
+	}
+	if tz, _ := o.Get("timezone"); tz.IsDefined() && !tz.IsNull() {
+		loc, err := time.LoadLocation(tz.String())
+		if err != nil {
+			return opts, fmt.Errorf("Invalid schedule timezone '%s': %s", tz.String(), err)
+		}
+		opts.Location = loc
+	}
+	return opts, nil
+}
+
+func init() {
+	// A retired runtime's jobs are never handed over
+	mcore.RegisterRetire(func(rt *otto.Otto, successor *otto.Otto) {
+		CancelAll(rt)
+	})
+	mcore.RegisterInit(func(context *mcore.Context) {
+		rt := context.Runtime
+
+		var o1 *otto.Object
+		if a, err := rt.Get("schedule"); err != nil || a.IsUndefined() {
+			o1, _ = rt.Object(`schedule = {}`)
+		} else {
+			o1 = a.Object()
+		}
+
+		// The function and options of a call to cron or every
+		args := func(call otto.FunctionCall) (otto.Value, Options) {
+			fn := call.Argument(1)
+			if !fn.IsFunction() {
+				context.Throwf("Scheduled job must be a function")
+			}
+			opts, err := options(call.Argument(2))
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			return fn, opts
+		}
+
+		o1.Set("cron", context.Guard(func(call otto.FunctionCall) otto.Value {
+			expr := call.Argument(0).String()
+			fn, opts := args(call)
+			j, err := CronJob(rt, expr, fn, opts)
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			return mcore.Sanitize(rt, j.ID)
+		}))
+		o1.Set("every", context.Guard(func(call otto.FunctionCall) otto.Value {
+			interval, err := duration(call.Argument(0))
+			if err != nil {
+				context.Throwf("Invalid schedule interval: %s", err)
+			}
+			fn, opts := args(call)
+			j, err := Every(rt, interval, fn, opts)
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			return mcore.Sanitize(rt, j.ID)
+		}))
+		o1.Set("cancel", context.Guard(func(id int) bool {
+			return Cancel(id)
+		}))
+		o1.Set("list", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return mcore.Sanitize(rt, List())
+		}))
+	})
+}
@@ -17,16 +17,23 @@
 package script
 
 import (
+	"bytes"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strings"
 
 	"github.com/codegangsta/cli"
 	"github.com/robertkrimen/otto"
 
 	"github.com/cvillecsteele/mithras/modules/build"
 	"github.com/cvillecsteele/mithras/modules/core"
+	"github.com/cvillecsteele/mithras/modules/remote"
+	"github.com/cvillecsteele/mithras/modules/repl"
 	"github.com/cvillecsteele/mithras/modules/require"
+	"github.com/cvillecsteele/mithras/modules/state"
 )
 
 var Home string
@@ -40,6 +47,7 @@ func initModules(rt *otto.Otto, jsdir string, home string, verbose bool, args []
 		Args:    args,
 		Modules: modules,
 		Version: version,
+		AWS:     core.AWS,
 	}
 	for idx, _ := range core.InitFuncs {
 		core.InitFuncs[idx](&context)
@@ -47,13 +55,256 @@ func initModules(rt *otto.Otto, jsdir string, home string, verbose bool, args []
 }
 
 func RunCli(c *cli.Context, versions []core.ModuleVersion, version string) *otto.Otto {
+	f := runInit(c)
+	return runCli(c, versions, version, &f)
+}
+
+// Set up a runtime for the run command from its flags.
+func runInit(c *cli.Context) func(*otto.Otto) {
+	parallel := c.Int("parallel")
+	return func(rt *otto.Otto) {
+		o, err := rt.Get("mithras")
+		if err != nil {
+			panic(err)
+		}
+		if parallel > 0 {
+			o.Object().Set("parallelism", parallel)
+		}
+		setTargets(c, rt)
+	}
+}
+
+// ReloadCli loads the script RunCli ran again, into a new, staged
+// runtime set up the same way, without calling its run().  Returns an
+// error, rather than exiting, if it can't be loaded.
+func ReloadCli(c *cli.Context, versions []core.ModuleVersion, version string) (*otto.Otto, error) {
+	home := c.GlobalString("mithras")
+	jsdir := c.String("js")
+	if home == "" && jsdir == "" {
+		return nil, fmt.Errorf("$MITHRASHOME (or -m) not set and no jsdir set on command line.")
+	}
+	rt, err := StageScriptRuntime(c.String("file"), jsdir, home, c.GlobalBool("verbose"), []string(c.Args()), versions, version)
+	if err != nil {
+		return nil, err
+	}
+	runInit(c)(rt)
+	return rt, nil
+}
+
+// CallEntry calls the entry point of a script named name, such as
+// "run" or "stop", which must return a boolean.  If optional is set, a
+// script without the entry point is fine, and true is returned.
+func CallEntry(rt *otto.Otto, name string, optional bool, args ...interface{}) (bool, error) {
+	if optional {
+		if fn, err := rt.Get(name); err != nil || !fn.IsFunction() {
+			return true, nil
+		}
+	}
+	result, err := rt.Call(name, nil, args...)
+	if err != nil {
+		if ottoErr, ok := err.(*otto.Error); ok {
+			return false, fmt.Errorf("JS error calling '%s' in script: %s", name, ottoErr.String())
+		}
+		return false, fmt.Errorf("Error calling '%s' in script: %s", name, err)
+	}
+	ok, err := result.ToBoolean()
+	if err != nil {
+		return false, fmt.Errorf("Error converting '%s' return value to boolean: %s", name, err)
+	}
+	return ok, nil
+}
+
+// Pass the --target and --exclude flags along to mithras.apply.
+func setTargets(c *cli.Context, rt *otto.Otto) {
+	o, err := rt.Get("mithras")
+	if err != nil {
+		panic(err)
+	}
+	if targets := c.StringSlice("target"); len(targets) > 0 {
+		o.Object().Set("targets", core.Sanitize(rt, targets))
+	}
+	if excludes := c.StringSlice("exclude"); len(excludes) > 0 {
+		o.Object().Set("excludes", core.Sanitize(rt, excludes))
+	}
+}
+
+// Run the script in dry-run mode and print the resulting plan.
+func PlanCli(c *cli.Context, versions []core.ModuleVersion, version string) *otto.Otto {
+	f := func(rt *otto.Otto) {
+		o, err := rt.Get("mithras")
+		if err != nil {
+			panic(err)
+		}
+		o.Object().Set("dryRun", true)
+		setTargets(c, rt)
+	}
+	rt := runCli(c, versions, version, &f)
+	fmt.Print(core.Plan.Summary())
+	return rt
+}
+
+// Load the script's resources without handling them, and print
+// their dependency graph.  Exits non-zero if any resource depends on
+// one that does not exist, or the graph has a cycle.
+func GraphCli(c *cli.Context, versions []core.ModuleVersion, version string) *otto.Otto {
+	format := c.String("format")
+	f := func(rt *otto.Otto) {
+		if _, err := rt.Run(`mithras.dryRun = true; mithras.graph.capture = true;`); err != nil {
+			log.Fatalf("Error setting up graph: %s", err)
+		}
+	}
+	rt := runCli(c, versions, version, &f)
+
+	js := `(function (format) {
+  var g = mithras.graph;
+  return {
+    text: g.render(g.graphs, format),
+    problems: _.flatten(_.map(g.graphs, g.problems)),
+    count: g.graphs.length
+  };
+})`
+	v, err := rt.Call(js, nil, format)
+	if err != nil {
+		log.Fatalf("Error rendering graph: %s", err)
+	}
+	text, _ := v.Object().Get("text")
+	count, _ := v.Object().Get("count")
+	problems, _ := v.Object().Get("problems")
+
+	if n, _ := count.ToInteger(); n == 0 {
+		log.Warn("Script did not call mithras.apply; no resources to graph")
+	}
+	fmt.Println(text.String())
+
+	if n, _ := problems.Object().Get("length"); n.String() != "0" {
+		for _, k := range problems.Object().Keys() {
+			p, _ := problems.Object().Get(k)
+			log.Warn(p.String())
+		}
+		os.Exit(1)
+	}
+	return rt
+}
+
+func runCli(c *cli.Context, versions []core.ModuleVersion, version string, initFn *func(*otto.Otto)) *otto.Otto {
+	jsfile := c.String("file")
+	jsdir := c.String("js")
+	home := c.GlobalString("mithras")
+	Home = home
+	verbose := c.GlobalBool("verbose")
+	args := []string(c.Args())
+	core.FatalErrors = c.GlobalBool("fatal-errors")
+	ConfigureAWS(c)
+	ConfigureState(c)
+	ConfigureRemote(c)
+	return RunJS(jsfile, jsdir, home, verbose, args, versions, version, initFn)
+}
+
+// Start an interactive session in a fully loaded runtime, after
+// loading the script named by the --file flag, if any.
+func ReplCli(c *cli.Context, versions []core.ModuleVersion, version string) *otto.Otto {
 	jsfile := c.String("file")
 	jsdir := c.String("js")
 	home := c.GlobalString("mithras")
 	Home = home
 	verbose := c.GlobalBool("verbose")
 	args := []string(c.Args())
-	return RunJS(jsfile, jsdir, home, verbose, args, versions, version, nil)
+	ConfigureAWS(c)
+	ConfigureState(c)
+	ConfigureRemote(c)
+
+	build.CachePath = filepath.Join(home, "cache")
+	if home == "" && jsdir == "" {
+		log.Fatalf("$MITHRASHOME (or -m) not set and no jsdir set on command line.")
+	}
+	rt := LoadScriptRuntime(jsfile, jsdir, home, verbose, args, versions, version)
+
+	history := c.String("history")
+	if history == "" {
+		if h, err := homedir(); err == nil {
+			history = filepath.Join(h, ".mithras_history")
+		}
+	}
+	err := repl.Run(rt, repl.Options{
+		HistoryFile: history,
+		Prelude:     fmt.Sprintf("Mithras %s.  Type .exit or Ctrl-D to quit.", version),
+	})
+	if err != nil {
+		log.Fatalf("Error running repl: %s", err)
+	}
+	return rt
+}
+
+func homedir() (string, error) {
+	if h := os.Getenv("HOME"); h != "" {
+		return h, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.HomeDir, nil
+}
+
+// Set up the AWS session provider from global command line flags.
+func ConfigureAWS(c *cli.Context) {
+	cfg := core.AWS.Config()
+	cfg.Profile = c.GlobalString("profile")
+	cfg.Endpoint = c.GlobalString("endpoint-url")
+	if c.GlobalIsSet("max-retries") {
+		cfg.MaxRetries = c.GlobalInt("max-retries")
+	}
+	for _, e := range c.GlobalStringSlice("endpoint") {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid endpoint '%s'; expected service=url", e)
+		}
+		cfg.Endpoints[parts[0]] = parts[1]
+	}
+	core.AWS.Configure(cfg)
+}
+
+// Set up remote operations from global command line flags.
+func ConfigureRemote(c *cli.Context) {
+	cfg := remote.CurrentConfig()
+	if c.GlobalIsSet("ssh-transport") {
+		cfg.Transport = c.GlobalString("ssh-transport")
+	}
+	if c.GlobalIsSet("host-keys") {
+		cfg.HostKeys = c.GlobalString("host-keys")
+	}
+	if c.GlobalIsSet("known-hosts") {
+		cfg.KnownHosts = c.GlobalString("known-hosts")
+	}
+	if c.GlobalIsSet("ssh-jump") {
+		cfg.Jump = c.GlobalString("ssh-jump")
+	}
+	if c.GlobalIsSet("ssh-address") {
+		cfg.Address = c.GlobalString("ssh-address")
+	}
+	if c.GlobalIsSet("stream") {
+		cfg.Stream = c.GlobalBool("stream")
+	}
+	if c.GlobalIsSet("ssh-timeout") {
+		cfg.Timeout = c.GlobalFloat64("ssh-timeout")
+	}
+	if c.GlobalIsSet("ssh-connect-timeout") {
+		cfg.ConnectTimeout = c.GlobalFloat64("ssh-connect-timeout")
+	}
+	if c.GlobalIsSet("ssh-retries") {
+		cfg.Retries = c.GlobalInt("ssh-retries")
+	}
+	if err := remote.Configure(cfg); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// Set up the state store from global command line flags.
+func ConfigureState(c *cli.Context) {
+	state.State.Configure(state.Config{
+		Location: c.GlobalString("state"),
+		Region:   c.GlobalString("state-region"),
+	})
 }
 
 func RunJS(jsfile, jsdir, home string, verbose bool, args []string, versions []core.ModuleVersion, version string, initFn *func(*otto.Otto)) *otto.Otto {
@@ -66,7 +317,14 @@ func RunJS(jsfile, jsdir, home string, verbose bool, args []string, versions []c
 	if home == "" && jsdir == "" {
 		log.Fatalf("$MITHRASHOME (or -m) not set and no jsdir set on command line.")
 	}
+
+	// Web handlers and scheduled jobs wait while the script runs,
+	// except while it sleeps or makes web requests
+	core.RuntimeLock.Lock()
+	defer core.RuntimeLock.Unlock()
 	runtime := LoadScriptRuntime(jsfile, jsdir, home, verbose, args, versions, version)
+	core.Holding(runtime)
+	defer core.Holding(nil)
 
 	// Caller init
 	if initFn != nil {
@@ -98,6 +356,28 @@ func RunJS(jsfile, jsdir, home string, verbose bool, args []string, versions []c
 }
 
 func LoadScriptRuntime(name string, jsdir string, home string, verbose bool, args []string, modules []core.ModuleVersion, version string) *otto.Otto {
+	rt, err := NewScriptRuntime(name, jsdir, home, verbose, args, modules, version)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return rt
+}
+
+// NewScriptRuntime is LoadScriptRuntime, returning an error instead of
+// exiting if the runtime can't be made or the script can't be loaded.
+func NewScriptRuntime(name string, jsdir string, home string, verbose bool, args []string, modules []core.ModuleVersion, version string) (*otto.Otto, error) {
+	return newScriptRuntime(name, jsdir, home, verbose, args, modules, version, false)
+}
+
+// StageScriptRuntime is NewScriptRuntime for a script loaded to take
+// over from a running one.  The runtime is staged, so the script can't
+// start anything at load time which the running script may be using.
+// If it can't be loaded, what it scheduled is discarded.
+func StageScriptRuntime(name string, jsdir string, home string, verbose bool, args []string, modules []core.ModuleVersion, version string) (*otto.Otto, error) {
+	return newScriptRuntime(name, jsdir, home, verbose, args, modules, version, true)
+}
+
+func newScriptRuntime(name string, jsdir string, home string, verbose bool, args []string, modules []core.ModuleVersion, version string, staged bool) (result *otto.Otto, err error) {
 
 	// Set path
 	if jsdir != "" {
@@ -109,19 +389,30 @@ func LoadScriptRuntime(name string, jsdir string, home string, verbose bool, arg
 	path := filepath.Join(require.JsDir, "mithras.js")
 	coreBuff, err := require.LoadScript(path)
 	if err != nil {
-		log.Fatalf("Error loading '%s': %s", path, err)
+		return nil, fmt.Errorf("Error loading '%s': %s", path, err)
 	}
 	path = filepath.Join(require.JsDir, "underscore-min.js")
 	underBuff, err := require.LoadScript(path)
 	if err != nil {
-		log.Fatalf("Error loading '%s': %s", path, err)
+		return nil, fmt.Errorf("Error loading '%s': %s", path, err)
 	}
-	userBuff, err := require.LoadScript(name)
-	if err != nil {
-		log.Fatalf("Error loading '%s': %s", name, err)
+	var userBuff *bytes.Buffer
+	if name != "" {
+		userBuff, err = require.LoadScript(name)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading '%s': %s", name, err)
+		}
 	}
 
 	rt := otto.New()
+	if staged {
+		core.Stage(rt)
+		defer func() {
+			if err != nil {
+				core.Retire(rt, nil)
+			}
+		}()
+	}
 
 	// Create empty mithras object and module exports
 	rt.Object(`mithras = {}`)
@@ -131,12 +422,12 @@ func LoadScriptRuntime(name string, jsdir string, home string, verbose bool, arg
 
 	// Load underscore
 	if _, err := rt.Run(underBuff.String()); err != nil {
-		log.Fatalf("Error loading '%s': %s", path, err)
+		return nil, fmt.Errorf("Error loading '%s': %s", path, err)
 	}
 
 	// Load our base js
 	if _, err := rt.Run(coreBuff.String()); err != nil {
-		log.Fatalf("Error loading '%s': %s", path, err)
+		return nil, fmt.Errorf("Error loading '%s': %s", path, err)
 	}
 
 	// Set some variables
@@ -153,7 +444,7 @@ func LoadScriptRuntime(name string, jsdir string, home string, verbose bool, arg
 		js := `(function (name, version) { return this["MODULES"][name] = version; })`
 		_, err = rt.Call(js, o, mod.Module, mod.Version)
 		if err != nil {
-			log.Fatalf("Error setting module versions")
+			return nil, fmt.Errorf("Error setting module versions")
 		}
 	}
 
@@ -165,6 +456,7 @@ func LoadScriptRuntime(name string, jsdir string, home string, verbose bool, arg
 	o.Object().Set("VERSION", version)
 	o.Object().Set("VERBOSE", verbose)
 	o.Object().Set("verbose", verbose)
+	o.Object().Set("fatalErrors", core.FatalErrors)
 	o.Object().Set("GOPATH", os.Getenv("GOPATH"))
 	o.Object().Set("HOME", home)
 	o.Object().Set("CWD", cwd)
@@ -184,8 +476,13 @@ func LoadScriptRuntime(name string, jsdir string, home string, verbose bool, arg
 	o.Object().Set("ARGS", a)
 
 	// Load the script file into the runtime before we return it for use
-	if _, err := rt.Run(userBuff.String()); err != nil {
-		log.Fatal(err)
+	if userBuff != nil {
+		if _, err := rt.Run(userBuff.String()); err != nil {
+			if ottoErr, ok := err.(*otto.Error); ok {
+				return nil, fmt.Errorf("Error loading '%s': %s", name, ottoErr.String())
+			}
+			return nil, fmt.Errorf("Error loading '%s': %s", name, err)
+		}
 	}
-	return rt
+	return rt, nil
 }
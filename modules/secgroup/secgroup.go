@@ -155,11 +155,10 @@ package secgroup
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -170,8 +169,7 @@ var Version = "1.0.0"
 var ModuleName = "secgroup"
 
 func describe(region string, id string) *ec2.SecurityGroup {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeSecurityGroupsInput{
 		GroupIds: []*string{
@@ -181,41 +179,43 @@ func describe(region string, id string) *ec2.SecurityGroup {
 	resp, err := svc.DescribeSecurityGroups(params)
 
 	if err != nil {
-		return nil
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "InvalidGroup.NotFound" == awsErr.Code() {
+				return nil
+			}
+		}
+		mcore.Failf("Error describing security group: %s", err)
 	}
 
 	return resp.SecurityGroups[0]
 }
 
 func authorizeIngress(region string, params *ec2.AuthorizeSecurityGroupIngressInput, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.AuthorizeSecurityGroupIngress(params)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 }
 
 func authorizeEgress(region string, params *ec2.AuthorizeSecurityGroupEgressInput, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.AuthorizeSecurityGroupEgress(params)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 }
 
 func create(region string, params *ec2.CreateSecurityGroupInput, verbose bool) *ec2.SecurityGroup {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.CreateSecurityGroup(params)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 	id := *resp.GroupId
 
@@ -235,8 +235,7 @@ func create(region string, params *ec2.CreateSecurityGroupInput, verbose bool) *
 }
 
 func delete(region string, id string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	i := &ec2.DeleteSecurityGroupInput{
 		GroupId: aws.String(id),
@@ -244,19 +243,18 @@ func delete(region string, id string, verbose bool) {
 	_, err := svc.DeleteSecurityGroup(i)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// TODO: Wait for it.
 }
 
-func scan(rt *otto.Otto, region string) otto.Value {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scan(region string) []ec2.SecurityGroup {
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.DescribeSecurityGroups(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing security groups: %s", err)
 	}
 
 	// shove instances into jsland
@@ -264,10 +262,14 @@ func scan(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.SecurityGroups {
 		sgs = append(sgs, *i)
 	}
-	return mcore.Sanitize(rt, sgs)
+	return sgs
 }
 
 func init() {
+	mcore.RegisterScanner("securityGroups", func(region string) interface{} {
+		return scan(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -275,20 +277,20 @@ func init() {
 			rt.Object(`aws = {}`)
 		}
 		o1, _ := rt.Object(`aws.securityGroups = {}`)
-		o1.Set("scan", func(region string) otto.Value {
-			return scan(rt, region)
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scan(region))
+		}))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.securityGroups.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.CreateSecurityGroupInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for secgroup create input: %s", err)
+				context.Throwf("Can't create json for secgroup create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall secgroup create json: %s", err)
+				context.Throwf("Can't unmarshall secgroup create json: %s", err)
 			}
 
 			verbose := mcore.IsVerbose(rt)
@@ -296,55 +298,59 @@ func init() {
 
 			f := mcore.Sanitizer(rt)
 			return f(create(region, &input, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"GroupId": mcore.Plan.ID("sg"),
+			})
+		}))))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.securityGroups.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			delete(region, id, verbose)
 			return otto.Value{}
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describe(region, id))
-		})
-		o1.Set("authorizeIngress", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("authorizeIngress", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.securityGroups.authorizeIngress", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.AuthorizeSecurityGroupIngressInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for secgroup create input: %s", err)
+				context.Throwf("Can't create json for secgroup create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall secgroup ingress json: %s", err)
+				context.Throwf("Can't unmarshall secgroup ingress json: %s", err)
 			}
 
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			authorizeIngress(region, &input, verbose)
 			return otto.Value{}
-		})
-		o1.Set("authorizeEgress", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("authorizeEgress", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.securityGroups.authorizeEgress", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.AuthorizeSecurityGroupEgressInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for secgroup create input: %s", err)
+				context.Throwf("Can't create json for secgroup create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall secgroup egress json: %s", err)
+				context.Throwf("Can't unmarshall secgroup egress json: %s", err)
 			}
 
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			authorizeEgress(region, &input, verbose)
 			return otto.Value{}
-		})
+		})))
 	})
 }
@@ -193,11 +193,10 @@ package sns
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/robertkrimen/otto"
 
@@ -208,12 +207,11 @@ var Version = "1.0.0"
 var ModuleName = "sns"
 
 func createTopic(region string, params *sns.CreateTopicInput) string {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	resp, err := svc.CreateTopic(params)
 	if err != nil {
-		log.Fatalf("Error creating sns topic: %s", err)
+		mcore.Failf("Error creating sns topic: %s", err)
 	}
 	id := *resp.TopicArn
 
@@ -230,13 +228,12 @@ func createTopic(region string, params *sns.CreateTopicInput) string {
 }
 
 func deleteTopic(region string, id string) {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	_, err := svc.DeleteTopic(&sns.DeleteTopicInput{TopicArn: aws.String(id)})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// TODO: Wait for it.
@@ -252,13 +249,12 @@ func describeTopic(region string, snsId string) string {
 }
 
 func scanTopics(region string) []string {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	params := &sns.ListTopicsInput{}
 	resp, err := svc.ListTopics(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	topics := []string{}
@@ -269,12 +265,11 @@ func scanTopics(region string) []string {
 }
 
 func createSubscription(region string, params *sns.SubscribeInput) *sns.Subscription {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	resp, err := svc.Subscribe(params)
 	if err != nil {
-		log.Fatalf("Error creating sns subscription: %s", err)
+		mcore.Failf("Error creating sns subscription: %s", err)
 	}
 	id := *resp.SubscriptionArn
 
@@ -282,13 +277,12 @@ func createSubscription(region string, params *sns.SubscribeInput) *sns.Subscrip
 }
 
 func deleteSubscription(region string, id string) {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	_, err := svc.Unsubscribe(&sns.UnsubscribeInput{SubscriptionArn: aws.String(id)})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// TODO: Wait for it.
@@ -304,31 +298,36 @@ func describeSubscription(region string, subArn string) *sns.Subscription {
 }
 
 func scanSubscriptions(region string) []*sns.Subscription {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	params := &sns.ListSubscriptionsInput{}
 	resp, err := svc.ListSubscriptions(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	return resp.Subscriptions
 }
 
 func publish(region string, params *sns.PublishInput) *string {
-	svc := sns.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sns.New(mcore.Session(sns.ServiceName, region))
 
 	resp, err := svc.Publish(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	return resp.MessageId
 }
 
 func init() {
+	mcore.RegisterScanner("subs", func(region string) interface{} {
+		return scanSubscriptions(region)
+	})
+	mcore.RegisterScanner("topics", func(region string) interface{} {
+		return scanTopics(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -361,93 +360,100 @@ func init() {
 		}
 
 		// Topics
-		o2.Set("scan", func(region string) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanTopics(region))
-		})
-		o2.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.sns.topics.delete", func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			deleteTopic(region, id)
 			return otto.Value{}
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.sns.topics.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sns.CreateTopicInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SNS topic create input: %s", err)
+				context.Throwf("Can't create json for SNS topic create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SNS create topic json: %s", err)
+				context.Throwf("Can't unmarshall SNS create topic json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			f := mcore.Sanitizer(rt)
 			return f(createTopic(region, &input))
-		})
-		o2.Set("publish", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			params := mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+			return fmt.Sprintf("arn:aws:sns:%v:planned:%v", mcore.PlannedArg(args, 0), params["Name"])
+		}))))
+		o2.Set("publish", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.sns.topics.publish", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sns.PublishInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SNS publish input: %s", err)
+				context.Throwf("Can't create json for SNS publish input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SNS publish json: %s", err)
+				context.Throwf("Can't unmarshall SNS publish json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			f := mcore.Sanitizer(rt)
 			return f(publish(region, &input))
-		})
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			snsId := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeTopic(region, snsId))
-		})
+		}))
 
 		// Subs
-		o3.Set("scan", func(region string) otto.Value {
+		o3.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanSubscriptions(region))
-		})
-		o3.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o3.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.sns.subs.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sns.SubscribeInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SNS subs create input: %s", err)
+				context.Throwf("Can't create json for SNS subs create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SNS create subs json: %s", err)
+				context.Throwf("Can't unmarshall SNS create subs json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			f := mcore.Sanitizer(rt)
 			return f(createSubscription(region, &input))
-		})
-		o3.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"SubscriptionArn": mcore.Plan.ID("subscription"),
+			})
+		}))))
+		o3.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.sns.subs.delete", func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			snsId := call.Argument(1).String()
 			deleteSubscription(region, snsId)
 			return otto.Value{}
-		})
-		o3.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o3.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			snsId := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeSubscription(region, snsId))
-		})
+		}))
 	})
 }
@@ -213,12 +213,11 @@ package sqs
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/robertkrimen/otto"
 
@@ -229,12 +228,11 @@ var Version = "1.0.0"
 var ModuleName = "sqs"
 
 func createQueue(region string, params *sqs.CreateQueueInput) *string {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	_, err := svc.CreateQueue(params)
 	if err != nil {
-		log.Fatalf("Error creating sqs queue: %s", err)
+		mcore.Failf("Error creating sqs queue: %s", err)
 	}
 	id := *params.QueueName
 
@@ -251,13 +249,12 @@ func createQueue(region string, params *sqs.CreateQueueInput) *string {
 }
 
 func deleteQueue(region string, id string) {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	_, err := svc.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: aws.String(id)})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// Wait for it.
@@ -271,8 +268,7 @@ func deleteQueue(region string, id string) {
 }
 
 func describeQueue(region string, name string) *string {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	params := &sqs.ListQueuesInput{
 		QueueNamePrefix: aws.String(name),
@@ -284,7 +280,7 @@ func describeQueue(region string, name string) *string {
 				return nil
 			}
 		}
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	if len(resp.QueueUrls) > 0 {
@@ -294,8 +290,7 @@ func describeQueue(region string, name string) *string {
 }
 
 func attributesQueue(region string, url string) map[string]*string {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	params := &sqs.GetQueueAttributesInput{
 		QueueUrl: aws.String(url),
@@ -305,31 +300,29 @@ func attributesQueue(region string, url string) map[string]*string {
 	}
 	resp, err := svc.GetQueueAttributes(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	return resp.Attributes
 }
 
 func setAttributesQueue(region string, params *sqs.SetQueueAttributesInput) {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	_, err := svc.SetQueueAttributes(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 }
 
 func scanQueues(region string) []string {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	params := &sqs.ListQueuesInput{}
 	resp, err := svc.ListQueues(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	queues := []string{}
@@ -340,40 +333,41 @@ func scanQueues(region string) []string {
 }
 
 func sendMessage(region string, params *sqs.SendMessageInput) *sqs.SendMessageOutput {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	resp, err := svc.SendMessage(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	return resp
 }
 
 func receiveMessage(region string, params *sqs.ReceiveMessageInput) []*sqs.Message {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	resp, err := svc.ReceiveMessage(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 
 	return resp.Messages
 }
 
 func deleteMessage(region string, params *sqs.DeleteMessageInput) {
-	svc := sqs.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := sqs.New(mcore.Session(sqs.ServiceName, region))
 
 	_, err := svc.DeleteMessage(params)
 	if err != nil {
-		log.Fatal(err)
+		mcore.Failf("%s", err)
 	}
 }
 
 func init() {
+	mcore.RegisterScanner("queues", func(region string) interface{} {
+		return scanQueues(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -399,119 +393,122 @@ func init() {
 		}
 
 		// Queues
-		o1.Set("scan", func(region string) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
 			f := mcore.Sanitizer(rt)
 			return f(scanQueues(region))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.sqs.delete", func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			deleteQueue(region, id)
 			return otto.Value{}
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.sqs.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sqs.CreateQueueInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SQS queue create input: %s", err)
+				context.Throwf("Can't create json for SQS queue create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SQS create queue json: %s", err)
+				context.Throwf("Can't unmarshall SQS create queue json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			f := mcore.Sanitizer(rt)
 			return f(createQueue(region, &input))
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			params := mcore.Placeholder(mcore.PlannedArg(args, 1), nil)
+			return fmt.Sprintf("https://sqs.%v.amazonaws.com/planned/%v", mcore.PlannedArg(args, 0), params["QueueName"])
+		}))))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			sqsId := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(describeQueue(region, sqsId))
-		})
-		o1.Set("attributes", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("attributes", context.Guard(func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			sqsId := call.Argument(1).String()
 			f := mcore.Sanitizer(rt)
 			return f(attributesQueue(region, sqsId))
-		})
-		o1.Set("setAttributes", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("setAttributes", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.sqs.setAttributes", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sqs.SetQueueAttributesInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SQS queue attributes input: %s", err)
+				context.Throwf("Can't create json for SQS queue attributes input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SQS setAttributes json: %s", err)
+				context.Throwf("Can't unmarshall SQS setAttributes json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			setAttributesQueue(region, &input)
 			return otto.Value{}
-		})
+		})))
 
 		// Messages
-		o2.Set("send", func(call otto.FunctionCall) otto.Value {
+		o2.Set("send", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.sqs.messages.send", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sqs.SendMessageInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SQS publish input: %s", err)
+				context.Throwf("Can't create json for SQS publish input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SQS publish json: %s", err)
+				context.Throwf("Can't unmarshall SQS publish json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			f := mcore.Sanitizer(rt)
 			return f(sendMessage(region, &input))
-		})
-		o2.Set("receive", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("receive", context.Guard(func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sqs.ReceiveMessageInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SQS receive message input: %s", err)
+				context.Throwf("Can't create json for SQS receive message input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SQS receieve message json: %s", err)
+				context.Throwf("Can't unmarshall SQS receieve message json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			f := mcore.Sanitizer(rt)
 			return f(receiveMessage(region, &input))
-		})
-		o2.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}))
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.sqs.messages.delete", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input sqs.DeleteMessageInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for SQS delete message input: %s", err)
+				context.Throwf("Can't create json for SQS delete message input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall SQS delete message json: %s", err)
+				context.Throwf("Can't unmarshall SQS delete message json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 
 			deleteMessage(region, &input)
 			return otto.Value{}
-		})
+		})))
 	})
 }
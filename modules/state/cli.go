@@ -0,0 +1,102 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+func mustBeEnabled() {
+	if !State.Enabled() {
+		log.Fatalf("No state location; use 'mithras --state <path or s3 url> state ...'")
+	}
+}
+
+// List the resources in the state file.
+func ListCli(c *cli.Context) {
+	mustBeEnabled()
+	entries, err := State.Entries()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMODULE\tREGION\tIDS\tUPDATED")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			e.Name, e.Module, e.Region, strings.Join(e.IDs, ","), e.Updated.Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+}
+
+// Show the full state of the named resources.
+func ShowCli(c *cli.Context) {
+	mustBeEnabled()
+	if len(c.Args()) == 0 {
+		log.Fatalf("Usage: mithras state show <name>...")
+	}
+	for _, name := range c.Args() {
+		e, err := State.Get(name)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		if e == nil {
+			log.Fatalf("No state for '%s'", name)
+		}
+		j, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		fmt.Println(string(j))
+	}
+}
+
+// Forget the named resources.
+func RemoveCli(c *cli.Context) {
+	mustBeEnabled()
+	if len(c.Args()) == 0 {
+		log.Fatalf("Usage: mithras state rm <name>...")
+	}
+	for _, name := range c.Args() {
+		if err := State.Remove(name); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if err := State.Save(); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// Rename a resource in the state file.
+func MoveCli(c *cli.Context) {
+	mustBeEnabled()
+	if len(c.Args()) != 2 {
+		log.Fatalf("Usage: mithras state mv <from> <to>")
+	}
+	if err := State.Move(c.Args()[0], c.Args()[1]); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if err := State.Save(); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
@@ -0,0 +1,579 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// @public
+//
+//
+// # CORE FUNCTIONS: STATE
+//
+
+package state
+
+// @public
+//
+// This package exports entry points into the JS environment:
+//
+// > * [mithras.state.configure](#configure)
+// > * [mithras.state.config](#config)
+// > * [mithras.state.enabled](#enabled)
+// > * [mithras.state.load](#load)
+// > * [mithras.state.list](#list)
+// > * [mithras.state.get](#get)
+// > * [mithras.state.set](#set)
+// > * [mithras.state.remove](#remove)
+// > * [mithras.state.move](#move)
+// > * [mithras.state.save](#save)
+//
+// This API keeps track of the AWS resources Mithras manages, between
+// runs.  For each resource name, the state records its `module`,
+// `region`, the `_target` found for it by its handler, the AWS `ids`
+// in that target, and when it was last `updated`.
+//
+// State is kept in a JSON file.  Its `location` is either a local
+// path or an S3 url, such as `s3://my-bucket/site/state.json`.  No
+// state is kept unless a location is set, with the global
+// `--state` flag or with `mithras.state.configure`.
+//
+// When state is kept, `mithras.run` doesn't scan AWS, and
+// `mithras.apply` preloads each resource's `_target` from it, refreshed
+// from AWS by the module's refresh function.  AWS is scanned only for
+// resources state doesn't cover.  The results are recorded after all
+// resources are handled.
+//
+// ## MITHRAS.STATE.CONFIGURE
+// <a name="configure"></a>
+// `mithras.state.configure(settings);`
+//
+// Set the `location` of the state file, and the `region` of its S3
+// bucket, if it is kept in S3.  Any state already loaded is
+// discarded.
+//
+// Example:
+//
+// ```
+//
+//  mithras.state.configure({location: "s3://my-bucket/site.json", region: "us-west-2"});
+//
+// ```
+//
+// ## MITHRAS.STATE.CONFIG
+// <a name="config"></a>
+// `mithras.state.config();`
+//
+// Returns the current settings.
+//
+// ## MITHRAS.STATE.ENABLED
+// <a name="enabled"></a>
+// `mithras.state.enabled();`
+//
+// Returns `true` if a state location is set.
+//
+// ## MITHRAS.STATE.LOAD
+// <a name="load"></a>
+// `mithras.state.load();`
+//
+// Read the state file again, discarding unsaved changes.  A missing
+// file is empty state.
+//
+// ## MITHRAS.STATE.LIST
+// <a name="list"></a>
+// `mithras.state.list();`
+//
+// Returns an object mapping resource names to their state entries.
+//
+// ## MITHRAS.STATE.GET
+// <a name="get"></a>
+// `mithras.state.get(name);`
+//
+// Returns the state entry for the resource `name`, or `undefined`.
+//
+// ## MITHRAS.STATE.SET
+// <a name="set"></a>
+// `mithras.state.set(name, entry);`
+//
+// Record state for resource `name`.  The `entry` object supplies its
+// `module`, `region` and `target`.
+//
+// Example:
+//
+// ```
+//
+//  mithras.state.set("webserver", {module: "instance",
+//                                  region: "us-east-1",
+//                                  target: resource._target});
+//
+// ```
+//
+// ## MITHRAS.STATE.REMOVE
+// <a name="remove"></a>
+// `mithras.state.remove(name);`
+//
+// Forget the resource `name`.
+//
+// ## MITHRAS.STATE.MOVE
+// <a name="move"></a>
+// `mithras.state.move(from, to);`
+//
+// Record the state of resource `from` under the name `to` instead.
+//
+// ## MITHRAS.STATE.SAVE
+// <a name="save"></a>
+// `mithras.state.save();`
+//
+// Write the state file.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/robertkrimen/otto"
+
+	mcore "github.com/cvillecsteele/mithras/modules/core"
+)
+
+var Version = "1.0.0"
+var ModuleName = "state"
+
+// FormatVersion is written into every state file.
+const FormatVersion = 1
+
+// DefaultRegion is used for S3 state when no region is configured.
+const DefaultRegion = "us-east-1"
+
+// Properties of a target which hold AWS ids, in order of preference.
+var idKeys = []string{
+	"InstanceId",
+	"VpcId",
+	"SubnetId",
+	"GroupId",
+	"InternetGatewayId",
+	"RouteTableId",
+	"DBInstanceIdentifier",
+	"CacheClusterId",
+	"LoadBalancerName",
+	"KeyName",
+	"QueueUrl",
+	"TopicArn",
+	"SubscriptionArn",
+	"AutoScalingGroupName",
+	"LaunchConfigurationName",
+	"InstanceProfileName",
+	"RoleName",
+	"ApplicationName",
+	"EnvironmentId",
+	"Id",
+	"Name",
+}
+
+type Config struct {
+	Location string `json:"location"`
+	Region   string `json:"region"`
+}
+
+// Entry is the recorded state of one resource.
+type Entry struct {
+	Name    string      `json:"name"`
+	Module  string      `json:"module"`
+	Region  string      `json:"region,omitempty"`
+	IDs     []string    `json:"ids"`
+	Target  interface{} `json:"target"`
+	Updated time.Time   `json:"updated"`
+}
+
+type File struct {
+	Version   int               `json:"version"`
+	Resources map[string]*Entry `json:"resources"`
+}
+
+// Store holds the state of the current run.  It is safe for
+// concurrent use.
+type Store struct {
+	mu     sync.Mutex
+	config Config
+	file   *File
+}
+
+// State is the store used by all runtimes.
+var State = &Store{}
+
+func newFile() *File {
+	return &File{Version: FormatVersion, Resources: map[string]*Entry{}}
+}
+
+// Configure sets where state is kept, and discards any loaded state.
+func (s *Store) Configure(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg.Region == "" {
+		cfg.Region = DefaultRegion
+	}
+	s.config = cfg
+	s.file = nil
+}
+
+func (s *Store) Config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+func (s *Store) Enabled() bool {
+	return s.Config().Location != ""
+}
+
+// Load reads the state file, discarding unsaved changes.
+func (s *Store) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+func (s *Store) load() error {
+	if s.config.Location == "" {
+		return errors.New("No state location set")
+	}
+	data, err := read(s.config)
+	if err != nil {
+		return err
+	}
+	f := newFile()
+	if data != nil {
+		if err := json.Unmarshal(data, f); err != nil {
+			return fmt.Errorf("Can't parse state '%s': %s", s.config.Location, err)
+		}
+		if f.Version > FormatVersion {
+			return fmt.Errorf("State '%s' has format %d; this mithras understands up to %d",
+				s.config.Location, f.Version, FormatVersion)
+		}
+		if f.Resources == nil {
+			f.Resources = map[string]*Entry{}
+		}
+		for name, e := range f.Resources {
+			e.Name = name
+		}
+	}
+	s.file = f
+	return nil
+}
+
+func (s *Store) loaded() error {
+	if s.file != nil {
+		return nil
+	}
+	return s.load()
+}
+
+// Save writes the state file.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loaded(); err != nil {
+		return err
+	}
+	s.file.Version = FormatVersion
+	data, err := json.MarshalIndent(s.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return write(s.config, data)
+}
+
+// Entries returns all entries, sorted by name.
+func (s *Store) Entries() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loaded(); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range s.file.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []Entry{}
+	for _, name := range names {
+		result = append(result, *s.file.Resources[name])
+	}
+	return result, nil
+}
+
+func (s *Store) Get(name string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loaded(); err != nil {
+		return nil, err
+	}
+	e, ok := s.file.Resources[name]
+	if !ok {
+		return nil, nil
+	}
+	c := *e
+	return &c, nil
+}
+
+func (s *Store) Set(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loaded(); err != nil {
+		return err
+	}
+	e.IDs = IDs(e.Target)
+	e.Updated = time.Now().UTC()
+	s.file.Resources[e.Name] = &e
+	return nil
+}
+
+func (s *Store) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loaded(); err != nil {
+		return err
+	}
+	if _, ok := s.file.Resources[name]; !ok {
+		return fmt.Errorf("No state for '%s'", name)
+	}
+	delete(s.file.Resources, name)
+	return nil
+}
+
+func (s *Store) Move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loaded(); err != nil {
+		return err
+	}
+	e, ok := s.file.Resources[from]
+	if !ok {
+		return fmt.Errorf("No state for '%s'", from)
+	}
+	if _, ok := s.file.Resources[to]; ok {
+		return fmt.Errorf("State for '%s' already exists", to)
+	}
+	delete(s.file.Resources, from)
+	e.Name = to
+	s.file.Resources[to] = e
+	return nil
+}
+
+// IDs finds the AWS ids in a target, which may be a single object or
+// an array of them.
+func IDs(target interface{}) []string {
+	ids := []string{}
+	switch t := target.(type) {
+	case []interface{}:
+		for _, item := range t {
+			ids = append(ids, IDs(item)...)
+		}
+	case map[string]interface{}:
+		for _, k := range idKeys {
+			if v, ok := t[k].(string); ok && v != "" {
+				ids = append(ids, v)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+func parseS3(location string) (bucket string, key string, ok bool) {
+	if !strings.HasPrefix(location, "s3://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// read returns nil data if there is no state yet.
+func read(cfg Config) ([]byte, error) {
+	if strings.HasPrefix(cfg.Location, "s3://") {
+		bucket, key, ok := parseS3(cfg.Location)
+		if !ok {
+			return nil, fmt.Errorf("Invalid S3 state location '%s'", cfg.Location)
+		}
+		svc := s3.New(mcore.Session(s3.ServiceName, cfg.Region))
+		resp, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Can't read state '%s': %s", cfg.Location, err)
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	data, err := ioutil.ReadFile(cfg.Location)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read state '%s': %s", cfg.Location, err)
+	}
+	return data, nil
+}
+
+func write(cfg Config, data []byte) error {
+	if strings.HasPrefix(cfg.Location, "s3://") {
+		bucket, key, ok := parseS3(cfg.Location)
+		if !ok {
+			return fmt.Errorf("Invalid S3 state location '%s'", cfg.Location)
+		}
+		svc := s3.New(mcore.Session(s3.ServiceName, cfg.Region))
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return fmt.Errorf("Can't write state '%s': %s", cfg.Location, err)
+		}
+		return nil
+	}
+
+	// Write then rename, so a failed write never loses the old state
+	dir, base := filepath.Split(cfg.Location)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base)
+	if err != nil {
+		return fmt.Errorf("Can't write state '%s': %s", cfg.Location, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Can't write state '%s': %s", cfg.Location, err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), cfg.Location); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Can't write state '%s': %s", cfg.Location, err)
+	}
+	return nil
+}
+
+func init() {
+	mcore.RegisterInit(func(context *mcore.Context) {
+		rt := context.Runtime
+
+		if a, err := rt.Get("mithras"); err != nil || a.IsUndefined() {
+			rt.Object(`mithras = {}`)
+		}
+		o1, _ := rt.Object(`mithras.state = {}`)
+
+		o1.Set("configure", context.Guard(func(call otto.FunctionCall) otto.Value {
+			js := `(function (o) { return JSON.stringify(o); })`
+			s, err := rt.Call(js, nil, call.Argument(0))
+			if err != nil {
+				context.Throwf("Can't create json for state settings: %s", err)
+			}
+			cfg := State.Config()
+			if err := json.Unmarshal([]byte(s.String()), &cfg); err != nil {
+				context.Throwf("Can't unmarshall state settings: %s", err)
+			}
+			State.Configure(cfg)
+			return otto.Value{}
+		}))
+		o1.Set("config", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return mcore.Sanitize(rt, State.Config())
+		}))
+		o1.Set("enabled", context.Guard(func(call otto.FunctionCall) otto.Value {
+			v, _ := rt.ToValue(State.Enabled())
+			return v
+		}))
+		o1.Set("load", context.Guard(func(call otto.FunctionCall) otto.Value {
+			if err := State.Load(); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		o1.Set("list", context.Guard(func(call otto.FunctionCall) otto.Value {
+			entries, err := State.Entries()
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			m := map[string]Entry{}
+			for _, e := range entries {
+				m[e.Name] = e
+			}
+			return mcore.Sanitize(rt, m)
+		}))
+		o1.Set("get", context.Guard(func(name string) otto.Value {
+			e, err := State.Get(name)
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			if e == nil {
+				return otto.UndefinedValue()
+			}
+			return mcore.Sanitize(rt, e)
+		}))
+		o1.Set("set", context.Guard(func(call otto.FunctionCall) otto.Value {
+			js := `(function (o) { return JSON.stringify(o); })`
+			s, err := rt.Call(js, nil, call.Argument(1))
+			if err != nil {
+				context.Throwf("Can't create json for state entry: %s", err)
+			}
+			var e Entry
+			if err := json.Unmarshal([]byte(s.String()), &e); err != nil {
+				context.Throwf("Can't unmarshall state entry: %s", err)
+			}
+			e.Name = call.Argument(0).String()
+			if err := State.Set(e); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		o1.Set("remove", context.Guard(func(name string) otto.Value {
+			if err := State.Remove(name); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		o1.Set("move", context.Guard(func(from, to string) otto.Value {
+			if err := State.Move(from, to); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+		o1.Set("save", context.Guard(func(call otto.FunctionCall) otto.Value {
+			if err := State.Save(); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+	})
+}
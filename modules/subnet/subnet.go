@@ -132,11 +132,10 @@ package subnet
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -147,8 +146,7 @@ var Version = "1.0.0"
 var ModuleName = "subnet"
 
 func describeSubnet(region string, id string) *ec2.Subnet {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeSubnetsInput{
 		SubnetIds: []*string{
@@ -158,19 +156,23 @@ func describeSubnet(region string, id string) *ec2.Subnet {
 	resp, err := svc.DescribeSubnets(params)
 
 	if err != nil {
-		return nil
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "InvalidSubnetID.NotFound" == awsErr.Code() {
+				return nil
+			}
+		}
+		mcore.Failf("Error describing subnet: %s", err)
 	}
 
 	return resp.Subnets[0]
 }
 
 func createSubnet(region string, params *ec2.CreateSubnetInput, verbose bool) *ec2.Subnet {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.CreateSubnet(params)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 	id := *resp.Subnet.SubnetId
 
@@ -188,19 +190,17 @@ func createSubnet(region string, params *ec2.CreateSubnetInput, verbose bool) *e
 }
 
 func createRoute(region string, input ec2.CreateRouteInput, verbose bool) *ec2.CreateRouteOutput {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	output, err := svc.CreateRoute(&input)
 	if err != nil {
-		log.Fatalf("AWS error creating route: %s", err)
+		mcore.Failf("AWS error creating route: %s", err)
 	}
 	return output
 }
 
 func deleteRoute(region string, cidr string, routeTableId string, verbose bool) *ec2.DeleteRouteOutput {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DeleteRouteInput{
 		DestinationCidrBlock: aws.String(cidr),
@@ -209,14 +209,13 @@ func deleteRoute(region string, cidr string, routeTableId string, verbose bool)
 	resp, err := svc.DeleteRoute(params)
 
 	if err != nil {
-		log.Fatalf("AWS error deleting route: %s", err)
+		mcore.Failf("AWS error deleting route: %s", err)
 	}
 	return resp
 }
 
 func deleteSubnet(region string, id string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	i := &ec2.DeleteSubnetInput{
 		SubnetId: aws.String(id),
@@ -224,19 +223,18 @@ func deleteSubnet(region string, id string, verbose bool) {
 	_, err := svc.DeleteSubnet(i)
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// TODO: Wait for it.
 }
 
-func scanSubnets(rt *otto.Otto, region string) otto.Value {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scanSubnets(region string) []ec2.Subnet {
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.DescribeSubnets(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing subnets: %s", err)
 	}
 
 	// shove instances into jsland
@@ -244,10 +242,14 @@ func scanSubnets(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.Subnets {
 		subnets = append(subnets, *i)
 	}
-	return mcore.Sanitize(rt, subnets)
+	return subnets
 }
 
 func init() {
+	mcore.RegisterScanner("subnets", func(region string) interface{} {
+		return scanSubnets(region)
+	})
+
 	// mcore.RegisterHandler(handle)
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
@@ -261,71 +263,76 @@ func init() {
 				o0, _ = rt.Object(`aws.subnets = {}`)
 				o1, _ = rt.Object(`aws.subnets.routes = {}`)
 			} else {
-				log.Fatalf("Logic error: aws.subnets already defined")
+				context.Throwf("Logic error: aws.subnets already defined")
 			}
 		}
 
-		o0.Set("scan", func(region string) otto.Value {
-			return scanSubnets(rt, region)
-		})
-		o0.Set("create", func(call otto.FunctionCall) otto.Value {
+		o0.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scanSubnets(region))
+		}))
+		o0.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.subnets.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.CreateSubnetInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for subnet create input: %s", err)
+				context.Throwf("Can't create json for subnet create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall subnet create json: %s", err)
+				context.Throwf("Can't unmarshall subnet create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			verbose := mcore.IsVerbose(rt)
 			f := mcore.Sanitizer(rt)
 			return f(createSubnet(region, &input, verbose))
-		})
-		o0.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"SubnetId": mcore.Plan.ID("subnet"),
+				"State":    "pending",
+			})
+		}))))
+		o0.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.subnets.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			deleteSubnet(region, id, verbose)
 			return otto.Value{}
-		})
-		o0.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o0.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			return f(describeSubnet(region, id))
-		})
+		}))
 
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.subnets.routes.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.CreateRouteInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for subnet create input: %s", err)
+				context.Throwf("Can't create json for subnet create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall subnet create json: %s", err)
+				context.Throwf("Can't unmarshall subnet create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			verbose := mcore.IsVerbose(rt)
 			f := mcore.Sanitizer(rt)
 			return f(createRoute(region, input, verbose))
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		}, map[string]interface{}{"Return": true})))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.subnets.routes.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			cidr := call.Argument(1).String()
 			routeTableId := call.Argument(2).String()
 			deleteRoute(region, cidr, routeTableId, verbose)
 			return otto.Value{}
-		})
+		})))
 
 	})
 }
@@ -69,12 +69,12 @@ func init() {
 			}
 		}
 
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanUpdate, "aws.tags.create", func(call otto.FunctionCall) otto.Value {
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			verbose := mcore.IsVerbose(rt)
 			mcore.Tag(rt, *call.Argument(2).Object(), id, region, verbose)
 			return otto.Value{}
-		})
+		})))
 	})
 }
@@ -63,6 +63,8 @@ func init() {
 		rt := context.Runtime
 
 		fsObj, _ := rt.Object(`time = {}`)
-		fsObj.Set("sleep", sleep)
+		fsObj.Set("sleep", context.Guard(func(seconds int) {
+			core.Unlocked(rt, func() { sleep(seconds) })
+		}))
 	})
 }
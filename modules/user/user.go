@@ -65,10 +65,10 @@ func init() {
 		rt := context.Runtime
 
 		obj, _ := rt.Object(`user = {}`)
-		obj.Set("lookup", func(call otto.FunctionCall) otto.Value {
+		obj.Set("lookup", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := core.Sanitizer(rt)
 			user := call.Argument(0).String()
 			return f(lookup(user))
-		})
+		}))
 	})
 }
@@ -158,11 +158,10 @@ package vpc
 
 import (
 	"encoding/json"
-	log "github.com/Sirupsen/logrus"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/robertkrimen/otto"
 
@@ -173,24 +172,22 @@ var Version = "1.0.0"
 var ModuleName = "vpc"
 
 func createGateway(region string) ec2.InternetGateway {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	p := &ec2.CreateInternetGatewayInput{}
 	resp, err := svc.CreateInternetGateway(p)
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 	return *resp.InternetGateway
 }
 
 func createVPC(params *ec2.CreateVpcInput, region string, gateway bool, verbose bool) (ec2.Vpc, ec2.InternetGateway) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.CreateVpc(params)
 	if err != nil {
-		log.Fatalf("Error creating vpc: %s", err)
+		mcore.Failf("Error creating vpc: %s", err)
 	}
 	id := *resp.Vpc.VpcId
 
@@ -210,7 +207,7 @@ func createVPC(params *ec2.CreateVpcInput, region string, gateway bool, verbose
 		},
 	}
 	if _, err := svc.ModifyVpcAttribute(modParams); err != nil {
-		log.Fatalf("Error modifying vpc '%s': %s", id, err)
+		mcore.Failf("Error modifying vpc '%s': %s", id, err)
 	}
 
 	// Create gateway
@@ -224,7 +221,7 @@ func createVPC(params *ec2.CreateVpcInput, region string, gateway bool, verbose
 		}
 		_, err := svc.AttachInternetGateway(params)
 		if err != nil {
-			log.Fatal(err.Error())
+			mcore.Failf("%s", err.Error())
 		}
 		gw = describeGW(region, *gw.InternetGatewayId)
 	}
@@ -232,28 +229,26 @@ func createVPC(params *ec2.CreateVpcInput, region string, gateway bool, verbose
 }
 
 func deleteVPC(region string, id string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.DeleteVpc(&ec2.DeleteVpcInput{VpcId: aws.String(id)})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	// TODO: Wait for it.
 }
 
 func deleteGW(region string, vpcId string, gwId string, verbose bool) {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	_, err := svc.DetachInternetGateway(&ec2.DetachInternetGatewayInput{
 		InternetGatewayId: aws.String(gwId),
 		VpcId:             aws.String(vpcId),
 	})
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 
 	_, err = svc.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{
@@ -261,13 +256,12 @@ func deleteGW(region string, vpcId string, gwId string, verbose bool) {
 	})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		mcore.Failf("%s", err.Error())
 	}
 }
 
 func describeVPC(region string, vpcId string) ec2.Vpc {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeVpcsInput{
 		VpcIds: []*string{aws.String(vpcId)},
@@ -275,6 +269,14 @@ func describeVPC(region string, vpcId string) ec2.Vpc {
 	resp, err := svc.DescribeVpcs(params)
 
 	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "InvalidVpcID.NotFound" == awsErr.Code() {
+				return ec2.Vpc{}
+			}
+		}
+		mcore.Failf("Error describing VPC: %s", err)
+	}
+	if len(resp.Vpcs) == 0 {
 		return ec2.Vpc{}
 	}
 
@@ -282,8 +284,7 @@ func describeVPC(region string, vpcId string) ec2.Vpc {
 }
 
 func describeGW(region string, id string) ec2.InternetGateway {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	params := &ec2.DescribeInternetGatewaysInput{
 		InternetGatewayIds: []*string{aws.String(id)},
@@ -291,19 +292,23 @@ func describeGW(region string, id string) ec2.InternetGateway {
 	resp, err := svc.DescribeInternetGateways(params)
 
 	if err != nil {
-		return ec2.InternetGateway{}
+		if awsErr, ok := err.(awserr.Error); ok {
+			if "InvalidInternetGatewayID.NotFound" == awsErr.Code() {
+				return ec2.InternetGateway{}
+			}
+		}
+		mcore.Failf("Error describing internet gateway: %s", err)
 	}
 
 	return *resp.InternetGateways[0]
 }
 
-func scanVPCs(rt *otto.Otto, region string) otto.Value {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scanVPCs(region string) []ec2.Vpc {
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.DescribeVpcs(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing vpcs: %s", err)
 	}
 
 	// shove instances into jsland
@@ -311,16 +316,15 @@ func scanVPCs(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.Vpcs {
 		vpcs = append(vpcs, *i)
 	}
-	return mcore.Sanitize(rt, vpcs)
+	return vpcs
 }
 
-func scanGateways(rt *otto.Otto, region string) otto.Value {
-	svc := ec2.New(session.New(),
-		aws.NewConfig().WithRegion(region).WithMaxRetries(5))
+func scanGateways(region string) []ec2.InternetGateway {
+	svc := ec2.New(mcore.Session(ec2.ServiceName, region))
 
 	resp, err := svc.DescribeInternetGateways(nil)
 	if err != nil {
-		panic(err)
+		mcore.Failf("Error describing internet gateways: %s", err)
 	}
 
 	// shove instances into jsland
@@ -328,10 +332,17 @@ func scanGateways(rt *otto.Otto, region string) otto.Value {
 	for _, i := range resp.InternetGateways {
 		gws = append(gws, *i)
 	}
-	return mcore.Sanitize(rt, gws)
+	return gws
 }
 
 func init() {
+	mcore.RegisterScanner("vpcs", func(region string) interface{} {
+		return scanVPCs(region)
+	})
+	mcore.RegisterScanner("gateways", func(region string) interface{} {
+		return scanGateways(region)
+	})
+
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -350,70 +361,85 @@ func init() {
 		}
 
 		// VPCs
-		o1.Set("scan", func(region string) otto.Value {
-			return scanVPCs(rt, region)
-		})
-		o1.Set("delete", func(call otto.FunctionCall) otto.Value {
+		o1.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scanVPCs(region))
+		}))
+		o1.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.vpcs.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			id := call.Argument(1).String()
 			deleteVPC(region, id, verbose)
 			return otto.Value{}
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		})))
+		o1.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.vpcs.create", func(call otto.FunctionCall) otto.Value {
 			// Translate params input into a struct
 			var input ec2.CreateVpcInput
 			js := `(function (o) { return JSON.stringify(o); })`
 			s, err := rt.Call(js, nil, call.Argument(1))
 			if err != nil {
-				log.Fatalf("Can't create json for VPC create input: %s", err)
+				context.Throwf("Can't create json for VPC create input: %s", err)
 			}
 			err = json.Unmarshal([]byte(s.String()), &input)
 			if err != nil {
-				log.Fatalf("Can't unmarshall VPC create json: %s", err)
+				context.Throwf("Can't unmarshall VPC create json: %s", err)
 			}
 
 			region := call.Argument(0).String()
 			gateway, err := call.Argument(2).ToBoolean()
 			if err != nil {
-				log.Fatalf("Invalid gateway arg to VPC create: %s", err)
+				context.Throwf("Invalid gateway arg to VPC create: %s", err)
 			}
 			verbose := mcore.IsVerbose(rt)
 
 			f := mcore.Sanitizer(rt)
 			return f(createVPC(&input, region, gateway, verbose))
-		})
-		o1.Set("describe", func(call otto.FunctionCall) otto.Value {
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			vpc := mcore.Placeholder(mcore.PlannedArg(args, 1), map[string]interface{}{
+				"VpcId": mcore.Plan.ID("vpc"),
+				"State": "pending",
+			})
+			gw := map[string]interface{}{}
+			if gateway, _ := mcore.PlannedArg(args, 2).(bool); gateway {
+				gw = map[string]interface{}{
+					"InternetGatewayId": mcore.Plan.ID("igw"),
+					"Attachments":       []interface{}{map[string]interface{}{"VpcId": vpc["VpcId"]}},
+				}
+			}
+			return []interface{}{vpc, gw}
+		}))))
+		o1.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			vpcId := call.Argument(1).String()
 			return f(describeVPC(region, vpcId))
-		})
+		}))
 
 		// Internet Gatways
 		o2, _ := rt.Object(`aws.vpcs.gateways = {}`)
-		o2.Set("scan", func(region string) otto.Value {
-			return scanGateways(rt, region)
-		})
-		o2.Set("create", func(call otto.FunctionCall) otto.Value {
+		o2.Set("scan", context.Guard(func(region string) otto.Value {
+			return mcore.Sanitize(rt, scanGateways(region))
+		}))
+		o2.Set("create", context.Guard(context.Plannable(mcore.PlanCreate, "aws.vpcs.gateways.create", func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			return f(createGateway(region))
-		})
+		}, mcore.Planned(func(args []interface{}) interface{} {
+			return map[string]interface{}{"InternetGatewayId": mcore.Plan.ID("igw")}
+		}))))
 		// TODO: add associate function
-		o2.Set("delete", func(call otto.FunctionCall) otto.Value {
+		o2.Set("delete", context.Guard(context.Plannable(mcore.PlanDelete, "aws.vpcs.gateways.delete", func(call otto.FunctionCall) otto.Value {
 			verbose := mcore.IsVerbose(rt)
 			region := call.Argument(0).String()
 			vpcId := call.Argument(1).String()
 			gwId := call.Argument(2).String()
 			deleteGW(region, vpcId, gwId, verbose)
 			return otto.Value{}
-		})
-		o2.Set("describe", func(call otto.FunctionCall) otto.Value {
+		})))
+		o2.Set("describe", context.Guard(func(call otto.FunctionCall) otto.Value {
 			f := mcore.Sanitizer(rt)
 			region := call.Argument(0).String()
 			vpcId := call.Argument(1).String()
 			return f(describeGW(region, vpcId))
-		})
+		}))
 	})
 }
@@ -0,0 +1,336 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+// Requests are routed to JS handlers by method and path.  Each server
+// has a router of its own; what it doesn't route goes to the default
+// router, shared by all servers, and what that doesn't route goes to
+// handlers registered with web.handler.
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+
+	"github.com/cvillecsteele/mithras/modules/core"
+)
+
+// The most of a request body read
+const maxBody = 10 << 20
+
+// Request is what a JS handler is passed.
+type Request struct {
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Params     map[string]string `json:"params"`
+	Query      map[string]string `json:"query"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	Host       string            `json:"host"`
+	RemoteAddr string            `json:"remoteAddr"`
+}
+
+// Response is what a JS handler returns.
+type Response struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	fn       otto.Value
+	// The runtime fn belongs to
+	rt *otto.Otto
+}
+
+// Match path against the route's pattern, returning the parameters
+// found.
+func (ro *route) match(path string) (map[string]string, bool) {
+	parts := splitPath(path)
+	params := map[string]string{}
+	for i, seg := range ro.segments {
+		if strings.HasPrefix(seg, "*") {
+			name := seg[1:]
+			if name == "" {
+				name = "*"
+			}
+			params[name] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, ":") {
+			params[seg[1:]] = parts[i]
+		} else if seg != parts[i] {
+			return nil, false
+		}
+	}
+	if len(parts) != len(ro.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+type router struct {
+	mu       sync.Mutex
+	routes   []*route
+	fallback http.Handler
+	// The runtime which ran the server; nil for the default router
+	rt *otto.Otto
+}
+
+// Routes not found on a server's router are looked for here, then in
+// the handlers registered with web.handler
+var defaultRouter = &router{fallback: http.DefaultServeMux}
+
+// Add a route, replacing any for the same method and pattern added
+// by the same runtime.
+func (r *router) add(rt *otto.Otto, method string, pattern string, fn otto.Value) error {
+	method = strings.ToUpper(method)
+	if method == "" {
+		return fmt.Errorf("No method given for route '%s'", pattern)
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("Invalid route '%s': must start with '/'", pattern)
+	}
+	segments := splitPath(pattern)
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, "*") && i != len(segments)-1 {
+			return fmt.Errorf("Invalid route '%s': '*' must be last", pattern)
+		}
+		if seg == ":" {
+			return fmt.Errorf("Invalid route '%s': unnamed parameter", pattern)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nr := &route{method: method, pattern: pattern, segments: segments, fn: fn, rt: rt}
+	for i, old := range r.routes {
+		if old.method == method && old.pattern == pattern && old.rt == rt {
+			r.routes[i] = nr
+			return nil
+		}
+	}
+	r.routes = append(r.routes, nr)
+	return nil
+}
+
+// Remove the route for method and pattern added by a runtime,
+// returning false if there is none.
+func (r *router) remove(rt *otto.Otto, method string, pattern string) bool {
+	method = strings.ToUpper(method)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, ro := range r.routes {
+		if ro.method == method && ro.pattern == pattern && ro.rt == rt {
+			r.routes = append(r.routes[:i], r.routes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the routes added by a runtime.
+func (r *router) drop(rt *otto.Otto) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := []*route{}
+	for _, ro := range r.routes {
+		if ro.rt != rt {
+			kept = append(kept, ro)
+		}
+	}
+	r.routes = kept
+}
+
+// Find the route for a request.  If the path matches routes, but not
+// for its method, the methods they are for are returned.  Routes added
+// by a staged runtime aren't used until it takes over.
+func (r *router) find(method string, path string) (*route, map[string]string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	allowed := []string{}
+	for _, ro := range r.routes {
+		if core.IsStaged(ro.rt) {
+			continue
+		}
+		params, ok := ro.match(path)
+		if !ok {
+			continue
+		}
+		if ro.method == method || ro.method == "*" {
+			return ro, params, nil
+		}
+		allowed = append(allowed, ro.method)
+	}
+	return nil, nil, allowed
+}
+
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ro, params, allowed := r.find(req.Method, req.URL.Path)
+	if ro == nil && len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ro == nil {
+		r.fallback.ServeHTTP(w, req)
+		return
+	}
+	ro.serve(w, req, params)
+}
+
+// Make the request passed to a handler.
+func request(w http.ResponseWriter, req *http.Request, params map[string]string) (*Request, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+	r := &Request{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Params:     params,
+		Query:      map[string]string{},
+		Headers:    map[string]string{},
+		Body:       string(body),
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+	}
+	for k, v := range req.URL.Query() {
+		r.Query[k] = v[0]
+	}
+	for k, v := range req.Header {
+		r.Headers[strings.ToLower(k)] = strings.Join(v, ", ")
+	}
+	return r, nil
+}
+
+// Turn what a handler returned into a response.
+var responseJS = `(function (r) {
+  if (r === undefined || r === null) {
+    return JSON.stringify({status: 204, headers: {}, body: ""});
+  }
+  if (typeof r !== "object") {
+    r = {body: String(r)};
+  }
+  var headers = {};
+  var type = false;
+  _.each(r.headers || {}, function (v, k) {
+    headers[k] = String(v);
+    type = type || k.toLowerCase() === "content-type";
+  });
+  var body = r.body;
+  if (body === undefined || body === null) {
+    body = "";
+  } else if (typeof body === "object") {
+    body = JSON.stringify(body);
+    if (!type) { headers["Content-Type"] = "application/json"; }
+  } else {
+    body = String(body);
+    if (!type) { headers["Content-Type"] = "text/plain; charset=utf-8"; }
+  }
+  return JSON.stringify({status: r.status || 200, headers: headers, body: body});
+})`
+
+// Parse a request's body as JSON, if it says it is.
+var jsonBodyJS = `(function (r) {
+  if ((r.headers["content-type"] || "").indexOf("json") >= 0 && r.body !== "") {
+    r.json = JSON.parse(r.body);
+  }
+  return r;
+})`
+
+func (ro *route) serve(w http.ResponseWriter, req *http.Request, params map[string]string) {
+	r, err := request(w, req, params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't read request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// The runtime isn't safe for concurrent use
+	resp, status, err := func() (*Response, int, error) {
+		core.RuntimeLock.Lock()
+		defer core.RuntimeLock.Unlock()
+		return ro.call(r)
+	}()
+
+	if err != nil && status == http.StatusInternalServerError {
+		// Don't tell clients about the script
+		log.Errorf("Error in web handler for %s %s: %s", ro.method, ro.pattern, err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	if resp.Status < 100 || resp.Status > 999 {
+		log.Errorf("Web handler for %s %s returned invalid status %d", ro.method, ro.pattern, resp.Status)
+		resp.Status = http.StatusInternalServerError
+	}
+	w.WriteHeader(resp.Status)
+	fmt.Fprint(w, resp.Body)
+}
+
+// Call the handler, returning its response, or an error and the status
+// to respond with.
+func (ro *route) call(r *Request) (*Response, int, error) {
+	obj, err := ro.rt.Call(jsonBodyJS, nil, core.Sanitize(ro.rt, r))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid JSON body: %s", err)
+	}
+
+	v, err := ro.fn.Call(otto.NullValue(), obj)
+	if err == nil {
+		v, err = ro.rt.Call(responseJS, nil, v)
+	}
+	if err != nil {
+		if ottoErr, ok := err.(*otto.Error); ok {
+			err = fmt.Errorf("%s", ottoErr.String())
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	var resp Response
+	if err := json.Unmarshal([]byte(v.String()), &resp); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return &resp, http.StatusOK, nil
+}
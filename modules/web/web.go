@@ -30,16 +30,20 @@ package web
 // > * [web.run](#run)
 // > * [web.stop](#stop)
 // > * [web.get](#get)
+// > * [web.request](#request)
+// > * [web.route](#route)
+// > * [web.unroute](#unroute)
 // > * [web.handler](#handler)
 // > * [web.url.parse](#uparse)
 //
-// This API allows JS to fetch from the web and to create a web server.
+// This API allows JS to fetch from the web and to create web servers.
 //
 // ## WEB.RUN
 // <a name="run"></a>
 // `web.run(addr);`
 //
-// Run a web server.
+// Run a web server, returning it.  Several may run at once, each
+// with routes of its own.
 //
 // Example:
 //
@@ -82,6 +86,104 @@ package web
 //
 // ```
 //
+// ## WEB.REQUEST
+// <a name="request"></a>
+// `web.request(method, url, options);`
+//
+// Make a request, returning the whole response, as an object with
+// `status`, `headers` (with lowercase names) and `body`.  Unlike
+// [web.get](#get), a response with an error status is returned, not
+// thrown.  The optional `options` object may have `headers`, an
+// object, and `body`, a string.
+//
+// Example:
+//
+// ```
+//
+// var res = web.request("PUT", "http://localhost:8080/items/1",
+//                       {headers: {"Content-Type": "application/json"}, body: JSON.stringify(item)});
+// if (res.status !== 200) {
+//   ...
+// }
+//
+// ```
+//
+// ## WEB.ROUTE
+// <a name="route"></a>
+// `web.route(method, path, handler, server);`
+//
+// Handle requests for `method` and `path` with the function
+// `handler`.  If `server`, returned by [web.run](#run), is given, the
+// route is the server's own.  Otherwise, it is shared by all servers,
+// and used for requests their own routes don't match.  Routing the
+// same method and path again replaces the handler.
+//
+// The method `"*"` matches any method.  In the path, a segment
+// `:name` matches any one segment, and a last segment `*name` (or
+// just `*`) matches the rest of the path; what they matched is in the
+// request's `params`.  Routes are tried in the order they were added.
+// If a path is routed, but not for the request's method, the response
+// is "405 Method Not Allowed".
+//
+// The handler is passed a request object with `method`, `path`,
+// `params`, `query` (the first value of each query parameter),
+// `headers` (with lowercase names), `body`, `host` and `remoteAddr`.
+// If the body is JSON, as its `Content-Type` says, it is parsed into
+// `json` too.  A body which doesn't parse gets a "400 Bad Request".
+//
+// The handler returns an object with `status` (by default, 200),
+// `headers` and `body`.  A body which isn't a string is sent as JSON.
+// Returning a string sends just that; returning nothing sends "204 No
+// Content".  If the handler throws, the response is "500 Internal
+// Server Error", and the error is logged.
+//
+// Handlers are called on the script's runtime, one at a time, taking
+// turns with scheduled jobs and the daemon's signal handlers.  While
+// the script itself runs, they wait, except while it is in
+// `time.sleep`, [web.get](#get) or
+// [web.request](#request).
+//
+// Example:
+//
+// ```
+//
+// var server = web.run(":8080");
+// web.route("POST", "/hooks/:id", function(req) {
+//   var hook = hooks[req.params.id];
+//   if (!hook) {
+//     return {status: 404, body: {error: "no such hook"}};
+//   }
+//   return {status: 202, headers: {"X-Hook": hook.name}, body: hook.fire(req.json)};
+// }, server);
+//
+// ```
+//
+// ## WEB.UNROUTE
+// <a name="unroute"></a>
+// `web.unroute(method, path, server);`
+//
+// Remove the route for `method` and `path`, of `server` if it is
+// given, or shared by all servers otherwise.  The `path` is as it was
+// given to [web.route](#route).  Returns `false` if there is no such
+// route.
+//
+// Example:
+//
+// ```
+//
+// web.unroute("POST", "/hooks/:id", server);
+//
+// ```
+//
+// ## WEB.HANDLER
+// <a name="handler"></a>
+// `web.handler(fn);`
+//
+// Handle requests which aren't routed, by any server, with `fn`,
+// which is passed Go's `http.ResponseWriter` and `http.Request`, and
+// whose return value is written as the response body.  Prefer
+// [web.route](#route).
+//
 // ## WEB.URL.PARSE
 // <a name="uparse"></a>
 // `web.url.parse(url);`
@@ -97,6 +199,7 @@ package web
 // ```
 //
 import (
+	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io/ioutil"
@@ -104,6 +207,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/facebookgo/httpdown"
@@ -120,21 +224,54 @@ var ModuleName = "web"
 func setHandler(cb otto.Value) {
 	wrapper := func(w http.ResponseWriter, r *http.Request) {
 		resp, _ := cb.Call(cb, w, r)
-		fmt.Fprintf(w, resp.String())
+		fmt.Fprint(w, resp.String())
 	}
 	http.HandleFunc("/", wrapper)
 }
 
-func stop(server httpdown.Server) error {
+// The routers of running servers
+var (
+	serversMu sync.Mutex
+	servers   = map[httpdown.Server]*router{}
+)
+
+// Find the router to add a route to: the server's if one is given,
+// otherwise the default router.
+func routerFor(v otto.Value) *router {
+	if v.IsUndefined() || v.IsNull() {
+		return defaultRouter
+	}
+	exported, _ := v.Export()
+	server, ok := exported.(httpdown.Server)
+	if !ok {
+		core.Failf("Not a web server: %s", v.String())
+	}
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	r, ok := servers[server]
+	if !ok {
+		core.Failf("Web server is not running")
+	}
+	return r
+}
+
+func stop(server httpdown.Server) {
+	serversMu.Lock()
+	delete(servers, server)
+	serversMu.Unlock()
 	if err := server.Stop(); err != nil {
-		panic(err)
+		core.Failf("Error stopping server: %s", err)
+	}
+	if err := server.Wait(); err != nil {
+		core.Failf("Error stopping server: %s", err)
 	}
-	return server.Wait()
 }
 
-func run(addr string) (httpdown.Server, error) {
+func run(rt *otto.Otto, addr string) httpdown.Server {
+	r := &router{fallback: defaultRouter, rt: rt}
 	s := &http.Server{
-		Addr: addr,
+		Addr:    addr,
+		Handler: r,
 	}
 
 	hd := &httpdown.HTTP{
@@ -142,10 +279,38 @@ func run(addr string) (httpdown.Server, error) {
 		KillTimeout: 1 * time.Second,
 	}
 
-	return hd.ListenAndServe(s)
+	server, err := hd.ListenAndServe(s)
+	if err != nil {
+		core.Failf("Can't run web server on '%s': %s", addr, err)
+	}
+	serversMu.Lock()
+	servers[server] = r
+	serversMu.Unlock()
+	return server
+}
+
+// Retire a runtime's servers and routes.  Their handlers are its
+// functions, so they can't be handed over.
+func retire(rt *otto.Otto, successor *otto.Otto) {
+	serversMu.Lock()
+	stopping := []httpdown.Server{}
+	for server, r := range servers {
+		if r.rt == rt {
+			delete(servers, server)
+			stopping = append(stopping, server)
+		}
+	}
+	serversMu.Unlock()
+	for _, server := range stopping {
+		if err := server.Stop(); err != nil {
+			log.Errorf("Error stopping server: %s", err)
+		}
+	}
+	defaultRouter.drop(rt)
 }
 
 func init() {
+	core.RegisterRetire(retire)
 	core.RegisterInit(func(context *core.Context) {
 		rt := context.Runtime
 
@@ -157,9 +322,15 @@ func init() {
 			webObj = a.Object()
 		}
 
-		webObj.Set("run", run)
-		webObj.Set("stop", stop)
-		webObj.Set("post", func(call otto.FunctionCall) otto.Value {
+		webObj.Set("run", context.Guard(func(addr string) httpdown.Server {
+			context.Unstaged("web.run")
+			return run(rt, addr)
+		}))
+		webObj.Set("stop", context.Guard(func(server httpdown.Server) {
+			context.Unstaged("web.stop")
+			stop(server)
+		}))
+		webObj.Set("post", context.Guard(func(call otto.FunctionCall) otto.Value {
 			theUrl := call.Argument(0).String()
 			body := call.Argument(1).String()
 
@@ -175,7 +346,7 @@ func init() {
 					return otto.Value{}
 				})
 				if err != nil {
-					log.Fatalf("Can't load url.post() headers: '%s'", err)
+					context.Throwf("Can't load url.post() headers: '%s'", err)
 				}
 			}
 
@@ -190,7 +361,7 @@ func init() {
 				perm, err = call.Argument(4).ToInteger()
 			}
 			if err != nil {
-				log.Fatalf("Can't fetch '%s': %s", theUrl, err)
+				context.Throwf("Can't fetch '%s': %s", theUrl, err)
 			}
 
 			httpclient.Defaults(httpclient.Map{
@@ -198,9 +369,12 @@ func init() {
 			})
 
 			res, err := httpclient.Do("POST", theUrl, headers, strings.NewReader(body))
+			if err != nil {
+				context.Throwf("Error in post: '%s'", err)
+			}
 			bodyBytes, err := res.ReadAll()
 			if err != nil {
-				log.Fatalf("Error in post: '%s'", err)
+				context.Throwf("Error in post: '%s'", err)
 			}
 
 			if file != "" {
@@ -208,8 +382,8 @@ func init() {
 			}
 			v, err := rt.ToValue(string(bodyBytes))
 			return v
-		})
-		webObj.Set("get", func(call otto.FunctionCall) otto.Value {
+		}))
+		webObj.Set("get", context.Guard(func(call otto.FunctionCall) otto.Value {
 			theUrl := call.Argument(0).String()
 
 			qp := map[string]string{}
@@ -224,7 +398,7 @@ func init() {
 					return otto.Value{}
 				})
 				if err != nil {
-					log.Fatalf("Can't load url.get() query parameters: '%s'", err)
+					context.Throwf("Can't load url.get() query parameters: '%s'", err)
 				}
 			}
 
@@ -239,37 +413,114 @@ func init() {
 				perm, err = call.Argument(3).ToInteger()
 			}
 			if err != nil {
-				log.Fatalf("Can't fetch '%s': %s", theUrl, err)
+				context.Throwf("Can't fetch '%s': %s", theUrl, err)
 			}
 
 			httpclient.Defaults(httpclient.Map{
 				httpclient.OPT_USERAGENT: "mithras",
 			})
 
-			res, err := httpclient.Get(theUrl, qp)
-			bodyBytes, err := res.ReadAll()
+			var res *httpclient.Response
+			var bodyBytes []byte
+			core.Unlocked(rt, func() {
+				res, err = httpclient.Get(theUrl, qp)
+				if err == nil {
+					bodyBytes, err = res.ReadAll()
+				}
+			})
+			if res == nil {
+				context.Throwf("Error in get: '%s'", err)
+			}
 
 			if file != "" {
 				err = ioutil.WriteFile(file, bodyBytes, os.FileMode(perm))
 			}
 			v, err := rt.ToValue(string(bodyBytes))
 			return v
-		})
-		webObj.Set("handler", func(call otto.FunctionCall) otto.Value {
+		}))
+		webObj.Set("handler", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("web.handler")
 			setHandler(call.Argument(0))
 			return otto.Value{}
-		})
+		}))
+		webObj.Set("route", context.Guard(func(call otto.FunctionCall) otto.Value {
+			method := call.Argument(0).String()
+			path := call.Argument(1).String()
+			fn := call.Argument(2)
+			if !fn.IsFunction() {
+				context.Throwf("Handler for route '%s' must be a function", path)
+			}
+			r := routerFor(call.Argument(3))
+			if err := r.add(rt, method, path, fn); err != nil {
+				context.Throwf("%s", err)
+			}
+			return otto.Value{}
+		}))
+
+		webObj.Set("unroute", context.Guard(func(call otto.FunctionCall) otto.Value {
+			method := call.Argument(0).String()
+			path := call.Argument(1).String()
+			r := routerFor(call.Argument(2))
+			return core.Sanitize(rt, r.remove(rt, method, path))
+		}))
+		webObj.Set("request", context.Guard(func(call otto.FunctionCall) otto.Value {
+			method := strings.ToUpper(call.Argument(0).String())
+			theUrl := call.Argument(1).String()
+
+			var opts struct {
+				Headers map[string]string `json:"headers"`
+				Body    string            `json:"body"`
+			}
+			if o := call.Argument(2); o.IsObject() {
+				js := `(function (o) { return JSON.stringify(o); })`
+				s, err := rt.Call(js, nil, o)
+				if err == nil {
+					err = json.Unmarshal([]byte(s.String()), &opts)
+				}
+				if err != nil {
+					context.Throwf("Invalid web.request() options: %s", err)
+				}
+			} else if o.IsDefined() && !o.IsNull() {
+				context.Throwf("web.request() options must be an object")
+			}
+
+			httpclient.Defaults(httpclient.Map{
+				httpclient.OPT_USERAGENT: "mithras",
+			})
+
+			var res *httpclient.Response
+			var bodyBytes []byte
+			var err error
+			core.Unlocked(rt, func() {
+				res, err = httpclient.Do(method, theUrl, opts.Headers, strings.NewReader(opts.Body))
+				if err == nil {
+					bodyBytes, err = res.ReadAll()
+				}
+			})
+			if err != nil {
+				context.Throwf("Error in request: '%s'", err)
+			}
+			headers := map[string]string{}
+			for k, v := range res.Header {
+				headers[strings.ToLower(k)] = strings.Join(v, ", ")
+			}
+			return core.Sanitize(rt, Response{
+				Status:  res.StatusCode,
+				Headers: headers,
+				Body:    string(bodyBytes),
+			})
+		}))
 
 		if b, err := webObj.Get("web"); err != nil || b.IsUndefined() {
 			o1, _ = rt.Object(`web.url = {}`)
 		} else {
 			o1 = b.Object()
 		}
-		o1.Set("parse", func(call otto.FunctionCall) otto.Value {
+		o1.Set("parse", context.Guard(func(call otto.FunctionCall) otto.Value {
 			raw := call.Argument(0).String()
 			url, err := url.Parse(raw)
 			if err != nil {
-				log.Fatalf("Can't parse url '%s': %s", raw, err)
+				context.Throwf("Can't parse url '%s': %s", raw, err)
 			}
 			f := core.Sanitizer(rt)
 			obj := f(url)
@@ -286,11 +537,11 @@ func init() {
              })`
 			fixed, err := rt.Call(js, obj, obj)
 			if err != nil {
-				log.Fatalf("Can't traverse url '%s'", raw, err)
+				context.Throwf("Can't traverse url '%s': %s", raw, err)
 			}
 
 			return fixed
-		})
+		}))
 
 	})
 }
@@ -26,28 +26,79 @@ package workers
 //
 // This package exports entry points into the JS environment:
 //
+// > * [workers.create](#create)
+// > * [workers.pool](#pool)
 // > * [workers.run](#run)
 // > * [workers.stop](#stop)
 // > * [workers.send](#send)
 // > * [workers.receive](#receive)
+// > * [workers.select](#select)
+// > * [workers.list](#list)
+// > * [workers.status](#status)
+// > * [workers.errors](#errors)
 //
-// This API allows the caller to work with workers
+// This API allows the caller to work with workers: JS functions
+// running in their own goroutines, each with its own copy of the JS
+// runtime, passing strings in and out over channels.
 //
-// ## WORKERS.RUN
-// <a name="run"></a>
-// `workers.run(name, source);`
+// ## WORKERS.CREATE
+// <a name="create"></a>
+// `workers.create(name, source, poll, input, output);`
 //
 // Create a new worker identified by `name` and with a handler
 // function with the JS source of `source` (a string, not a function).
+// The worker is started with [workers.run](#run).
+//
+// The function is called with each value sent to the worker, and
+// what it returns, unless `undefined`, is the worker's output.  If
+// `poll` is given, the function is also called, with no input, every
+// `poll` seconds.  If `input` names another worker, this worker reads
+// that worker's output, instead of values sent to it.  If `output`
+// names another worker, this worker's output is sent to that worker.
 //
 // Example:
 //
 // ```
 //  function foo(input) { return "hi!"; }
-//  workers.run("test", foo.toString());
+//  workers.create("test", foo.toString());
+//  workers.run("test");
+//
+// ```
+//
+// ## WORKERS.POOL
+// <a name="pool"></a>
+// `workers.pool(name, size, source, options);`
+//
+// Create and start a pool of `size` workers under one `name`.  Each
+// runs the function in `source` in its own copy of the JS runtime,
+// and all of them read the values sent to `name`, so each value is
+// handled by whichever is free.  Their outputs are read together,
+// with [workers.receive](#receive).  The optional `options` may have:
+//
+// > * `buffer`: how many values may be sent to the pool, and how many outputs may wait to be received, without blocking.  By default, none.
+// > * `poll`, `input`, `output`: as for [workers.create](#create)
+// > * `onError`: the source of a function called, in the worker which failed, with the error message and the input being handled
+//
+// Example:
+//
+// ```
+//  function resize(input) { ... return JSON.stringify(result); }
+//  workers.pool("resizers", 4, resize.toString(), {buffer: 100});
+//  _.each(images, function(i) { workers.send("resizers", i); });
 //
 // ```
 //
+// An error thrown by a worker's function doesn't stop the worker.  It
+// is counted, kept as the worker's last error, passed to the
+// `onError` function, if any, and queued to be read with
+// [workers.errors](#errors).
+//
+// ## WORKERS.RUN
+// <a name="run"></a>
+// `workers.run(name);`
+//
+// Start a worker made by [workers.create](#create).
+//
 // ## WORKERS.SEND
 // <a name="send"></a>
 // `workers.send(name, value);`
@@ -63,14 +114,37 @@ package workers
 //
 // ## WORKERS.RECEIVE
 // <a name="receive"></a>
-// `workers.receive(name);
+// `workers.receive(name, timeout);`
 //
-// Read the output of a worker.
+// Read the output of a worker.  If `timeout` is given, wait at most
+// that many milliseconds for it, returning `undefined` if there is
+// none.  Otherwise, wait for as long as it takes.
 //
 // Example:
 //
 // ```
 //  var out = JSON.parse(workers.receive("test"));
+//  var maybe = workers.receive("test", 500);
+//
+// ```
+//
+// ## WORKERS.SELECT
+// <a name="select"></a>
+// `workers.select(names, timeout);`
+//
+// Read the output of whichever of the workers in the array `names`
+// produces one first, returning an object with the worker's `name`
+// and the `value`.  If `timeout` is given, wait at most that many
+// milliseconds, returning `undefined` if none of them produce
+// anything.
+//
+// Example:
+//
+// ```
+//  var got = workers.select(["sqs", "hooks"], 1000);
+//  if (got) {
+//    handlers[got.name](got.value);
+//  }
 //
 // ```
 //
@@ -78,7 +152,8 @@ package workers
 // <a name="stop"></a>
 // `workers.stop(name);
 //
-// Shut down the worker and remove it.
+// Shut down the worker, or all the workers of a pool, and remove it.
+// Each finishes what it is doing first.
 //
 // Example:
 //
@@ -87,10 +162,49 @@ package workers
 //
 // ```
 //
+// ## WORKERS.LIST
+// <a name="list"></a>
+// `workers.list();`
+//
+// Returns the names of all workers, sorted.
+//
+// ## WORKERS.STATUS
+// <a name="status"></a>
+// `workers.status(name);`
+//
+// Returns an object describing a worker, with:
+//
+// > * `name`, `size` (the number of goroutines), `running` and `buffer`
+// > * `queued`: the number of values sent, waiting to be handled
+// > * `received`: the number of values handled
+// > * `sent`: the number of outputs
+// > * `errors`: the number of errors thrown
+// > * `lastError` and `lastErrorAt`: the last error, and when it was thrown, if there has been one
+//
+// Example:
+//
+// ```
+//  var s = workers.status("resizers");
+//  log(sprintf("%d handled, %d failed: %s", s.received, s.errors, s.lastError));
+//
+// ```
+//
+// ## WORKERS.ERRORS
+// <a name="errors"></a>
+// `workers.errors(name);`
+//
+// Returns the errors a worker has thrown since last asked, oldest
+// first, as objects with `message`, `input` and `time`.  Up to 100
+// are kept; older ones are dropped.
+//
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/robertkrimen/otto"
@@ -101,6 +215,30 @@ import (
 var Version = "1.0.0"
 var ModuleName = "workers"
 
+// How many errors are kept for workers.errors
+const errorBuffer = 100
+
+// WorkerError is an error thrown by a worker's function.
+type WorkerError struct {
+	Message string    `json:"message"`
+	Input   *string   `json:"input"`
+	Time    time.Time `json:"time"`
+}
+
+// Status describes a worker.
+type Status struct {
+	Name        string     `json:"name"`
+	Size        int        `json:"size"`
+	Running     bool       `json:"running"`
+	Buffer      int        `json:"buffer"`
+	Queued      int        `json:"queued"`
+	Received    int64      `json:"received"`
+	Sent        int64      `json:"sent"`
+	Errors      int64      `json:"errors"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
 type Worker struct {
 	Poll     int64
 	Name     string
@@ -108,68 +246,221 @@ type Worker struct {
 	Function otto.Value
 	Input    chan string
 	Output   chan string
-	Control  chan struct{}
-	Runtime  *otto.Otto
+	// Closed to stop the worker
+	Control chan struct{}
+	Runtime *otto.Otto
+	// Errors thrown by the function, dropped when full
+	Errors chan WorkerError
+
+	// The runtime which made the worker, or took it over; guarded by
+	// workersMu
+	owner *otto.Otto
+	// The copies of the runtime, one per goroutine
+	copies  []*replica
+	onError string
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	running   bool
+	received  int64
+	sent      int64
+	errors    int64
+	lastError *WorkerError
+}
+
+// A copy of the runtime running a worker's function
+type replica struct {
+	runtime  *otto.Otto
+	function otto.Value
+	onError  otto.Value
 }
 
+var workersMu sync.Mutex
 var Workers map[string]*Worker = map[string]*Worker{}
 
-func (worker *Worker) setFunction(funcSource string) (bool, error) {
-	if funcSource == worker.FnSource {
-		return false, nil // no-op
+// Find a worker by name.
+func lookup(name string) *Worker {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	w, ok := Workers[name]
+	if !ok {
+		mcore.Failf("No worker named '%s'", name)
 	}
-	if funcSource == "" {
-		worker.Function = otto.UndefinedValue()
-	} else {
-		fnobj, err := worker.Runtime.Object("(" + funcSource + ")")
-		if err != nil {
-			return false, err
+	return w
+}
+
+// Evaluate source, which must be a function, in a runtime.
+func compile(rt *otto.Otto, source string) (otto.Value, error) {
+	if source == "" {
+		return otto.UndefinedValue(), nil
+	}
+	fnobj, err := rt.Object("(" + source + ")")
+	if err != nil {
+		return otto.UndefinedValue(), err
+	}
+	if fnobj.Class() != "Function" {
+		return otto.UndefinedValue(), errors.New("JavaScript source does not evaluate to a function")
+	}
+	return fnobj.Value(), nil
+}
+
+// Make a worker with size copies of rt.
+func newWorker(rt *otto.Otto, name string, size int, source string, onError string, poll int64, input chan string, output chan string) (*Worker, error) {
+	if source == "" {
+		return nil, errors.New("Worker function source is empty")
+	}
+	w := &Worker{
+		Poll:    poll,
+		Name:    name,
+		Input:   input,
+		Output:  output,
+		Control: make(chan struct{}),
+		Errors:  make(chan WorkerError, errorBuffer),
+		onError: onError,
+		owner:   rt,
+	}
+	for i := 0; i < size; i++ {
+		newRT := rt.Copy()
+
+		// Hide worker functions from workers (thread protection)
+		newRT.Set("workers", otto.NullValue())
+
+		c := &replica{runtime: newRT}
+		var err error
+		if c.function, err = compile(newRT, source); err != nil {
+			return nil, err
 		}
-		if fnobj.Class() != "Function" {
-			return false, errors.New("JavaScript source does not evaluate to a function")
+		if c.onError, err = compile(newRT, onError); err != nil {
+			return nil, fmt.Errorf("Error in onError: %s", err)
 		}
-		worker.Function = fnobj.Value()
+		w.copies = append(w.copies, c)
 	}
-	worker.FnSource = funcSource
-	return true, nil
+	w.Runtime = w.copies[0].runtime
+	w.Function = w.copies[0].function
+	w.FnSource = source
+	return w, nil
 }
 
-func (worker *Worker) run() {
-	go func() {
-		for {
-			timeout := make(chan bool, 1)
-			go func() {
-				time.Sleep(time.Duration(worker.Poll) * time.Second)
-				timeout <- true
-			}()
-			select {
-			case <-timeout:
-				val, err := worker.Function.Call(otto.Value{}, nil)
-				if err != nil {
-					log.Fatalf("Error in worker '%s': %s", worker.Name, err)
-				}
-				if !val.IsUndefined() {
-					worker.Output <- val.String()
-				}
-			case input := <-worker.Input:
-				val, err := worker.Function.Call(otto.Value{}, input)
-				if err != nil {
-					log.Fatalf("Error in worker '%s': %s", worker.Name, err)
-				}
-				if !val.IsUndefined() {
-					worker.Output <- val.String()
-				}
-			case <-worker.Control:
-				worker.Control <- struct{}{}
+// Note an error thrown while handling input.
+func (worker *Worker) failed(c *replica, err error, input *string) {
+	msg := err.Error()
+	if ottoErr, ok := err.(*otto.Error); ok {
+		msg = ottoErr.String()
+	}
+	e := WorkerError{Message: msg, Input: input, Time: time.Now()}
+	log.Errorf("Error in worker '%s': %s", worker.Name, msg)
+
+	worker.mu.Lock()
+	worker.errors++
+	worker.lastError = &e
+	worker.mu.Unlock()
+
+	select {
+	case worker.Errors <- e:
+	default:
+		// Drop the oldest
+		select {
+		case <-worker.Errors:
+		default:
+		}
+		select {
+		case worker.Errors <- e:
+		default:
+		}
+	}
+
+	if c.onError.IsFunction() {
+		in := otto.UndefinedValue()
+		if input != nil {
+			in, _ = c.runtime.ToValue(*input)
+		}
+		if _, err := c.onError.Call(otto.Value{}, msg, in); err != nil {
+			log.Errorf("Error in onError of worker '%s': %s", worker.Name, err)
+		}
+	}
+}
+
+// Call the function with input, if any, passing on what it returns.
+// Returns false if the worker was stopped while waiting to send.
+func (worker *Worker) call(c *replica, input *string) bool {
+	var val otto.Value
+	var err error
+	if input == nil {
+		val, err = c.function.Call(otto.Value{}, nil)
+	} else {
+		val, err = c.function.Call(otto.Value{}, *input)
+	}
+	if err != nil {
+		worker.failed(c, err, input)
+		return true
+	}
+	if val.IsUndefined() {
+		return true
+	}
+	// Counted before it's sent, so whoever receives it sees it counted
+	worker.mu.Lock()
+	worker.sent++
+	worker.mu.Unlock()
+	select {
+	case worker.Output <- val.String():
+		return true
+	case <-worker.Control:
+		worker.mu.Lock()
+		worker.sent--
+		worker.mu.Unlock()
+		return false
+	}
+}
+
+func (worker *Worker) loop(c *replica) {
+	defer worker.wg.Done()
+	var tick <-chan time.Time
+	if worker.Poll > 0 {
+		ticker := time.NewTicker(time.Duration(worker.Poll) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			if !worker.call(c, nil) {
 				return
 			}
+		case input := <-worker.Input:
+			worker.mu.Lock()
+			worker.received++
+			worker.mu.Unlock()
+			if !worker.call(c, &input) {
+				return
+			}
+		case <-worker.Control:
+			return
 		}
-	}()
+	}
+}
+
+func (worker *Worker) run() {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if worker.running {
+		return
+	}
+	worker.running = true
+	for _, c := range worker.copies {
+		worker.wg.Add(1)
+		go worker.loop(c)
+	}
 }
 
 func (worker *Worker) stop() {
-	worker.Control <- struct{}{}
-	<-worker.Control
+	worker.mu.Lock()
+	running := worker.running
+	worker.running = false
+	worker.mu.Unlock()
+	if running {
+		close(worker.Control)
+		worker.wg.Wait()
+	}
 }
 
 func (worker *Worker) send(val string) {
@@ -180,7 +471,151 @@ func (worker *Worker) receive() string {
 	return <-worker.Output
 }
 
+// Selected is an output read by Select.
+type Selected struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Select reads the output of whichever of workers produces one first.
+// A negative timeout waits forever.  Returns nil if the timeout passes
+// first.
+func Select(workers []*Worker, timeout time.Duration) *Selected {
+	cases := []reflect.SelectCase{}
+	for _, w := range workers {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(w.Output),
+		})
+	}
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(timer.C),
+		})
+	}
+	i, val, _ := reflect.Select(cases)
+	if i == len(workers) {
+		return nil
+	}
+	return &Selected{Name: workers[i].Name, Value: val.String()}
+}
+
+// Status describes the worker.
+func (worker *Worker) Status() Status {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	s := Status{
+		Name:     worker.Name,
+		Size:     len(worker.copies),
+		Running:  worker.running,
+		Buffer:   cap(worker.Input),
+		Queued:   len(worker.Input),
+		Received: worker.received,
+		Sent:     worker.sent,
+		Errors:   worker.errors,
+	}
+	if worker.lastError != nil {
+		s.LastError = worker.lastError.Message
+		at := worker.lastError.Time
+		s.LastErrorAt = &at
+	}
+	return s
+}
+
+// Take the errors queued by the worker.
+func (worker *Worker) takeErrors() []WorkerError {
+	errs := []WorkerError{}
+	for {
+		select {
+		case e := <-worker.Errors:
+			errs = append(errs, e)
+		default:
+			return errs
+		}
+	}
+}
+
+// Add a worker, replacing any of the same name.
+func add(w *Worker) {
+	workersMu.Lock()
+	old := Workers[w.Name]
+	Workers[w.Name] = w
+	workersMu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+}
+
+// Retire the workers of a runtime.  Those it left running are handed
+// over to its successor, if it has one; the others are stopped.
+func retire(rt *otto.Otto, successor *otto.Otto) {
+	workersMu.Lock()
+	stopping := []*Worker{}
+	for name, w := range Workers {
+		if w.owner != rt {
+			continue
+		}
+		if successor != nil && w.Status().Running {
+			w.owner = successor
+			continue
+		}
+		delete(Workers, name)
+		stopping = append(stopping, w)
+	}
+	workersMu.Unlock()
+	for _, w := range stopping {
+		w.stop()
+	}
+}
+
+// Names lists the workers, sorted.
+func Names() []string {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	names := []string{}
+	for name := range Workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A timeout, in milliseconds, passed to a binding
+func milliseconds(context *mcore.Context, v otto.Value) time.Duration {
+	ms, err := v.ToFloat()
+	if err != nil || !(ms >= 0) {
+		context.Throwf("Invalid worker timeout '%s'", v.String())
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// Statuses describes all the workers, sorted by name.
+func Statuses() []Status {
+	workersMu.Lock()
+	ws := []*Worker{}
+	for _, w := range Workers {
+		ws = append(ws, w)
+	}
+	workersMu.Unlock()
+	sort.Sort(byName(ws))
+	list := []Status{}
+	for _, w := range ws {
+		list = append(list, w.Status())
+	}
+	return list
+}
+
+type byName []*Worker
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
 func init() {
+	mcore.RegisterRetire(retire)
 	mcore.RegisterInit(func(context *mcore.Context) {
 		rt := context.Runtime
 
@@ -191,87 +626,181 @@ func init() {
 			o1 = a.Object()
 		}
 
+		// The channel a worker reads, or writes, when chained to
+		// another
+		chained := func(v otto.Value, what string, buffer int, output bool) chan string {
+			if v.IsNull() || v.IsUndefined() {
+				return make(chan string, buffer)
+			}
+			name, err := v.ToString()
+			if err != nil {
+				context.Throwf("Error in worker %s argument: %s", what, err)
+			}
+			if output {
+				return lookup(name).Input
+			}
+			return lookup(name).Output
+		}
+
 		// Expose goroutine operations
-		o1.Set("run", func(call otto.FunctionCall) otto.Value {
+		o1.Set("run", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.run")
 			name := call.Argument(0).String()
-			w := Workers[name]
+			w := lookup(name)
 			w.run()
 			return otto.Value{}
-		})
-		o1.Set("create", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("create", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.create")
 			name := call.Argument(0).String()
 
 			src, err := call.Argument(1).ToString()
 			if err != nil {
-				log.Fatalf("Error in worker run() src argument: %s", err)
+				context.Throwf("Error in worker run() src argument: %s", err)
 			}
 
 			poll := int64(0)
 			if !call.Argument(2).IsNull() && !call.Argument(2).IsUndefined() {
 				poll, err = call.Argument(2).ToInteger()
 				if err != nil {
-					log.Fatalf("Error in worker run() poll argument: %s", err)
+					context.Throwf("Error in worker run() poll argument: %s", err)
 				}
 			}
 
-			input := make(chan string, 0)
-			if !call.Argument(3).IsNull() && !call.Argument(3).IsUndefined() {
-				inputName, err := call.Argument(3).ToString()
-				if err != nil {
-					log.Fatalf("Error in worker run() input argument: %s", err)
-				}
-				input = Workers[inputName].Output
+			input := chained(call.Argument(3), "input", 0, false)
+			output := chained(call.Argument(4), "output", 0, true)
+
+			w, err := newWorker(rt, name, 1, src, "", poll, input, output)
+			if err != nil {
+				context.Throwf("%s", err)
+			}
+			add(w)
+			return otto.Value{}
+		}))
+		o1.Set("pool", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.pool")
+			name := call.Argument(0).String()
+			size, err := call.Argument(1).ToInteger()
+			if err != nil || size < 1 {
+				context.Throwf("Worker pool size must be a positive number")
+			}
+			src, err := call.Argument(2).ToString()
+			if err != nil {
+				context.Throwf("Error in worker pool() src argument: %s", err)
 			}
 
-			output := make(chan string, 0)
-			if !call.Argument(4).IsNull() && !call.Argument(4).IsUndefined() {
-				outputName, err := call.Argument(4).ToString()
-				if err != nil {
-					log.Fatalf("Error in worker run() output argument: %s", err)
+			var buffer, poll int64
+			var onError string
+			var input, output otto.Value
+			opts := call.Argument(3)
+			if opts.IsObject() {
+				o := opts.Object()
+				if v, _ := o.Get("buffer"); v.IsDefined() && !v.IsNull() {
+					if buffer, err = v.ToInteger(); err != nil || buffer < 0 {
+						context.Throwf("Worker pool buffer must be a non-negative number")
+					}
+				}
+				if v, _ := o.Get("poll"); v.IsDefined() && !v.IsNull() {
+					if poll, err = v.ToInteger(); err != nil {
+						context.Throwf("Error in worker pool() poll option: %s", err)
+					}
+				}
+				if v, _ := o.Get("onError"); v.IsDefined() && !v.IsNull() {
+					onError = v.String()
 				}
-				output = Workers[outputName].Input
+				input, _ = o.Get("input")
+				output, _ = o.Get("output")
+			} else if opts.IsDefined() && !opts.IsNull() {
+				context.Throwf("Worker pool options must be an object")
 			}
 
-			newRT := rt.Copy()
-
-			// Hide worker functions from workers (thread protection)
-			newRT.Set("workers", otto.NullValue())
-
-			Workers[name] = &Worker{
-				Poll:    poll,
-				Name:    name,
-				Input:   input,
-				Output:  output,
-				Control: make(chan struct{}, 0),
-				Runtime: newRT,
-			}
-			w := Workers[name]
-			ok, err := w.setFunction(src)
-			if !ok || err != nil {
-				log.Fatalf("%s", err)
+			w, err := newWorker(rt, name, int(size), src, onError, poll,
+				chained(input, "input", int(buffer), false),
+				chained(output, "output", int(buffer), true))
+			if err != nil {
+				context.Throwf("%s", err)
 			}
+			add(w)
+			w.run()
 			return otto.Value{}
-		})
-		o1.Set("stop", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("stop", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.stop")
 			name := call.Argument(0).String()
-			w := Workers[name]
+			w := lookup(name)
 			w.stop()
-			delete(Workers, name)
+			workersMu.Lock()
+			if Workers[name] == w {
+				delete(Workers, name)
+			}
+			workersMu.Unlock()
 			return otto.Value{}
-		})
-		o1.Set("send", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("send", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.send")
 			name := call.Argument(0).String()
 			input := call.Argument(1).String()
-			w := Workers[name]
+			w := lookup(name)
 			w.send(input)
 			return otto.Value{}
-		})
-		o1.Set("receive", func(call otto.FunctionCall) otto.Value {
+		}))
+		o1.Set("receive", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.receive")
 			name := call.Argument(0).String()
-			w := Workers[name]
+			w := lookup(name)
+			if timeout := call.Argument(1); timeout.IsDefined() && !timeout.IsNull() {
+				got := Select([]*Worker{w}, milliseconds(context, timeout))
+				if got == nil {
+					return otto.UndefinedValue()
+				}
+				return mcore.Sanitize(rt, got.Value)
+			}
 			val := w.receive()
 			f := mcore.Sanitizer(rt)
 			return f(val)
-		})
+		}))
+		o1.Set("select", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.select")
+			arg := call.Argument(0)
+			if !arg.IsObject() || arg.Object().Class() != "Array" {
+				context.Throwf("workers.select() needs an array of worker names")
+			}
+			exported, _ := arg.Export()
+			names, ok := exported.([]string)
+			if !ok && exported != nil {
+				// otto exports an empty array as []interface{}
+				if empty, isEmpty := exported.([]interface{}); !isEmpty || len(empty) > 0 {
+					context.Throwf("workers.select() needs an array of worker names")
+				}
+			}
+			if len(names) == 0 {
+				context.Throwf("workers.select() needs at least one worker name")
+			}
+			ws := []*Worker{}
+			for _, name := range names {
+				ws = append(ws, lookup(name))
+			}
+			timeout := time.Duration(-1)
+			if t := call.Argument(1); t.IsDefined() && !t.IsNull() {
+				timeout = milliseconds(context, t)
+			}
+			got := Select(ws, timeout)
+			if got == nil {
+				return otto.UndefinedValue()
+			}
+			return mcore.Sanitize(rt, got)
+		}))
+		o1.Set("list", context.Guard(func(call otto.FunctionCall) otto.Value {
+			return mcore.Sanitize(rt, Names())
+		}))
+		o1.Set("status", context.Guard(func(call otto.FunctionCall) otto.Value {
+			name := call.Argument(0).String()
+			return mcore.Sanitize(rt, lookup(name).Status())
+		}))
+		o1.Set("errors", context.Guard(func(call otto.FunctionCall) otto.Value {
+			context.Unstaged("workers.errors")
+			name := call.Argument(0).String()
+			return mcore.Sanitize(rt, lookup(name).takeErrors())
+		}))
 	})
 }
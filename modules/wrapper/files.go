@@ -0,0 +1,248 @@
+// MITHRAS: Javascript configuration management tool for AWS.
+// Copyright (C) 2016, Colin Steele
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//   the Free Software Foundation, either version 3 of the License, or
+//                  (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//              GNU General Public License for more details.
+//
+//   You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// File operations used by mithras to transfer files: describing the
+// files under a path, with their checksums, and installing files
+// staged on this host.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/cvillecsteele/mithras/modules/build"
+)
+
+// A file or directory under a path.  The path itself is ".".
+type FileStat struct {
+	Path   string
+	Dir    bool
+	Mode   uint32
+	Size   int64
+	Sha256 string
+	Uid    uint32
+	Gid    uint32
+	Owner  string
+	Group  string
+}
+
+// A change to a file or directory under a path.
+type FileChange struct {
+	Path   string
+	Action string
+	Dir    bool
+	Mode   uint32
+	// Name of the new content in the staging directory
+	Staged string
+}
+
+// Names of users and groups, by id
+var owners = map[uint32]string{}
+var groups = map[uint32]string{}
+
+func ownerName(uid uint32) string {
+	if name, ok := owners[uid]; ok {
+		return name
+	}
+	name := strconv.Itoa(int(uid))
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	owners[uid] = name
+	return name
+}
+
+func groupName(gid uint32) string {
+	if name, ok := groups[gid]; ok {
+		return name
+	}
+	name := strconv.Itoa(int(gid))
+	if g, err := user.LookupGroupId(name); err == nil {
+		name = g.Name
+	}
+	groups[gid] = name
+	return name
+}
+
+// Describe the files and directories under root.  Symlinks are not
+// followed, and are left out.  A root which doesn't exist has no
+// files.
+func manifest(root string) ([]FileStat, error) {
+	files := []FileStat{}
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return files, nil
+	}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		stat := FileStat{
+			Path: filepath.ToSlash(rel),
+			Dir:  fi.IsDir(),
+			Mode: uint32(fi.Mode().Perm()),
+			Size: fi.Size(),
+		}
+		if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+			stat.Uid = sys.Uid
+			stat.Gid = sys.Gid
+			stat.Owner = ownerName(sys.Uid)
+			stat.Group = groupName(sys.Gid)
+		}
+		if !fi.IsDir() {
+			if stat.Sha256, err = build.Hash(p); err != nil {
+				return err
+			}
+		}
+		files = append(files, stat)
+		return nil
+	})
+	return files, err
+}
+
+// An id for a user or group given by name or number.
+func lookupId(name string, group bool) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(g.Gid)
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// Copy a staged file into place, replacing what is there.
+func installFile(staged string, dest string, mode os.FileMode) error {
+	in, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".mithras")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if fi, err := os.Lstat(dest); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(dest); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Apply changes to the files under root, taking new content from the
+// staging directory.
+func install(root string, staging string, changes []FileChange, owner string, group string) error {
+	uid, err := lookupId(owner, false)
+	if err != nil {
+		return fmt.Errorf("Unknown owner '%s': %s", owner, err)
+	}
+	gid, err := lookupId(group, true)
+	if err != nil {
+		return fmt.Errorf("Unknown group '%s': %s", group, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(root), 0755); err != nil {
+		return err
+	}
+
+	// Deletions first, deepest first
+	deletes := []string{}
+	for _, c := range changes {
+		if c.Action == "delete" {
+			deletes = append(deletes, c.Path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(deletes)))
+	for _, p := range deletes {
+		if err := os.RemoveAll(filepath.Join(root, filepath.FromSlash(path.Clean(p)))); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range changes {
+		dest := filepath.Join(root, filepath.FromSlash(path.Clean(c.Path)))
+		mode := os.FileMode(c.Mode).Perm()
+		switch c.Action {
+		case "delete":
+			continue
+		case "create", "update":
+			if c.Dir {
+				if fi, err := os.Lstat(dest); err == nil && !fi.IsDir() {
+					if err := os.Remove(dest); err != nil {
+						return err
+					}
+				}
+				if err := os.MkdirAll(dest, mode); err != nil {
+					return err
+				}
+			} else if err := installFile(filepath.Join(staging, c.Staged), dest, mode); err != nil {
+				return err
+			}
+		case "attributes":
+		default:
+			return fmt.Errorf("Unknown change '%s' to '%s'", c.Action, c.Path)
+		}
+		if err := os.Chmod(dest, mode); err != nil {
+			return err
+		}
+		if uid >= 0 || gid >= 0 {
+			if err := os.Lchown(dest, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -17,49 +17,216 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/cvillecsteele/mithras/modules/build"
 )
 
+// The version of the wrapper, reported by `wrapper --version`
+const Version = "1.0.0"
+
+// The version of the job spec and results understood.  Wrappers
+// before versioning report none, and so version 0.
+const ProtocolVersion = 3
+
+// How long a command has to exit after its kill signal, before it is
+// sent SIGKILL
+const killGrace = 5 * time.Second
+
 type Results struct {
+	Version int
 	Out     string
 	Err     string
 	Success bool
 	Status  int
+	// When the command started and ended, and how long it ran, in
+	// seconds
+	Start    time.Time
+	End      time.Time
+	Duration float64
+	// Whether the command was killed by a signal, and which
+	Signaled bool
+	Signal   string
+	// Whether the command was killed for running too long
+	TimedOut bool
+	// Files described by the "manifest" operation
+	Files []FileStat
 }
 
 type JobSpec struct {
-	Cmd []string
-	Env map[string]string
+	Version int
+	Cmd     []string
+	Env     map[string]string
+	// Print output a line at a time as it arrives, as well as in
+	// the results
+	Stream bool
+	// Given to the command as its stdin
+	Stdin string
+	// Working directory of the command
+	Dir string
+	// Octal umask for the command, eg. "022"
+	Umask string
+	// Seconds the command may run before it is sent Signal (by
+	// default, KILL)
+	Timeout float64
+	Signal  string
+	// User and group to run the command as
+	Uid *uint32
+	Gid *uint32
+	// Instead of running Cmd, "manifest" describes the files under
+	// Path, and "install" applies Changes to them, taking new content
+	// from the staging directory From and setting Owner and Group.
+	Op      string
+	Path    string
+	From    string
+	Changes []FileChange
+	Owner   string
+	Group   string
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+func signalNamed(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGKILL, nil
+	}
+	if sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("Unknown signal '%s'", name)
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// Markers put before streamed lines, to tell them from the results.
+const (
+	streamOut = "mithras-stdout: "
+	streamErr = "mithras-stderr: "
+)
+
+// Lines of stdout and stderr are both streamed to our stdout
+var streamMu sync.Mutex
+
+// A Writer capturing output, and printing each complete line with a
+// marker when streaming.
+type streamWriter struct {
+	buf     bytes.Buffer
+	pending []byte
+	marker  string
+	stream  bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if !w.stream {
+		return len(p), nil
+	}
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.print(string(w.pending[:i]))
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *streamWriter) Flush() {
+	if w.stream && len(w.pending) > 0 {
+		w.print(string(w.pending))
+	}
+	w.pending = nil
+}
+
+func (w *streamWriter) print(line string) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	fmt.Println(w.marker + strings.TrimRight(line, "\r"))
+}
+
+// Print the version, protocol and build hash of this binary, for
+// bootstrap to tell whether it is stale.
+func printVersion() {
+	hash := "unknown"
+	if exe, err := os.Executable(); err == nil {
+		if h, err := build.Hash(exe); err == nil {
+			hash = h
+		}
+	}
+	fmt.Printf("wrapper version %s protocol %d build %s\n", Version, ProtocolVersion, hash)
 }
 
 func main() {
-	input := ""
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		input += scanner.Text()
+	if len(os.Args) > 1 && (os.Args[1] == "--version" || os.Args[1] == "-V") {
+		printVersion()
+		return
+	}
+
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail(fmt.Sprintf("Can't read job spec: %s", err))
+		return
 	}
 
 	var spec JobSpec
-	if input != "" {
-		if err := json.Unmarshal([]byte(input), &spec); err != nil {
-			results := Results{
-				Out:     "",
-				Err:     fmt.Sprintf("Can't unmarshall job spec: %s", err),
-				Success: false,
-				Status:  -1,
-			}
-			fmt.Println(resultToJSONString(&results))
+	if len(bytes.TrimSpace(input)) > 0 {
+		if err := json.Unmarshal(input, &spec); err != nil {
+			fail(fmt.Sprintf("Can't unmarshall job spec: %s", err))
 			return
 		}
 	}
+	if spec.Version > ProtocolVersion {
+		fail(fmt.Sprintf("Job spec version %d is newer than this wrapper's (%d)",
+			spec.Version, ProtocolVersion))
+		return
+	}
+	switch spec.Op {
+	case "":
+	case "manifest", "install":
+		fileOp(&spec)
+		return
+	default:
+		fail(fmt.Sprintf("Unknown job spec operation '%s'", spec.Op))
+		return
+	}
+	if len(spec.Cmd) == 0 {
+		fail("No command in job spec")
+		return
+	}
+	sig, err := signalNamed(spec.Signal)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
 
 	c := exec.Command(spec.Cmd[0], spec.Cmd[1:]...)
 
@@ -70,31 +237,123 @@ func main() {
 	}
 	env = append(env, fmt.Sprintf("MITHRASHOME=%s", home))
 	c.Env = env
+	c.Dir = spec.Dir
+	if spec.Stdin != "" {
+		c.Stdin = strings.NewReader(spec.Stdin)
+	}
 
-	var out bytes.Buffer
-	var err bytes.Buffer
-	c.Stdout = &out
-	c.Stderr = &err
+	// Put the command in its own process group, so all of it can
+	// be killed on timeout
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: spec.Timeout > 0}
+	if spec.Uid != nil || spec.Gid != nil {
+		cred := &syscall.Credential{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		}
+		if spec.Uid != nil {
+			cred.Uid = *spec.Uid
+		}
+		if spec.Gid != nil {
+			cred.Gid = *spec.Gid
+		}
+		c.SysProcAttr.Credential = cred
+	}
 
-	e := c.Run()
+	if spec.Umask != "" {
+		mask, err := strconv.ParseUint(spec.Umask, 8, 32)
+		if err != nil {
+			fail(fmt.Sprintf("Invalid umask '%s'", spec.Umask))
+			return
+		}
+		syscall.Umask(int(mask))
+	}
+
+	out := &streamWriter{marker: streamOut, stream: spec.Stream}
+	errOut := &streamWriter{marker: streamErr, stream: spec.Stream}
+	c.Stdout = out
+	c.Stderr = errOut
+
+	results := Results{Version: ProtocolVersion}
+	results.Start = time.Now()
+	e := c.Start()
+	if e == nil {
+		var timer *time.Timer
+		var timedOut bool
+		var timeMu sync.Mutex
+		if spec.Timeout > 0 {
+			pgid := c.Process.Pid
+			timer = time.AfterFunc(time.Duration(spec.Timeout*float64(time.Second)), func() {
+				timeMu.Lock()
+				timedOut = true
+				timeMu.Unlock()
+				syscall.Kill(-pgid, sig)
+				if sig != syscall.SIGKILL {
+					time.AfterFunc(killGrace, func() {
+						syscall.Kill(-pgid, syscall.SIGKILL)
+					})
+				}
+			})
+		}
+		e = c.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		timeMu.Lock()
+		results.TimedOut = timedOut
+		timeMu.Unlock()
+	}
+	results.End = time.Now()
+	results.Duration = results.End.Sub(results.Start).Seconds()
+	out.Flush()
+	errOut.Flush()
 
-	var status int
 	if e1, ok := e.(*exec.ExitError); ok {
-		status = e1.Sys().(syscall.WaitStatus).ExitStatus()
+		ws := e1.Sys().(syscall.WaitStatus)
+		results.Status = ws.ExitStatus()
+		if ws.Signaled() {
+			results.Signaled = true
+			results.Signal = signalName(ws.Signal())
+		}
+	} else if e != nil {
+		errOut.buf.WriteString(e.Error())
+		results.Status = -1
 	}
 
-	resultErr := err.String()
-	resultOut := out.String()
-	ok := true
-	if e != nil || !c.ProcessState.Success() {
-		ok = false
+	results.Out = out.buf.String()
+	results.Err = errOut.buf.String()
+	results.Success = e == nil && c.ProcessState.Success()
+	fmt.Println(resultToJSONString(&results))
+}
+
+// Run a file operation.
+func fileOp(spec *JobSpec) {
+	results := Results{Version: ProtocolVersion}
+	results.Start = time.Now()
+	var err error
+	if spec.Op == "manifest" {
+		results.Files, err = manifest(spec.Path)
+	} else {
+		err = install(spec.Path, spec.From, spec.Changes, spec.Owner, spec.Group)
 	}
+	results.End = time.Now()
+	results.Duration = results.End.Sub(results.Start).Seconds()
+	if err != nil {
+		results.Err = err.Error()
+		results.Status = 1
+	} else {
+		results.Success = true
+	}
+	fmt.Println(resultToJSONString(&results))
+}
 
+// Report a job which couldn't be run.
+func fail(msg string) {
 	results := Results{
-		Out:     resultOut,
-		Err:     resultErr,
-		Success: ok,
-		Status:  status,
+		Version: ProtocolVersion,
+		Out:     "",
+		Err:     msg,
+		Success: false,
+		Status:  -1,
 	}
 	fmt.Println(resultToJSONString(&results))
 }